@@ -3,38 +3,171 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
+	"fileshare/internal/atrest"
+	"fileshare/internal/audit"
+	"fileshare/internal/auth"
 	"fileshare/internal/discovery"
 	"fileshare/internal/handler"
 	"fileshare/internal/network"
+	"fileshare/internal/sandbox"
+	"fileshare/internal/scan"
 	"fileshare/internal/server"
+	"fileshare/internal/turn"
 )
 
 func main() {
 	portFlag := flag.Int("p", 8080, "Port number")
 	sharedDir := flag.String("d", "shared_files", "Shared directory")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose forwarded headers are trusted")
+	allowList := flag.String("allow", "", "Comma-separated CIDRs allowed to connect (empty allows all)")
+	denyList := flag.String("deny", "", "Comma-separated CIDRs refused access")
+	lanOnly := flag.Bool("lan-only", false, "Reject clients that are not on a private, loopback or link-local address")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to call the API cross-origin (\"*\" allows any)")
+	csp := flag.String("csp", handler.DefaultCSP, "Content-Security-Policy template ({nonce} is replaced per response; empty disables)")
+	tlsAuto := flag.Bool("tls", false, "Serve HTTPS with an automatically generated local certificate")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables HTTPS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsDir := flag.String("tls-dir", "certs", "Directory for the generated local CA and certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle for verifying client certificates (enables mutual TLS)")
+	httpRedirect := flag.Int("http-redirect", 0, "Port for a plain-HTTP listener that redirects to HTTPS (0 disables)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL (enables single sign-on)")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcRedirect := flag.String("oidc-redirect-url", "", "OpenID Connect callback URL (default: derived from request host)")
+	oidcGroups := flag.String("oidc-groups", "", "Comma-separated groups allowed to sign in (empty allows all)")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	atRestKeyFile := flag.String("at-rest-key-file", "", "Master key file for encrypting private inbox files at rest (created if missing)")
+	allowExt := flag.String("allow-ext", "", "Comma-separated file extensions accepted for upload (empty allows all)")
+	denyExt := flag.String("deny-ext", "", "Comma-separated file extensions refused for upload")
+	allowMIME := flag.String("allow-mime", "", "Comma-separated sniffed MIME types accepted for upload, e.g. image/* (empty allows all)")
+	denyMIME := flag.String("deny-mime", "", "Comma-separated sniffed MIME types refused for upload")
+	maxFiles := flag.Int("max-files", 0, "Maximum files per upload request (0 is unlimited)")
+	scanner := flag.String("scanner", "", "Scan uploads before publishing: clamd:unix:<socket>, clamd:tcp:<host:port> or cmd:<command>")
+	pipeUnscanned := flag.Bool("pipe-unscanned", false, "Allow P2P transfers through the server while -scanner is set; they cannot be scanned")
+	symlinks := flag.String("symlinks", "deny", "Symlinks inside the shared directory: deny, or within (follow links that stay inside it)")
+	auditLog := flag.String("audit-log", "", "Append-only JSONL audit log of file and device operations (empty disables)")
+	auditMaxSize := flag.Int("audit-max-size", 10, "Rotate the audit log when it reaches this many megabytes")
+	auditKeep := flag.Int("audit-keep", audit.DefaultKeep, "Number of rotated audit log files to keep")
+	adminGroup := flag.String("admin-group", "", "SSO group whose members may use the admin API")
+	maxRooms := flag.Int("max-rooms", handler.DefaultMaxRooms, "Maximum number of open P2P signaling rooms")
+	stunPortFlag := flag.Int("stun-port", 3478, "UDP port for the built-in STUN server (0 disables)")
+	publicSTUN := flag.Bool("public-stun", false, "Also advertise public STUN servers (Google, Twilio) to browsers")
+	turnFlag := flag.Bool("turn", false, "Also run a TURN relay on the STUN port, for networks where peers cannot connect directly")
+	turnRelayIP := flag.String("turn-relay-ip", "", "Address relayed traffic is sent from and browsers must reach (default: the LAN address)")
+	turnMaxAlloc := flag.Int("turn-max-allocations", turn.DefaultMaxAllocations, "Maximum number of open TURN relay allocations")
+	turnBandwidth := flag.Int("turn-bandwidth", 4096, "TURN relay bandwidth per allocation in KB/s (0 is unlimited)")
+	turnRoomBandwidth := flag.Int("turn-room-bandwidth", 16384, "TURN relay bandwidth per P2P room, all its allocations together, in KB/s (0 is unlimited)")
+	stripMetadata := flag.String("strip-metadata", "off", "Remove EXIF/GPS/XMP from uploaded JPEG and PNG images: off, public or all")
 	flag.Parse()
 
-	// PORT and SHARED_DIR env vars override flags (for cloud deployments).
-	port := *portFlag
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		if p, err := strconv.Atoi(envPort); err == nil {
-			port = p
+	// Env vars override flags (for cloud deployments).
+	port := envInt("PORT", *portFlag)
+
+	sharedPath := envString("SHARED_DIR", *sharedDir)
+
+	proxies := envString("TRUSTED_PROXIES", *trustedProxies)
+	if err := network.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+		log.Fatalf("Invalid trusted proxy list: %v", err)
+	}
+
+	allow := envString("ALLOW_CIDRS", *allowList)
+	deny := envString("DENY_CIDRS", *denyList)
+	if err := handler.SetAccessPolicy(strings.Split(allow, ","), strings.Split(deny, ","), envBool("LAN_ONLY", *lanOnly)); err != nil {
+		log.Fatalf("Invalid access policy: %v", err)
+	}
+
+	err := handler.SetFilePolicy(handler.FilePolicy{
+		AllowExtensions: splitList(envString("ALLOW_EXTENSIONS", *allowExt)),
+		DenyExtensions:  splitList(envString("DENY_EXTENSIONS", *denyExt)),
+		AllowMIME:       splitList(envString("ALLOW_MIME", *allowMIME)),
+		DenyMIME:        splitList(envString("DENY_MIME", *denyMIME)),
+		MaxFiles:        envInt("MAX_FILES", *maxFiles),
+	})
+	if err != nil {
+		log.Fatalf("Invalid file policy: %v", err)
+	}
+
+	if err := handler.SetMetadataStripping(envString("STRIP_METADATA", *stripMetadata)); err != nil {
+		log.Fatalf("Invalid metadata stripping mode: %v", err)
+	}
+
+	if spec := envString("SCANNER", *scanner); spec != "" {
+		s, err := scan.New(spec)
+		if err != nil {
+			log.Fatalf("Invalid scanner: %v", err)
+		}
+		handler.SetScanner(s)
+		log.Printf("Upload scanning enabled via %s", spec)
+		if envBool("PIPE_UNSCANNED", *pipeUnscanned) {
+			handler.SetUnscannedPipes(true)
+			log.Printf("P2P transfers through the server are allowed without scanning")
 		}
 	}
 
-	sharedPath := *sharedDir
-	if envShared := os.Getenv("SHARED_DIR"); envShared != "" {
-		sharedPath = envShared
+	if path := envString("AUDIT_LOG", *auditLog); path != "" {
+		l, err := audit.Open(path, int64(envInt("AUDIT_MAX_SIZE", *auditMaxSize))<<20, envInt("AUDIT_KEEP", *auditKeep))
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		handler.SetAuditLog(l)
+		log.Printf("Audit log enabled: %s", path)
+	}
+	// ADMIN_TOKEN is read from the environment only, like other secrets.
+	handler.SetAdmin(os.Getenv("ADMIN_TOKEN"), envString("ADMIN_GROUP", *adminGroup))
+	handler.SetMaxRooms(envInt("MAX_ROOMS", *maxRooms))
+
+	handler.SetAllowedOrigins(strings.Split(envString("CORS_ORIGINS", *corsOrigins), ","))
+
+	if env, ok := os.LookupEnv("CSP_POLICY"); ok {
+		*csp = env
+	}
+	handler.SetContentSecurityPolicy(*csp)
+
+	if issuer := envString("OIDC_ISSUER", *oidcIssuer); issuer != "" {
+		err := auth.Configure(auth.Config{
+			Issuer:        issuer,
+			ClientID:      envString("OIDC_CLIENT_ID", *oidcClientID),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   envString("OIDC_REDIRECT_URL", *oidcRedirect),
+			AllowedGroups: splitList(envString("OIDC_GROUPS", *oidcGroups)),
+			GroupsClaim:   envString("OIDC_GROUPS_CLAIM", *oidcGroupsClaim),
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure single sign-on: %v", err)
+		}
+		log.Printf("Single sign-on enabled via %s", issuer)
+	}
+
+	// AT_REST_KEY (hex or base64) takes precedence over a key file.
+	if envKey := os.Getenv("AT_REST_KEY"); envKey != "" {
+		key, err := atrest.ParseKey(envKey)
+		if err != nil {
+			log.Fatalf("Invalid AT_REST_KEY: %v", err)
+		}
+		handler.SetAtRestKey(key)
+	} else if keyFile := envString("AT_REST_KEY_FILE", *atRestKeyFile); keyFile != "" {
+		key, err := atrest.LoadKeyFile(keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load at-rest key: %v", err)
+		}
+		handler.SetAtRestKey(key)
 	}
 
-	handler.SharedDir = sharedPath
 	if err := os.MkdirAll(sharedPath, 0755); err != nil {
 		log.Fatalf("Failed to create shared directory %s: %v", sharedPath, err)
 	}
+	symlinkPolicy, err := sandbox.ParseSymlinkPolicy(envString("SYMLINKS", *symlinks))
+	if err != nil {
+		log.Fatalf("Invalid symlink policy: %v", err)
+	}
+	if err := handler.OpenShare(sharedPath, symlinkPolicy); err != nil {
+		log.Fatalf("Failed to open shared directory %s: %v", sharedPath, err)
+	}
 
 	// Static file server — serves from web/pages for HTML, web/static for assets.
 	staticFS := http.FileServer(http.Dir("web"))
@@ -44,8 +177,90 @@ func main() {
 	go discovery.CleanupStale()
 	handler.StartP2PCleanup()
 	handler.StartPrivateCleanup()
+	handler.StartLinkCleanup()
+
+	// The STUN server is optional: if its port is taken, P2P falls back
+	// to host candidates (and public STUN, if enabled).
+	stunPort := envInt("STUN_PORT", *stunPortFlag)
+	var relay *server.TURNOptions
+	if envBool("TURN", *turnFlag) {
+		if stunPort <= 0 {
+			log.Fatalf("The TURN relay runs on the STUN port; set -stun-port")
+		}
+		relayIP := envString("TURN_RELAY_IP", *turnRelayIP)
+		if relayIP == "" {
+			relayIP = network.GetLocalIP()
+		}
+		ip := net.ParseIP(relayIP)
+		if ip == nil {
+			log.Fatalf("Invalid TURN relay address %q", relayIP)
+		}
+		relay = &server.TURNOptions{
+			RelayIP:        ip,
+			MaxAllocations: envInt("TURN_MAX_ALLOCATIONS", *turnMaxAlloc),
+			Bandwidth:      envInt("TURN_BANDWIDTH", *turnBandwidth) * 1024,
+			RoomBandwidth:  envInt("TURN_ROOM_BANDWIDTH", *turnRoomBandwidth) * 1024,
+		}
+	}
+	if stunPort > 0 {
+		if err := server.StartSTUN(stunPort, relay); err != nil {
+			log.Printf("STUN server disabled: %v", err)
+			stunPort = 0
+		}
+	}
+	handler.SetICEConfig(stunPort, envBool("PUBLIC_STUN", *publicSTUN))
+
+	tlsOpts := server.TLSOptions{
+		CertFile:     envString("TLS_CERT", *tlsCert),
+		KeyFile:      envString("TLS_KEY", *tlsKey),
+		ClientCAFile: envString("TLS_CLIENT_CA", *tlsClientCA),
+		RedirectPort: envInt("HTTP_REDIRECT_PORT", *httpRedirect),
+	}
+	if tlsOpts.CertFile == "" && envBool("TLS", *tlsAuto) {
+		tlsOpts.AutoDir = envString("TLS_DIR", *tlsDir)
+	}
+	if tlsOpts.ClientCAFile != "" && !tlsOpts.Enabled() {
+		log.Fatalf("Client certificates require TLS; pass -tls or -tls-cert")
+	}
 
 	// Start the server.
 	ip := network.GetLocalIP()
-	server.Start(port, ip)
+	server.Start(port, ip, tlsOpts)
+}
+
+// splitList splits a comma-separated value, dropping blank entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// envString returns the named environment variable, or fallback if unset.
+func envString(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt parses the named environment variable as an int, or returns
+// fallback if it is unset or malformed.
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return fallback
+}
+
+// envBool parses the named environment variable as a bool, or returns
+// fallback if it is unset or malformed.
+func envBool(name string, fallback bool) bool {
+	if b, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return b
+	}
+	return fallback
 }
@@ -0,0 +1,138 @@
+// Package atrest encrypts files stored on the server's disk.
+//
+// Each file gets a random 256-bit data key, wrapped with the server master
+// key and stored in the file header. The body is a chunked AES-256-GCM
+// stream under the data key (see package stream), so a reader can decrypt
+// any chunk on its own — downloads stream and HTTP range requests keep
+// working.
+//
+// File layout:
+//
+//	magic "GSENC\x01" | wrap nonce (12) | wrapped data key (32+16) | stream...
+package atrest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"fileshare/pkg/stream"
+)
+
+// Key is a 256-bit master key.
+type Key [32]byte
+
+// HeaderSize is the number of bytes before the stream.
+const HeaderSize = len(magic) + 12 + 32 + stream.Overhead
+
+const magic = "GSENC\x01"
+
+// ErrCorrupt is returned when a file fails authentication, which includes
+// a file encrypted under a different master key.
+var ErrCorrupt = stream.ErrCorrupt
+
+// ParseKey decodes a master key given as 64 hex characters or as
+// standard/URL-safe base64 of 32 bytes.
+func ParseKey(s string) (*Key, error) {
+	s = strings.TrimSpace(s)
+	var raw []byte
+	if b, err := hex.DecodeString(s); err == nil {
+		raw = b
+	} else if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		raw = b
+	} else if b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err == nil {
+		raw = b
+	}
+	if len(raw) != len(Key{}) {
+		return nil, errors.New("atrest: master key must be 32 bytes (hex or base64)")
+	}
+	var k Key
+	copy(k[:], raw)
+	return &k, nil
+}
+
+// LoadKeyFile reads a master key from path, generating and saving a new
+// random key (mode 0600) if the file does not exist yet.
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ParseKey(string(data))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(k[:])+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("atrest: save new master key: %w", err)
+	}
+	return &k, nil
+}
+
+// IsEncrypted reports whether a file starts with the at-rest header magic.
+func IsEncrypted(r io.ReaderAt) bool {
+	buf := make([]byte, len(magic))
+	n, _ := r.ReadAt(buf, 0)
+	return n == len(magic) && string(buf) == magic
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // key length is fixed at 32 bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// NewWriter writes the header to dst and returns a stream.Writer that
+// encrypts everything written to it under a fresh data key. Close must be
+// called to write the final chunk.
+func NewWriter(dst io.Writer, master *Key) (*stream.Writer, error) {
+	dek := make([]byte, 32)
+	wrapNonce := make([]byte, 12)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, err
+	}
+	header := []byte(magic)
+	header = append(header, wrapNonce...)
+	header = newGCM(master[:]).Seal(header, wrapNonce, dek, []byte(magic))
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	return stream.NewWriter(dst, newGCM(dek)), nil
+}
+
+// NewReader opens an encrypted file of the given on-disk size. The
+// returned reader seeks over the plaintext, suitable for
+// http.ServeContent.
+func NewReader(src io.ReaderAt, fileSize int64, master *Key) (*stream.Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return nil, ErrCorrupt
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("atrest: not an encrypted file")
+	}
+	wrapNonce := header[len(magic) : len(magic)+12]
+	dek, err := newGCM(master[:]).Open(nil, wrapNonce, header[len(magic)+12:], []byte(magic))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return stream.NewReader(src, int64(HeaderSize), fileSize-int64(HeaderSize), newGCM(dek))
+}
@@ -0,0 +1,148 @@
+package atrest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"fileshare/pkg/stream"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	var k Key
+	rand.Read(k[:])
+	return &k
+}
+
+func seal(t *testing.T, key *Key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, stream.ChunkSize - 1, stream.ChunkSize, stream.ChunkSize + 1, 3*stream.ChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := seal(t, key, plain)
+
+		if !IsEncrypted(bytes.NewReader(sealed)) {
+			t.Fatalf("size %d: header magic missing", size)
+		}
+		r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+		if err != nil {
+			t.Fatalf("size %d: NewReader: %v", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Errorf("size %d: Size() = %d", size, r.Size())
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: ReadAll: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: plaintext mismatch", size)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*stream.ChunkSize+500)
+	rand.Read(plain)
+	sealed := seal(t, key, plain)
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	// A range spanning a chunk boundary, as an HTTP Range request would ask.
+	start := int64(stream.ChunkSize - 10)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	got := make([]byte, 30)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, plain[start:start+30]) {
+		t.Error("ranged read returned wrong bytes")
+	}
+
+	if end, _ := r.Seek(0, io.SeekEnd); end != int64(len(plain)) {
+		t.Errorf("SeekEnd = %d, want %d", end, len(plain))
+	}
+}
+
+func TestTamperAndTruncation(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*stream.ChunkSize+5)
+	sealed := seal(t, key, plain)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[HeaderSize+100] ^= 1
+	r, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)), key)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if _, err := io.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("expected ErrCorrupt for flipped bit, got %v", err)
+	}
+
+	// Dropping the final chunk leaves a file of whole, valid chunks; the
+	// missing final flag must still be caught.
+	truncated := sealed[:HeaderSize+2*stream.SealedChunkSize]
+	r, err = NewReader(bytes.NewReader(truncated), int64(len(truncated)), key)
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err == nil {
+		t.Error("expected truncated file to be rejected")
+	}
+
+	if _, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), testKey(t)); err != ErrCorrupt {
+		t.Errorf("expected ErrCorrupt for wrong master key, got %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	hexKey := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	if _, err := ParseKey(hexKey); err != nil {
+		t.Errorf("hex key: %v", err)
+	}
+	if _, err := ParseKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="); err != nil {
+		t.Errorf("base64 key: %v", err)
+	}
+	if _, err := ParseKey("too-short"); err == nil {
+		t.Error("expected error for short key")
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	k1, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile (create): %v", err)
+	}
+	k2, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile (reload): %v", err)
+	}
+	if *k1 != *k2 {
+		t.Error("expected the generated key to be persisted")
+	}
+}
@@ -0,0 +1,250 @@
+// Package audit keeps an append-only JSON Lines record of file and device
+// operations, rotated by size.
+//
+// The active file is written with O_APPEND and never rewritten. When it
+// would grow past the size limit it is renamed to <path>.1, older files
+// shift up by one, and the oldest beyond the retention count is deleted.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded by the server.
+const (
+	ActionRegister   = "register"
+	ActionUpload     = "upload"  // file put in the public share
+	ActionDeliver    = "deliver" // file sent to a device's private inbox
+	ActionDownload   = "download"
+	ActionDelete     = "delete"
+	ActionRoomCreate = "room-create"
+	ActionRoomJoin   = "room-join"
+	ActionPipe       = "pipe" // file streamed through a P2P room, not stored
+	ActionAdmin      = "admin"
+)
+
+// Outcomes of an action.
+const (
+	OutcomeOK          = "ok"
+	OutcomeRejected    = "rejected"    // refused by policy, scan or sandbox
+	OutcomeQuarantined = "quarantined" // held until its scan finishes
+	OutcomeDenied      = "denied"      // caller lacked permission
+	OutcomeCancelled   = "cancelled"   // abandoned by a party before it finished
+)
+
+// Entry is one audit record. Size is the size as uploaded or served;
+// SHA256 is of the stored content, after metadata stripping and before
+// at-rest encryption.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	DeviceID   string    `json:"device_id,omitempty"`
+	DeviceName string    `json:"device_name,omitempty"`
+	User       string    `json:"user,omitempty"` // SSO account, if signed in
+	ClientIP   string    `json:"client_ip,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Target     string    `json:"target,omitempty"` // recipient device or room
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// Defaults for Open.
+const (
+	DefaultMaxSize = 10 << 20
+	DefaultKeep    = 5
+)
+
+// Log is an audit log file. It is safe for concurrent use.
+type Log struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens or creates the log at path. The active file is rotated once
+// it would exceed maxSize bytes, and keep rotated files are retained.
+// Non-positive values select the defaults.
+func Open(path string, maxSize int64, keep int) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+	l := &Log{path: path, maxSize: maxSize, keep: keep}
+	if err := l.openActive(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) openActive() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotated returns the name of the n-th rotated file; 0 is the active one.
+func (l *Log) rotated(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.rotated(l.keep))
+	for n := l.keep - 1; n >= 0; n-- {
+		if err := os.Rename(l.rotated(n), l.rotated(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return l.openActive()
+}
+
+// Write appends an entry, stamping the time if it is unset.
+func (l *Log) Write(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return os.ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("audit: rotate: %w", err)
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the active file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Query selects entries. Zero fields match everything.
+type Query struct {
+	Action   string
+	DeviceID string
+	File     string
+	Since    time.Time
+	Until    time.Time
+	Limit    int // most recent entries to return; 0 is unlimited
+}
+
+func (q Query) matches(e Entry) bool {
+	return (q.Action == "" || e.Action == q.Action) &&
+		(q.DeviceID == "" || e.DeviceID == q.DeviceID) &&
+		(q.File == "" || e.File == q.File) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Search returns matching entries, oldest first, across the active and
+// rotated files. With a limit only the most recent matches are kept.
+func (l *Log) Search(q Query) ([]Entry, error) {
+	files, err := l.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var out []Entry
+	for _, f := range files {
+		if out, err = scanEntries(f, q, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// snapshot opens every log file, oldest first, under the lock, so a
+// rotation cannot shift them mid-search. The files are read after the
+// lock is released; the active one is capped at its current size so
+// writes that land during the search are not half-read.
+func (l *Log) snapshot() ([]io.ReadCloser, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var files []io.ReadCloser
+	for n := l.keep; n >= 0; n-- {
+		f, err := os.Open(l.rotated(n))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		if n == 0 && l.f != nil {
+			files = append(files, struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(f, l.size), f})
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func scanEntries(r io.Reader, q Query, out []Entry) ([]Entry, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e Entry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || !q.matches(e) {
+			continue // a torn last line after a crash is skipped
+		}
+		out = append(out, e)
+		if q.Limit > 0 && len(out) > q.Limit {
+			out = out[1:]
+		}
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAndSearch(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []Entry{
+		{Time: base, Action: ActionUpload, Outcome: OutcomeOK, DeviceID: "dev_a", File: "a.txt"},
+		{Time: base.Add(time.Minute), Action: ActionDownload, Outcome: OutcomeOK, DeviceID: "dev_b", File: "a.txt"},
+		{Time: base.Add(2 * time.Minute), Action: ActionDelete, Outcome: OutcomeOK, DeviceID: "dev_a", File: "a.txt"},
+	}
+	for _, e := range entries {
+		if err := l.Write(e); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string // actions
+	}{
+		{"all", Query{}, []string{ActionUpload, ActionDownload, ActionDelete}},
+		{"by action", Query{Action: ActionDownload}, []string{ActionDownload}},
+		{"by device", Query{DeviceID: "dev_a"}, []string{ActionUpload, ActionDelete}},
+		{"since", Query{Since: base.Add(time.Minute)}, []string{ActionDownload, ActionDelete}},
+		{"until", Query{Until: base.Add(time.Minute)}, []string{ActionUpload}},
+		{"limit keeps newest", Query{Limit: 2}, []string{ActionDownload, ActionDelete}},
+		{"no match", Query{File: "b.txt"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := l.Search(tt.q)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			var actions []string
+			for _, e := range got {
+				actions = append(actions, e.Action)
+			}
+			if strings.Join(actions, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", actions, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 300, 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := l.Write(Entry{Action: ActionRegister, Outcome: OutcomeOK, DeviceID: "dev_rotate", Detail: strings.Repeat("x", 50)}); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	l.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s is %d bytes, over the limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only two rotated files to be kept")
+	}
+
+	// Reopening appends to the active file rather than truncating it.
+	before, _ := os.ReadFile(path)
+	l, err = Open(path, 300, 2)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	got, err := l.Search(Query{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(got) == 0 || len(got) >= 20 {
+		t.Errorf("expected the retained entries only, got %d", len(got))
+	}
+	after, _ := os.ReadFile(path)
+	if string(after) != string(before) {
+		t.Error("reopening changed the active file")
+	}
+}
+
+func TestSearchDuringRotation(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"), 400, 3)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			l.Write(Entry{Action: ActionUpload, Outcome: OutcomeOK, Size: int64(i)})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		got, err := l.Search(Query{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].Size != got[i-1].Size+1 {
+				t.Fatalf("entries out of order or torn: %d after %d", got[i].Size, got[i-1].Size)
+			}
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID Connect provider for exercising the login flow.
+type mockIdP struct {
+	srv       *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	groups    []string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	m := &mockIdP{key: key, groups: []string{"engineering"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if id != "goshare" || secret != "s3cret" || r.Form.Get("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, map[string]interface{}{
+			"iss":    m.srv.URL,
+			"aud":    "goshare",
+			"sub":    "user-42",
+			"name":   "Ada Lovelace",
+			"email":  "ada@example.com",
+			"groups": m.groups,
+			"nonce":  m.nonce,
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signing := enc(map[string]string{"alg": "RS256", "kid": "test-key"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// login drives HandleLogin and HandleCallback against the mock provider
+// and returns the callback response.
+func (m *mockIdP) login(t *testing.T, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	HandleLogin(w, httptest.NewRequest("GET", "/auth/login?next=/pages/lan.html", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected login redirect, got %d", w.Code)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	m.challenge, m.nonce = q.Get("code_challenge"), q.Get("nonce")
+
+	cb := httptest.NewRequest("GET", "/auth/callback?code="+code+"&state="+q.Get("state"), nil)
+	for _, c := range w.Result().Cookies() {
+		cb.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	HandleCallback(w, cb)
+	return w
+}
+
+// sessionCookie returns the session cookie set by a response, or nil.
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie {
+			return c
+		}
+	}
+	return nil
+}
+
+func configureMock(t *testing.T, m *mockIdP, groups []string) {
+	t.Helper()
+	p, err := NewProvider(Config{Issuer: m.srv.URL, ClientID: "goshare", ClientSecret: "s3cret", AllowedGroups: groups})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	provider = p
+	t.Cleanup(func() { provider = nil })
+}
+
+func TestLoginFlow(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, []string{"engineering"})
+
+	w := m.login(t, "good-code")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/pages/lan.html" {
+		t.Fatalf("expected redirect back to page, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("expected session cookie")
+	}
+
+	// The session cookie unlocks guarded routes and exposes the user.
+	guarded := Require(HandleMe)
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	guarded(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with session, got %d", w.Code)
+	}
+	var u User
+	json.NewDecoder(w.Body).Decode(&u)
+	if u.Name != "Ada Lovelace" || u.Email != "ada@example.com" {
+		t.Errorf("unexpected user %+v", u)
+	}
+
+	// Without the cookie the route is closed.
+	w = httptest.NewRecorder()
+	guarded(w, httptest.NewRequest("GET", "/api/me", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without session, got %d", w.Code)
+	}
+}
+
+func TestLoginFlow_GroupDenied(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, []string{"admins"})
+
+	if w := m.login(t, "good-code"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for user outside allowed groups, got %d", w.Code)
+	}
+}
+
+func TestLoginFlow_BadCode(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, nil)
+
+	if w := m.login(t, "stolen-code"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for rejected code, got %d", w.Code)
+	}
+}
+
+func TestHandleCallback_UnknownState(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, nil)
+
+	w := httptest.NewRecorder()
+	HandleCallback(w, httptest.NewRequest("GET", "/auth/callback?code=good-code&state=forged", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown state, got %d", w.Code)
+	}
+}
+
+func TestHandleCallback_LoginCookie(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, nil)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"other browser", &http.Cookie{Name: loginCookie, Value: "someone-elses-state"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleLogin(w, httptest.NewRequest("GET", "/auth/login", nil))
+			loc, _ := url.Parse(w.Header().Get("Location"))
+			q := loc.Query()
+			m.challenge, m.nonce = q.Get("code_challenge"), q.Get("nonce")
+
+			cb := httptest.NewRequest("GET", "/auth/callback?code=good-code&state="+q.Get("state"), nil)
+			if tt.cookie != nil {
+				cb.AddCookie(tt.cookie)
+			}
+			w = httptest.NewRecorder()
+			HandleCallback(w, cb)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken_Rejects(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, nil)
+
+	base := map[string]interface{}{"iss": m.srv.URL, "aud": "goshare", "sub": "x", "nonce": "n", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name   string
+		mutate func(map[string]interface{})
+	}{
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other-app" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := make(map[string]interface{})
+			for k, v := range base {
+				claims[k] = v
+			}
+			tt.mutate(claims)
+			if _, err := provider.verifyIDToken(m.sign(t, claims), "n"); err == nil {
+				t.Error("expected token to be rejected")
+			}
+		})
+	}
+
+	// Tampering with the payload breaks the signature.
+	tok := m.sign(t, base)
+	tampered := tok[:len(tok)-4] + "AAAA"
+	if _, err := provider.verifyIDToken(tampered, "n"); err == nil {
+		t.Error("expected tampered token to be rejected")
+	}
+}
+
+func TestRequire_Disabled(t *testing.T) {
+	h := Require(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/api/files", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected passthrough when SSO is disabled, got %d", w.Code)
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	m := newMockIdP(t)
+	configureMock(t, m, nil)
+	cookie := sessionCookie(m.login(t, "good-code"))
+
+	logout := func(method string, header map[string]string) int {
+		req := httptest.NewRequest(method, "http://goshare.lan/auth/logout", nil)
+		req.AddCookie(cookie)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		HandleLogout(w, req)
+		return w.Code
+	}
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"GET", "GET", nil, http.StatusMethodNotAllowed},
+		{"cross-site POST", "POST", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"POST without origin", "POST", nil, http.StatusForbidden},
+		{"same-site subdomain", "POST", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code := logout(tt.method, tt.header); code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, code)
+		}
+	}
+	if lookupSession(withCookie(cookie)) == nil {
+		t.Fatal("rejected logouts must keep the session")
+	}
+
+	if code := logout("POST", map[string]string{"Origin": "http://goshare.lan"}); code != http.StatusFound {
+		t.Fatalf("same-origin POST: expected 302, got %d", code)
+	}
+	if lookupSession(withCookie(cookie)) != nil {
+		t.Error("expected the session to be ended")
+	}
+}
+
+func withCookie(c *http.Cookie) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	return req
+}
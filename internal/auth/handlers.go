@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HandleLogin starts the authorization code flow.
+func HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if !Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	// Only local paths, so the login flow cannot be used as an open redirect.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	redirect := provider.cfg.RedirectURL
+	if redirect == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		redirect = scheme + "://" + r.Host + "/auth/callback"
+	}
+
+	sessionLock.Lock()
+	logins[state] = &pendingLogin{
+		verifier: verifier,
+		nonce:    nonce,
+		redirect: redirect,
+		next:     next,
+		expires:  time.Now().Add(loginTTL),
+	}
+	sessionLock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    state,
+		Path:     "/auth",
+		MaxAge:   int(loginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(redirect, state, nonce, verifier), http.StatusFound)
+}
+
+// HandleCallback completes the login, verifies the ID token and sets the
+// session cookie. The state must match the login cookie, so a callback
+// URL started in one browser cannot be completed in another.
+func HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if !Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("SSO login failed at provider: %s %s", e, q.Get("error_description"))
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	state := q.Get("state")
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Value: "", Path: "/auth", MaxAge: -1, HttpOnly: true})
+	c, err := r.Cookie(loginCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		log.Printf("SSO callback without matching login cookie from %s", r.RemoteAddr)
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	sessionLock.Lock()
+	login, ok := logins[state]
+	delete(logins, state)
+	sessionLock.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	user, err := provider.Exchange(q.Get("code"), login.redirect, login.verifier, login.nonce)
+	if errors.Is(err, ErrGroupDenied) {
+		log.Printf("SSO login denied by group policy from %s", r.RemoteAddr)
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("SSO login failed: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    newSession(user),
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	logSession("login", user, r)
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+// HandleLogout ends the session. It takes a same-origin POST only, so a
+// cross-site link or image cannot sign the user out.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		log.Printf("Cross-origin logout rejected from %s", r.RemoteAddr)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		sessionLock.Lock()
+		if s, ok := sessions[c.Value]; ok {
+			logSession("logout", s.user, r)
+			delete(sessions, c.Value)
+		}
+		sessionLock.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// sameOrigin reports whether the browser says the request comes from this
+// server's own pages. Browsers send Origin on every POST; Sec-Fetch-Site
+// covers those that omit it.
+func sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+}
+
+// HandleMe returns the signed-in user.
+func HandleMe(w http.ResponseWriter, r *http.Request) {
+	u := UserFromRequest(r)
+	if u == nil {
+		http.Error(w, "not signed in", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(u); err != nil {
+		log.Printf("Error encoding user response: %v", err)
+	}
+}
+
+// userFromClaims maps ID token claims onto a User. The display name falls
+// back through name, preferred_username and email to the subject.
+func userFromClaims(claims map[string]interface{}, groupsClaim string) *User {
+	str := func(k string) string {
+		s, _ := claims[k].(string)
+		return s
+	}
+	u := &User{Subject: str("sub"), Email: str("email")}
+	for _, k := range []string{"name", "preferred_username", "email", "sub"} {
+		if u.Name = str(k); u.Name != "" {
+			break
+		}
+	}
+	switch g := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				u.Groups = append(u.Groups, s)
+			}
+		}
+	case string:
+		u.Groups = strings.Fields(strings.ReplaceAll(g, ",", " "))
+	}
+	return u
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is an authenticated person, as asserted by the identity provider.
+type User struct {
+	Subject string   `json:"sub"`
+	Name    string   `json:"name"`
+	Email   string   `json:"email,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// SessionCookie is the name of the cookie carrying the session token.
+const SessionCookie = "goshare_session"
+
+// loginCookie carries the state of a login in progress, binding the
+// callback to the browser that started it.
+const loginCookie = "goshare_login"
+
+const (
+	sessionTTL = 12 * time.Hour
+	loginTTL   = 10 * time.Minute
+)
+
+type session struct {
+	user    *User
+	expires time.Time
+}
+
+// pendingLogin is the state kept between the redirect to the provider and
+// the callback.
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	redirect string
+	next     string
+	expires  time.Time
+}
+
+var (
+	provider *Provider
+
+	sessionLock sync.Mutex
+	sessions    = make(map[string]*session)
+	logins      = make(map[string]*pendingLogin)
+)
+
+// Configure enables single sign-on with the given provider settings.
+func Configure(cfg Config) error {
+	p, err := NewProvider(cfg)
+	if err != nil {
+		return err
+	}
+	provider = p
+	go cleanupSessions()
+	return nil
+}
+
+// Enabled reports whether single sign-on is configured.
+func Enabled() bool {
+	return provider != nil
+}
+
+func cleanupSessions() {
+	for {
+		time.Sleep(5 * time.Minute)
+		now := time.Now()
+		sessionLock.Lock()
+		for tok, s := range sessions {
+			if now.After(s.expires) {
+				delete(sessions, tok)
+			}
+		}
+		for state, l := range logins {
+			if now.After(l.expires) {
+				delete(logins, state)
+			}
+		}
+		sessionLock.Unlock()
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newSession(u *User) string {
+	tok := randomToken()
+	sessionLock.Lock()
+	sessions[tok] = &session{user: u, expires: time.Now().Add(sessionTTL)}
+	sessionLock.Unlock()
+	return tok
+}
+
+func lookupSession(r *http.Request) *User {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s, ok := sessions[c.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(sessions, c.Value)
+		return nil
+	}
+	return s.user
+}
+
+type userKey struct{}
+
+// UserFromRequest returns the signed-in user for the request, or nil when
+// single sign-on is disabled or the request has no valid session.
+func UserFromRequest(r *http.Request) *User {
+	if u, ok := r.Context().Value(userKey{}).(*User); ok {
+		return u
+	}
+	if !Enabled() {
+		return nil
+	}
+	return lookupSession(r)
+}
+
+// WithUser returns a copy of ctx carrying u as the signed-in user, as
+// Require does for a valid session.
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// Require rejects requests without a valid session when single sign-on is
+// enabled. It is a no-op otherwise.
+func Require(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			h(w, r)
+			return
+		}
+		u := lookupSession(r)
+		if u == nil {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(WithUser(r.Context(), u)))
+	}
+}
+
+// RequirePage redirects browsers without a session to the login flow,
+// returning them to the page they asked for afterwards.
+func RequirePage(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isPage := r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, ".html")
+		if Enabled() && isPage && lookupSession(r) == nil {
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func logSession(event string, u *User, r *http.Request) {
+	log.Printf("SSO %s: %s <%s> from %s", event, u.Name, u.Email, r.RemoteAddr)
+}
@@ -0,0 +1,309 @@
+// Package certs manages the TLS certificates GoShare serves with: either a
+// user-supplied pair, or a locally generated CA plus a leaf certificate that
+// covers every interface address of the machine.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// File names inside the certificate directory.
+const (
+	CAFile   = "ca.pem"
+	caKey    = "ca-key.pem"
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 825 * 24 * time.Hour // longest lifetime Apple platforms accept
+	renewBefore  = 30 * 24 * time.Hour
+)
+
+// lanRanges are the private, loopback and link-local blocks a LAN server
+// is reached on. The local CA may issue for any address in them, so a new
+// DHCP lease only needs a new leaf, not a new CA to install.
+var lanRanges = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+}
+
+// Load reads a user-supplied certificate and key pair.
+func Load(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("parse certificate: %w", err)
+		}
+	}
+	return cert, nil
+}
+
+// LoadPool reads a PEM bundle of CA certificates, e.g. the CA that signs
+// client certificates for mutual TLS.
+func LoadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("load CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// EnsureLocal returns a certificate for the given addresses, signed by a
+// local CA kept in dir. The CA is created on first use and reused after
+// that so devices only need to trust it once. The leaf certificate is
+// re-issued when it is close to expiry or no longer covers every address.
+func EnsureLocal(dir string, ips []net.IP, hosts []string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, caPriv, err := loadOrCreateCA(dir, ips, hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPath := filepath.Join(dir, CertFile)
+	keyPath := filepath.Join(dir, KeyFile)
+	if cert, err := Load(certPath, keyPath); err == nil && leafUsable(cert.Leaf, ca, ips, hosts) {
+		return cert, nil
+	}
+
+	if err := issueLeaf(certPath, keyPath, ca, caPriv, ips, hosts); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Issued TLS certificate for %d addresses in %s", len(ips)+len(hosts), dir)
+	return Load(certPath, keyPath)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as
+// colon-separated upper-case hex, the format browsers display.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadOrCreateCA returns the CA in dir, replacing it when it has expired
+// or its name constraints do not cover ips and hosts. The CA is name
+// constrained so that, once trusted by a device, it cannot vouch for any
+// other site.
+func loadOrCreateCA(dir string, ips []net.IP, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, CAFile)
+	keyPath := filepath.Join(dir, caKey)
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse CA: %w", err)
+		}
+		priv, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("CA key is not ECDSA")
+		}
+		switch {
+		case !time.Now().Before(ca.NotAfter):
+			log.Printf("Local CA in %s has expired, generating a new one", dir)
+		case !caCovers(ca, ips, hosts):
+			log.Printf("Local CA in %s is not constrained to this server's addresses, generating a new one; devices must trust the new %s", dir, CAFile)
+		default:
+			return ca, priv, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("load CA: %w", err)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	ranges, domains := caConstraints(ips, hosts)
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{Organization: []string{"GoShare"}, CommonName: "GoShare Local CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         domains,
+		PermittedIPRanges:           ranges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyPath, priv); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Generated local CA: %s", certPath)
+	ca, err := x509.ParseCertificate(der)
+	return ca, priv, err
+}
+
+// caConstraints returns the name constraints for a CA serving ips and
+// hosts: the LAN ranges plus any served address outside them, and the host
+// names. "localhost" is always included so the DNS constraint is never
+// empty, which would leave DNS names unconstrained.
+func caConstraints(ips []net.IP, hosts []string) ([]*net.IPNet, []string) {
+	var ranges []*net.IPNet
+	for _, cidr := range lanRanges {
+		_, n, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, n)
+	}
+	for _, ip := range ips {
+		if ipCovered(ranges, ip) {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ranges = append(ranges, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	domains := []string{"localhost"}
+	for _, h := range hosts {
+		if h = strings.ToLower(h); !slices.Contains(domains, h) {
+			domains = append(domains, h)
+		}
+	}
+	return ranges, domains
+}
+
+// caCovers reports whether ca is name constrained and may issue for every
+// address and host name.
+func caCovers(ca *x509.Certificate, ips []net.IP, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedIPRanges) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ipCovered(ca.PermittedIPRanges, ip) {
+			return false
+		}
+	}
+	for _, h := range hosts {
+		if !slices.Contains(ca.PermittedDNSDomains, strings.ToLower(h)) {
+			return false
+		}
+	}
+	return true
+}
+
+func ipCovered(ranges []*net.IPNet, ip net.IP) bool {
+	for _, n := range ranges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func issueLeaf(certPath, keyPath string, ca *x509.Certificate, caPriv *ecdsa.PrivateKey, ips []net.IP, hosts []string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{Organization: []string{"GoShare"}, CommonName: "GoShare"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+		DNSNames:     hosts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caPriv)
+	if err != nil {
+		return err
+	}
+	// Serve the chain so clients that trust the CA can verify the leaf.
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	if err := os.WriteFile(certPath, chain, 0644); err != nil {
+		return err
+	}
+	return writeKey(keyPath, priv)
+}
+
+// leafUsable reports whether an existing leaf was issued by ca, is not
+// about to expire, and covers every requested address and host name.
+func leafUsable(leaf, ca *x509.Certificate, ips []net.IP, hosts []string) bool {
+	if leaf == nil || leaf.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	if time.Until(leaf.NotAfter) < renewBefore {
+		return false
+	}
+	for _, ip := range ips {
+		found := false
+		for _, have := range leaf.IPAddresses {
+			if have.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func newSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+func writeKey(path string, priv *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
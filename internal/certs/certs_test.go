@@ -0,0 +1,127 @@
+package certs
+
+import (
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnsureLocal(t *testing.T) {
+	dir := t.TempDir()
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.168.1.20")}
+
+	cert, err := EnsureLocal(dir, ips, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("EnsureLocal: %v", err)
+	}
+	for _, ip := range ips {
+		if err := cert.Leaf.VerifyHostname(ip.String()); err != nil {
+			t.Errorf("certificate does not cover %s: %v", ip, err)
+		}
+	}
+
+	// The leaf must chain to the persisted CA.
+	caPEM, err := os.ReadFile(filepath.Join(dir, CAFile))
+	if err != nil {
+		t.Fatalf("reading CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "localhost"}); err != nil {
+		t.Errorf("leaf does not verify against local CA: %v", err)
+	}
+
+	// A second call with the same addresses reuses the certificate.
+	again, err := EnsureLocal(dir, ips, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("EnsureLocal (reuse): %v", err)
+	}
+	if Fingerprint(again.Leaf) != Fingerprint(cert.Leaf) {
+		t.Error("expected existing certificate to be reused")
+	}
+
+	// A new interface address forces a re-issue from the same CA.
+	ips = append(ips, net.ParseIP("10.0.0.7"))
+	renewed, err := EnsureLocal(dir, ips, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("EnsureLocal (renew): %v", err)
+	}
+	if Fingerprint(renewed.Leaf) == Fingerprint(cert.Leaf) {
+		t.Error("expected certificate to be re-issued for new address")
+	}
+	if _, err := renewed.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "10.0.0.7"}); err != nil {
+		t.Errorf("re-issued leaf does not verify against the original CA: %v", err)
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	if _, err := Load("missing.pem", "missing-key.pem"); err == nil {
+		t.Error("expected error for missing certificate files")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert, err := EnsureLocal(t.TempDir(), []net.IP{net.ParseIP("127.0.0.1")}, nil)
+	if err != nil {
+		t.Fatalf("EnsureLocal: %v", err)
+	}
+	fp := Fingerprint(cert.Leaf)
+	if parts := strings.Split(fp, ":"); len(parts) != 32 {
+		t.Errorf("expected 32 colon-separated bytes, got %q", fp)
+	}
+}
+
+func TestLocalCA_NameConstraints(t *testing.T) {
+	dir := t.TempDir()
+	ips := []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("203.0.113.9")}
+	ca, priv, err := loadOrCreateCA(dir, ips, []string{"nas"})
+	if err != nil {
+		t.Fatalf("loadOrCreateCA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	tests := []struct {
+		name  string
+		ips   []net.IP
+		hosts []string
+		ok    bool
+	}{
+		{"served host", nil, []string{"nas"}, true},
+		{"other LAN address", []net.IP{net.ParseIP("10.1.2.3")}, nil, true},
+		{"served public address", []net.IP{net.ParseIP("203.0.113.9")}, nil, true},
+		{"foreign domain", nil, []string{"example.com"}, false},
+		{"foreign address", []net.IP{net.ParseIP("198.51.100.1")}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPath := filepath.Join(t.TempDir(), CertFile)
+			keyPath := filepath.Join(t.TempDir(), KeyFile)
+			if err := issueLeaf(certPath, keyPath, ca, priv, tt.ips, tt.hosts); err != nil {
+				t.Fatalf("issueLeaf: %v", err)
+			}
+			leaf, err := Load(certPath, keyPath)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			_, err = leaf.Leaf.Verify(x509.VerifyOptions{Roots: pool})
+			if (err == nil) != tt.ok {
+				t.Errorf("verify error = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+
+	// The CA is kept while it covers the server and replaced when the
+	// server gains a name outside its constraints.
+	same, _, err := loadOrCreateCA(dir, ips[:1], []string{"nas"})
+	if err != nil || Fingerprint(same) != Fingerprint(ca) {
+		t.Errorf("expected the CA to be reused, err=%v", err)
+	}
+	renamed, _, err := loadOrCreateCA(dir, ips, []string{"nas", "files"})
+	if err != nil || Fingerprint(renamed) == Fingerprint(ca) {
+		t.Errorf("expected a new CA for a new host name, err=%v", err)
+	}
+}
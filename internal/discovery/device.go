@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"strings"
 	"sync"
 	"time"
@@ -13,15 +12,26 @@ import (
 
 // Device represents a discovered peer on the network.
 type Device struct {
-	ID        string        `json:"id"`
-	Name      string        `json:"name"`
-	Icon      string        `json:"icon"`
-	Type      string        `json:"type"`
-	IP        string        `json:"-"` // raw RemoteAddr (may include port)
-	NetworkIP string        `json:"-"` // public IP only (for network grouping)
-	UA        string        `json:"-"`
-	LastSeen  time.Time     `json:"-"`
-	Queues    []chan []byte `json:"-"`
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Icon      string       `json:"icon"`
+	Type      string       `json:"type"`
+	Trusted   bool         `json:"trusted,omitempty"`    // authenticated by client certificate
+	User      string       `json:"user,omitempty"`       // SSO account (subject claim)
+	PublicKey string       `json:"public_key,omitempty"` // E2E encryption key (base64url P-256 point)
+	IP        string       `json:"-"`                    // raw RemoteAddr (may include port)
+	NetworkIP string       `json:"-"`                    // public IP only (for network grouping)
+	FirstIP   string       `json:"-"`                    // client IP that first registered the ID
+	UA        string       `json:"-"`
+	LastSeen  time.Time    `json:"-"`
+	Queues    []chan Event `json:"-"`
+}
+
+// Event is a message queued for a device's live connections (SSE or
+// WebSocket), which frame it for their transport.
+type Event struct {
+	Name string
+	Data json.RawMessage
 }
 
 // Global device registry.
@@ -70,28 +80,6 @@ func DetectType(ua string) string {
 	return "desktop"
 }
 
-// ExtractIP extracts the client's public IP from the HTTP request context.
-// It checks X-Forwarded-For (reverse proxy), X-Real-IP, then falls back to RemoteAddr.
-func ExtractIP(remoteAddr string, xForwardedFor string, xRealIP string) string {
-	// Check X-Forwarded-For first (Koyeb, Cloudflare, etc.)
-	// Format: "client, proxy1, proxy2" — take the first (real client) IP.
-	if xForwardedFor != "" {
-		if i := strings.IndexByte(xForwardedFor, ','); i > 0 {
-			return strings.TrimSpace(xForwardedFor[:i])
-		}
-		return strings.TrimSpace(xForwardedFor)
-	}
-	if xRealIP != "" {
-		return strings.TrimSpace(xRealIP)
-	}
-	// Strip port from RemoteAddr
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		return remoteAddr
-	}
-	return host
-}
-
 // PeersOnSameNetwork returns all devices that share the same NetworkIP as
 // the given device, excluding the device itself.
 // Must be called with Lock held (at least RLock).
@@ -118,7 +106,7 @@ func Broadcast(event string, data interface{}, senderID string) {
 		log.Printf("Broadcast marshal error: %v", err)
 		return
 	}
-	payload := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, msg))
+	payload := Event{Name: event, Data: msg}
 
 	Lock.RLock()
 	defer Lock.RUnlock()
@@ -150,7 +138,7 @@ func Broadcast(event string, data interface{}, senderID string) {
 	}
 }
 
-// Notify sends an SSE event to a specific device by ID.
+// Notify sends an event to a specific device by ID.
 // Must be called WITHOUT the lock held.
 func Notify(targetID string, event string, data interface{}) {
 	msg, err := json.Marshal(data)
@@ -158,7 +146,7 @@ func Notify(targetID string, event string, data interface{}) {
 		log.Printf("Notify marshal error: %v", err)
 		return
 	}
-	payload := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, msg))
+	payload := Event{Name: event, Data: msg}
 
 	Lock.RLock()
 	defer Lock.RUnlock()
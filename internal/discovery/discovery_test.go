@@ -72,31 +72,6 @@ func TestDetectType(t *testing.T) {
 	}
 }
 
-func TestExtractIP(t *testing.T) {
-	tests := []struct {
-		name     string
-		remote   string
-		xff      string
-		xri      string
-		expected string
-	}{
-		{"X-Forwarded-For single", "10.0.0.1:1234", "203.0.113.50", "", "203.0.113.50"},
-		{"X-Forwarded-For chain", "10.0.0.1:1234", "203.0.113.50, 70.41.3.18, 150.172.238.178", "", "203.0.113.50"},
-		{"X-Real-IP", "10.0.0.1:1234", "", "198.51.100.10", "198.51.100.10"},
-		{"RemoteAddr with port", "192.168.1.5:54321", "", "", "192.168.1.5"},
-		{"RemoteAddr no port", "192.168.1.5", "", "", "192.168.1.5"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := ExtractIP(tt.remote, tt.xff, tt.xri)
-			if result != tt.expected {
-				t.Errorf("ExtractIP(%q, %q, %q) = %q, want %q", tt.remote, tt.xff, tt.xri, result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestPeersOnSameNetwork(t *testing.T) {
 	// Setup: two devices on same network, one on different
 	Lock.Lock()
@@ -125,13 +100,13 @@ func TestPeersOnSameNetwork(t *testing.T) {
 }
 
 func TestBroadcast_SameNetworkOnly(t *testing.T) {
-	qA := make(chan []byte, 10)
-	qC := make(chan []byte, 10)
+	qA := make(chan Event, 10)
+	qC := make(chan Event, 10)
 
 	Lock.Lock()
-	Devices["dev-a"] = &Device{ID: "dev-a", Name: "A", NetworkIP: "203.0.113.50", Queues: []chan []byte{qA}}
+	Devices["dev-a"] = &Device{ID: "dev-a", Name: "A", NetworkIP: "203.0.113.50", Queues: []chan Event{qA}}
 	Devices["dev-b"] = &Device{ID: "dev-b", Name: "B", NetworkIP: "203.0.113.50"}
-	Devices["dev-c"] = &Device{ID: "dev-c", Name: "C", NetworkIP: "198.51.100.10", Queues: []chan []byte{qC}}
+	Devices["dev-c"] = &Device{ID: "dev-c", Name: "C", NetworkIP: "198.51.100.10", Queues: []chan Event{qC}}
 	Lock.Unlock()
 
 	// Broadcast from dev-b — should reach dev-a (same network) but NOT dev-c
@@ -139,8 +114,8 @@ func TestBroadcast_SameNetworkOnly(t *testing.T) {
 
 	select {
 	case msg := <-qA:
-		if len(msg) == 0 {
-			t.Error("expected non-empty message for dev-a")
+		if msg.Name != "test-event" || len(msg.Data) == 0 {
+			t.Errorf("unexpected message for dev-a: %+v", msg)
 		}
 	default:
 		t.Error("dev-a should have received the broadcast (same network)")
@@ -162,18 +137,18 @@ func TestBroadcast_SameNetworkOnly(t *testing.T) {
 }
 
 func TestNotify(t *testing.T) {
-	q := make(chan []byte, 10)
+	q := make(chan Event, 10)
 
 	Lock.Lock()
-	Devices["dev-target"] = &Device{ID: "dev-target", Name: "Target", Queues: []chan []byte{q}}
+	Devices["dev-target"] = &Device{ID: "dev-target", Name: "Target", Queues: []chan Event{q}}
 	Lock.Unlock()
 
 	Notify("dev-target", "files-sent", map[string]string{"from": "someone"})
 
 	select {
 	case msg := <-q:
-		if len(msg) == 0 {
-			t.Error("expected non-empty notification")
+		if msg.Name != "files-sent" || len(msg.Data) == 0 {
+			t.Errorf("unexpected notification: %+v", msg)
 		}
 	default:
 		t.Error("target should have received the notification")
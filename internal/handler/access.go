@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"fileshare/internal/network"
+)
+
+// accessPolicy decides which source addresses may reach the server.
+// Deny entries always win; a non-empty allow list admits only matching
+// addresses; LAN-only mode additionally rejects anything that is not a
+// private, loopback or link-local address.
+type accessPolicy struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	lanOnly bool
+}
+
+var (
+	accessLock    sync.RWMutex
+	currentAccess accessPolicy
+)
+
+// SetAccessPolicy configures the IP allow/deny lists and LAN-only mode
+// enforced by AccessControl. Entries may be CIDRs or bare addresses.
+func SetAccessPolicy(allow, deny []string, lanOnly bool) error {
+	allowNets, err := network.ParseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := network.ParseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	accessLock.Lock()
+	currentAccess = accessPolicy{allow: allowNets, deny: denyNets, lanOnly: lanOnly}
+	accessLock.Unlock()
+	return nil
+}
+
+func (p *accessPolicy) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(p.allow) == 0 && !p.lanOnly
+	}
+	if network.ContainsIP(p.deny, ip) {
+		return false
+	}
+	if len(p.allow) > 0 && !network.ContainsIP(p.allow, ip) {
+		return false
+	}
+	if p.lanOnly && !isLANAddress(ip) {
+		return false
+	}
+	return true
+}
+
+// isLANAddress reports whether ip is a private (RFC 1918 / RFC 4193),
+// loopback or link-local address.
+func isLANAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// IPAllowed reports whether the access policy admits ip, for services
+// that do not go through AccessControl, such as the STUN server.
+func IPAllowed(ip net.IP) bool {
+	accessLock.RLock()
+	policy := currentAccess
+	accessLock.RUnlock()
+	return policy.permits(ip)
+}
+
+// AccessControl wraps a handler with the configured IP access policy.
+// Rejected requests get 403 and are logged with the resolved client IP.
+func AccessControl(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accessLock.RLock()
+		policy := currentAccess
+		accessLock.RUnlock()
+
+		ip := network.ClientIP(r)
+		if !policy.permits(net.ParseIP(ip)) {
+			log.Printf("Access denied: %s %s from %s", r.Method, r.URL.Path, ip)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
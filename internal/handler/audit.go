@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"fileshare/internal/audit"
+	"fileshare/internal/auth"
+	"fileshare/internal/discovery"
+	"fileshare/internal/network"
+)
+
+var (
+	auditLog   *audit.Log
+	adminToken string
+	adminGroup string
+)
+
+// Bounds for audit queries.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditQueryParams are the parameters HandleAuditQuery understands, in
+// the order they are summarised.
+var auditQueryParams = []string{"action", "device", "file", "since", "until", "limit"}
+
+// maxAuditDetailValue bounds each value copied into an audit summary.
+const maxAuditDetailValue = 64
+
+// SetAuditLog enables recording of file and device operations; nil
+// disables it.
+func SetAuditLog(l *audit.Log) {
+	auditLog = l
+}
+
+// SetAdmin configures who may use the admin endpoints: callers sending
+// token as a bearer token, and SSO users in group. Empty values disable
+// that way in; with both empty no one is an admin.
+func SetAdmin(token, group string) {
+	adminToken = token
+	adminGroup = group
+}
+
+// auditEntry starts an audit record for a request, filling in the client
+// address, the device's current name and the SSO account.
+func auditEntry(r *http.Request, action, deviceID string) audit.Entry {
+	e := audit.Entry{
+		Action:   action,
+		Outcome:  audit.OutcomeOK,
+		DeviceID: deviceID,
+		ClientIP: network.ClientIP(r),
+	}
+	if deviceID != "" {
+		discovery.Lock.RLock()
+		if dev, ok := discovery.Devices[deviceID]; ok {
+			e.DeviceName = dev.Name
+		}
+		discovery.Lock.RUnlock()
+	}
+	if u := auth.UserFromRequest(r); u != nil {
+		e.User = u.Email
+		if e.User == "" {
+			e.User = u.Subject
+		}
+	}
+	return e
+}
+
+// record writes an audit entry when auditing is enabled.
+func record(e audit.Entry) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Write(e); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// isAdmin reports whether the request carries admin credentials.
+func isAdmin(r *http.Request) bool {
+	if adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return true
+		}
+	}
+	if adminGroup != "" {
+		if u := auth.UserFromRequest(r); u != nil {
+			return containsString(u.Groups, adminGroup)
+		}
+	}
+	return false
+}
+
+// HandleAuditQuery returns audit entries to admins, oldest first.
+// Optional query parameters: action, device, file, since and until
+// (RFC 3339) and limit (most recent entries, default 100).
+func HandleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e := auditEntry(r, audit.ActionAdmin, "")
+	if !isAdmin(r) {
+		// Callers who are not admins only get the parameter names logged.
+		e.Detail = "audit query " + querySummary(r.URL.Query(), false)
+		log.Printf("Admin access denied for %s", e.ClientIP)
+		e.Outcome = audit.OutcomeDenied
+		record(e)
+		http.Error(w, "admin access required", http.StatusForbidden)
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "audit log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	q := audit.Query{
+		Action:   params.Get("action"),
+		DeviceID: params.Get("device"),
+		File:     params.Get("file"),
+		Limit:    defaultAuditLimit,
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid "+name, 400)
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		q.Limit = n
+	}
+
+	e.Detail = "audit query " + querySummary(params, true)
+	record(e)
+	entries, err := auditLog.Search(q)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("Error encoding audit entries: %v", err)
+	}
+}
+
+// querySummary describes an audit query for the log: the recognised
+// parameters, with their values (trimmed and stripped of control
+// characters) if withValues is set, and a count of any others.
+func querySummary(params map[string][]string, withValues bool) string {
+	var parts []string
+	known := 0
+	for _, name := range auditQueryParams {
+		v, ok := params[name]
+		if !ok {
+			continue
+		}
+		known++
+		if !withValues || len(v) == 0 {
+			parts = append(parts, name)
+			continue
+		}
+		val := strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, v[0])
+		if len(val) > maxAuditDetailValue {
+			val = strings.ToValidUTF8(val[:maxAuditDetailValue], "") + "..."
+		}
+		parts = append(parts, name+"="+strconv.Quote(val))
+	}
+	if other := len(params) - known; other > 0 {
+		parts = append(parts, fmt.Sprintf("+%d other", other))
+	}
+	if len(parts) == 0 {
+		return "(no parameters)"
+	}
+	return strings.Join(parts, " ")
+}
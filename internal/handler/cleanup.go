@@ -2,7 +2,6 @@ package handler
 
 import (
 	"log"
-	"os"
 	"path/filepath"
 	"time"
 )
@@ -17,8 +16,9 @@ func StartPrivateCleanup() {
 func cleanupPrivateFiles() {
 	for {
 		time.Sleep(5 * time.Minute)
-		privateDir := filepath.Join(SharedDir, "private")
-		entries, err := os.ReadDir(privateDir)
+		cleanupQuarantine()
+		privateDir := "private"
+		entries, err := share.ReadDir(privateDir)
 		if err != nil {
 			continue // directory may not exist yet
 		}
@@ -27,12 +27,12 @@ func cleanupPrivateFiles() {
 				continue
 			}
 			deviceDir := filepath.Join(privateDir, entry.Name())
-			files, err := os.ReadDir(deviceDir)
+			files, err := share.ReadDir(deviceDir)
 			if err != nil {
 				continue
 			}
 			if len(files) == 0 {
-				os.Remove(deviceDir) // clean up empty directories
+				share.Remove(deviceDir) // clean up empty directories
 				continue
 			}
 			for _, f := range files {
@@ -45,7 +45,7 @@ func cleanupPrivateFiles() {
 				}
 				if time.Since(info.ModTime()) > 30*time.Minute {
 					target := filepath.Join(deviceDir, f.Name())
-					if err := os.Remove(target); err != nil {
+					if err := removeStored(target); err != nil {
 						log.Printf("Failed to clean up private file %s: %v", target, err)
 					} else {
 						log.Printf("Cleaned up stale private file: %s", target)
@@ -53,10 +53,33 @@ func cleanupPrivateFiles() {
 				}
 			}
 			// Remove the device dir if now empty
-			remaining, _ := os.ReadDir(deviceDir)
+			remaining, _ := share.ReadDir(deviceDir)
 			if len(remaining) == 0 {
-				os.Remove(deviceDir)
+				share.Remove(deviceDir)
 			}
 		}
 	}
 }
+
+// cleanupQuarantine removes quarantined uploads whose scan never finished,
+// e.g. because the server restarted mid-scan. Files still waiting for a
+// scan slot, or being scanned, are left alone however old they are.
+func cleanupQuarantine() {
+	entries, err := share.ReadDir(quarantineDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < 30*time.Minute {
+			continue
+		}
+		target := filepath.Join(quarantineDir, e.Name())
+		if scanPending(target) {
+			continue
+		}
+		if err := share.Remove(target); err == nil {
+			log.Printf("Cleaned up abandoned quarantine file: %s", target)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"fileshare/internal/network"
+)
+
+// DefaultCSP is the Content-Security-Policy sent with every response.
+// "{nonce}" is replaced with a fresh per-response nonce that the static
+// server injects into each <script> tag of the served HTML pages. Inline
+// event handler attributes are blocked: the pages bind handlers from
+// script through data-action attributes.
+const DefaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}' https://cdnjs.cloudflare.com; " +
+	"style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://fonts.googleapis.com; " +
+	"font-src 'self' https://cdnjs.cloudflare.com https://fonts.gstatic.com; " +
+	"img-src 'self' data: blob:; " +
+	"media-src 'self' blob:; " +
+	"connect-src 'self'; " +
+	"worker-src 'self'; " +
+	"manifest-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri /api/csp-report"
+
+// maxCSPReportSize caps the body accepted by the violation report endpoint.
+const maxCSPReportSize = 64 << 10
+
+var (
+	cspLock   sync.RWMutex
+	cspPolicy = DefaultCSP
+)
+
+// SetContentSecurityPolicy overrides the policy template. An empty string
+// disables the header entirely.
+func SetContentSecurityPolicy(policy string) {
+	cspLock.Lock()
+	cspPolicy = policy
+	cspLock.Unlock()
+}
+
+type nonceKey struct{}
+
+// CSPNonce returns the script nonce assigned to this request by
+// SecureHeaders, or "" if none was assigned.
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// withCSP sets the Content-Security-Policy header and returns the request
+// carrying its nonce.
+func withCSP(w http.ResponseWriter, r *http.Request) *http.Request {
+	cspLock.RLock()
+	policy := cspPolicy
+	cspLock.RUnlock()
+	if policy == "" {
+		return r
+	}
+	nonce := newNonce()
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(policy, "{nonce}", nonce))
+	return r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+}
+
+// HandleCSPReport logs Content-Security-Policy violation reports. Both the
+// legacy report-uri format and the Reporting API format are accepted.
+func HandleCSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize))
+	if err != nil {
+		http.Error(w, "invalid report", 400)
+		return
+	}
+
+	type violation struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+	}
+	var reports []violation
+
+	var legacy struct {
+		Report *violation `json:"csp-report"`
+	}
+	var batch []struct {
+		Type string    `json:"type"`
+		Body violation `json:"body"`
+	}
+	switch {
+	case json.Unmarshal(body, &legacy) == nil && legacy.Report != nil:
+		reports = append(reports, *legacy.Report)
+	case json.Unmarshal(body, &batch) == nil:
+		for _, b := range batch {
+			if b.Type == "csp-violation" {
+				reports = append(reports, b.Body)
+			}
+		}
+	default:
+		http.Error(w, "invalid report", 400)
+		return
+	}
+
+	ip := network.ClientIP(r)
+	for _, v := range reports {
+		doc, blocked, directive := v.DocumentURI, v.BlockedURI, v.ViolatedDirective
+		if doc == "" {
+			doc = v.DocumentURL
+		}
+		if blocked == "" {
+			blocked = v.BlockedURL
+		}
+		if directive == "" {
+			directive = v.EffectiveDirective
+		}
+		log.Printf("CSP violation from %s: %s blocked %q on %s", ip, directive, blocked, doc)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
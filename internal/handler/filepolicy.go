@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FilePolicy restricts which files HandleUpload accepts. Deny lists
+// always win; a non-empty allow list admits only matching files. MIME
+// types are sniffed from the file's first bytes, never taken from the
+// client, and may use a "type/*" wildcard.
+type FilePolicy struct {
+	AllowExtensions []string
+	DenyExtensions  []string
+	AllowMIME       []string
+	DenyMIME        []string
+	MaxFiles        int // per request; 0 means unlimited
+}
+
+var (
+	filePolicyLock    sync.RWMutex
+	currentFilePolicy FilePolicy
+)
+
+// SetFilePolicy configures the upload file-type policy. Extensions are
+// matched case-insensitively with or without a leading dot.
+func SetFilePolicy(p FilePolicy) error {
+	if p.MaxFiles < 0 {
+		return fmt.Errorf("max files must not be negative")
+	}
+	p.AllowExtensions = normalizeExtensions(p.AllowExtensions)
+	p.DenyExtensions = normalizeExtensions(p.DenyExtensions)
+	var err error
+	if p.AllowMIME, err = normalizeMIME(p.AllowMIME); err != nil {
+		return err
+	}
+	if p.DenyMIME, err = normalizeMIME(p.DenyMIME); err != nil {
+		return err
+	}
+	filePolicyLock.Lock()
+	currentFilePolicy = p
+	filePolicyLock.Unlock()
+	return nil
+}
+
+func normalizeExtensions(list []string) []string {
+	var out []string
+	for _, v := range list {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if !strings.HasPrefix(v, ".") {
+			v = "." + v
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func normalizeMIME(list []string) ([]string, error) {
+	var out []string
+	for _, v := range list {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		typ, sub, ok := strings.Cut(v, "/")
+		if !ok || typ == "" || sub == "" || strings.Contains(sub, "/") {
+			return nil, fmt.Errorf("invalid MIME type %q", v)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func getFilePolicy() FilePolicy {
+	filePolicyLock.RLock()
+	defer filePolicyLock.RUnlock()
+	return currentFilePolicy
+}
+
+func matchMIME(patterns []string, mt string) bool {
+	for _, p := range patterns {
+		if p == mt || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName applies the extension rules to a file name, returning a
+// rejection reason or "". Trailing dots and spaces are ignored, as Windows
+// strips them when saving: "setup.exe. " is checked as "setup.exe".
+func (p *FilePolicy) checkName(name string) string {
+	ext := strings.ToLower(filepath.Ext(strings.TrimRight(name, ". ")))
+	if containsString(p.DenyExtensions, ext) {
+		return fmt.Sprintf("file type %s is not allowed", ext)
+	}
+	if len(p.AllowExtensions) > 0 && !containsString(p.AllowExtensions, ext) {
+		if ext == "" {
+			return "files without an extension are not allowed"
+		}
+		return fmt.Sprintf("file type %s is not allowed", ext)
+	}
+	return ""
+}
+
+// checkContent sniffs the MIME type from the start of f, returning a
+// rejection reason or "".
+func (p *FilePolicy) checkContent(f io.ReaderAt) string {
+	if len(p.AllowMIME) == 0 && len(p.DenyMIME) == 0 {
+		return ""
+	}
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	mt, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if matchMIME(p.DenyMIME, mt) {
+		return fmt.Sprintf("content type %s is not allowed", mt)
+	}
+	if len(p.AllowMIME) > 0 && !matchMIME(p.AllowMIME, mt) {
+		return fmt.Sprintf("content type %s is not allowed", mt)
+	}
+	return ""
+}
@@ -2,12 +2,50 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"fileshare/internal/atrest"
+	"fileshare/internal/audit"
+	"fileshare/internal/auth"
+	"fileshare/internal/discovery"
+	"fileshare/internal/sandbox"
+	"fileshare/internal/scan"
+	"fileshare/pkg/e2e"
+	"fileshare/pkg/link"
 )
 
+// useTempShare opens a temp directory as the share for one test and
+// returns its path.
+func useTempShare(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := OpenShare(dir, sandbox.SymlinksDeny); err != nil {
+		t.Fatalf("OpenShare: %v", err)
+	}
+	t.Cleanup(func() {
+		share.Close()
+		share = nil
+	})
+	return dir
+}
+
 func TestHandleHealth(t *testing.T) {
 	req := httptest.NewRequest("GET", "/health", nil)
 	w := httptest.NewRecorder()
@@ -97,10 +135,8 @@ func TestHandleRegister_InvalidJSON(t *testing.T) {
 }
 
 func TestHandleListFiles(t *testing.T) {
-	// Set SharedDir to a temp directory for isolation
-	originalDir := SharedDir
-	SharedDir = t.TempDir()
-	defer func() { SharedDir = originalDir }()
+	// Use a temp directory as the share for isolation
+	useTempShare(t)
 
 	req := httptest.NewRequest("GET", "/api/files", nil)
 	w := httptest.NewRecorder()
@@ -144,3 +180,849 @@ func TestHandleDownload_InvalidFilename(t *testing.T) {
 		t.Errorf("expected status 400, got %d", w.Code)
 	}
 }
+
+func TestHandleRegister_ClientCertificate(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject:    pkix.Name{CommonName: "Build Machine 1"},
+		RawSubject: []byte("build-machine-1"),
+	}
+	body := `{"id":"dev_browser_generated","name":"Ignored"}`
+	req := httptest.NewRequest("POST", "/api/register", bytes.NewBufferString(body))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+	w := httptest.NewRecorder()
+
+	HandleRegister(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	id, _ := resp["id"].(string)
+	if !strings.HasPrefix(id, certIDPrefix) {
+		t.Errorf("expected certificate-derived id, got %q", id)
+	}
+	if resp["name"] != "Build Machine 1" {
+		t.Errorf("expected name from certificate subject, got %v", resp["name"])
+	}
+	if resp["trusted"] != true {
+		t.Error("expected certificate device to be trusted")
+	}
+
+	discovery.Lock.Lock()
+	delete(discovery.Devices, id)
+	discovery.Lock.Unlock()
+}
+
+func TestHandleRegister_ForgedCertificateID(t *testing.T) {
+	body := `{"id":"cert-0123456789abcdef","name":"Impostor"}`
+	req := httptest.NewRequest("POST", "/api/register", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+
+	HandleRegister(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+}
+
+func TestHandleRegister_SSOOwner(t *testing.T) {
+	register := func(email string) int {
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewBufferString(`{"id":"dev_owned"}`))
+		req = req.WithContext(auth.WithUser(req.Context(), &auth.User{Subject: email, Name: email, Email: email}))
+		w := httptest.NewRecorder()
+		HandleRegister(w, req)
+		return w.Code
+	}
+	defer func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_owned")
+		discovery.Lock.Unlock()
+	}()
+
+	if code := register("ada@example.com"); code != http.StatusOK {
+		t.Fatalf("owner: expected status 200, got %d", code)
+	}
+	if code := register("ada@example.com"); code != http.StatusOK {
+		t.Errorf("owner again: expected status 200, got %d", code)
+	}
+	if code := register("mallory@example.com"); code != http.StatusForbidden {
+		t.Errorf("other account: expected status 403, got %d", code)
+	}
+	discovery.Lock.RLock()
+	owner := discovery.Devices["dev_owned"].User
+	discovery.Lock.RUnlock()
+	if owner != "ada@example.com" {
+		t.Errorf("device owner = %q, want ada@example.com", owner)
+	}
+
+	// An account claiming the owner's email under another subject is not the owner.
+	req := httptest.NewRequest("POST", "/api/register", bytes.NewBufferString(`{"id":"dev_owned"}`))
+	req = req.WithContext(auth.WithUser(req.Context(), &auth.User{Subject: "m", Email: "ada@example.com"}))
+	w := httptest.NewRecorder()
+	HandleRegister(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("same email, other subject: expected status 403, got %d", w.Code)
+	}
+
+	// Nor can the other account read the device's inbox.
+	req = httptest.NewRequest("GET", "/download/x.txt?id=dev_owned", nil)
+	req = req.WithContext(auth.WithUser(req.Context(), &auth.User{Subject: "m", Email: "mallory@example.com"}))
+	w = httptest.NewRecorder()
+	HandleDownload(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("download as other account: expected status 403, got %d", w.Code)
+	}
+}
+
+func TestPrivateUpload_EncryptedAtRest(t *testing.T) {
+	dir := useTempShare(t)
+	var key atrest.Key
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	SetAtRestKey(&key)
+	defer SetAtRestKey(nil)
+
+	content := bytes.Repeat([]byte("secret payload "), 10000)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("to", "dev_receiver")
+	fw, _ := mw.CreateFormFile("files", "report.txt")
+	fw.Write(content)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	HandleUpload(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: expected status 200, got %d", w.Code)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dir, "private", "dev_receiver", "report.txt"))
+	if err != nil {
+		t.Fatalf("reading stored file: %v", err)
+	}
+	if bytes.Contains(stored, []byte("secret payload")) {
+		t.Fatal("private file was stored in plaintext")
+	}
+
+	req = httptest.NewRequest("GET", "/download/report.txt?id=dev_receiver", nil)
+	req.Header.Set("Range", "bytes=15-29")
+	w = httptest.NewRecorder()
+	HandleDownload(w, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("download: expected status 206, got %d", w.Code)
+	}
+	if got := w.Body.String(); got != string(content[15:30]) {
+		t.Errorf("ranged download = %q, want %q", got, content[15:30])
+	}
+
+	// Neither a partial download nor a failed decrypt consumes the file.
+	storedPath := filepath.Join(dir, "private", "dev_receiver", "report.txt")
+	if _, err := os.Stat(storedPath); err != nil {
+		t.Fatalf("file removed after a ranged download: %v", err)
+	}
+	var wrong atrest.Key
+	copy(wrong[:], "fedcba9876543210fedcba9876543210")
+	SetAtRestKey(&wrong)
+	w = httptest.NewRecorder()
+	HandleDownload(w, httptest.NewRequest("GET", "/download/report.txt?id=dev_receiver", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("download with wrong key: expected status 500, got %d", w.Code)
+	}
+	if _, err := os.Stat(storedPath); err != nil {
+		t.Fatalf("file removed after a failed decrypt: %v", err)
+	}
+
+	// A complete download delivers the file and removes it.
+	SetAtRestKey(&key)
+	w = httptest.NewRecorder()
+	HandleDownload(w, httptest.NewRequest("GET", "/download/report.txt?id=dev_receiver", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("download: got %d with %d bytes, want the upload", w.Code, w.Body.Len())
+	}
+	if _, err := os.Stat(storedPath); !os.IsNotExist(err) {
+		t.Errorf("file still stored after a complete download: %v", err)
+	}
+}
+
+func TestPublicUpload_LooksEncrypted(t *testing.T) {
+	useTempShare(t)
+	var key atrest.Key
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	SetAtRestKey(&key)
+	defer SetAtRestKey(nil)
+
+	// A public file that starts like an at-rest header is still plaintext.
+	content := append([]byte("GSENC\x01"), bytes.Repeat([]byte("x"), 100)...)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("files", "lookalike.bin")
+	fw.Write(content)
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	HandleUpload(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: expected status 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	HandleDownload(w, httptest.NewRequest("GET", "/download/lookalike.bin", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("download: got %d with %d bytes, want the upload unchanged", w.Code, w.Body.Len())
+	}
+}
+
+func TestHandleRegister_PublicKey(t *testing.T) {
+	const owner, attacker = "192.0.2.10:1000", "192.0.2.66:1000"
+	priv, _ := e2e.GenerateKey()
+	other, _ := e2e.GenerateKey()
+	register := func(from, key, nonce, sig string) int {
+		body, _ := json.Marshal(map[string]string{"id": "dev_keyholder", "public_key": key, "key_nonce": nonce, "key_signature": sig})
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewReader(body))
+		req.RemoteAddr = from
+		w := httptest.NewRecorder()
+		HandleRegister(w, req)
+		return w.Code
+	}
+	challenge := func(from string) (string, int) {
+		req := httptest.NewRequest("POST", "/api/keys/dev_keyholder", nil)
+		req.RemoteAddr = from
+		w := httptest.NewRecorder()
+		HandleKey(w, req)
+		var resp struct{ Nonce string }
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Nonce, w.Code
+	}
+	sign := func(k *ecdh.PrivateKey, nonce string) string {
+		sig, err := e2e.SignKeyProof(k, "dev_keyholder", nonce)
+		if err != nil {
+			t.Fatalf("SignKeyProof: %v", err)
+		}
+		return sig
+	}
+	defer func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_keyholder")
+		discovery.Lock.Unlock()
+	}()
+
+	// The device registers first, as browsers do, and its ID becomes public.
+	if code := register(owner, "", "", ""); code != http.StatusOK {
+		t.Fatalf("register: expected status 200, got %d", code)
+	}
+	if code := register(owner, "bm90IGEga2V5", "", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid key: expected status 400, got %d", code)
+	}
+
+	// Another client can neither get a challenge nor bind a key without one.
+	if _, code := challenge(attacker); code != http.StatusForbidden {
+		t.Errorf("attacker challenge: expected status 403, got %d", code)
+	}
+	if code := register(attacker, e2e.EncodePublicKey(other.PublicKey()), "", ""); code != http.StatusForbidden {
+		t.Errorf("attacker key: expected status 403, got %d", code)
+	}
+	nonce, _ := challenge(owner)
+	if code := register(attacker, e2e.EncodePublicKey(other.PublicKey()), nonce, sign(other, nonce)); code != http.StatusForbidden {
+		t.Errorf("attacker with the owner's nonce: expected status 403, got %d", code)
+	}
+
+	// The owner's nonce was used up; a proof signed by a different key fails.
+	nonce, code := challenge(owner)
+	if code != http.StatusOK || nonce == "" {
+		t.Fatalf("challenge: expected status 200 with a nonce, got %d", code)
+	}
+	if code := register(owner, e2e.EncodePublicKey(priv.PublicKey()), nonce, sign(other, nonce)); code != http.StatusForbidden {
+		t.Errorf("wrong signer: expected status 403, got %d", code)
+	}
+	nonce, _ = challenge(owner)
+	if code := register(owner, e2e.EncodePublicKey(priv.PublicKey()), nonce, sign(priv, nonce)); code != http.StatusOK {
+		t.Fatalf("first key: expected status 200, got %d", code)
+	}
+	if code := register(owner, e2e.EncodePublicKey(priv.PublicKey()), "", ""); code != http.StatusOK {
+		t.Errorf("same key again: expected status 200, got %d", code)
+	}
+	if code := register(owner, e2e.EncodePublicKey(other.PublicKey()), "", ""); code != http.StatusConflict {
+		t.Errorf("key change: expected status 409, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	HandleGetKey(w, httptest.NewRequest("GET", "/api/keys/dev_keyholder", nil))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["public_key"] != e2e.EncodePublicKey(priv.PublicKey()) {
+		t.Errorf("key directory returned %q", resp["public_key"])
+	}
+}
+
+func TestPrivateUpload_EndToEnd(t *testing.T) {
+	dir := useTempShare(t)
+	var key atrest.Key
+	SetAtRestKey(&key)
+	defer SetAtRestKey(nil)
+
+	priv, _ := e2e.GenerateKey()
+	discovery.Lock.Lock()
+	discovery.Devices["dev_e2e_receiver"] = &discovery.Device{ID: "dev_e2e_receiver", PublicKey: e2e.EncodePublicKey(priv.PublicKey())}
+	discovery.Lock.Unlock()
+	defer func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_e2e_receiver")
+		discovery.Lock.Unlock()
+	}()
+
+	var sealed bytes.Buffer
+	enc, _ := e2e.NewWriter(&sealed, priv.PublicKey())
+	enc.Write([]byte("for your eyes only"))
+	enc.Close()
+
+	upload := func(content []byte) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("to", "dev_e2e_receiver")
+		mw.WriteField("e2e", "1")
+		fw, _ := mw.CreateFormFile("files", "note.txt")
+		fw.Write(content)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		HandleUpload(w, req)
+		return w.Code
+	}
+
+	if code := upload([]byte("plaintext pretending to be encrypted")); code != http.StatusUnprocessableEntity {
+		t.Errorf("plaintext: expected status 422, got %d", code)
+	}
+	if code := upload(sealed.Bytes()); code != http.StatusOK {
+		t.Fatalf("envelope: expected status 200, got %d", code)
+	}
+
+	// The envelope is stored byte-for-byte, not re-wrapped with the at-rest key.
+	stored, err := os.ReadFile(filepath.Join(dir, "private", "dev_e2e_receiver", "note.txt"))
+	if err != nil {
+		t.Fatalf("reading stored file: %v", err)
+	}
+	if !bytes.Equal(stored, sealed.Bytes()) {
+		t.Error("stored envelope differs from what was uploaded")
+	}
+}
+
+func TestPublicLink_Lifecycle(t *testing.T) {
+	useTempShare(t)
+
+	secret, _ := link.NewSecret()
+	var blob bytes.Buffer
+	enc, _ := secret.NewWriter(&blob)
+	enc.Write([]byte("shared via link"))
+	enc.Close()
+	meta, _ := secret.SealMetadata(link.Metadata{Name: "notes.txt"})
+
+	req := httptest.NewRequest("POST", "/api/links?downloads=1", bytes.NewReader(blob.Bytes()))
+	req.Header.Set("X-Link-Metadata", meta)
+	w := httptest.NewRecorder()
+	HandleCreateLink(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: expected status 201, got %d", w.Code)
+	}
+	var created struct {
+		ID         string `json:"id"`
+		OwnerToken string `json:"owner_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+
+	w = httptest.NewRecorder()
+	HandleLink(w, httptest.NewRequest("GET", "/api/links/"+created.ID, nil))
+	var info map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&info)
+	if info["metadata"] != meta || info["downloads_left"] != float64(1) {
+		t.Fatalf("unexpected metadata response %v", info)
+	}
+
+	w = httptest.NewRecorder()
+	HandleLink(w, httptest.NewRequest("GET", "/api/links/"+created.ID+"/blob", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), blob.Bytes()) {
+		t.Fatalf("blob: expected the stored ciphertext, got status %d", w.Code)
+	}
+
+	// The single allowed download has been used.
+	w = httptest.NewRecorder()
+	HandleLink(w, httptest.NewRequest("GET", "/api/links/"+created.ID+"/blob", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second download: expected status 404, got %d", w.Code)
+	}
+}
+
+func TestPublicLink_Rejects(t *testing.T) {
+	useTempShare(t)
+
+	tests := []struct {
+		name  string
+		query string
+		meta  string
+		body  string
+	}{
+		{"missing metadata", "", "", strings.Repeat("x", 32)},
+		{"expiry too long", "?expires=99999999", "bWV0YQ", strings.Repeat("x", 32)},
+		{"too many downloads", "?downloads=1000", "bWV0YQ", strings.Repeat("x", 32)},
+		{"not a stream", "", "bWV0YQ", "short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/links"+tt.query, strings.NewReader(tt.body))
+			req.Header.Set("X-Link-Metadata", tt.meta)
+			w := httptest.NewRecorder()
+			HandleCreateLink(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestSweepLinks(t *testing.T) {
+	dir := useTempShare(t)
+	links := filepath.Join(dir, linksDir)
+	os.MkdirAll(links, 0700)
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(links, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live, _ := json.Marshal(linkRecord{ID: "live", Expires: time.Now().Add(time.Hour), MaxDownloads: 1})
+	dead, _ := json.Marshal(linkRecord{ID: "dead", Expires: time.Now().Add(-time.Hour), MaxDownloads: 1})
+	write("live.json", string(live))
+	write("live.bin", "blob")
+	write("dead.json", string(dead))
+	write("dead.bin", "blob")
+	write("garbled.json", "{not json")
+	write("garbled.bin", "blob")
+	write("crashed.json.tmp", "{}")
+	write("orphan.bin", "blob")
+	write("uploading.bin", "blob")
+	old := time.Now().Add(-MaxLinkExpiry - time.Hour)
+	os.Chtimes(filepath.Join(links, "orphan.bin"), old, old)
+
+	sweepLinks(time.Now())
+
+	for name, want := range map[string]bool{
+		"live.json": true, "live.bin": true, "uploading.bin": true,
+		"dead.json": false, "dead.bin": false,
+		"garbled.json": false, "garbled.bin": false,
+		"crashed.json.tmp": false, "orphan.bin": false,
+	} {
+		_, err := os.Stat(filepath.Join(links, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s: exists = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestPublicLink_OwnerDelete(t *testing.T) {
+	useTempShare(t)
+
+	req := httptest.NewRequest("POST", "/api/links?downloads=5", bytes.NewReader(make([]byte, 64)))
+	req.Header.Set("X-Link-Metadata", "bWV0YQ")
+	w := httptest.NewRecorder()
+	HandleCreateLink(w, req)
+	var created struct {
+		ID         string `json:"id"`
+		OwnerToken string `json:"owner_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+
+	del := func(token string) int {
+		req := httptest.NewRequest("DELETE", "/api/links/"+created.ID, nil)
+		req.Header.Set("X-Owner-Token", token)
+		w := httptest.NewRecorder()
+		HandleLink(w, req)
+		return w.Code
+	}
+	if code := del("guess"); code != http.StatusForbidden {
+		t.Errorf("wrong token: expected status 403, got %d", code)
+	}
+	if code := del(created.OwnerToken); code != http.StatusNoContent {
+		t.Errorf("owner token: expected status 204, got %d", code)
+	}
+	if code := del(created.OwnerToken); code != http.StatusNotFound {
+		t.Errorf("after delete: expected status 404, got %d", code)
+	}
+}
+
+func TestUpload_FilePolicy(t *testing.T) {
+	useTempShare(t)
+	if err := SetFilePolicy(FilePolicy{DenyExtensions: []string{"EXE", ".sh"}, AllowMIME: []string{"image/*", "text/plain"}, MaxFiles: 4}); err != nil {
+		t.Fatalf("SetFilePolicy: %v", err)
+	}
+	defer SetFilePolicy(FilePolicy{})
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	upload := func(files map[string][]byte) (int, map[string]interface{}) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, content := range files {
+			fw, _ := mw.CreateFormFile("files", name)
+			fw.Write(content)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		HandleUpload(w, req)
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	code, resp := upload(map[string][]byte{
+		"photo.png":  png,
+		"setup.exe":  png,
+		"fake.png":   []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff\x00\x00"),
+		"readme.txt": []byte("hello"),
+	})
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	saved, _ := resp["saved"].([]interface{})
+	rejected, _ := resp["rejected"].([]interface{})
+	if len(saved) != 2 || len(rejected) != 2 {
+		t.Fatalf("expected 2 saved and 2 rejected, got %v", resp)
+	}
+	for _, r := range rejected {
+		name := r.(map[string]interface{})["name"]
+		if name != "setup.exe" && name != "fake.png" {
+			t.Errorf("unexpected rejection of %v", name)
+		}
+	}
+
+	if code, _ := upload(map[string][]byte{"run.sh": []byte("#!/bin/sh")}); code != http.StatusUnprocessableEntity {
+		t.Errorf("all rejected: expected status 422, got %d", code)
+	}
+	if code, _ := upload(map[string][]byte{"a.txt": nil, "b.txt": nil, "c.txt": nil, "d.txt": nil, "e.txt": nil}); code != http.StatusBadRequest {
+		t.Errorf("too many files: expected status 400, got %d", code)
+	}
+}
+
+func TestFilePolicy_CheckName(t *testing.T) {
+	p := FilePolicy{DenyExtensions: []string{".exe"}}
+	tests := []struct {
+		name   string
+		reject bool
+	}{
+		{"report.pdf", false},
+		{"setup.exe", true},
+		{"setup.EXE", true},
+		{"setup.exe.", true},
+		{"setup.exe ", true},
+		{"setup.exe . .", true},
+		{"setup.exe.txt", false},
+	}
+	for _, tt := range tests {
+		if got := p.checkName(tt.name) != ""; got != tt.reject {
+			t.Errorf("checkName(%q) rejected = %v, want %v", tt.name, got, tt.reject)
+		}
+	}
+
+	allow := FilePolicy{AllowExtensions: []string{".txt"}}
+	if reason := allow.checkName("notes.txt."); reason != "" {
+		t.Errorf("allowed extension with trailing dot rejected: %s", reason)
+	}
+	if reason := allow.checkName("..."); reason == "" {
+		t.Error("name without an extension passed the allow list")
+	}
+}
+
+func TestSetFilePolicy_InvalidMIME(t *testing.T) {
+	if err := SetFilePolicy(FilePolicy{AllowMIME: []string{"image"}}); err == nil {
+		t.Error("expected error for MIME type without subtype")
+	}
+}
+
+// fakeScanner flags any file containing "EICAR".
+type fakeScanner struct{}
+
+func (fakeScanner) Scan(ctx context.Context, path string) (scan.Verdict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scan.Verdict{}, err
+	}
+	if bytes.Contains(data, []byte("EICAR")) {
+		return scan.Verdict{Signature: "Eicar-Test-Signature", Scanner: "fake", ScannedAt: time.Now()}, nil
+	}
+	return scan.Verdict{Clean: true, Scanner: "fake", ScannedAt: time.Now()}, nil
+}
+
+func TestUpload_ScanQuarantine(t *testing.T) {
+	dir := useTempShare(t)
+	SetScanner(fakeScanner{})
+	defer SetScanner(nil)
+
+	q := make(chan discovery.Event, 10)
+	discovery.Lock.Lock()
+	discovery.Devices["dev_uploader"] = &discovery.Device{ID: "dev_uploader", Queues: []chan discovery.Event{q}}
+	discovery.Lock.Unlock()
+	defer func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_uploader")
+		discovery.Lock.Unlock()
+	}()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("from", "dev_uploader")
+	fw, _ := mw.CreateFormFile("files", "clean.txt")
+	fw.Write([]byte("nothing to see here"))
+	fw, _ = mw.CreateFormFile("files", "infected.txt")
+	fw.Write([]byte("X5O!P%@AP EICAR test"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	HandleUpload(w, req)
+
+	var resp map[string][]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp["quarantined"]) != 2 || len(resp["saved"]) != 0 {
+		t.Fatalf("expected both files quarantined, got %d %v", w.Code, resp)
+	}
+
+	// The uploader hears about the infected file once the scan finishes.
+	select {
+	case msg := <-q:
+		if msg.Name != "upload-rejected" || !bytes.Contains(msg.Data, []byte("infected.txt")) {
+			t.Errorf("unexpected event %s %s", msg.Name, msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for upload-rejected event")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "public", "clean.txt")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("clean file was never released from quarantine")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "public", "infected.txt")); !os.IsNotExist(err) {
+		t.Error("infected file was published")
+	}
+
+	w = httptest.NewRecorder()
+	HandleListFiles(w, httptest.NewRequest("GET", "/api/files", nil))
+	var list []map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || list[0]["scan"] == nil {
+		t.Errorf("expected scan verdict in listing, got %v", list)
+	}
+}
+
+func TestCleanupQuarantine_SkipsPendingScans(t *testing.T) {
+	dir := useTempShare(t)
+	if err := share.MkdirAll(quarantineDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"waiting", "abandoned"} {
+		path := filepath.Join(dir, quarantineDir, name)
+		os.WriteFile(path, []byte("data"), 0600)
+		os.Chtimes(path, old, old)
+	}
+	waiting := filepath.Join(quarantineDir, "waiting")
+	setScanPending(waiting, true)
+	defer setScanPending(waiting, false)
+
+	cleanupQuarantine()
+
+	if _, err := os.Stat(filepath.Join(dir, waiting)); err != nil {
+		t.Error("file still queued for scanning was swept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDir, "abandoned")); !os.IsNotExist(err) {
+		t.Error("abandoned quarantine file was kept")
+	}
+}
+
+// photoWithGPS returns a small JPEG carrying an EXIF segment with a GPS
+// position ("GPSLatitude").
+func photoWithGPS() []byte {
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	payload := "Exif\x00\x00GPSLatitude=51.5N"
+	exif := append([]byte{0xFF, 0xE1, 0x00, byte(len(payload) + 2)}, payload...)
+	return append(append(append([]byte{}, img.Bytes()[:2]...), exif...), img.Bytes()[2:]...)
+}
+
+func TestUpload_StripMetadata(t *testing.T) {
+	dir := useTempShare(t)
+	photo := photoWithGPS()
+
+	upload := func(strip string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("strip_metadata", strip)
+		fw, _ := mw.CreateFormFile("files", "photo.jpg")
+		fw.Write(photo)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		HandleUpload(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload: expected status 200, got %d", w.Code)
+		}
+	}
+
+	upload("1")
+	stored, _ := os.ReadFile(filepath.Join(dir, "public", "photo.jpg"))
+	if bytes.Contains(stored, []byte("GPSLatitude")) {
+		t.Fatal("GPS metadata was stored")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Fatalf("sanitized photo does not decode: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleListFiles(w, httptest.NewRequest("GET", "/api/files", nil))
+	var list []map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&list)
+	sum := sha256.Sum256(stored)
+	if len(list) != 1 || list[0]["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected checksum of sanitized file in listing, got %v", list)
+	}
+
+	// Without the opt-in (and with stripping off) the file is untouched
+	// and the record of the replaced file is overwritten.
+	upload("")
+	stored, _ = os.ReadFile(filepath.Join(dir, "public", "photo.jpg"))
+	if !bytes.Equal(stored, photo) {
+		t.Error("expected original file when stripping is off")
+	}
+	sum = sha256.Sum256(photo)
+	if m, _ := readMeta(filepath.Join("public", "photo.jpg")); m.MetadataStripped != "" || m.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected unstripped record with the original checksum, got %+v", m)
+	}
+}
+
+func TestShare_SymlinkViolation(t *testing.T) {
+	dir := useTempShare(t)
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	os.MkdirAll(filepath.Join(dir, "public"), 0755)
+	if err := os.Symlink(outside, filepath.Join(dir, "public", "secret.txt")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/download/secret.txt", nil)
+	w := httptest.NewRecorder()
+	HandleDownload(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("download through symlink: got %d %q", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/files", nil)
+	w = httptest.NewRecorder()
+	HandleListFiles(w, req)
+	if strings.Contains(w.Body.String(), "secret.txt") {
+		t.Errorf("symlinked file listed: %s", w.Body.String())
+	}
+
+	// An upload cannot write through the link either.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("files", "secret.txt")
+	fw.Write([]byte("overwrite"))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	HandleUpload(w, req)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "path not allowed") {
+		t.Errorf("upload through symlink: got %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "secret" {
+		t.Errorf("file outside the share was modified: %q", data)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := useTempShare(t)
+	l, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatalf("audit.Open: %v", err)
+	}
+	SetAuditLog(l)
+	SetAdmin("s3cret", "")
+	defer func() {
+		SetAuditLog(nil)
+		SetAdmin("", "")
+		l.Close()
+	}()
+
+	discovery.Lock.Lock()
+	discovery.Devices["dev_auditor"] = &discovery.Device{ID: "dev_auditor", Name: "Quiet Heron"}
+	discovery.Lock.Unlock()
+	defer func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_auditor")
+		discovery.Lock.Unlock()
+	}()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("from", "dev_auditor")
+	fw, _ := mw.CreateFormFile("files", "minutes.txt")
+	fw.Write([]byte("meeting minutes"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	HandleUpload(httptest.NewRecorder(), req)
+	if _, err := os.Stat(filepath.Join(dir, "public", "minutes.txt")); err != nil {
+		t.Fatalf("upload not stored: %v", err)
+	}
+	HandleDownload(httptest.NewRecorder(), httptest.NewRequest("GET", "/download/minutes.txt?id=dev_auditor", nil))
+	HandleDelete(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/delete/minutes.txt?id=dev_auditor", nil))
+
+	// Without the token the query is refused, and that is recorded too.
+	w := httptest.NewRecorder()
+	HandleAuditQuery(w, httptest.NewRequest("GET", "/api/admin/audit?file=%0Aforged&x="+strings.Repeat("A", 4096), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin token, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/admin/audit?file=minutes.txt", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	HandleAuditQuery(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var entries []audit.Entry
+	json.NewDecoder(w.Body).Decode(&entries)
+	sum := sha256.Sum256([]byte("meeting minutes"))
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		if e.DeviceID != "dev_auditor" || e.DeviceName != "Quiet Heron" || e.ClientIP == "" {
+			t.Errorf("%s entry missing identity: %+v", e.Action, e)
+		}
+		if e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s entry has checksum %q", e.Action, e.SHA256)
+		}
+	}
+	if strings.Join(actions, ",") != "upload,download,delete" {
+		t.Errorf("expected upload, download, delete; got %v", actions)
+	}
+
+	denied, _ := l.Search(audit.Query{Action: audit.ActionAdmin})
+	if len(denied) != 2 || denied[0].Outcome != audit.OutcomeDenied || denied[1].Outcome != audit.OutcomeOK {
+		t.Errorf("expected denied then allowed admin entries, got %+v", denied)
+	} else if d := denied[0].Detail; d != "audit query file +1 other" {
+		t.Errorf("denied query logged as %q", d)
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"fileshare/internal/auth"
+	"fileshare/internal/discovery"
+	"fileshare/internal/network"
+)
+
+// certIDPrefix marks device IDs derived from a verified client certificate.
+// Browsers cannot claim such an ID without presenting the certificate.
+const certIDPrefix = "cert-"
+
+// certIdentity returns the device ID and display name bound to the
+// request's verified client certificate. The ID is derived from the
+// certificate subject, so it survives certificate renewal.
+func certIdentity(r *http.Request) (id, name string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(leaf.RawSubject)
+	name = leaf.Subject.CommonName
+	if name == "" {
+		name = leaf.Subject.String()
+	}
+	return certIDPrefix + hex.EncodeToString(sum[:8]), name, true
+}
+
+// resolveDeviceID returns the device ID a request acts as. A verified
+// client certificate always wins over the ID the client claims. Claiming
+// a certificate-derived ID without the certificate is refused, and so is
+// claiming a device bound to a different SSO account, so one user cannot
+// take over another's device ID.
+func resolveDeviceID(r *http.Request, claimed string) (string, bool) {
+	if id, _, ok := certIdentity(r); ok {
+		return id, true
+	}
+	if strings.HasPrefix(claimed, certIDPrefix) {
+		return "", false
+	}
+	discovery.Lock.RLock()
+	dev, ok := discovery.Devices[claimed]
+	owner := ""
+	if ok {
+		owner = dev.User
+	}
+	discovery.Lock.RUnlock()
+	if owner != "" && owner != sessionUser(r) {
+		log.Printf("Device %s is bound to another account; refused for %s", claimed, network.ClientIP(r))
+		return "", false
+	}
+	return claimed, true
+}
+
+// sessionUser returns the SSO account of the request, or "" without a
+// session. Accounts are keyed on the subject claim: the provider never
+// reassigns it, while an email can be changed or left unverified.
+func sessionUser(r *http.Request) string {
+	if u := auth.UserFromRequest(r); u != nil {
+		return u.Subject
+	}
+	return ""
+}
+
+// applyIdentity stamps identity asserted by a client certificate or an SSO
+// session onto a device. Asserted names cannot be changed by the client,
+// and a device already bound to one account is never re-bound to another.
+// It reports whether the name was asserted. Callers hold discovery.Lock.
+func applyIdentity(dev *discovery.Device, r *http.Request) bool {
+	if _, name, ok := certIdentity(r); ok {
+		dev.Name = name
+		dev.Trusted = true
+		return true
+	}
+	if u := auth.UserFromRequest(r); u != nil {
+		if user := sessionUser(r); dev.User == "" || dev.User == user {
+			dev.Name = u.Name
+			dev.User = user
+		}
+		return true
+	}
+	return false
+}
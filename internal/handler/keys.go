@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fileshare/internal/discovery"
+	"fileshare/internal/network"
+	"fileshare/pkg/e2e"
+)
+
+// keyChallengeTTL is how long a key binding nonce stays usable, and
+// maxKeyChallenges bounds how many can be outstanding.
+const (
+	keyChallengeTTL  = 5 * time.Minute
+	maxKeyChallenges = 1000
+)
+
+// keyChallenge is a nonce issued to one client for binding a key to one
+// device ID.
+type keyChallenge struct {
+	deviceID string
+	ip       string
+	expires  time.Time
+}
+
+var (
+	keyChallengeLock sync.Mutex
+	keyChallenges    = make(map[string]keyChallenge) // nonce → challenge
+)
+
+// HandleKey serves /api/keys/{id}: GET returns the device's published key,
+// POST issues a nonce for proving possession of a key before binding it.
+func HandleKey(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		HandleGetKey(w, r)
+	case "POST":
+		handleKeyChallenge(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleKeyChallenge issues a key binding nonce. Only the client that first
+// registered a device ID (or its authenticated owner) gets one, so a
+// device ID seen on the network cannot be claimed by someone else's key.
+func handleKeyChallenge(w http.ResponseWriter, r *http.Request) {
+	id, allowed := resolveDeviceID(r, filepath.Base(r.URL.Path))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
+	if !isValidName(id) {
+		http.Error(w, "invalid device id", 400)
+		return
+	}
+	ip := network.ClientIP(r)
+	discovery.Lock.RLock()
+	dev, ok := discovery.Devices[id]
+	foreign := ok && dev.FirstIP != ip && !ownsDevice(r, dev)
+	discovery.Lock.RUnlock()
+	if foreign {
+		log.Printf("Key challenge for %s refused: device registered from another client (%s)", id, ip)
+		http.Error(w, "device registered by another client", http.StatusForbidden)
+		return
+	}
+
+	nonce := randomToken(24)
+	now := time.Now()
+	keyChallengeLock.Lock()
+	for n, c := range keyChallenges {
+		if now.After(c.expires) {
+			delete(keyChallenges, n)
+		}
+	}
+	full := len(keyChallenges) >= maxKeyChallenges
+	if !full {
+		keyChallenges[nonce] = keyChallenge{deviceID: id, ip: ip, expires: now.Add(keyChallengeTTL)}
+	}
+	keyChallengeLock.Unlock()
+	if full {
+		http.Error(w, "too many pending key challenges", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"nonce":   nonce,
+		"expires": now.Add(keyChallengeTTL),
+	}); err != nil {
+		log.Printf("Error encoding key challenge: %v", err)
+	}
+}
+
+// consumeKeyChallenge uses up nonce and reports whether it was issued for
+// deviceID to ip and has not expired.
+func consumeKeyChallenge(nonce, deviceID, ip string) bool {
+	keyChallengeLock.Lock()
+	defer keyChallengeLock.Unlock()
+	c, ok := keyChallenges[nonce]
+	delete(keyChallenges, nonce)
+	return ok && c.deviceID == deviceID && c.ip == ip && time.Now().Before(c.expires)
+}
+
+// ownsDevice reports whether the request is authenticated as the owner of
+// dev (nil for a device not registered yet): by a client certificate, or
+// by an SSO session the device is bound to. Callers hold discovery.Lock.
+func ownsDevice(r *http.Request, dev *discovery.Device) bool {
+	if _, _, ok := certIdentity(r); ok {
+		return true
+	}
+	user := sessionUser(r)
+	return user != "" && (dev == nil || dev.User == user)
+}
+
+// keyProven reports whether a request may bind pub to device id: its
+// authenticated owner may, and so may the client that first registered the
+// ID when it signs a nonce issued to it with the key (see e2e.SignKeyProof).
+// dev is nil for a new device. Callers hold discovery.Lock.
+func keyProven(r *http.Request, id string, dev *discovery.Device, pub *ecdh.PublicKey, nonce, sig string) bool {
+	if ownsDevice(r, dev) {
+		return true
+	}
+	ip := network.ClientIP(r)
+	if dev != nil && dev.FirstIP != ip {
+		return false
+	}
+	return nonce != "" && consumeKeyChallenge(nonce, id, ip) && e2e.VerifyKeyProof(pub, id, nonce, sig)
+}
+
+// HandleGetKey returns a device's E2E public key from the key directory.
+func HandleGetKey(w http.ResponseWriter, r *http.Request) {
+	id := filepath.Base(r.URL.Path)
+	discovery.Lock.RLock()
+	var key string
+	if dev, ok := discovery.Devices[id]; ok {
+		key = dev.PublicKey
+	}
+	discovery.Lock.RUnlock()
+
+	if key == "" {
+		http.Error(w, "no key published for device", 404)
+		return
+	}
+	pub, err := e2e.ParsePublicKey(key)
+	if err != nil {
+		http.Error(w, "internal error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"id":         id,
+		"public_key": key,
+		"key_id":     e2e.KeyIDOf(pub).String(),
+	}); err != nil {
+		log.Printf("Error encoding key response: %v", err)
+	}
+}
+
+// recipientKeyID returns the key ID of a device's published E2E key.
+func recipientKeyID(toID string) (e2e.KeyID, error) {
+	discovery.Lock.RLock()
+	var key string
+	if dev, ok := discovery.Devices[toID]; ok {
+		key = dev.PublicKey
+	}
+	discovery.Lock.RUnlock()
+	if key == "" {
+		return e2e.KeyID{}, errors.New("recipient has no public key")
+	}
+	pub, err := e2e.ParsePublicKey(key)
+	if err != nil {
+		return e2e.KeyID{}, err
+	}
+	return e2e.KeyIDOf(pub), nil
+}
+
+// checkEnvelope verifies that an uploaded file is an E2E envelope
+// addressed to the recipient's key, returning a rejection reason or "".
+// The server cannot decrypt the file; this only guarantees it never
+// stores plaintext by mistake.
+func checkEnvelope(f io.ReaderAt, size int64, want e2e.KeyID) string {
+	h, err := e2e.ParseHeader(f, size)
+	if err != nil {
+		return "not a valid encrypted envelope"
+	}
+	if h.KeyID != want {
+		return "encrypted for a different key"
+	}
+	return ""
+}
@@ -1,23 +1,22 @@
 package handler
 
 import (
+	"crypto/ecdh"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"fileshare/internal/audit"
 	"fileshare/internal/discovery"
 	"fileshare/internal/network"
+	"fileshare/internal/sandbox"
+	"fileshare/pkg/e2e"
 )
 
-// SharedDir is the root directory for uploaded files.
-var SharedDir = "shared_files"
-
 // MaxUploadSize is the maximum allowed upload size (500 MB).
 const MaxUploadSize = 500 << 20
 
@@ -29,23 +28,63 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Registering request from %s", r.RemoteAddr)
 	var body struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		PublicKey string `json:"public_key"`
+		// KeyNonce and KeySignature prove possession of PublicKey; see
+		// HandleKey and e2e.SignKeyProof.
+		KeyNonce     string `json:"key_nonce"`
+		KeySignature string `json:"key_signature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Printf("Register error: %v", err)
 		http.Error(w, "invalid json", 400)
 		return
 	}
-	id := body.ID
+	id, allowed := resolveDeviceID(r, body.ID)
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
 	if id == "" {
 		http.Error(w, "missing id", 400)
 		return
 	}
 
+	var pub *ecdh.PublicKey
+	if body.PublicKey != "" {
+		var err error
+		if pub, err = e2e.ParsePublicKey(body.PublicKey); err != nil {
+			log.Printf("Register error: %v", err)
+			http.Error(w, "invalid public key", 400)
+			return
+		}
+	}
+
 	var nameUpdated bool
 	discovery.Lock.Lock()
 	dev, ok := discovery.Devices[id]
+	if ok && body.PublicKey != "" && dev.PublicKey != "" && body.PublicKey != dev.PublicKey {
+		// Keys are trust-on-first-use; a new key needs a new device ID.
+		discovery.Lock.Unlock()
+		log.Printf("Register rejected: public key change for %s", id)
+		e := auditEntry(r, audit.ActionRegister, id)
+		e.Outcome, e.Detail = audit.OutcomeDenied, "public key change"
+		record(e)
+		http.Error(w, "public key already registered", http.StatusConflict)
+		return
+	}
+	if pub != nil && (!ok || dev.PublicKey == "") && !keyProven(r, id, dev, pub, body.KeyNonce, body.KeySignature) {
+		// Device IDs are visible on the network; only the device itself
+		// may publish the key others will encrypt to.
+		discovery.Lock.Unlock()
+		log.Printf("Register rejected: unproven public key for %s", id)
+		e := auditEntry(r, audit.ActionRegister, id)
+		e.Outcome, e.Detail = audit.OutcomeDenied, "unproven public key"
+		record(e)
+		http.Error(w, "public key requires proof of possession", http.StatusForbidden)
+		return
+	}
 	if !ok {
 		dev = &discovery.Device{
 			ID:        id,
@@ -53,26 +92,35 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 			Icon:      discovery.MakeDeviceIcon(id),
 			Type:      discovery.DetectType(r.UserAgent()),
 			IP:        r.RemoteAddr,
-			NetworkIP: discovery.ExtractIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP")),
+			NetworkIP: network.ClientIP(r),
+			FirstIP:   network.ClientIP(r),
 			UA:        r.UserAgent(),
 			LastSeen:  time.Now(),
+			PublicKey: body.PublicKey,
 		}
-		if dev.Name == "" {
+		if !applyIdentity(dev, r) && dev.Name == "" {
 			dev.Name = discovery.MakeDeviceName(id)
 		}
 		discovery.Devices[id] = dev
 		log.Printf("Device Registered: %s (%s) from %s", dev.Name, id, r.RemoteAddr)
 	} else {
-		if body.Name != "" && body.Name != dev.Name {
+		if body.PublicKey != "" {
+			dev.PublicKey = body.PublicKey
+		}
+		before := dev.Name
+		if applyIdentity(dev, r) {
+			nameUpdated = dev.Name != before
+		} else if body.Name != "" && body.Name != dev.Name {
 			dev.Name = body.Name
 			log.Printf("Device Name Updated: %s (%s)", dev.Name, id)
 			nameUpdated = true
 		}
 		dev.LastSeen = time.Now()
 		dev.IP = r.RemoteAddr
-		dev.NetworkIP = discovery.ExtractIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+		dev.NetworkIP = network.ClientIP(r)
 	}
 	discovery.Lock.Unlock()
+	record(auditEntry(r, audit.ActionRegister, id))
 
 	// Broadcast outside the lock to prevent race conditions
 	if nameUpdated {
@@ -85,9 +133,14 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleEvents opens an SSE stream for real-time peer updates.
+// HandleEvents opens an SSE stream for real-time peer updates. It is the
+// fallback for clients that cannot hold a WebSocket (see HandleWebSocket).
 func HandleEvents(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
+	id, allowed := resolveDeviceID(r, r.URL.Query().Get("id"))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
 	if id == "" {
 		http.Error(w, "missing id", 400)
 		return
@@ -103,7 +156,35 @@ func HandleEvents(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	q := make(chan []byte, 10)
+	q, peers := attachDevice(r, id, "SSE")
+	defer detachDevice(id, q, "SSE")
+
+	// Send the initial peer list (only peers on the same network).
+	fmt.Fprintf(w, "event: peers\ndata: %s\n\n", peers.Data)
+	flusher.Flush()
+
+	ticker := time.NewTicker(20 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-q:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// attachDevice registers a live connection for a device, creating the
+// device if needed, and announces it to its network. It returns the
+// connection's event queue and the initial "peers" event to send.
+func attachDevice(r *http.Request, id, transport string) (chan discovery.Event, discovery.Event) {
+	q := make(chan discovery.Event, 10)
 
 	discovery.Lock.Lock()
 	dev, ok := discovery.Devices[id]
@@ -114,25 +195,24 @@ func HandleEvents(w http.ResponseWriter, r *http.Request) {
 			Icon:      discovery.MakeDeviceIcon(id),
 			Type:      discovery.DetectType(r.UserAgent()),
 			IP:        r.RemoteAddr,
-			NetworkIP: discovery.ExtractIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP")),
+			NetworkIP: network.ClientIP(r),
+			FirstIP:   network.ClientIP(r),
 			UA:        r.UserAgent(),
 			LastSeen:  time.Now(),
 		}
+		applyIdentity(dev, r)
 		discovery.Devices[id] = dev
-		log.Printf("Auto-registered device on SSE connection: %s (%s) [Network: %s]", dev.Name, id, dev.NetworkIP)
+		log.Printf("Auto-registered device on %s connection: %s (%s) [Network: %s]", transport, dev.Name, id, dev.NetworkIP)
 	}
 	dev.Queues = append(dev.Queues, q)
 	dev.LastSeen = time.Now()
-	log.Printf("SSE Connected: %s (%s) [Total Queues: %d]", dev.Name, id, len(dev.Queues))
+	log.Printf("%s Connected: %s (%s) [Total Queues: %d]", transport, dev.Name, id, len(dev.Queues))
 	discovery.Lock.Unlock()
 
-	// Send the initial peer list (only peers on the same network).
 	discovery.Lock.RLock()
 	list := discovery.PeersOnSameNetwork(id)
 	discovery.Lock.RUnlock()
 	msg, _ := json.Marshal(list)
-	fmt.Fprintf(w, "event: peers\ndata: %s\n\n", msg)
-	flusher.Flush()
 	log.Printf("Sent initial peer list to %s (%d peers on same network)", id, len(list))
 
 	// Announce this device to others.
@@ -142,44 +222,31 @@ func HandleEvents(w http.ResponseWriter, r *http.Request) {
 	}
 	discovery.Lock.RUnlock()
 
-	// Cleanup on disconnect.
-	defer func() {
-		discovery.Lock.Lock()
-		shouldBroadcastLeft := false
-		if dev, ok := discovery.Devices[id]; ok {
-			for i, qq := range dev.Queues {
-				if qq == q {
-					dev.Queues = append(dev.Queues[:i], dev.Queues[i+1:]...)
-					break
-				}
-			}
-			// Only broadcast device-left when ALL SSE connections are gone
-			if len(dev.Queues) == 0 {
-				shouldBroadcastLeft = true
+	return q, discovery.Event{Name: "peers", Data: msg}
+}
+
+// detachDevice removes a connection's queue, announcing the device as
+// gone once its last connection closes.
+func detachDevice(id string, q chan discovery.Event, transport string) {
+	discovery.Lock.Lock()
+	shouldBroadcastLeft := false
+	if dev, ok := discovery.Devices[id]; ok {
+		for i, qq := range dev.Queues {
+			if qq == q {
+				dev.Queues = append(dev.Queues[:i], dev.Queues[i+1:]...)
+				break
 			}
 		}
-		discovery.Lock.Unlock()
-		log.Printf("SSE Disconnected: %s", id)
-		if shouldBroadcastLeft {
-			discovery.Broadcast("device-left", map[string]string{"id": id}, id)
-		}
-	}()
-
-	ticker := time.NewTicker(20 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case msg := <-q:
-			w.Write(msg)
-			flusher.Flush()
-		case <-ticker.C:
-			fmt.Fprintf(w, ": ping\n\n")
-			flusher.Flush()
-		case <-r.Context().Done():
-			return
+		// Only broadcast device-left when ALL connections are gone
+		if len(dev.Queues) == 0 {
+			shouldBroadcastLeft = true
 		}
 	}
+	discovery.Lock.Unlock()
+	log.Printf("%s Disconnected: %s", transport, id)
+	if shouldBroadcastLeft {
+		discovery.Broadcast("device-left", map[string]string{"id": id}, id)
+	}
 }
 
 // HandleUpload processes multipart file uploads (public or private).
@@ -202,76 +269,192 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rawTo := r.FormValue("to")
-	fromID := r.FormValue("from")
+	fromID, allowed := resolveDeviceID(r, r.FormValue("from"))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
 	toID := ""
-	var saved []string
+	saved := []string{}
+	rejected := []fileRejection{}
 
-	uploadDir := filepath.Join(SharedDir, "public")
+	uploadDir := "public"
 	if rawTo != "" {
 		toID = filepath.Base(rawTo)
 		if !isValidName(toID) || len(toID) < 5 {
 			http.Error(w, "invalid destination", 400)
 			return
 		}
-		uploadDir = filepath.Join(SharedDir, "private", toID)
+		uploadDir = filepath.Join("private", toID)
 	}
-	os.MkdirAll(uploadDir, 0755)
 
+	policy := getFilePolicy()
 	files := r.MultipartForm.File["files"]
+	if policy.MaxFiles > 0 && len(files) > policy.MaxFiles {
+		http.Error(w, fmt.Sprintf("too many files (limit %d)", policy.MaxFiles), 400)
+		return
+	}
+
+	// E2E sends carry ciphertext the server cannot read; every file must
+	// be an envelope for the recipient's key, and content sniffing is moot.
+	isE2E := r.FormValue("e2e") == "1"
+	var wantKey e2e.KeyID
+	if isE2E {
+		if toID == "" {
+			http.Error(w, "end-to-end encryption requires a recipient", 400)
+			return
+		}
+		if wantKey, err = recipientKeyID(toID); err != nil {
+			log.Printf("E2E upload rejected for %s: %v", toID, err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if err := share.MkdirAll(uploadDir, 0755); rejectViolation(w, r, err) {
+		return
+	}
+
+	// With a scanner configured, plaintext uploads wait in quarantine and
+	// are published in the background once they pass.
+	s := getScanner()
+	strip := !isE2E && shouldStrip(toID, r.FormValue("strip_metadata") == "1")
+	var held []heldFile
+	action := audit.ActionUpload
+	if toID != "" {
+		action = audit.ActionDeliver
+	}
+	base := auditEntry(r, action, fromID)
+	base.Target = toID
+	if isE2E {
+		base.Detail = "end-to-end encrypted"
+	}
 	for _, fh := range files {
-		func() {
+		safeName := filepath.Base(fh.Filename)
+		entry := base
+		entry.File, entry.Size = safeName, fh.Size
+		reason := func() string {
+			if !isValidName(safeName) {
+				return "invalid file name"
+			}
+			if reason := policy.checkName(safeName); reason != "" {
+				return reason
+			}
 			f, err := fh.Open()
 			if err != nil {
 				log.Printf("Error opening uploaded file: %v", err)
-				return
+				return "could not read file"
 			}
 			defer f.Close()
 
-			safeName := filepath.Base(fh.Filename)
-			outPath := filepath.Join(uploadDir, safeName)
-
-			dst, err := os.Create(outPath)
-			if err != nil {
-				log.Printf("Error creating file %s: %v", outPath, err)
-				return
+			if isE2E {
+				if reason := checkEnvelope(f, fh.Size, wantKey); reason != "" {
+					return reason
+				}
+			} else if reason := policy.checkContent(f); reason != "" {
+				return reason
 			}
-			defer dst.Close()
 
-			if _, err := io.Copy(dst, f); err != nil {
+			if s != nil && !isE2E {
+				h, err := quarantineUpload(safeName, f, strip)
+				if err != nil {
+					log.Printf("Error quarantining file %s: %v", safeName, err)
+					return saveFailure(err)
+				}
+				h.Size = fh.Size
+				held = append(held, h)
+				entry.Outcome, entry.SHA256 = audit.OutcomeQuarantined, h.Meta.SHA256
+				return ""
+			}
+			outPath := filepath.Join(uploadDir, safeName)
+			m, err := saveUpload(outPath, f, toID != "" && !isE2E, strip)
+			if sandbox.IsViolation(err) {
+				logViolation(r, err)
+			} else if err != nil {
 				log.Printf("Error saving file %s: %v", outPath, err)
-				return
+			}
+			if err != nil {
+				return saveFailure(err)
+			}
+			// Replaces any record left by a file of the same name.
+			if err := writeMeta(outPath, m); err != nil {
+				log.Printf("Error recording metadata for %s: %v", outPath, err)
 			}
 			saved = append(saved, safeName)
+			entry.SHA256 = m.SHA256
+			return ""
 		}()
+		if reason != "" {
+			log.Printf("Upload rejected: %s (%s)", safeName, reason)
+			rejected = append(rejected, fileRejection{Name: safeName, Reason: reason})
+			entry.Outcome, entry.Detail = audit.OutcomeRejected, reason
+		}
+		record(entry)
 	}
 
-	if toID != "" && fromID != "" && len(saved) > 0 {
-		discovery.Lock.RLock()
-		sender := discovery.Devices[fromID]
-		discovery.Lock.RUnlock()
-		if sender != nil {
-			discovery.Notify(toID, "files-sent", map[string]interface{}{
-				"filenames": saved,
-				"from_name": sender.Name,
-				"from_icon": sender.Icon,
-			})
+	if len(saved) > 0 {
+		announceUpload(fromID, toID, saved, isE2E)
+	}
+	quarantined := []string{}
+	if len(held) > 0 {
+		for _, h := range held {
+			quarantined = append(quarantined, h.Name)
 		}
-	} else {
+		go releaseAfterScan(s, held, base, uploadDir)
+	}
+
+	// Report per-file outcomes; fail the request only if nothing was kept.
+	status := http.StatusOK
+	if len(saved) == 0 && len(held) == 0 && len(rejected) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"saved":       saved,
+		"quarantined": quarantined,
+		"rejected":    rejected,
+	}); err != nil {
+		log.Printf("Error encoding upload response: %v", err)
+	}
+}
+
+// announceUpload tells the recipient about newly delivered private files,
+// or everyone about new public files.
+func announceUpload(fromID, toID string, names []string, isE2E bool) {
+	if toID == "" || fromID == "" {
 		discovery.Broadcast("shared-update", nil, "")
+		return
+	}
+	discovery.Lock.RLock()
+	sender := discovery.Devices[fromID]
+	discovery.Lock.RUnlock()
+	if sender != nil {
+		discovery.Notify(toID, "files-sent", map[string]interface{}{
+			"from":      fromID,
+			"filenames": names,
+			"from_name": sender.Name,
+			"from_icon": sender.Icon,
+			"trusted":   sender.Trusted,
+			"e2e":       isE2E,
+		})
 	}
+}
 
-	w.WriteHeader(200)
+// fileRejection explains why one file of an upload was not stored.
+type fileRejection struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
 
 // HandleListFiles returns a JSON list of publicly shared files.
 func HandleListFiles(w http.ResponseWriter, r *http.Request) {
-	publicDir := filepath.Join(SharedDir, "public")
-	if err := os.MkdirAll(publicDir, 0755); err != nil {
+	publicDir := "public"
+	if err := share.MkdirAll(publicDir, 0755); err != nil {
 		log.Printf("Error creating public dir: %v", err)
 		http.Error(w, "internal error", 500)
 		return
 	}
-	entries, err := os.ReadDir(publicDir)
+	entries, err := share.ReadDir(publicDir)
 	if err != nil {
 		log.Printf("Error reading public dir: %v", err)
 		http.Error(w, "internal error", 500)
@@ -280,14 +463,27 @@ func HandleListFiles(w http.ResponseWriter, r *http.Request) {
 	var list []map[string]interface{}
 	for _, e := range entries {
 		if !e.IsDir() {
-			info, err := e.Info()
-			if err != nil {
+			// Stat through the share so links the policy refuses are hidden.
+			info, err := share.Stat(filepath.Join(publicDir, e.Name()))
+			if err != nil || info.IsDir() {
 				continue
 			}
-			list = append(list, map[string]interface{}{
+			item := map[string]interface{}{
 				"name": e.Name(),
 				"size": info.Size(),
-			})
+			}
+			if m, ok := readMeta(filepath.Join(publicDir, e.Name())); ok {
+				if m.Scan != nil {
+					item["scan"] = m.Scan
+				}
+				if m.MetadataStripped != "" {
+					item["metadata_stripped"] = true
+				}
+				if m.SHA256 != "" {
+					item["sha256"] = m.SHA256
+				}
+			}
+			list = append(list, item)
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -313,13 +509,30 @@ func HandleDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid filename", 400)
 		return
 	}
-	target := filepath.Join(SharedDir, "public", name)
-	if err := os.Remove(target); err != nil {
+	deviceID, allowed := resolveDeviceID(r, filepath.Base(r.URL.Query().Get("id")))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
+	target := filepath.Join("public", name)
+	e := auditEntry(r, audit.ActionDelete, deviceID)
+	e.File = name
+	if info, err := share.Stat(target); err == nil {
+		e.Size = info.Size()
+	}
+	if m, ok := readMeta(target); ok {
+		e.SHA256 = m.SHA256
+	}
+	if err := removeStored(target); err != nil {
+		if rejectViolation(w, r, err) {
+			return
+		}
 		log.Printf("Error deleting file %s: %v", target, err)
 		http.Error(w, "could not delete file", 500)
 		return
 	}
 	log.Printf("File deleted: %s", name)
+	record(e)
 	discovery.Broadcast("shared-update", nil, "")
 	w.WriteHeader(200)
 }
@@ -331,27 +544,57 @@ func HandleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid filename", 400)
 		return
 	}
-	myID := filepath.Base(r.URL.Query().Get("id"))
+	myID, allowed := resolveDeviceID(r, filepath.Base(r.URL.Query().Get("id")))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
 
 	if myID != "" && isValidName(myID) {
-		privatePath := filepath.Join(SharedDir, "private", myID, name)
-		if _, err := os.Stat(privatePath); err == nil {
+		privatePath := filepath.Join("private", myID, name)
+		info, err := share.Stat(privatePath)
+		if rejectViolation(w, r, err) {
+			return
+		}
+		if err == nil {
+			// Inbox files are delivered once: removed, and audited, only
+			// after the whole file went out. A failed decrypt or a broken
+			// transfer leaves it in place for another try.
 			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
-			defer os.Remove(privatePath)
-			http.ServeFile(w, r, privatePath)
+			if serveFile(w, r, privatePath, name) {
+				recordDownload(r, myID, privatePath, info.Size(), "private inbox")
+				if err := removeStored(privatePath); err != nil {
+					log.Printf("Error removing delivered file %s: %v", privatePath, err)
+				}
+			}
 			return
 		}
 	}
 
-	publicPath := filepath.Join(SharedDir, "public", name)
-	if _, err := os.Stat(publicPath); err == nil {
+	publicPath := filepath.Join("public", name)
+	info, err := share.Stat(publicPath)
+	if rejectViolation(w, r, err) {
+		return
+	}
+	if err == nil {
+		recordDownload(r, myID, publicPath, info.Size(), "")
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
-		http.ServeFile(w, r, publicPath)
+		serveFile(w, r, publicPath, name)
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
+// recordDownload audits a stored file that is being or has been served.
+func recordDownload(r *http.Request, deviceID, path string, size int64, detail string) {
+	e := auditEntry(r, audit.ActionDownload, deviceID)
+	e.File, e.Size, e.Detail = filepath.Base(path), size, detail
+	if m, ok := readMeta(path); ok {
+		e.SHA256 = m.SHA256
+	}
+	record(e)
+}
+
 // HandleGetDevice returns a single device's info by ID.
 func HandleGetDevice(w http.ResponseWriter, r *http.Request) {
 	id := filepath.Base(r.URL.Path)
@@ -0,0 +1,378 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/pkg/link"
+	"fileshare/pkg/stream"
+)
+
+// Limits for zero-knowledge public links.
+const (
+	DefaultLinkExpiry = 24 * time.Hour
+	MaxLinkExpiry     = 7 * 24 * time.Hour
+	MaxLinkDownloads  = 100
+)
+
+// linkRecord is everything the server knows about a link: an opaque blob,
+// opaque sealed metadata and the limits it enforces.
+type linkRecord struct {
+	ID           string    `json:"id"`
+	Metadata     string    `json:"metadata"`
+	Size         int64     `json:"size"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+	OwnerHash    string    `json:"owner_hash"`
+}
+
+// linkMu serialises reads and writes of link records so download counts
+// are never lost or exceeded.
+var linkMu sync.Mutex
+
+const linksDir = "links"
+
+func linkPaths(id string) (blob, meta string) {
+	return filepath.Join(linksDir, id+".bin"), filepath.Join(linksDir, id+".json")
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// loadLink reads a link record, removing it if it has expired, run out of
+// downloads or cannot be read. The caller must hold linkMu.
+func loadLink(id string) (*linkRecord, bool) {
+	if !isValidName(id) {
+		return nil, false
+	}
+	rec, err := readLink(id)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Removing unreadable link record %s: %v", id, err)
+			removeLink(id)
+		}
+		return nil, false
+	}
+	if rec.spent(time.Now()) {
+		removeLink(id)
+		return nil, false
+	}
+	return rec, true
+}
+
+// readLink reads and decodes a link record as stored.
+func readLink(id string) (*linkRecord, error) {
+	_, metaPath := linkPaths(id)
+	data, err := share.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var rec linkRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// spent reports whether a link has expired or run out of downloads.
+func (rec *linkRecord) spent(now time.Time) bool {
+	return now.After(rec.Expires) || rec.Downloads >= rec.MaxDownloads
+}
+
+// saveLink writes a link record through a temporary file, so a failed
+// write never clobbers the current record. sweepLinks clears whatever a
+// crash leaves behind. The caller must hold linkMu.
+func saveLink(rec *linkRecord) error {
+	_, metaPath := linkPaths(rec.ID)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := metaPath + ".tmp"
+	if err := share.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := share.Move(tmp, metaPath); err != nil {
+		share.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func removeLink(id string) {
+	blobPath, metaPath := linkPaths(id)
+	share.Remove(metaPath)
+	share.Remove(blobPath)
+}
+
+// HandleCreateLink stores an encrypted blob for a zero-knowledge public
+// link. The request body is the blob itself; the sealed metadata travels
+// in the X-Link-Metadata header so no file name ever reaches the server.
+// Optional query parameters: expires (seconds) and downloads (limit).
+func HandleCreateLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	meta := r.Header.Get("X-Link-Metadata")
+	if meta == "" || len(meta) > link.MaxMetadataSize {
+		http.Error(w, "missing or oversized metadata", 400)
+		return
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(meta); err != nil {
+		http.Error(w, "metadata must be base64url", 400)
+		return
+	}
+
+	expiry := DefaultLinkExpiry
+	if v := r.URL.Query().Get("expires"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > MaxLinkExpiry {
+			http.Error(w, "invalid expires", 400)
+			return
+		}
+		expiry = time.Duration(secs) * time.Second
+	}
+	maxDownloads := 1
+	if v := r.URL.Query().Get("downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxLinkDownloads {
+			http.Error(w, "invalid downloads", 400)
+			return
+		}
+		maxDownloads = n
+	}
+
+	if err := share.MkdirAll(linksDir, 0700); err != nil {
+		log.Printf("Error creating links dir: %v", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	id := randomToken(12)
+	blobPath, _ := linkPaths(id)
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	if err := saveFile(blobPath, r.Body, false); err != nil {
+		log.Printf("Error saving link blob %s: %v", id, err)
+		http.Error(w, "upload failed", 400)
+		return
+	}
+	info, err := share.Stat(blobPath)
+	if err != nil {
+		http.Error(w, "internal error", 500)
+		return
+	}
+	// The server cannot decrypt the blob, but it can refuse anything that
+	// is not shaped like an encrypted stream.
+	if _, err := stream.PlainSize(info.Size()); err != nil {
+		share.Remove(blobPath)
+		http.Error(w, "blob is not an encrypted stream", 400)
+		return
+	}
+
+	owner := randomToken(16)
+	now := time.Now()
+	rec := &linkRecord{
+		ID:           id,
+		Metadata:     meta,
+		Size:         info.Size(),
+		Created:      now,
+		Expires:      now.Add(expiry),
+		MaxDownloads: maxDownloads,
+		OwnerHash:    hashToken(owner),
+	}
+	linkMu.Lock()
+	err = saveLink(rec)
+	linkMu.Unlock()
+	if err != nil {
+		share.Remove(blobPath)
+		log.Printf("Error saving link record %s: %v", id, err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	log.Printf("Link created: %s (%d bytes, %d downloads, expires %s)", id, rec.Size, maxDownloads, rec.Expires.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            id,
+		"owner_token":   owner,
+		"expires":       rec.Expires,
+		"max_downloads": maxDownloads,
+	}); err != nil {
+		log.Printf("Error encoding link response: %v", err)
+	}
+}
+
+// HandleLink serves /api/links/{id} (GET metadata, DELETE with the owner
+// token) and /api/links/{id}/blob (GET the encrypted content).
+func HandleLink(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/links/")
+	id, sub, _ := strings.Cut(rest, "/")
+
+	switch {
+	case sub == "blob" && r.Method == "GET":
+		serveLinkBlob(w, r, id)
+	case sub == "" && r.Method == "GET":
+		linkMu.Lock()
+		rec, ok := loadLink(id)
+		linkMu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":             rec.ID,
+			"metadata":       rec.Metadata,
+			"size":           rec.Size,
+			"expires":        rec.Expires,
+			"downloads_left": rec.MaxDownloads - rec.Downloads,
+		}); err != nil {
+			log.Printf("Error encoding link metadata: %v", err)
+		}
+	case sub == "" && r.Method == "DELETE":
+		linkMu.Lock()
+		defer linkMu.Unlock()
+		rec, ok := loadLink(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		token := r.Header.Get("X-Owner-Token")
+		if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(rec.OwnerHash)) != 1 {
+			http.Error(w, "invalid owner token", http.StatusForbidden)
+			return
+		}
+		removeLink(id)
+		log.Printf("Link deleted by owner: %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveLinkBlob streams a link's blob and counts the download. The count
+// is taken up front so concurrent requests cannot exceed the limit; the
+// link is removed once the last allowed download has been sent.
+func serveLinkBlob(w http.ResponseWriter, r *http.Request, id string) {
+	linkMu.Lock()
+	rec, ok := loadLink(id)
+	var f *os.File
+	if ok {
+		blobPath, _ := linkPaths(id)
+		var err error
+		if f, err = share.Open(blobPath); err != nil {
+			ok = false
+		} else {
+			rec.Downloads++
+			if err := saveLink(rec); err != nil {
+				log.Printf("Error updating link %s: %v", id, err)
+			}
+		}
+	}
+	linkMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	last := rec.Downloads >= rec.MaxDownloads
+	defer func() {
+		f.Close()
+		if last {
+			linkMu.Lock()
+			removeLink(id)
+			linkMu.Unlock()
+			log.Printf("Link %s reached its download limit", id)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(rec.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, f); err != nil && !errors.Is(err, r.Context().Err()) {
+		log.Printf("Error sending link blob %s: %v", id, err)
+	}
+}
+
+// StartLinkCleanup starts a background goroutine that removes expired
+// public links.
+func StartLinkCleanup() {
+	go func() {
+		for {
+			time.Sleep(5 * time.Minute)
+			sweepLinks(time.Now())
+		}
+	}()
+}
+
+// sweepLinks removes spent and unreadable link records, temporary record
+// files left by a crash, and blobs whose record is gone. A blob is only
+// taken once it is older than any link may live, so an upload still
+// waiting for its record is left alone.
+func sweepLinks(now time.Time) {
+	entries, err := share.ReadDir(linksDir)
+	if err != nil {
+		return // directory may not exist yet
+	}
+	linkMu.Lock()
+	defer linkMu.Unlock()
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(linksDir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			// saveLink runs under linkMu, so no temporary file is in use.
+			if err := share.Remove(path); err == nil {
+				log.Printf("Cleaned up stale link file: %s", name)
+			}
+			continue
+		}
+		if id, ok := strings.CutSuffix(name, ".json"); ok {
+			rec, err := readLink(id)
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+			case err != nil:
+				log.Printf("Removing unreadable link record %s: %v", id, err)
+				removeLink(id)
+			case rec.spent(now):
+				removeLink(id)
+				log.Printf("Cleaned up expired link: %s", id)
+			}
+			continue
+		}
+		if id, ok := strings.CutSuffix(name, ".bin"); ok {
+			_, metaPath := linkPaths(id)
+			if _, err := share.Stat(metaPath); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > MaxLinkExpiry {
+				if err := share.Remove(path); err == nil {
+					log.Printf("Cleaned up orphaned link blob: %s", id)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"fileshare/internal/scan"
+)
+
+// fileMeta is server-side metadata about a stored file. It lives in a
+// sidecar under .meta in the share so directory listings never see it.
+type fileMeta struct {
+	Scan             *scan.Verdict `json:"scan,omitempty"`
+	MetadataStripped string        `json:"metadata_stripped,omitempty"` // image format sanitized
+	SHA256           string        `json:"sha256,omitempty"`            // of the stored, pre-encryption content
+	Encrypted        bool          `json:"encrypted,omitempty"`         // stored encrypted at rest
+}
+
+// metaPathFor maps a stored file's share name to its sidecar.
+func metaPathFor(name string) string {
+	return filepath.Join(".meta", name+".json")
+}
+
+func writeMeta(name string, m fileMeta) error {
+	mp := metaPathFor(name)
+	if err := share.MkdirAll(filepath.Dir(mp), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return share.WriteFile(mp, data, 0600)
+}
+
+func readMeta(name string) (fileMeta, bool) {
+	var m fileMeta
+	data, err := share.ReadFile(metaPathFor(name))
+	if err != nil {
+		return m, false
+	}
+	return m, json.Unmarshal(data, &m) == nil
+}
+
+// removeStored deletes a stored file together with its metadata.
+func removeStored(name string) error {
+	share.Remove(metaPathFor(name))
+	return share.Remove(name)
+}
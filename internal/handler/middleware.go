@@ -3,31 +3,123 @@ package handler
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"runtime/debug"
+	"strings"
+	"sync"
 )
 
-// Cors wraps a handler with permissive CORS headers.
+// CORS configuration. With no allowed origins only same-origin browser
+// requests are accepted; a "*" entry restores fully permissive CORS.
+var (
+	corsLock       sync.RWMutex
+	allowedOrigins map[string]bool
+	corsPermissive bool
+)
+
+// SetAllowedOrigins configures the origins (e.g. "https://app.example.com")
+// that may call the API cross-origin. Pass "*" to allow any origin.
+func SetAllowedOrigins(origins []string) {
+	m := make(map[string]bool)
+	permissive := false
+	for _, o := range origins {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		switch o {
+		case "":
+		case "*":
+			permissive = true
+		default:
+			m[strings.ToLower(o)] = true
+		}
+	}
+	corsLock.Lock()
+	allowedOrigins = m
+	corsPermissive = permissive
+	corsLock.Unlock()
+}
+
+// originAllowed reports whether origin may make cross-origin calls.
+func originAllowed(origin string) bool {
+	corsLock.RLock()
+	defer corsLock.RUnlock()
+	return corsPermissive || allowedOrigins[strings.ToLower(origin)]
+}
+
+// isSameOrigin reports whether the Origin header names this server.
+func isSameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// isStateChanging reports whether the method can modify server state.
+func isStateChanging(method string) bool {
+	return method != "GET" && method != "HEAD" && method != "OPTIONS"
+}
+
+// Cors wraps a handler with the configured CORS policy. State-changing
+// requests from a foreign origin — identified by the Origin header or by
+// Sec-Fetch-Site — are rejected unless that origin is allowlisted, so a
+// website a LAN user visits cannot drive the local instance.
 func Cors(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		corsLock.RLock()
+		permissive := corsPermissive
+		corsLock.RUnlock()
+
+		origin := r.Header.Get("Origin")
+		crossOrigin := origin != "" && !isSameOrigin(r, origin)
+		allowed := !crossOrigin || originAllowed(origin)
+
+		if crossOrigin && allowed {
+			if permissive {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Link-Metadata, X-Owner-Token")
+		}
+
 		if r.Method == "OPTIONS" {
+			if !allowed {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+			}
 			return
 		}
+
+		if isStateChanging(r.Method) {
+			// Browsers that omit Origin still send Sec-Fetch-Site.
+			site := r.Header.Get("Sec-Fetch-Site")
+			if !allowed || (origin == "" && !permissive && (site == "cross-site" || site == "same-site")) {
+				log.Printf("Cross-origin %s %s rejected (origin %q, fetch-site %q)", r.Method, r.URL.Path, origin, site)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+		}
 		h(w, r)
 	}
 }
 
-// SecureHeaders adds security headers to every response.
+// SecureHeaders adds security headers to every response, including a
+// Content-Security-Policy with a fresh script nonce (see CSPNonce).
 func SecureHeaders(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
+		// The legacy XSS auditor is itself exploitable; CSP replaces it.
+		w.Header().Set("X-XSS-Protection", "0")
 		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
 		w.Header().Set("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
-		h(w, r)
+		w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+		w.Header().Set("Cross-Origin-Resource-Policy", "same-origin")
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		h(w, withCSP(w, r))
 	}
 }
 
@@ -36,6 +128,9 @@ func Recover(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // a deliberately aborted response, not a bug
+				}
 				log.Printf("PANIC recovered: %v\n%s", err, debug.Stack())
 				http.Error(w, "Internal Server Error", 500)
 			}
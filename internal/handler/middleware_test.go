@@ -3,16 +3,22 @@ package handler
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCors(t *testing.T) {
+	SetAllowedOrigins([]string{"*"})
+	defer SetAllowedOrigins(nil)
+
 	handler := Cors(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
 	// Test regular request
 	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Origin", "http://other.example")
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -22,6 +28,7 @@ func TestCors(t *testing.T) {
 
 	// Test OPTIONS preflight
 	req = httptest.NewRequest("OPTIONS", "/test", nil)
+	req.Header.Set("Origin", "http://other.example")
 	w = httptest.NewRecorder()
 	handler(w, req)
 
@@ -30,6 +37,51 @@ func TestCors(t *testing.T) {
 	}
 }
 
+func TestCors_SameOriginDefault(t *testing.T) {
+	SetAllowedOrigins([]string{"http://trusted.example"})
+	defer SetAllowedOrigins(nil)
+
+	handler := Cors(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		origin   string
+		site     string
+		expected int
+	}{
+		{"same-origin upload", "POST", "http://example.com", "same-origin", http.StatusOK},
+		{"no origin (CLI client)", "DELETE", "", "", http.StatusOK},
+		{"foreign origin upload", "POST", "http://evil.example", "cross-site", http.StatusForbidden},
+		{"foreign fetch-site without origin", "POST", "", "cross-site", http.StatusForbidden},
+		{"allowlisted origin", "POST", "http://trusted.example", "cross-site", http.StatusOK},
+		{"foreign origin read", "GET", "http://evil.example", "cross-site", http.StatusOK},
+		{"foreign preflight", "OPTIONS", "http://evil.example", "cross-site", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com/api/upload", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.site != "" {
+				req.Header.Set("Sec-Fetch-Site", tt.site)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+			if tt.origin == "http://evil.example" && w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("foreign origin must not receive Access-Control-Allow-Origin")
+			}
+		})
+	}
+}
+
 func TestSecureHeaders(t *testing.T) {
 	handler := SecureHeaders(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -45,6 +97,9 @@ func TestSecureHeaders(t *testing.T) {
 		"X-XSS-Protection",
 		"Referrer-Policy",
 		"Permissions-Policy",
+		"Content-Security-Policy",
+		"Cross-Origin-Opener-Policy",
+		"Cross-Origin-Resource-Policy",
 	}
 
 	for _, h := range headers {
@@ -52,6 +107,69 @@ func TestSecureHeaders(t *testing.T) {
 			t.Errorf("expected %s header to be set", h)
 		}
 	}
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS must not be sent over plain HTTP")
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/test", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("expected HSTS header over TLS")
+	}
+}
+
+func TestSecureHeaders_CSPNonce(t *testing.T) {
+	var nonces []string
+	handler := SecureHeaders(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, CSPNonce(r))
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		if !strings.Contains(w.Header().Get("Content-Security-Policy"), "'nonce-"+nonces[i]+"'") {
+			t.Errorf("CSP header does not carry the request nonce %q", nonces[i])
+		}
+	}
+	if nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Errorf("expected distinct per-response nonces, got %q and %q", nonces[0], nonces[1])
+	}
+	for _, directive := range strings.Split(DefaultCSP, ";") {
+		if strings.HasPrefix(strings.TrimSpace(directive), "script-src") && strings.Contains(directive, "'unsafe-inline'") {
+			t.Errorf("scripts must not allow inline code: %q", directive)
+		}
+	}
+
+	SetContentSecurityPolicy("")
+	defer SetContentSecurityPolicy(DefaultCSP)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Content-Security-Policy") != "" {
+		t.Error("expected CSP to be disabled by an empty policy")
+	}
+}
+
+func TestHandleCSPReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"legacy report", `{"csp-report":{"document-uri":"http://x/","blocked-uri":"inline","violated-directive":"script-src"}}`, http.StatusNoContent},
+		{"reporting API", `[{"type":"csp-violation","body":{"documentURL":"http://x/","blockedURL":"eval","effectiveDirective":"script-src"}}]`, http.StatusNoContent},
+		{"garbage", `not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/csp-report", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			HandleCSPReport(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
 }
 
 func TestRecover(t *testing.T) {
@@ -85,3 +203,81 @@ func TestRateLimit(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 }
+
+func TestRateLimit_StreamCap(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, maxStreamsPerIP+1)
+	handler := RateLimit(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	stream := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/p2p/events", nil)
+		req.RemoteAddr = "192.168.99.98:12345"
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	for i := 0; i < maxStreamsPerIP; i++ {
+		go stream()
+		<-started
+	}
+	if w := stream(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the stream limit, got %d", w.Code)
+	}
+	close(release)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		streamsLock.Lock()
+		n := openStreams["192.168.99.98"]
+		streamsLock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams still counted after they closed", n)
+		}
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	defer SetAccessPolicy(nil, nil, false)
+
+	handler := AccessControl(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		lanOnly  bool
+		remote   string
+		expected int
+	}{
+		{"no policy", nil, nil, false, "203.0.113.9:1000", http.StatusOK},
+		{"denied address", nil, []string{"192.168.1.0/24"}, false, "192.168.1.20:1000", http.StatusForbidden},
+		{"allow list match", []string{"192.168.1.0/24"}, nil, false, "192.168.1.20:1000", http.StatusOK},
+		{"allow list miss", []string{"192.168.1.0/24"}, nil, false, "10.1.1.1:1000", http.StatusForbidden},
+		{"deny beats allow", []string{"192.168.1.0/24"}, []string{"192.168.1.20"}, false, "192.168.1.20:1000", http.StatusForbidden},
+		{"LAN-only private", nil, nil, true, "10.0.0.5:1000", http.StatusOK},
+		{"LAN-only loopback", nil, nil, true, "127.0.0.1:1000", http.StatusOK},
+		{"LAN-only link-local", nil, nil, true, "[fe80::1]:1000", http.StatusOK},
+		{"LAN-only public", nil, nil, true, "203.0.113.9:1000", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetAccessPolicy(tt.allow, tt.deny, tt.lanOnly); err != nil {
+				t.Fatalf("SetAccessPolicy: %v", err)
+			}
+			req := httptest.NewRequest("GET", "/api/files", nil)
+			req.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
@@ -2,35 +2,109 @@ package handler
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"fileshare/internal/audit"
+	"fileshare/internal/network"
 )
 
 // P2PRoom holds signaling data for a WebRTC session.
 type P2PRoom struct {
 	ID        string      `json:"id"`
 	CreatedAt time.Time   `json:"-"`
+	CreatorIP string      `json:"-"` // client IP that created the room
 	Signals   []P2PSignal `json:"-"`
 	mu        sync.Mutex
+	changed   chan struct{} // closed and replaced when a signal or the status changes
+
+	state        string // see p2pstatus.go
+	sender       peerPresence
+	receivers    []*roomReceiver // in join order; see p2ppeers.go
+	maxReceivers int             // 1 unless created as a broadcast room
+
+	lastActive  time.Time
+	watchers    int           // open event streams, subscriptions and waiting polls
+	done        chan struct{} // closed when the room is removed
+	closeReason string        // why the room was removed, set before done is closed
+
+	relayed      bool  // the TURN relay has carried data for the room
+	relayedBytes int64 // how much, in both directions
+
+	pipes map[string]*roomPipe // by receiving peer; see p2ppipe.go
+
+	signalCount map[string]int // stored signals by P2PSignal.Peer, against maxPeerSignals
+
+	// Per-role secrets. The creator gets senderToken; joinToken travels in
+	// the share link and is exchanged for each receiver's own token until
+	// maxReceivers have joined, after which the room is locked.
+	senderToken string
+	joinToken   string
 }
 
 // P2PSignal is a single signaling message (offer, answer, ICE candidate, etc.).
+// Peer is the receiver's peer ID: the one that sent it, or for the
+// sender's signals the one it is addressed to (empty for all receivers).
 type P2PSignal struct {
 	From string          `json:"from"`
+	Peer string          `json:"peer,omitempty"`
 	Type string          `json:"type"`
 	Data json.RawMessage `json:"data"`
+
+	dropped bool // its receiver was removed; kept only to hold its index
 }
 
 var (
-	p2pLock  sync.RWMutex
-	p2pRooms = make(map[string]*P2PRoom)
+	p2pLock     sync.RWMutex
+	p2pRooms    = make(map[string]*P2PRoom)
+	maxP2PRooms = DefaultMaxRooms
+)
+
+// DefaultMaxRooms is the default limit on open P2P rooms.
+const DefaultMaxRooms = 1000
+
+// Room lifecycle and resource limits.
+const (
+	p2pIdleTimeout     = 10 * time.Minute // unwatched rooms with no activity for this long expire
+	p2pMaxRoomAge      = 6 * time.Hour    // rooms expire this long after creation, watched or not
+	p2pCleanupInterval = time.Minute
+	maxRoomsPerIP      = 50       // open rooms one client address may have created
+	maxPeerSignals     = 500      // signals stored per receiver, both ways, and for the sender's broadcasts
+	maxRoomSignals     = 5000     // signals stored per room, counting those dropped with removed receivers
+	maxSignalPayload   = 32 << 10 // bytes of a signal's data (an SDP offer is a few KB)
+)
+
+// Reasons a room is removed, sent to its peers in the room-closed event.
+const (
+	roomClosed  = "closed"
+	roomExpired = "expired"
+)
+
+var (
+	errRoomFull     = errors.New("room signal limit reached")
+	errSignalTooBig = errors.New("signal too large")
 )
 
+// SetMaxRooms limits how many P2P rooms may be open at once (0 or less
+// restores the default).
+func SetMaxRooms(n int) {
+	if n <= 0 {
+		n = DefaultMaxRooms
+	}
+	p2pLock.Lock()
+	maxP2PRooms = n
+	p2pLock.Unlock()
+}
+
 // StartP2PCleanup starts the background goroutine that cleans up expired P2P rooms.
 func StartP2PCleanup() {
 	go cleanupP2PRooms()
@@ -38,16 +112,189 @@ func StartP2PCleanup() {
 
 func cleanupP2PRooms() {
 	for {
-		time.Sleep(5 * time.Minute)
-		p2pLock.Lock()
-		for id, room := range p2pRooms {
-			if time.Since(room.CreatedAt) > 30*time.Minute {
-				delete(p2pRooms, id)
-				log.Printf("P2P room expired: %s", id)
-			}
+		time.Sleep(p2pCleanupInterval)
+		expireIdleRooms()
+		expireRoomCodes()
+	}
+}
+
+// expireIdleRooms removes rooms that nobody is watching and that have
+// seen no activity for p2pIdleTimeout, and every room older than
+// p2pMaxRoomAge, so an open stream cannot keep a room alive forever.
+func expireIdleRooms() {
+	var idle []string
+	p2pLock.RLock()
+	for id, room := range p2pRooms {
+		if room.idleFor() > p2pIdleTimeout || time.Since(room.CreatedAt) > p2pMaxRoomAge {
+			idle = append(idle, id)
+		}
+	}
+	p2pLock.RUnlock()
+	for _, id := range idle {
+		removeRoom(id, roomExpired)
+	}
+}
+
+// removeRoom deletes a room and wakes everyone watching it with reason.
+func removeRoom(id, reason string) bool {
+	p2pLock.Lock()
+	room, ok := p2pRooms[id]
+	delete(p2pRooms, id)
+	p2pLock.Unlock()
+	if !ok {
+		return false
+	}
+	room.mu.Lock()
+	room.closeReason = reason
+	room.cancelPipesLocked("", "room "+reason)
+	close(room.done)
+	room.mu.Unlock()
+	log.Printf("P2P room %s: %s", reason, id)
+	return true
+}
+
+func (room *P2PRoom) idleFor() time.Duration {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.watchers > 0 {
+		return 0
+	}
+	return time.Since(room.lastActive)
+}
+
+// closedReason returns why the room was removed; call it once done is closed.
+func (room *P2PRoom) closedReason() string {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.closeReason
+}
+
+// Limits for waiting on signals.
+const (
+	maxP2PWait    = 25 * time.Second // long-poll hold time
+	p2pStreamPing = 20 * time.Second
+)
+
+// addSignal appends a signal from peer and wakes everyone waiting on the
+// room. The sender addresses a receiver with to; a receiver's signals
+// always go to the sender.
+func (room *P2PRoom) addSignal(peer, to string, sig P2PSignal) error {
+	if len(sig.Data) > maxSignalPayload {
+		return errSignalTooBig
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	sig.From, sig.Peer = roleOf(peer), peer
+	if peer == senderPeer {
+		if to != "" && room.receiverLocked(to) == nil {
+			return errUnknownPeer
+		}
+		sig.Peer = to
+	}
+	if len(room.Signals) >= maxRoomSignals || room.signalCount[sig.Peer] >= maxPeerSignals {
+		return errRoomFull
+	}
+	room.Signals = append(room.Signals, sig)
+	if room.signalCount == nil {
+		room.signalCount = make(map[string]int)
+	}
+	room.signalCount[sig.Peer]++
+	now := time.Now()
+	room.lastActive = now
+	if p := room.peer(peer); p != nil {
+		p.lastSeen = now
+	}
+	room.notifyLocked()
+	return nil
+}
+
+// pendingSignals returns a copy of the signals from index since onward,
+// the index of the first one, and a channel that is closed when the next
+// signal arrives or the room status changes.
+func (room *P2PRoom) pendingSignals(since int) ([]P2PSignal, int, <-chan struct{}) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	start := min(max(since, 0), len(room.Signals))
+	if room.changed == nil {
+		room.changed = make(chan struct{})
+	}
+	return append([]P2PSignal(nil), room.Signals[start:]...), start, room.changed
+}
+
+// signalsFor returns the signals from index since onward that are meant
+// for peer, the index to resume from, and a channel that is closed when
+// the next signal arrives.
+func (room *P2PRoom) signalsFor(peer string, since int) ([]P2PSignal, int, <-chan struct{}) {
+	pending, start, changed := room.pendingSignals(since)
+	var result []P2PSignal
+	for _, sig := range pending {
+		if visibleTo(sig, peer) {
+			result = append(result, sig)
+		}
+	}
+	return result, start + len(pending), changed
+}
+
+func tokenEqual(a, b string) bool {
+	return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// peerFor returns the peer ID a token belongs to in the room (senderPeer
+// or a receiver's ID), or "" if none.
+func (room *P2PRoom) peerFor(token string) string {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if tokenEqual(token, room.senderToken) {
+		return senderPeer
+	}
+	for _, rc := range room.receivers {
+		if tokenEqual(token, rc.token) {
+			return rc.id
 		}
-		p2pLock.Unlock()
 	}
+	return ""
+}
+
+var (
+	errRoomNotFound = errors.New("room not found")
+	errRoomToken    = errors.New("invalid room token")
+)
+
+// authorizeRoom looks up a room and the peer the token belongs to.
+func authorizeRoom(roomID, token string) (*P2PRoom, string, error) {
+	room, ok := lookupRoom(roomID)
+	if !ok {
+		return nil, "", errRoomNotFound
+	}
+	peer := room.peerFor(token)
+	if peer == "" {
+		return nil, "", errRoomToken
+	}
+	return room, peer, nil
+}
+
+// roomForRequest is authorizeRoom for HTTP handlers; on failure it has
+// already answered 404 or 403.
+func roomForRequest(w http.ResponseWriter, r *http.Request, roomID, token string) (*P2PRoom, string, bool) {
+	room, peer, err := authorizeRoom(roomID, token)
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		http.Error(w, err.Error(), 404)
+		return nil, "", false
+	case err != nil:
+		log.Printf("P2P room %s: rejected token from %s", roomID, network.ClientIP(r))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, "", false
+	}
+	room.addAddr(peer, network.ClientIP(r))
+	return room, peer, true
+}
+
+func lookupRoom(id string) (*P2PRoom, bool) {
+	p2pLock.RLock()
+	defer p2pLock.RUnlock()
+	room, ok := p2pRooms[id]
+	return room, ok
 }
 
 func generateRoomID() string {
@@ -56,33 +303,177 @@ func generateRoomID() string {
 	return hex.EncodeToString(b)
 }
 
-// HandleP2PCreate creates a new P2P signaling room.
+// HandleP2PCreate creates a new P2P signaling room. With receivers=N it
+// creates a broadcast room that admits up to N receivers. With code=digits
+// or code=words it also issues a short code for HandleP2PJoinCode.
 func HandleP2PCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
 		return
 	}
+	codeKind := r.URL.Query().Get("code")
+	if codeKind != "" && codeKind != codeDigits && codeKind != codeWords {
+		http.Error(w, "code must be digits or words", 400)
+		return
+	}
+	receivers := 1
+	if s := r.URL.Query().Get("receivers"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxRoomReceivers {
+			http.Error(w, fmt.Sprintf("receivers must be between 1 and %d", maxRoomReceivers), 400)
+			return
+		}
+		receivers = n
+	}
 
 	roomID := generateRoomID()
+	now := time.Now()
+	ip := network.ClientIP(r)
 	room := &P2PRoom{
-		ID:        roomID,
-		CreatedAt: time.Now(),
-		Signals:   make([]P2PSignal, 0),
+		ID:           roomID,
+		CreatedAt:    now,
+		CreatorIP:    ip,
+		Signals:      make([]P2PSignal, 0),
+		state:        stateWaiting,
+		sender:       peerPresence{joined: true, lastSeen: now, addrs: map[string]bool{ip: true}},
+		maxReceivers: receivers,
+		lastActive:   now,
+		done:         make(chan struct{}),
+		senderToken:  randomToken(16),
+		joinToken:    randomToken(16),
 	}
 
 	p2pLock.Lock()
+	if len(p2pRooms) >= maxP2PRooms {
+		p2pLock.Unlock()
+		log.Printf("P2P room limit (%d) reached; refusing create from %s", maxP2PRooms, ip)
+		http.Error(w, "too many open rooms, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if roomsCreatedByLocked(ip) >= maxRoomsPerIP {
+		p2pLock.Unlock()
+		log.Printf("P2P room limit per address (%d) reached; refusing create from %s", maxRoomsPerIP, ip)
+		http.Error(w, "too many open rooms from this address", http.StatusTooManyRequests)
+		return
+	}
 	p2pRooms[roomID] = room
 	p2pLock.Unlock()
 
+	resp := map[string]interface{}{
+		"room":  roomID,
+		"token": room.senderToken,
+		"join":  room.joinToken,
+	}
+	if receivers > 1 {
+		resp["receivers"] = receivers
+	}
+	if codeKind != "" {
+		code, expires, err := issueRoomCode(roomID, codeKind)
+		if err != nil {
+			removeRoom(roomID, roomClosed)
+			log.Printf("P2P room code: %v", err)
+			http.Error(w, "no room code available, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		resp["code"], resp["code_expires"] = code, expires
+	}
+
 	log.Printf("P2P room created: %s", roomID)
+	e := auditEntry(r, audit.ActionRoomCreate, "")
+	e.Target = roomID
+	record(e)
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]string{"room": roomID}); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding P2P create response: %v", err)
 	}
 }
 
-// HandleP2PSignal stores a signaling message in a room.
+// roomsCreatedByLocked counts the open rooms created from ip. Callers
+// hold p2pLock.
+func roomsCreatedByLocked(ip string) int {
+	n := 0
+	for _, room := range p2pRooms {
+		if room.CreatorIP == ip {
+			n++
+		}
+	}
+	return n
+}
+
+// HandleP2PJoin exchanges a room's join token for a receiver token and
+// peer ID. Once the room has all the receivers it was created for, it is
+// locked.
+func HandleP2PJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var req struct {
+		Room  string `json:"room"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	room, ok := lookupRoom(req.Room)
+	if !ok {
+		http.Error(w, "room not found", 404)
+		return
+	}
+
+	rc, ok := joinAsReceiver(w, r, room, req.Token)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"token": rc.token, "peer": rc.id}); err != nil {
+		log.Printf("Error encoding P2P join response: %v", err)
+	}
+}
+
+// joinAsReceiver exchanges joinToken for a new receiver of the room,
+// auditing the attempt. On failure it has already answered 403 or 409.
+func joinAsReceiver(w http.ResponseWriter, r *http.Request, room *P2PRoom, joinToken string) (*roomReceiver, bool) {
+	e := auditEntry(r, audit.ActionRoomJoin, "")
+	e.Target = room.ID
+	room.mu.Lock()
+	var rc *roomReceiver
+	status := http.StatusOK
+	switch {
+	case !tokenEqual(joinToken, room.joinToken):
+		status, e.Detail = http.StatusForbidden, "invalid join token"
+	case room.maxReceivers == 1 && len(room.receivers) > 0:
+		status, e.Detail = http.StatusConflict, "room already joined"
+	case len(room.receivers) >= room.maxReceivers:
+		status, e.Detail = http.StatusConflict, "room is full"
+	default:
+		rc = room.addReceiverLocked()
+		rc.peerPresence = peerPresence{joined: true, lastSeen: time.Now(), addrs: map[string]bool{e.ClientIP: true}}
+		room.lastActive = rc.lastSeen
+		if room.state == stateWaiting {
+			room.state = stateNegotiating
+		}
+		room.notifyLocked()
+	}
+	room.mu.Unlock()
+	if status != http.StatusOK {
+		e.Outcome = audit.OutcomeDenied
+		record(e)
+		log.Printf("P2P room %s: join refused from %s: %s", room.ID, e.ClientIP, e.Detail)
+		http.Error(w, e.Detail, status)
+		return nil, false
+	}
+	e.Detail = "peer " + rc.id
+	record(e)
+	log.Printf("P2P room joined: %s (peer %s)", room.ID, rc.id)
+	return rc, true
+}
+
+// HandleP2PSignal stores a signaling message in a room. Its origin is the
+// peer the token belongs to; the room's sender names the receiver it is
+// for with "to", or leaves it empty to address all receivers.
 func HandleP2PSignal(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
@@ -90,41 +481,56 @@ func HandleP2PSignal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Room string          `json:"room"`
-		From string          `json:"from"`
-		Type string          `json:"type"`
-		Data json.RawMessage `json:"data"`
+		Room  string          `json:"room"`
+		Token string          `json:"token"`
+		To    string          `json:"to"`
+		Type  string          `json:"type"`
+		Data  json.RawMessage `json:"data"`
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSignalPayload+1024)
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, errSignalTooBig.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "invalid json", 400)
 		return
 	}
 
-	p2pLock.RLock()
-	room, ok := p2pRooms[req.Room]
-	p2pLock.RUnlock()
-
+	room, peer, ok := roomForRequest(w, r, req.Room, req.Token)
 	if !ok {
-		http.Error(w, "room not found", 404)
 		return
 	}
 
-	room.mu.Lock()
-	room.Signals = append(room.Signals, P2PSignal{
-		From: req.From,
+	err := room.addSignal(peer, req.To, P2PSignal{
 		Type: req.Type,
 		Data: req.Data,
 	})
-	room.mu.Unlock()
+	switch {
+	case errors.Is(err, errSignalTooBig):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errUnknownPeer):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("P2P room %s: %v", req.Room, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
 
-	log.Printf("P2P signal [%s] %s from %s", req.Room, req.Type, req.From)
+	log.Printf("P2P signal [%s] %s from %s", req.Room, req.Type, peer)
 	w.WriteHeader(200)
 }
 
-// HandleP2PPoll returns new signals for a given role since a specific index.
+// HandleP2PPoll returns new signals for the token's peer since a specific
+// index, and the room status. With wait=<seconds> (at most 25) it holds the
+// request until a signal arrives, the status changes or the time is up, so
+// clients need not poll on a timer.
 func HandleP2PPoll(w http.ResponseWriter, r *http.Request) {
 	roomID := r.URL.Query().Get("room")
-	role := r.URL.Query().Get("role")
+	token := r.URL.Query().Get("token")
 	sinceStr := r.URL.Query().Get("since")
 
 	since := 0
@@ -133,31 +539,170 @@ func HandleP2PPoll(w http.ResponseWriter, r *http.Request) {
 			since = s
 		}
 	}
+	var wait time.Duration
+	if secs, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && secs > 0 {
+		wait = min(time.Duration(secs)*time.Second, maxP2PWait)
+	}
 
-	p2pLock.RLock()
-	room, ok := p2pRooms[roomID]
-	p2pLock.RUnlock()
-
+	room, peer, ok := roomForRequest(w, r, roomID, token)
 	if !ok {
-		http.Error(w, "room not found", 404)
 		return
 	}
+	room.seen(peer)
 
-	room.mu.Lock()
-	var result []P2PSignal
-	for i := since; i < len(room.Signals); i++ {
-		if room.Signals[i].From != role {
-			result = append(result, room.Signals[i])
+	if wait > 0 {
+		defer room.watch(peer)()
+	}
+	status := room.status(peer)
+	result, total, changed := room.signalsFor(peer, since)
+	if len(result) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+	waitLoop:
+		for len(result) == 0 {
+			select {
+			case <-changed:
+				if !room.hasPeer(peer) {
+					http.Error(w, "room "+roomRemoved, http.StatusGone)
+					return
+				}
+				result, total, changed = room.signalsFor(peer, since)
+				if now := room.status(peer); !now.sameAs(status) {
+					status = now
+					break waitLoop
+				}
+			case <-timer.C:
+				break waitLoop
+			case <-room.done:
+				http.Error(w, "room "+room.closedReason(), http.StatusGone)
+				return
+			case <-r.Context().Done():
+				return
+			}
 		}
 	}
-	total := len(room.Signals)
-	room.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]interface{}{
 		"signals": result,
 		"index":   total,
+		"status":  status,
 	}); err != nil {
 		log.Printf("Error encoding P2P poll response: %v", err)
 	}
 }
+
+// HandleP2PEvents streams a room's signals for the token's peer as server-sent
+// events the moment they are stored. Each event's id is the index to
+// resume from, so a reconnecting EventSource (which sends Last-Event-ID)
+// or a client passing since=<id> picks up where it left off. Status events
+// carry the room state and presence whenever they change.
+func HandleP2PEvents(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room")
+	token := r.URL.Query().Get("token")
+	since := 0
+	if s, err := strconv.Atoi(r.URL.Query().Get("since")); err == nil {
+		since = s
+	}
+	if s, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		since = s
+	}
+
+	room, peer, ok := roomForRequest(w, r, roomID, token)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	defer room.watch(peer)()
+	ping := time.NewTicker(p2pStreamPing)
+	defer ping.Stop()
+	var sent RoomStatus
+	for {
+		if !room.hasPeer(peer) {
+			msg, _ := json.Marshal(map[string]string{"reason": roomRemoved})
+			fmt.Fprintf(w, "event: room-closed\ndata: %s\n\n", msg)
+			flusher.Flush()
+			return
+		}
+		if status := room.status(peer); !status.sameAs(sent) {
+			sent = status
+			msg, _ := json.Marshal(status)
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", msg)
+		}
+		pending, start, changed := room.pendingSignals(since)
+		lastID := start
+		for i, sig := range pending {
+			if !visibleTo(sig, peer) {
+				continue
+			}
+			lastID = start + i + 1
+			msg, _ := json.Marshal(sig)
+			fmt.Fprintf(w, "id: %d\nevent: signal\ndata: %s\n\n", lastID, msg)
+		}
+		if end := start + len(pending); end > lastID {
+			// An id-only event moves Last-Event-ID past signals not for us.
+			fmt.Fprintf(w, "id: %d\n\n", end)
+		}
+		since = start + len(pending)
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-ping.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		case <-room.done:
+			msg, _ := json.Marshal(map[string]string{"reason": room.closedReason()})
+			fmt.Fprintf(w, "event: room-closed\ndata: %s\n\n", msg)
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// HandleP2PRoom serves /api/p2p/rooms/{id} for any peer, which proves
+// who it is with the X-Room-Token header: GET returns the room status,
+// POST reports a state change (see handleRoomState) and DELETE ends the
+// peer's part in the room (see closeRoomAs). The sender removes a
+// receiver with DELETE /api/p2p/rooms/{id}/peers/{peer}, and
+// /api/p2p/rooms/{id}/pipe streams a file through the server (see
+// handleRoomPipe).
+func HandleP2PRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/p2p/rooms/")
+	roomID, isPipe := strings.CutSuffix(path, "/pipe")
+	roomID, target, isPeer := strings.Cut(roomID, "/peers/")
+	room, peer, ok := roomForRequest(w, r, roomID, r.Header.Get("X-Room-Token"))
+	if !ok {
+		return
+	}
+	if isPipe && !isPeer {
+		handleRoomPipe(w, r, room, peer)
+		return
+	}
+	if isPeer {
+		handleRoomPeer(w, r, room, peer, target)
+		return
+	}
+	if r.Method != "DELETE" {
+		handleRoomState(w, r, room, peer)
+		return
+	}
+	closeRoomAs(room, peer)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,13 +1,64 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+// testRoom is a P2P room with the tokens of both roles.
+type testRoom struct {
+	ID, Sender, Join, Receiver string
+}
+
+// createRoom makes a P2P room and joins it as the receiver.
+func createRoom(t *testing.T) testRoom {
+	t.Helper()
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create", nil))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	room := testRoom{ID: resp["room"], Sender: resp["token"], Join: resp["join"]}
+	w = joinRoom(room.ID, room.Join)
+	if w.Code != http.StatusOK {
+		t.Fatalf("join: expected 200, got %d", w.Code)
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	room.Receiver = resp["token"]
+	return room
+}
+
+func joinRoom(roomID, token string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"room": roomID, "token": token})
+	w := httptest.NewRecorder()
+	HandleP2PJoin(w, httptest.NewRequest("POST", "/api/p2p/join", bytes.NewReader(body)))
+	return w
+}
+
+// sendSignal posts a signal to a room with a role's token.
+func sendSignal(t *testing.T, room, token, typ string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"room": room, "token": token, "type": typ, "data": map[string]string{}})
+	w := httptest.NewRecorder()
+	HandleP2PSignal(w, httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("signal: expected 200, got %d", w.Code)
+	}
+}
+
 func TestHandleP2PCreate(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/p2p/create", nil)
 	w := httptest.NewRecorder()
@@ -44,21 +95,15 @@ func TestHandleP2PCreate_WrongMethod(t *testing.T) {
 }
 
 func TestHandleP2PSignal_Success(t *testing.T) {
-	// First create a room
-	createReq := httptest.NewRequest("POST", "/api/p2p/create", nil)
-	cw := httptest.NewRecorder()
-	HandleP2PCreate(cw, createReq)
+	room := createRoom(t)
 
-	var createResp map[string]string
-	json.NewDecoder(cw.Body).Decode(&createResp)
-	roomID := createResp["room"]
-
-	// Now signal to it
+	// The role comes from the token; a claimed "from" is ignored.
 	signalBody := map[string]interface{}{
-		"room": roomID,
-		"from": "sender",
-		"type": "offer",
-		"data": map[string]string{"test": "value"},
+		"room":  room.ID,
+		"token": room.Sender,
+		"from":  "receiver",
+		"type":  "offer",
+		"data":  map[string]string{"test": "value"},
 	}
 	body, _ := json.Marshal(signalBody)
 	req := httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewBuffer(body))
@@ -70,14 +115,59 @@ func TestHandleP2PSignal_Success(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
+	r, _ := lookupRoom(room.ID)
+	if sigs, _, _ := r.signalsFor("receiver", 0); len(sigs) != 1 || sigs[0].From != "sender" {
+		t.Errorf("expected one signal from the sender, got %+v", sigs)
+	}
+}
+
+func TestHandleP2PSignal_BadToken(t *testing.T) {
+	room := createRoom(t)
+	for _, token := range []string{"", "guess", room.Join} {
+		body, _ := json.Marshal(map[string]interface{}{"room": room.ID, "token": token, "type": "offer"})
+		w := httptest.NewRecorder()
+		HandleP2PSignal(w, httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewReader(body)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("token %q: expected 403, got %d", token, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	HandleP2PPoll(w, httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token=guess", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("poll: expected 403, got %d", w.Code)
+	}
+}
+
+func TestHandleP2PJoin(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create", nil))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["token"] == "" || resp["join"] == "" || resp["token"] == resp["join"] {
+		t.Fatalf("expected distinct sender and join tokens, got %v", resp)
+	}
+
+	if w := joinRoom(resp["room"], "guess"); w.Code != http.StatusForbidden {
+		t.Errorf("wrong join token: expected 403, got %d", w.Code)
+	}
+	if w := joinRoom(resp["room"], resp["join"]); w.Code != http.StatusOK {
+		t.Fatalf("join: expected 200, got %d", w.Code)
+	}
+	// The room is locked to the first receiver.
+	if w := joinRoom(resp["room"], resp["join"]); w.Code != http.StatusConflict {
+		t.Errorf("second join: expected 409, got %d", w.Code)
+	}
+	if w := joinRoom("nonexistent", resp["join"]); w.Code != http.StatusNotFound {
+		t.Errorf("unknown room: expected 404, got %d", w.Code)
+	}
 }
 
 func TestHandleP2PSignal_RoomNotFound(t *testing.T) {
 	signalBody := map[string]interface{}{
-		"room": "nonexistent",
-		"from": "sender",
-		"type": "offer",
-		"data": map[string]string{"test": "value"},
+		"room":  "nonexistent",
+		"token": "x",
+		"type":  "offer",
+		"data":  map[string]string{"test": "value"},
 	}
 	body, _ := json.Marshal(signalBody)
 	req := httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewBuffer(body))
@@ -92,7 +182,7 @@ func TestHandleP2PSignal_RoomNotFound(t *testing.T) {
 }
 
 func TestHandleP2PPoll_RoomNotFound(t *testing.T) {
-	req := httptest.NewRequest("GET", "/api/p2p/poll?room=nonexistent&role=sender&since=0", nil)
+	req := httptest.NewRequest("GET", "/api/p2p/poll?room=nonexistent&token=x&since=0", nil)
 	w := httptest.NewRecorder()
 
 	HandleP2PPoll(w, req)
@@ -103,17 +193,10 @@ func TestHandleP2PPoll_RoomNotFound(t *testing.T) {
 }
 
 func TestHandleP2PPoll_Success(t *testing.T) {
-	// Create a room first
-	createReq := httptest.NewRequest("POST", "/api/p2p/create", nil)
-	cw := httptest.NewRecorder()
-	HandleP2PCreate(cw, createReq)
-
-	var createResp map[string]string
-	json.NewDecoder(cw.Body).Decode(&createResp)
-	roomID := createResp["room"]
+	room := createRoom(t)
 
 	// Poll it
-	req := httptest.NewRequest("GET", "/api/p2p/poll?room="+roomID+"&role=sender&since=0", nil)
+	req := httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token="+room.Sender+"&since=0", nil)
 	w := httptest.NewRecorder()
 
 	HandleP2PPoll(w, req)
@@ -130,3 +213,1008 @@ func TestHandleP2PPoll_Success(t *testing.T) {
 		t.Error("expected index field in response")
 	}
 }
+
+func TestHandleP2PPoll_Wait(t *testing.T) {
+	room := createRoom(t)
+
+	done := make(chan map[string]interface{})
+	go func() {
+		req := httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token="+room.Receiver+"&since=0&wait=5", nil)
+		w := httptest.NewRecorder()
+		HandleP2PPoll(w, req)
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		done <- resp
+	}()
+
+	// The sender's own signals do not end the wait; the offer does.
+	time.Sleep(50 * time.Millisecond)
+	sendSignal(t, room.ID, room.Receiver, "candidate")
+	sendSignal(t, room.ID, room.Sender, "offer")
+
+	select {
+	case resp := <-done:
+		signals, _ := resp["signals"].([]interface{})
+		if len(signals) != 1 || resp["index"] != float64(2) {
+			t.Errorf("expected the offer and index 2, got %v", resp)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long-poll was not woken by the signal")
+	}
+}
+
+func TestHandleP2PEvents_StreamAndResume(t *testing.T) {
+	room := createRoom(t)
+	sendSignal(t, room.ID, room.Sender, "offer")
+	sendSignal(t, room.ID, room.Receiver, "answer")
+
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PEvents))
+	defer srv.Close()
+
+	// readEvents collects id/event pairs until n signal events arrive.
+	readEvents := func(lastID string, n int) []string {
+		req, _ := http.NewRequest("GET", srv.URL+"?room="+room.ID+"&token="+room.Sender, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		var got []string
+		id, event := "", ""
+		sc := bufio.NewScanner(resp.Body)
+		for len(got) < n && sc.Scan() {
+			line := sc.Text()
+			if v, ok := strings.CutPrefix(line, "id: "); ok {
+				id = v
+			}
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				event = v
+			}
+			if strings.HasPrefix(line, "data: ") && event == "signal" {
+				var sig P2PSignal
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &sig)
+				got = append(got, id+":"+sig.Type)
+			}
+		}
+		return got
+	}
+
+	// The existing answer is replayed (the sender's own offer is skipped),
+	// then a new candidate is pushed as soon as it is stored.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sendSignal(t, room.ID, room.Receiver, "candidate")
+	}()
+	if got := strings.Join(readEvents("", 2), ","); got != "2:answer,3:candidate" {
+		t.Errorf("stream: got %s", got)
+	}
+
+	// Resuming from Last-Event-ID skips what was already seen.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sendSignal(t, room.ID, room.Receiver, "bye")
+	}()
+	if got := strings.Join(readEvents("3", 1), ","); got != "4:bye" {
+		t.Errorf("resume: got %s", got)
+	}
+}
+
+func TestHandleP2PEvents_RoomNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleP2PEvents(w, httptest.NewRequest("GET", "/api/p2p/events?room=nonexistent&token=x", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func deleteRoom(roomID, token string) int {
+	req := httptest.NewRequest("DELETE", "/api/p2p/rooms/"+roomID, nil)
+	req.Header.Set("X-Room-Token", token)
+	w := httptest.NewRecorder()
+	HandleP2PRoom(w, req)
+	return w.Code
+}
+
+func TestHandleP2PRoom_Close(t *testing.T) {
+	room := createRoom(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PEvents))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?room=" + room.ID + "&token=" + room.Receiver)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// A long-poll waiting on the room is woken too.
+	polled := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		HandleP2PPoll(w, httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token="+room.Sender+"&wait=5", nil))
+		polled <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if code := deleteRoom(room.ID, "guess"); code != http.StatusForbidden {
+		t.Errorf("wrong token: expected 403, got %d", code)
+	}
+	if code := deleteRoom(room.ID, room.Sender); code != http.StatusNoContent {
+		t.Fatalf("close: expected 204, got %d", code)
+	}
+
+	// Status events come first; read until the room-closed event.
+	var event, data string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+			event = v
+		}
+		if v, ok := strings.CutPrefix(sc.Text(), "data: "); ok && event == "room-closed" {
+			data = v
+			break
+		}
+	}
+	if event != "room-closed" || data != `{"reason":"closed"}` {
+		t.Errorf("expected room-closed event, got %q %q", event, data)
+	}
+	if code := <-polled; code != http.StatusGone {
+		t.Errorf("waiting poll: expected 410, got %d", code)
+	}
+	if _, ok := lookupRoom(room.ID); ok {
+		t.Error("room still exists after close")
+	}
+}
+
+func TestP2PRoom_Limits(t *testing.T) {
+	room := createRoom(t)
+
+	big, _ := json.Marshal(map[string]interface{}{
+		"room": room.ID, "token": room.Sender, "type": "offer", "data": strings.Repeat("x", maxSignalPayload+1),
+	})
+	w := httptest.NewRecorder()
+	HandleP2PSignal(w, httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewReader(big)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized signal: expected 413, got %d", w.Code)
+	}
+
+	r, _ := lookupRoom(room.ID)
+	for i := 0; i < maxPeerSignals; i++ {
+		r.addSignal(senderPeer, "", P2PSignal{Type: "ice-candidate"})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"room": room.ID, "token": room.Sender, "type": "offer"})
+	w = httptest.NewRecorder()
+	HandleP2PSignal(w, httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewReader(body)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("full budget: expected 429, got %d", w.Code)
+	}
+	// Each receiver has a budget of its own.
+	sendSignal(t, room.ID, room.Receiver, "answer")
+}
+
+func TestHandleP2PCreate_RoomLimit(t *testing.T) {
+	p2pLock.RLock()
+	n := len(p2pRooms)
+	p2pLock.RUnlock()
+	SetMaxRooms(n)
+	defer SetMaxRooms(0)
+
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 at the room limit, got %d", w.Code)
+	}
+}
+
+func TestHandleP2PCreate_RoomLimitPerIP(t *testing.T) {
+	create := func(addr string) int {
+		req := httptest.NewRequest("POST", "/api/p2p/create", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		HandleP2PCreate(w, req)
+		if w.Code == http.StatusOK {
+			var resp map[string]string
+			json.NewDecoder(w.Body).Decode(&resp)
+			t.Cleanup(func() { removeRoom(resp["room"], roomClosed) })
+		}
+		return w.Code
+	}
+	for i := 0; i < maxRoomsPerIP; i++ {
+		if code := create("198.51.100.7:4000"); code != http.StatusOK {
+			t.Fatalf("room %d: expected 200, got %d", i, code)
+		}
+	}
+	if code := create("198.51.100.7:4001"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the per-address limit, got %d", code)
+	}
+	if code := create("198.51.100.8:4000"); code != http.StatusOK {
+		t.Errorf("another address: expected 200, got %d", code)
+	}
+}
+
+func TestExpireIdleRooms(t *testing.T) {
+	idle, watched, old := createRoom(t), createRoom(t), createRoom(t)
+	for _, id := range []string{idle.ID, watched.ID} {
+		r, _ := lookupRoom(id)
+		r.mu.Lock()
+		r.lastActive = time.Now().Add(-2 * p2pIdleTimeout)
+		r.mu.Unlock()
+	}
+	w, _ := lookupRoom(watched.ID)
+	unwatch := w.watch("sender")
+	defer unwatch()
+	o, _ := lookupRoom(old.ID)
+	o.CreatedAt = time.Now().Add(-p2pMaxRoomAge - time.Minute)
+	defer o.watch("sender")()
+
+	expireIdleRooms()
+	if _, ok := lookupRoom(idle.ID); ok {
+		t.Error("idle room was not expired")
+	}
+	if _, ok := lookupRoom(watched.ID); !ok {
+		t.Error("watched room expired")
+	}
+	if _, ok := lookupRoom(old.ID); ok {
+		t.Error("watched room past its lifetime was not expired")
+	}
+}
+
+func roomRequest(method, roomID, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/p2p/rooms/"+roomID, strings.NewReader(body))
+	req.Header.Set("X-Room-Token", token)
+	w := httptest.NewRecorder()
+	HandleP2PRoom(w, req)
+	return w
+}
+
+func TestHandleP2PRoom_Status(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create", nil))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+	roomID, sender := created["room"], created["token"]
+
+	status := func() RoomStatus {
+		t.Helper()
+		w := roomRequest("GET", roomID, sender, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status: expected 200, got %d", w.Code)
+		}
+		var s RoomStatus
+		json.NewDecoder(w.Body).Decode(&s)
+		return s
+	}
+	if s := status(); s.State != stateWaiting || s.Sender.Status != presenceOnline || s.Receiver.Status != presenceAbsent {
+		t.Errorf("new room: got %+v", s)
+	}
+
+	joinRoom(roomID, created["join"])
+	if s := status(); s.State != stateNegotiating || s.Receiver.Status != presenceOnline {
+		t.Errorf("after join: got %+v", s)
+	}
+
+	// A peer that stops listening shows as disconnected after the grace period.
+	r, _ := lookupRoom(roomID)
+	r.mu.Lock()
+	r.receivers[0].lastSeen = time.Now().Add(-2 * p2pPresenceGrace)
+	r.mu.Unlock()
+	if s := status(); s.Receiver.Status != presenceDisconnected {
+		t.Errorf("idle receiver: got %+v", s)
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"state":"negotiating"}`, http.StatusBadRequest},
+		{`{"state":"connected"}`, http.StatusOK},
+		{`{"state":"done"}`, http.StatusOK},
+		{`{"state":"connected"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if w := roomRequest("POST", roomID, sender, tt.body); w.Code != tt.code {
+			t.Errorf("POST %s: expected %d, got %d", tt.body, tt.code, w.Code)
+		}
+	}
+	if s := status(); s.State != stateDone {
+		t.Errorf("expected done, got %+v", s)
+	}
+}
+
+func TestHandleP2PPoll_WokenByStatus(t *testing.T) {
+	room := createRoom(t)
+
+	done := make(chan map[string]interface{})
+	go func() {
+		w := httptest.NewRecorder()
+		HandleP2PPoll(w, httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token="+room.Sender+"&wait=5", nil))
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		done <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	roomRequest("POST", room.ID, room.Receiver, `{"state":"connected"}`)
+
+	select {
+	case resp := <-done:
+		status, _ := resp["status"].(map[string]interface{})
+		if status["state"] != stateConnected {
+			t.Errorf("expected the connected state, got %v", resp)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long-poll was not woken by the state change")
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"482913", "482913"},
+		{" 482 913 ", "482913"},
+		{"482-913", "482913"},
+		{"Calm Witty Otter", "calm-witty-otter"},
+		{"calm_witty-OTTER", "calm-witty-otter"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeCode(tt.in); got != tt.want {
+			t.Errorf("normalizeCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func joinByCode(code, remoteAddr string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"code": code})
+	req := httptest.NewRequest("POST", "/api/p2p/join-code", bytes.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	HandleP2PJoinCode(w, req)
+	return w
+}
+
+func TestHandleP2PJoinCode(t *testing.T) {
+	tests := []struct {
+		kind    string
+		pattern string
+		format  func(string) string // how a user might type it back
+	}{
+		{codeDigits, `^[0-9]{6}$`, func(c string) string { return c[:3] + " " + c[3:] }},
+		{codeWords, `^[a-z]+-[a-z]+-[a-z]+$`, func(c string) string { return strings.ToUpper(strings.ReplaceAll(c, "-", " ")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?code="+tt.kind, nil))
+			var created map[string]string
+			json.NewDecoder(w.Body).Decode(&created)
+			if !regexp.MustCompile(tt.pattern).MatchString(created["code"]) {
+				t.Fatalf("unexpected %s code %q", tt.kind, created["code"])
+			}
+
+			w = joinByCode(tt.format(created["code"]), "198.51.100.1:1000")
+			if w.Code != http.StatusOK {
+				t.Fatalf("join by code: expected 200, got %d", w.Code)
+			}
+			var joined map[string]string
+			json.NewDecoder(w.Body).Decode(&joined)
+			r, _ := lookupRoom(created["room"])
+			if joined["room"] != created["room"] || r.peerFor(joined["token"]) != joined["peer"] {
+				t.Errorf("code resolved to %v", joined)
+			}
+
+			// Codes are single-use.
+			if w := joinByCode(created["code"], "198.51.100.1:1000"); w.Code != http.StatusNotFound {
+				t.Errorf("reused code: expected 404, got %d", w.Code)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?code=emoji", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown code kind: expected 400, got %d", w.Code)
+	}
+}
+
+func TestHandleP2PJoinCode_BruteForce(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?code=digits", nil))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+
+	const attacker = "203.0.113.66:4000"
+	for i := 0; i < maxCodeFailures; i++ {
+		if w := joinByCode("wrong-code", attacker); w.Code != http.StatusNotFound {
+			t.Fatalf("attempt %d: expected 404, got %d", i, w.Code)
+		}
+	}
+	// Locked out, even with the right code, which stays usable by others.
+	if w := joinByCode(created["code"], attacker); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after %d failures, got %d", maxCodeFailures, w.Code)
+	}
+	if w := joinByCode(created["code"], "198.51.100.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("other client: expected 200, got %d", w.Code)
+	}
+
+	// An IPv6 client is locked out across its whole /64.
+	for i := 0; i < maxCodeFailures; i++ {
+		joinByCode("wrong-code", fmt.Sprintf("[2001:db8:1:2::%x]:4000", i+1))
+	}
+	if w := joinByCode("wrong-code", "[2001:db8:1:2:ffff::1]:4000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same /64: expected 429, got %d", w.Code)
+	}
+	if w := joinByCode("wrong-code", "[2001:db8:1:3::1]:4000"); w.Code != http.StatusNotFound {
+		t.Errorf("other /64: expected 404, got %d", w.Code)
+	}
+}
+
+func TestHandleP2PJoinCode_GlobalLimit(t *testing.T) {
+	codeMu.Lock()
+	saved := globalFailures
+	globalFailures = codeFailures{}
+	codeMu.Unlock()
+	defer func() {
+		codeMu.Lock()
+		globalFailures = saved
+		codeMu.Unlock()
+	}()
+
+	// Each guess comes from a fresh address, so no client is locked out.
+	for i := 0; i < maxGlobalCodeFailures; i++ {
+		if w := joinByCode("wrong-code", fmt.Sprintf("10.77.%d.%d:4000", i/250, i%250+1)); w.Code != http.StatusNotFound {
+			t.Fatalf("attempt %d: expected 404, got %d", i, w.Code)
+		}
+	}
+	if w := joinByCode("wrong-code", "10.78.0.1:4000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after %d failures server-wide, got %d", maxGlobalCodeFailures, w.Code)
+	}
+}
+
+func TestCodeWordList(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, w := range codeWordList {
+		if seen[w] || normalizeCode(w) != w || strings.Trim(w, "abcdefghijklmnopqrstuvwxyz") != "" {
+			t.Errorf("bad or duplicate code word %q", w)
+		}
+		seen[w] = true
+	}
+	if len(seen) < 256 {
+		t.Errorf("expected at least 256 code words, got %d", len(seen))
+	}
+}
+
+// pollSignals returns the signals a token's peer sees in a room.
+func pollSignals(t *testing.T, room, token string) []P2PSignal {
+	t.Helper()
+	w := httptest.NewRecorder()
+	HandleP2PPoll(w, httptest.NewRequest("GET", "/api/p2p/poll?room="+room+"&token="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("poll: expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Signals []P2PSignal `json:"signals"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Signals
+}
+
+func TestP2PBroadcastRoom(t *testing.T) {
+	for _, n := range []string{"0", "11", "x"} {
+		w := httptest.NewRecorder()
+		HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?receivers="+n, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("receivers=%s: expected 400, got %d", n, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?receivers=2", nil))
+	var created struct {
+		Room, Token, Join string
+		Receivers         int
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Receivers != 2 {
+		t.Fatalf("expected receivers=2 in the response, got %d", created.Receivers)
+	}
+
+	type receiver struct{ Token, Peer string }
+	join := func() receiver {
+		t.Helper()
+		w := joinRoom(created.Room, created.Join)
+		if w.Code != http.StatusOK {
+			t.Fatalf("join: expected 200, got %d", w.Code)
+		}
+		var rc receiver
+		json.NewDecoder(w.Body).Decode(&rc)
+		return rc
+	}
+	a, b := join(), join()
+	if a.Peer == "" || a.Peer == b.Peer || a.Token == b.Token {
+		t.Fatalf("receivers not distinct: %+v %+v", a, b)
+	}
+	if w := joinRoom(created.Room, created.Join); w.Code != http.StatusConflict {
+		t.Errorf("third receiver: expected 409, got %d", w.Code)
+	}
+
+	signal := func(token, to, typ string) int {
+		body, _ := json.Marshal(map[string]interface{}{"room": created.Room, "token": token, "to": to, "type": typ, "data": map[string]string{}})
+		w := httptest.NewRecorder()
+		HandleP2PSignal(w, httptest.NewRequest("POST", "/api/p2p/signal", bytes.NewReader(body)))
+		return w.Code
+	}
+	signal(created.Token, a.Peer, "offer-a")
+	signal(created.Token, b.Peer, "offer-b")
+	signal(created.Token, "", "hello-all")
+	signal(a.Token, "", "answer-a")
+	signal(b.Token, a.Peer, "answer-b") // a receiver's "to" is ignored
+	if code := signal(created.Token, "nobody", "offer"); code != http.StatusNotFound {
+		t.Errorf("signal to unknown peer: expected 404, got %d", code)
+	}
+
+	types := func(sigs []P2PSignal) string {
+		var s []string
+		for _, sig := range sigs {
+			s = append(s, sig.Type+"@"+sig.Peer)
+		}
+		return strings.Join(s, " ")
+	}
+	tests := []struct {
+		name, token, want string
+	}{
+		{"receiver a", a.Token, "offer-a@" + a.Peer + " hello-all@"},
+		{"receiver b", b.Token, "offer-b@" + b.Peer + " hello-all@"},
+		{"sender", created.Token, "answer-a@" + a.Peer + " answer-b@" + b.Peer},
+	}
+	for _, tt := range tests {
+		if got := types(pollSignals(t, created.Room, tt.token)); got != tt.want {
+			t.Errorf("%s sees %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	var s RoomStatus
+	json.NewDecoder(roomRequest("GET", created.Room, created.Token, "").Body).Decode(&s)
+	if len(s.Receivers) != 2 || s.Receivers[0].ID != a.Peer || s.Receivers[1].ID != b.Peer || s.Receiver.Status != presenceOnline {
+		t.Errorf("sender status: got %+v", s)
+	}
+	var own RoomStatus
+	json.NewDecoder(roomRequest("GET", created.Room, a.Token, "").Body).Decode(&own)
+	if len(own.Receivers) != 0 || own.Receiver.Status != presenceOnline {
+		t.Errorf("receivers must see only themselves, got %+v", own)
+	}
+
+	// One receiver finishing does not end the broadcast.
+	roomRequest("POST", created.Room, a.Token, `{"state":"connected"}`)
+	roomRequest("POST", created.Room, a.Token, `{"state":"done"}`)
+	if r, _ := lookupRoom(created.Room); r.status(senderPeer).State != stateConnected {
+		t.Error("a receiver's done ended the broadcast room")
+	}
+}
+
+func TestP2PBroadcastRoom_RemoveReceiver(t *testing.T) {
+	room := createRoom(t)
+	r, _ := lookupRoom(room.ID)
+	peer := r.peerFor(room.Receiver)
+	sendSignal(t, room.ID, room.Receiver, "answer")
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		HandleP2PPoll(w, httptest.NewRequest("GET", "/api/p2p/poll?room="+room.ID+"&token="+room.Receiver+"&wait=5", nil))
+		done <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tests := []struct {
+		name, token, peer string
+		code              int
+	}{
+		{"receiver cannot remove", room.Receiver, peer, http.StatusForbidden},
+		{"unknown peer", room.Sender, "nobody", http.StatusNotFound},
+		{"sender removes", room.Sender, peer, http.StatusOK},
+		{"already removed", room.Sender, peer, http.StatusNotFound},
+	}
+	var newJoin string
+	for _, tt := range tests {
+		req := httptest.NewRequest("DELETE", "/api/p2p/rooms/"+room.ID+"/peers/"+tt.peer, nil)
+		req.Header.Set("X-Room-Token", tt.token)
+		w := httptest.NewRecorder()
+		HandleP2PRoom(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, w.Code)
+		}
+		if w.Code == http.StatusOK {
+			var resp map[string]string
+			json.NewDecoder(w.Body).Decode(&resp)
+			newJoin = resp["join"]
+		}
+	}
+
+	select {
+	case code := <-done:
+		if code != http.StatusGone {
+			t.Errorf("removed receiver's poll: expected 410, got %d", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("removed receiver's poll was not ended")
+	}
+	if w := roomRequest("GET", room.ID, room.Receiver, ""); w.Code != http.StatusForbidden {
+		t.Errorf("removed receiver's token: expected 403, got %d", w.Code)
+	}
+	if sigs := pollSignals(t, room.ID, room.Sender); len(sigs) != 0 {
+		t.Errorf("removed receiver's signals still delivered: %+v", sigs)
+	}
+	// The old link no longer admits anyone; the rotated one fills the
+	// freed place.
+	if w := joinRoom(room.ID, room.Join); w.Code != http.StatusForbidden {
+		t.Errorf("rejoin with the old link: expected 403, got %d", w.Code)
+	}
+	if newJoin == "" || newJoin == room.Join {
+		t.Fatalf("expected a rotated join token, got %q", newJoin)
+	}
+	if w := joinRoom(room.ID, newJoin); w.Code != http.StatusOK {
+		t.Errorf("join with the new link: expected 200, got %d", w.Code)
+	}
+}
+
+func TestHandleP2PRoom_ReceiverLeaves(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleP2PCreate(w, httptest.NewRequest("POST", "/api/p2p/create?receivers=3", nil))
+	var created struct{ Room, Token, Join string }
+	json.NewDecoder(w.Body).Decode(&created)
+	var a, b struct{ Token, Peer string }
+	json.NewDecoder(joinRoom(created.Room, created.Join).Body).Decode(&a)
+	json.NewDecoder(joinRoom(created.Room, created.Join).Body).Decode(&b)
+
+	// A receiver's close only takes that receiver out of the room.
+	if code := deleteRoom(created.Room, a.Token); code != http.StatusNoContent {
+		t.Fatalf("receiver close: expected 204, got %d", code)
+	}
+	r, ok := lookupRoom(created.Room)
+	if !ok {
+		t.Fatal("a receiver's close removed the room")
+	}
+	if r.hasPeer(a.Peer) || !r.hasPeer(b.Peer) {
+		t.Errorf("expected only %s to leave", a.Peer)
+	}
+
+	// Over the WebSocket too.
+	srv := newWSServer(t)
+	c := wsDial(t, srv, "")
+	c.send(wsMessage{Type: "close", Room: created.Room, Token: b.Token})
+	for deadline := time.Now().Add(2 * time.Second); r.hasPeer(b.Peer); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("receiver's WebSocket close did not remove it")
+		}
+	}
+	if _, ok := lookupRoom(created.Room); !ok {
+		t.Fatal("a receiver's WebSocket close removed the room")
+	}
+
+	if code := deleteRoom(created.Room, created.Token); code != http.StatusNoContent {
+		t.Fatalf("sender close: expected 204, got %d", code)
+	}
+	if _, ok := lookupRoom(created.Room); ok {
+		t.Error("the sender's close kept the room")
+	}
+}
+
+func TestHandleP2PConfig(t *testing.T) {
+	t.Cleanup(func() { SetICEConfig(0, false) })
+	tests := []struct {
+		name   string
+		port   int
+		public bool
+		host   string
+		want   string // URLs of all servers, space-separated
+	}{
+		{"offline, no STUN", 0, false, "192.168.1.5:8080", ""},
+		{"built-in STUN", 3478, false, "192.168.1.5:8080", "stun:192.168.1.5:3478"},
+		{"IPv6 host", 3478, false, "[fd00::5]:8080", "stun:[fd00::5]:3478"},
+		{"IPv6 host without port", 3478, false, "[fe80::1]", "stun:[fe80::1]:3478"},
+		{"public opt-in", 0, true, "share.local", strings.Join(publicSTUNServers, " ")},
+		{"both", 3479, true, "share.local", "stun:share.local:3479 " + strings.Join(publicSTUNServers, " ")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetICEConfig(tt.port, tt.public)
+			req := httptest.NewRequest("GET", "/api/p2p/config", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			HandleP2PConfig(w, req)
+			var resp struct {
+				ICEServers []struct {
+					URLs []string `json:"urls"`
+				} `json:"ice_servers"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.ICEServers == nil {
+				t.Fatalf("bad response %v (ice_servers must be a list)", err)
+			}
+			var urls []string
+			for _, s := range resp.ICEServers {
+				urls = append(urls, s.URLs...)
+			}
+			if got := strings.Join(urls, " "); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleP2PConfig_TURN(t *testing.T) {
+	SetTURN(3478, []byte("secret"))
+	t.Cleanup(func() { SetTURN(0, nil) })
+	room := createRoom(t)
+
+	config := func(roomID, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/p2p/config?room="+roomID, nil)
+		req.Host = "192.168.1.5:8080"
+		req.RemoteAddr = "192.168.1.30:5000"
+		req.Header.Set("X-Room-Token", token)
+		w := httptest.NewRecorder()
+		HandleP2PConfig(w, req)
+		return w
+	}
+	if w := config(room.ID, "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("bad token: expected 403, got %d", w.Code)
+	}
+	if w := config("nonexistent", room.Sender); w.Code != http.StatusNotFound {
+		t.Errorf("unknown room: expected 404, got %d", w.Code)
+	}
+
+	w := config(room.ID, room.Receiver)
+	var resp struct {
+		ICEServers []iceServer `json:"ice_servers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.ICEServers) == 0 {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+	relay := resp.ICEServers[0]
+	if strings.Join(relay.URLs, " ") != "turn:192.168.1.5:3478?transport=udp" {
+		t.Errorf("TURN URLs = %v", relay.URLs)
+	}
+	if !strings.HasSuffix(relay.Username, ":"+room.ID) || relay.Credential == "" {
+		t.Errorf("credentials %q / %q are not for room %s", relay.Username, relay.Credential, room.ID)
+	}
+	if !TURNAuthorize(room.ID) || TURNAuthorize("nonexistent") {
+		t.Error("TURNAuthorize should accept open rooms only")
+	}
+
+	// The relay may only reach addresses the room's peers have used.
+	peers := []struct {
+		room string
+		ip   string
+		want bool
+	}{
+		{room.ID, "192.0.2.1", true},    // created and joined from here
+		{room.ID, "192.168.1.30", true}, // fetched the config from here
+		{room.ID, "203.0.113.7", false},
+		{"nonexistent", "192.0.2.1", false},
+	}
+	for _, tt := range peers {
+		if got := TURNPeerAllowed(tt.room, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("TURNPeerAllowed(%s, %s) = %v, want %v", tt.room, tt.ip, got, tt.want)
+		}
+	}
+
+	// Relayed data shows in the room status of both peers.
+	TURNRelayed(room.ID, 1000)
+	TURNRelayed(room.ID, 500)
+	for _, token := range []string{room.Sender, room.Receiver} {
+		var status RoomStatus
+		json.NewDecoder(roomRequest("GET", room.ID, token, "").Body).Decode(&status)
+		if !status.Relayed || status.RelayedBytes != 1500 {
+			t.Errorf("status %+v: expected 1500 relayed bytes", status)
+		}
+	}
+}
+
+// pipeRequest makes a request to a room's pipe on srv with a role's token.
+func pipeRequest(t *testing.T, srv *httptest.Server, method, roomID, token string, body io.Reader) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+"/api/p2p/rooms/"+roomID+"/pipe", body)
+	req.Header.Set("X-Room-Token", token)
+	req.Header.Set("X-File-Name", url.PathEscape("notes for you.txt"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s pipe: %v", method, err)
+	}
+	return resp
+}
+
+func TestHandleP2PRoom_Pipe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PRoom))
+	defer srv.Close()
+	room := createRoom(t)
+	data := bytes.Repeat([]byte("relayed through the server\n"), 40000) // ~1 MiB, more than the buffer
+
+	// The receiver connects first and waits for the sender.
+	got := make(chan *http.Response)
+	go func() { got <- pipeRequest(t, srv, "GET", room.ID, room.Receiver, nil) }()
+	sent := pipeRequest(t, srv, "POST", room.ID, room.Sender, bytes.NewReader(data))
+	defer sent.Body.Close()
+	recv := <-got
+	defer recv.Body.Close()
+
+	if recv.StatusCode != http.StatusOK {
+		t.Fatalf("receiver: expected 200, got %d", recv.StatusCode)
+	}
+	if name, _ := url.PathUnescape(recv.Header.Get("X-File-Name")); name != "notes for you.txt" {
+		t.Errorf("X-File-Name = %q", name)
+	}
+	if recv.ContentLength != int64(len(data)) {
+		t.Errorf("Content-Length = %d, want %d", recv.ContentLength, len(data))
+	}
+	if body, err := io.ReadAll(recv.Body); err != nil || !bytes.Equal(body, data) {
+		t.Fatalf("receiver got %d bytes (%v), want %d", len(body), err, len(data))
+	}
+	var result map[string]int64
+	json.NewDecoder(sent.Body).Decode(&result)
+	if sent.StatusCode != http.StatusOK || result["bytes"] != int64(len(data)) {
+		t.Errorf("sender: got %d %v, want 200 with %d bytes", sent.StatusCode, result, len(data))
+	}
+
+	var status RoomStatus
+	json.NewDecoder(roomRequest("GET", room.ID, room.Sender, "").Body).Decode(&status)
+	want := []PipeStatus{{Peer: status.Receivers[0].ID, Name: "notes for you.txt", Size: int64(len(data)), Bytes: int64(len(data)), State: pipeDone}}
+	if !slices.Equal(status.Pipes, want) {
+		t.Errorf("pipes = %+v, want %+v", status.Pipes, want)
+	}
+}
+
+func TestHandleP2PRoom_PipeCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PRoom))
+	defer srv.Close()
+	room := createRoom(t)
+
+	// The sender streams one chunk and then stalls.
+	body, feed := io.Pipe()
+	defer feed.Close()
+	go feed.Write(make([]byte, pipeChunkSize))
+	sent := make(chan *http.Response)
+	go func() { sent <- pipeRequest(t, srv, "POST", room.ID, room.Sender, body) }()
+
+	recv := pipeRequest(t, srv, "GET", room.ID, room.Receiver, nil)
+	defer recv.Body.Close()
+	if _, err := io.ReadFull(recv.Body, make([]byte, pipeChunkSize)); err != nil {
+		t.Fatalf("receiver: reading the first chunk: %v", err)
+	}
+	if resp := pipeRequest(t, srv, "GET", room.ID, room.Receiver, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second receive: expected 409, got %d", resp.StatusCode)
+	}
+
+	if resp := pipeRequest(t, srv, "DELETE", room.ID, room.Receiver, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("cancel: expected 204, got %d", resp.StatusCode)
+	}
+	if _, err := io.ReadAll(recv.Body); err == nil {
+		t.Error("receiver: a cancelled transfer ended like a complete one")
+	}
+	resp := <-sent
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("sender: expected 410, got %d", resp.StatusCode)
+	}
+	var status RoomStatus
+	json.NewDecoder(roomRequest("GET", room.ID, room.Receiver, "").Body).Decode(&status)
+	if len(status.Pipes) != 1 || status.Pipes[0].State != pipeCancelled || status.Pipes[0].Reason != "cancelled by receiver" {
+		t.Errorf("pipes = %+v, want one cancelled by the receiver", status.Pipes)
+	}
+	if resp := pipeRequest(t, srv, "DELETE", room.ID, room.Sender, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("cancelling a finished transfer: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandleP2PRoom_PipeTruncated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PRoom))
+	defer srv.Close()
+	room := createRoom(t)
+
+	got := make(chan *http.Response)
+	go func() { got <- pipeRequest(t, srv, "GET", room.ID, room.Receiver, nil) }()
+
+	// The sender promises two chunks, sends a little over one and hangs up.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "POST /api/p2p/rooms/%s/pipe HTTP/1.1\r\nHost: goshare\r\nX-Room-Token: %s\r\nX-File-Name: short.txt\r\nContent-Length: %d\r\n\r\n",
+		room.ID, room.Sender, 2*pipeChunkSize)
+	conn.Write(bytes.Repeat([]byte("x"), pipeChunkSize+100))
+	recv := <-got
+	defer recv.Body.Close()
+	conn.Close()
+
+	if recv.StatusCode != http.StatusOK {
+		t.Fatalf("receiver: expected 200, got %d", recv.StatusCode)
+	}
+	if _, err := io.ReadAll(recv.Body); err == nil {
+		t.Error("receiver: a truncated transfer ended like a complete one")
+	}
+	var status RoomStatus
+	json.NewDecoder(roomRequest("GET", room.ID, room.Receiver, "").Body).Decode(&status)
+	if len(status.Pipes) != 1 || status.Pipes[0].State != pipeCancelled || status.Pipes[0].Reason != "sender disconnected" {
+		t.Errorf("pipes = %+v, want one cancelled by the sender's disconnect", status.Pipes)
+	}
+}
+
+func TestReadChunk(t *testing.T) {
+	chunk, eof, err := readChunk(strings.NewReader("the end"))
+	if string(chunk) != "the end" || !eof || err != nil {
+		t.Errorf("clean end: got %q, %v, %v", chunk, eof, err)
+	}
+	// A body cut short of its Content-Length is not a clean end.
+	_, eof, err = readChunk(io.MultiReader(strings.NewReader("the"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if eof || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated body: got eof %v, err %v", eof, err)
+	}
+}
+
+func TestHandleP2PRoom_PipeScanAndStrip(t *testing.T) {
+	SetScanner(fakeScanner{})
+	defer SetScanner(nil)
+	if err := SetMetadataStripping(StripAll); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMetadataStripping(StripOff)
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PRoom))
+	defer srv.Close()
+	room := createRoom(t)
+	photo := photoWithGPS()
+
+	// Piped files cannot be scanned, so a scanner turns pipes off...
+	resp := pipeRequest(t, srv, "POST", room.ID, room.Sender, bytes.NewReader(photo))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("pipe while scanning: expected 403, got %d", resp.StatusCode)
+	}
+
+	// ...unless the admin accepts that; metadata is stripped either way.
+	SetUnscannedPipes(true)
+	defer SetUnscannedPipes(false)
+	got := make(chan *http.Response)
+	go func() { got <- pipeRequest(t, srv, "GET", room.ID, room.Receiver, nil) }()
+	sent := pipeRequest(t, srv, "POST", room.ID, room.Sender, bytes.NewReader(photo))
+	sent.Body.Close()
+	recv := <-got
+	defer recv.Body.Close()
+	body, err := io.ReadAll(recv.Body)
+	if err != nil || sent.StatusCode != http.StatusOK {
+		t.Fatalf("pipe: sender got %d, receiver read error %v", sent.StatusCode, err)
+	}
+	if recv.ContentLength != -1 {
+		t.Errorf("Content-Length = %d, want none for a stripped file", recv.ContentLength)
+	}
+	if bytes.Contains(body, []byte("GPSLatitude")) || len(body) == 0 {
+		t.Errorf("receiver got %d bytes with the GPS metadata left in", len(body))
+	}
+}
+
+func TestHandleP2PRoom_PipeRejects(t *testing.T) {
+	if err := SetFilePolicy(FilePolicy{DenyExtensions: []string{".txt"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFilePolicy(FilePolicy{})
+	srv := httptest.NewServer(http.HandlerFunc(HandleP2PRoom))
+	defer srv.Close()
+	room := createRoom(t)
+
+	tests := []struct {
+		name, method, token string
+		want                int
+	}{
+		{"receiver sending", "POST", room.Receiver, http.StatusForbidden},
+		{"sender receiving", "GET", room.Sender, http.StatusForbidden},
+		{"denied file type", "POST", room.Sender, http.StatusUnsupportedMediaType},
+		{"bad token", "GET", "wrong", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp := pipeRequest(t, srv, tt.method, room.ID, tt.token, strings.NewReader("hello"))
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/audit"
+	"fileshare/internal/network"
+)
+
+// Short room codes are an alternative to the share link that can be read
+// aloud: six digits ("482 913") or three words ("maple-otter-violin").
+// They have far less entropy than the link, so each is single-use,
+// expires quickly, clients that guess wrong too often are locked out, and
+// once too many guesses fail server-wide all lookups pause, so an attacker
+// with many addresses cannot keep guessing either.
+const (
+	codeDigits = "digits"
+	codeWords  = "words"
+
+	roomCodeTTL           = 5 * time.Minute
+	maxCodeFailures       = 5   // failed lookups per client (IPv4 address or IPv6 /64) per window
+	maxGlobalCodeFailures = 100 // failed lookups from all clients per window
+	codeFailureReset      = 15 * time.Minute
+)
+
+var errCodeSpace = errors.New("no free room code")
+
+type roomCode struct {
+	roomID  string
+	expires time.Time
+}
+
+type codeFailures struct {
+	count int
+	reset time.Time
+}
+
+var (
+	codeMu         sync.Mutex
+	roomCodes      = make(map[string]roomCode)
+	codeAttempts   = make(map[string]*codeFailures) // by codeClientKey
+	globalFailures codeFailures
+)
+
+func randomIndex(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return int(v.Int64())
+}
+
+// generateCode returns a random code of the given kind in canonical form.
+func generateCode(kind string) string {
+	if kind == codeDigits {
+		return fmt.Sprintf("%06d", randomIndex(1000000))
+	}
+	words := make([]string, 3)
+	for i := range words {
+		words[i] = codeWordList[randomIndex(len(codeWordList))]
+	}
+	return strings.Join(words, "-")
+}
+
+// codeClientKey is the key failed lookups are counted under: the address
+// for IPv4, and its /64 for IPv6, since a single client usually holds a
+// whole /64.
+func codeClientKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Unmap().Is4() {
+		return ip
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix.String()
+}
+
+// normalizeCode brings user input to canonical form: digits without
+// separators, or lower-case words joined by dashes.
+func normalizeCode(s string) string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == '.'
+	})
+	if len(fields) > 0 && strings.Trim(strings.Join(fields, ""), "0123456789") == "" {
+		return strings.Join(fields, "")
+	}
+	return strings.Join(fields, "-")
+}
+
+// issueRoomCode assigns a fresh code of the given kind to a room.
+func issueRoomCode(roomID, kind string) (string, time.Time, error) {
+	codeMu.Lock()
+	defer codeMu.Unlock()
+	now := time.Now()
+	for range 20 {
+		code := generateCode(kind)
+		if c, taken := roomCodes[code]; taken && now.Before(c.expires) {
+			continue
+		}
+		expires := now.Add(roomCodeTTL)
+		roomCodes[code] = roomCode{roomID: roomID, expires: expires}
+		return code, expires, nil
+	}
+	return "", time.Time{}, errCodeSpace
+}
+
+// claimRoomCode resolves and consumes a code. It returns ok=false for an
+// unknown or expired code, and limited=true once ip, or all clients
+// together, have failed too often.
+func claimRoomCode(code, ip string) (roomID string, ok, limited bool) {
+	codeMu.Lock()
+	defer codeMu.Unlock()
+	now := time.Now()
+	key := codeClientKey(ip)
+	f := codeAttempts[key]
+	if f != nil && now.After(f.reset) {
+		delete(codeAttempts, key)
+		f = nil
+	}
+	if now.After(globalFailures.reset) {
+		globalFailures = codeFailures{reset: now.Add(codeFailureReset)}
+	}
+	if (f != nil && f.count >= maxCodeFailures) || globalFailures.count >= maxGlobalCodeFailures {
+		return "", false, true
+	}
+	c, found := roomCodes[code]
+	if found {
+		delete(roomCodes, code)
+	}
+	if !found || now.After(c.expires) {
+		if f == nil {
+			f = &codeFailures{reset: now.Add(codeFailureReset)}
+			codeAttempts[key] = f
+		}
+		f.count++
+		globalFailures.count++
+		return "", false, false
+	}
+	return c.roomID, true, false
+}
+
+// expireRoomCodes drops expired codes and failure counters.
+func expireRoomCodes() {
+	codeMu.Lock()
+	defer codeMu.Unlock()
+	now := time.Now()
+	for code, c := range roomCodes {
+		if now.After(c.expires) {
+			delete(roomCodes, code)
+		}
+	}
+	for key, f := range codeAttempts {
+		if now.After(f.reset) {
+			delete(codeAttempts, key)
+		}
+	}
+}
+
+// HandleP2PJoinCode joins a room as the receiver using a short code, in
+// place of the link's room ID and join token. It returns the room ID,
+// the receiver token and the receiver's peer ID.
+func HandleP2PJoinCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+
+	ip := network.ClientIP(r)
+	roomID, ok, limited := claimRoomCode(normalizeCode(req.Code), ip)
+	if limited {
+		log.Printf("P2P room code lookups locked out for %s", codeClientKey(ip))
+		http.Error(w, "too many wrong codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var room *P2PRoom
+	if ok {
+		room, ok = lookupRoom(roomID)
+	}
+	if !ok {
+		e := auditEntry(r, audit.ActionRoomJoin, "")
+		e.Outcome, e.Detail = audit.OutcomeDenied, "unknown or expired code"
+		record(e)
+		http.Error(w, "unknown or expired code", http.StatusNotFound)
+		return
+	}
+
+	rc, ok := joinAsReceiver(w, r, room, room.joinToken)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"room": room.ID, "token": rc.token, "peer": rc.id}); err != nil {
+		log.Printf("Error encoding P2P join response: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/turn"
+)
+
+// publicSTUNServers are advertised to browsers only when public STUN is
+// enabled, so an offline LAN never waits on lookups that cannot succeed.
+var publicSTUNServers = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:global.stun.twilio.com:3478",
+}
+
+var (
+	iceLock    sync.RWMutex
+	stunPort   int // UDP port of the built-in STUN server; 0 if it is off
+	publicSTUN bool
+	turnPort   int    // UDP port of the built-in TURN relay; 0 if it is off
+	turnSecret []byte // shared with the relay to derive credentials
+)
+
+// turnCredentialTTL is how long TURN credentials issued for a room stay
+// valid. An allocation made with them outlives them until it expires.
+const turnCredentialTTL = time.Hour
+
+// SetICEConfig sets what HandleP2PConfig advertises: the built-in STUN
+// server on port (0 if it is not running) and, if public is set, public
+// STUN servers as well.
+func SetICEConfig(port int, public bool) {
+	iceLock.Lock()
+	stunPort, publicSTUN = port, public
+	iceLock.Unlock()
+}
+
+// SetTURN makes HandleP2PConfig issue credentials for the built-in TURN
+// relay on port, derived from the secret it shares with the relay. Port
+// 0 turns this off.
+func SetTURN(port int, secret []byte) {
+	iceLock.Lock()
+	turnPort, turnSecret = port, secret
+	iceLock.Unlock()
+}
+
+// iceServer mirrors the browser's RTCIceServer dictionary.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// HandleP2PConfig returns the ICE servers browsers should use for WebRTC.
+// The built-in STUN server is named by the host the browser used to reach
+// this page, which is the address it can reach over UDP too. With no
+// servers at all, peers on the same LAN still connect through host
+// candidates.
+//
+// With ?room= and the room's token in X-Room-Token, it also lists the
+// built-in TURN relay (if enabled) with credentials for that room, the
+// fallback when peers cannot reach each other directly.
+func HandleP2PConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	iceLock.RLock()
+	port, public := stunPort, publicSTUN
+	relayPort, secret := turnPort, turnSecret
+	iceLock.RUnlock()
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		// A bare IPv6 literal keeps its brackets; JoinHostPort adds them.
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	servers := []iceServer{}
+	if roomID := r.URL.Query().Get("room"); roomID != "" && relayPort > 0 {
+		room, _, ok := roomForRequest(w, r, roomID, r.Header.Get("X-Room-Token"))
+		if !ok {
+			return
+		}
+		username, password := turn.Credentials(secret, room.ID, turnCredentialTTL)
+		servers = append(servers, iceServer{
+			URLs:       []string{"turn:" + net.JoinHostPort(host, strconv.Itoa(relayPort)) + "?transport=udp"},
+			Username:   username,
+			Credential: password,
+		})
+	}
+	if port > 0 {
+		servers = append(servers, iceServer{URLs: []string{"stun:" + net.JoinHostPort(host, strconv.Itoa(port))}})
+	}
+	if public {
+		servers = append(servers, iceServer{URLs: publicSTUNServers})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"ice_servers": servers}); err != nil {
+		log.Printf("Error encoding P2P config: %v", err)
+	}
+}
+
+// TURNAuthorize reports whether the TURN relay may serve user, the room
+// its credentials were issued for: only while the room is open.
+func TURNAuthorize(user string) bool {
+	_, ok := lookupRoom(user)
+	return ok
+}
+
+// maxPeerAddrs bounds the client addresses remembered per room peer.
+const maxPeerAddrs = 8
+
+// addAddr remembers that peer used the room from client IP ip, so the
+// TURN relay lets the other peers reach it there.
+func (room *P2PRoom) addAddr(peer, ip string) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	p := room.peer(peer)
+	if p == nil || p.addrs[ip] || len(p.addrs) >= maxPeerAddrs {
+		return
+	}
+	if p.addrs == nil {
+		p.addrs = make(map[string]bool)
+	}
+	p.addrs[ip] = true
+}
+
+// TURNPeerAllowed reports whether the TURN relay may open a permission
+// for a client of room user to ip: only to an address one of the room's
+// current peers has used, so the relay cannot carry traffic anywhere
+// else. Relayed addresses are checked by the relay itself.
+func TURNPeerAllowed(user string, ip net.IP) bool {
+	room, ok := lookupRoom(user)
+	if !ok {
+		return false
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	peers := []*peerPresence{&room.sender}
+	for _, rc := range room.receivers {
+		peers = append(peers, &rc.peerPresence)
+	}
+	for _, p := range peers {
+		for addr := range p.addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TURNRelayed records n bytes of a room's data relayed through TURN, so
+// room status can tell the peers why the transfer is slower than on a
+// direct connection.
+func TURNRelayed(roomID string, n int) {
+	room, ok := lookupRoom(roomID)
+	if !ok {
+		return
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.lastActive = time.Now()
+	room.relayedBytes += int64(n)
+	if !room.relayed {
+		room.relayed = true
+		room.notifyLocked()
+		log.Printf("P2P room %s: data is relayed through TURN", room.ID)
+	}
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A room has one sender and up to maxReceivers receivers. Ordinary rooms
+// take a single receiver; broadcast rooms (create with receivers=N) let
+// the same share link admit several, each with its own token and peer ID.
+// The sender runs one WebRTC connection per receiver and addresses its
+// signals with the receiver's peer ID; receivers only ever talk to the
+// sender.
+const (
+	senderPeer       = "sender" // peer ID of the room's creator
+	maxRoomReceivers = 10       // receivers a broadcast room may admit
+)
+
+// roomRemoved is the room-closed reason a receiver gets when the sender
+// removes it from the room.
+const roomRemoved = "removed"
+
+var errUnknownPeer = errors.New("unknown peer")
+
+// roomReceiver is one receiver admitted to a room.
+type roomReceiver struct {
+	id    string
+	token string
+	peerPresence
+}
+
+// roleOf returns the role of a peer ID: "sender" or "receiver".
+func roleOf(peer string) string {
+	if peer == senderPeer {
+		return "sender"
+	}
+	return "receiver"
+}
+
+func newPeerID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// receiverLocked returns the receiver with the given peer ID, or nil. The
+// caller holds room.mu.
+func (room *P2PRoom) receiverLocked(id string) *roomReceiver {
+	for _, rc := range room.receivers {
+		if rc.id == id {
+			return rc
+		}
+	}
+	return nil
+}
+
+// addReceiverLocked admits a new receiver and returns it. The caller
+// holds room.mu and has checked maxReceivers.
+func (room *P2PRoom) addReceiverLocked() *roomReceiver {
+	id := newPeerID()
+	for room.receiverLocked(id) != nil {
+		id = newPeerID()
+	}
+	rc := &roomReceiver{id: id, token: randomToken(16)}
+	room.receivers = append(room.receivers, rc)
+	return rc
+}
+
+// hasPeer reports whether peer still belongs to the room.
+func (room *P2PRoom) hasPeer(peer string) bool {
+	if peer == senderPeer {
+		return true
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.receiverLocked(peer) != nil
+}
+
+// removeReceiver revokes a receiver's token, drops the signals it
+// exchanged, cancels its pipe and ends its streams with a room-closed
+// event. When the sender removed it (kick), the join token is also
+// rotated, so the link the receiver holds cannot admit it again; the new
+// token is returned for the sender to share with everyone else.
+func (room *P2PRoom) removeReceiver(id string, kick bool) (join string, ok bool) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	n := len(room.receivers)
+	room.receivers = slices.DeleteFunc(room.receivers, func(rc *roomReceiver) bool { return rc.id == id })
+	if len(room.receivers) == n {
+		return "", false
+	}
+	for i, sig := range room.Signals {
+		if sig.Peer == id {
+			room.Signals[i] = P2PSignal{From: sig.From, Peer: id, dropped: true}
+		}
+	}
+	delete(room.signalCount, id)
+	if kick {
+		room.joinToken = randomToken(16)
+	}
+	room.cancelPipesLocked(id, "receiver removed")
+	room.lastActive = time.Now()
+	room.notifyLocked()
+	return room.joinToken, true
+}
+
+// closeRoomAs handles a close request from peer: the sender closes the
+// room for everyone, a receiver only leaves it.
+func closeRoomAs(room *P2PRoom, peer string) {
+	if peer == senderPeer {
+		removeRoom(room.ID, roomClosed)
+		return
+	}
+	if _, ok := room.removeReceiver(peer, false); ok {
+		log.Printf("P2P room %s: receiver %s left", room.ID, peer)
+	}
+}
+
+// visibleTo reports whether peer should receive sig: the sender gets
+// every receiver's signals, a receiver gets the sender's signals
+// addressed to it or to all receivers.
+func visibleTo(sig P2PSignal, peer string) bool {
+	if sig.dropped {
+		return false
+	}
+	if peer == senderPeer {
+		return sig.From != "sender"
+	}
+	return sig.From == "sender" && (sig.Peer == "" || sig.Peer == peer)
+}
+
+// handleRoomPeer serves DELETE /api/p2p/rooms/{id}/peers/{peer}, with
+// which the sender removes a receiver from the room. The response carries
+// the room's new join token.
+func handleRoomPeer(w http.ResponseWriter, r *http.Request, room *P2PRoom, peer, target string) {
+	if r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if peer != senderPeer {
+		http.Error(w, "only the sender can remove receivers", http.StatusForbidden)
+		return
+	}
+	join, ok := room.removeReceiver(target, true)
+	if !ok {
+		http.Error(w, errUnknownPeer.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("P2P room %s: sender removed receiver %s", room.ID, target)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]string{"join": join}); err != nil {
+		log.Printf("Error encoding P2P remove response: %v", err)
+	}
+}
@@ -0,0 +1,532 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"fileshare/internal/audit"
+	"fileshare/internal/imagemeta"
+)
+
+// A pipe streams one file from a room's sender to one of its receivers
+// through the server, for when WebRTC cannot connect. The sender POSTs the
+// file and the receiver GETs it at the same time; the server hands chunks
+// from one request to the other through a small bounded buffer and never
+// writes them to disk. When the buffer is full the sender's body is not
+// read, so TCP slows the sender down to the receiver's pace.
+const (
+	pipeChunkSize  = 64 << 10        // bytes read from the sender at a time
+	pipeBuffer     = 16              // chunks held between the two sides (1 MiB)
+	pipeWait       = 2 * time.Minute // how long one side waits for the other
+	pipeProgress   = 500 * time.Millisecond
+	maxActivePipes = 64 // open pipes server-wide, bounding buffer memory
+)
+
+// Pipe states.
+const (
+	pipeWaiting   = "waiting"   // one side has connected
+	pipeStreaming = "streaming" // both sides are connected
+	pipeDone      = "done"      // the receiver got every byte
+	pipeCancelled = "cancelled" // either side gave up; see reason
+)
+
+var (
+	errPipeBusy      = errors.New("a transfer to this receiver is already in progress")
+	errPipesFull     = errors.New("too many relayed transfers, try again later")
+	errPipeUnscanned = errors.New("transfers through the server are off while uploads are scanned")
+	activePipes      atomic.Int32
+	unscannedPipes   atomic.Bool
+)
+
+// SetUnscannedPipes lets files be piped through the server while an
+// upload scanner is configured. Piped files are never stored, so the
+// scanner cannot see them; by default pipes are refused while scanning
+// is on. Metadata stripping and the file policy apply either way.
+func SetUnscannedPipes(allow bool) {
+	unscannedPipes.Store(allow)
+}
+
+// roomPipe is the transfer to one receiver. Its fields are guarded by the
+// room's mu; the channels carry the data and the signals between the two
+// requests.
+type roomPipe struct {
+	peer        string // the receiving peer
+	name        string
+	contentType string
+	size        int64 // -1 until the sender connects, or if it sent no length
+	bytes       int64 // delivered to the receiver so far
+	state       string
+	reason      string
+	hasSender   bool
+	hasReceiver bool
+	notified    time.Time // last progress notification
+
+	started chan struct{} // closed once both sides are connected
+	chunks  chan []byte   // the bounded buffer; the sender closes it at EOF
+	done    chan struct{} // closed when the pipe is done or cancelled
+}
+
+// PipeStatus is a pipe's progress as reported in room status. Size is -1
+// while unknown.
+type PipeStatus struct {
+	Peer   string `json:"peer"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size"`
+	Bytes  int64  `json:"bytes"`
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (p *roomPipe) status() PipeStatus {
+	return PipeStatus{Peer: p.peer, Name: p.name, Size: p.size, Bytes: p.bytes, State: p.state, Reason: p.reason}
+}
+
+func (p *roomPipe) finished() bool {
+	return p.state == pipeDone || p.state == pipeCancelled
+}
+
+// attachPipe connects the sender (with the file's details) or the receiver
+// to the pipe for receiver peer, starting a new pipe if the last one has
+// finished. Each side may be connected once.
+func (room *P2PRoom) attachPipe(peer string, sender *roomPipe) (*roomPipe, error) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	p := room.pipes[peer]
+	if p == nil || p.finished() {
+		if activePipes.Load() >= maxActivePipes {
+			return nil, errPipesFull
+		}
+		activePipes.Add(1)
+		p = &roomPipe{
+			peer:    peer,
+			size:    -1,
+			state:   pipeWaiting,
+			started: make(chan struct{}),
+			chunks:  make(chan []byte, pipeBuffer),
+			done:    make(chan struct{}),
+		}
+		if room.pipes == nil {
+			room.pipes = make(map[string]*roomPipe)
+		}
+		room.pipes[peer] = p
+	}
+	if sender != nil {
+		if p.hasSender {
+			return nil, errPipeBusy
+		}
+		p.hasSender = true
+		p.name, p.contentType, p.size = sender.name, sender.contentType, sender.size
+	} else {
+		if p.hasReceiver {
+			return nil, errPipeBusy
+		}
+		p.hasReceiver = true
+	}
+	if p.hasSender && p.hasReceiver {
+		p.state = pipeStreaming
+		close(p.started)
+	}
+	room.lastActive = time.Now()
+	room.notifyLocked()
+	return p, nil
+}
+
+// finishPipe ends a pipe: done if reason is empty, cancelled otherwise.
+func (room *P2PRoom) finishPipe(p *roomPipe, reason string) {
+	room.mu.Lock()
+	room.finishPipeLocked(p, reason)
+	room.mu.Unlock()
+}
+
+// finishPipeLocked is finishPipe for callers holding room.mu.
+func (room *P2PRoom) finishPipeLocked(p *roomPipe, reason string) {
+	if p.finished() {
+		return
+	}
+	p.state, p.reason = pipeDone, reason
+	if reason != "" {
+		p.state = pipeCancelled
+	}
+	close(p.done)
+	activePipes.Add(-1)
+	room.notifyLocked()
+}
+
+// cancelPipesLocked cancels every pipe in the room, or only the one to
+// peer if it is not empty. The caller holds room.mu.
+func (room *P2PRoom) cancelPipesLocked(peer, reason string) {
+	for id, p := range room.pipes {
+		if peer == "" || id == peer {
+			room.finishPipeLocked(p, reason)
+		}
+	}
+}
+
+// pipeDelivered records n more bytes delivered to the receiver, notifying
+// watchers at most every pipeProgress.
+func (room *P2PRoom) pipeDelivered(p *roomPipe, n int) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	now := time.Now()
+	p.bytes += int64(n)
+	room.lastActive = now
+	if now.Sub(p.notified) >= pipeProgress {
+		p.notified = now
+		room.notifyLocked()
+	}
+}
+
+// pipeStatusesLocked lists the pipes peer may see: all of them for the
+// sender, its own for a receiver. The caller holds room.mu.
+func (room *P2PRoom) pipeStatusesLocked(peer string) []PipeStatus {
+	var list []PipeStatus
+	for _, rc := range room.receivers {
+		if p := room.pipes[rc.id]; p != nil && (peer == senderPeer || peer == rc.id) {
+			list = append(list, p.status())
+		}
+	}
+	return list
+}
+
+// pipeTarget returns the receiver a sender's pipe request is for: the one
+// named by ?to=, which a broadcast room requires, or else the room's only
+// receiver. On failure it has already answered.
+func pipeTarget(w http.ResponseWriter, r *http.Request, room *P2PRoom) (string, bool) {
+	to := r.URL.Query().Get("to")
+	room.mu.Lock()
+	broadcast, joined := room.maxReceivers > 1, len(room.receivers)
+	if to == "" && !broadcast && joined == 1 {
+		to = room.receivers[0].id
+	}
+	known := room.receiverLocked(to) != nil
+	room.mu.Unlock()
+	switch {
+	case to == "" && broadcast:
+		http.Error(w, "to is required in a broadcast room", 400)
+		return "", false
+	case to == "":
+		http.Error(w, "no receiver has joined", http.StatusConflict)
+		return "", false
+	case !known:
+		http.Error(w, errUnknownPeer.Error(), http.StatusNotFound)
+		return "", false
+	}
+	return to, true
+}
+
+// handleRoomPipe serves /api/p2p/rooms/{id}/pipe: the sender POSTs a file
+// (named by the URL-encoded X-File-Name header) and the receiver GETs it,
+// each waiting up to pipeWait for the other. DELETE cancels the transfer
+// from either side. The sender of a broadcast room names the receiver
+// with ?to=.
+func handleRoomPipe(w http.ResponseWriter, r *http.Request, room *P2PRoom, peer string) {
+	switch r.Method {
+	case "POST":
+		if peer != senderPeer {
+			http.Error(w, "only the sender can send", http.StatusForbidden)
+			return
+		}
+		if to, ok := pipeTarget(w, r, room); ok {
+			sendPipe(w, r, room, to)
+		}
+	case "GET":
+		if peer == senderPeer {
+			http.Error(w, "only receivers can receive", http.StatusForbidden)
+			return
+		}
+		receivePipe(w, r, room, peer)
+	case "DELETE":
+		target, who := peer, "receiver"
+		if peer == senderPeer {
+			to, ok := pipeTarget(w, r, room)
+			if !ok {
+				return
+			}
+			target, who = to, "sender"
+		}
+		room.mu.Lock()
+		p := room.pipes[target]
+		active := p != nil && !p.finished()
+		if active {
+			room.finishPipeLocked(p, "cancelled by "+who)
+		}
+		room.mu.Unlock()
+		if !active {
+			http.Error(w, "no transfer in progress", http.StatusNotFound)
+			return
+		}
+		log.Printf("P2P room %s: pipe to %s cancelled by %s", room.ID, target, who)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// waitPipe waits for the other side to connect. It returns false, having
+// cancelled the pipe, if that takes too long or this side goes away.
+func waitPipe(r *http.Request, room *P2PRoom, p *roomPipe, side string) bool {
+	timeout := time.NewTimer(pipeWait)
+	defer timeout.Stop()
+	select {
+	case <-p.started:
+		return true
+	case <-p.done:
+	case <-timeout.C:
+		room.finishPipe(p, "the other side did not connect")
+	case <-r.Context().Done():
+		room.finishPipe(p, side+" disconnected")
+	}
+	return false
+}
+
+// readChunk reads the next chunk of the sender's body; eof is set once
+// the body is exhausted. Any other error, such as the io.ErrUnexpectedEOF
+// of a body cut short of its Content-Length, is returned as is.
+func readChunk(body io.Reader) (chunk []byte, eof bool, err error) {
+	buf := make([]byte, pipeChunkSize)
+	n := 0
+	for n < len(buf) {
+		m, err := body.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return buf[:n], true, nil
+		}
+		if err != nil {
+			return buf[:n], false, err
+		}
+	}
+	return buf, false, nil
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// stripStream passes src through the image metadata stripper as it is
+// read. Closing the result stops the stripper.
+func stripStream(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := imagemeta.Strip(pw, src)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// pipeFailure is the reason a pipe is cancelled when reading the sender's
+// file fails.
+func pipeFailure(err error) string {
+	if errors.Is(err, imagemeta.ErrMalformed) {
+		return "could not remove image metadata"
+	}
+	return "sender disconnected"
+}
+
+func sendPipe(w http.ResponseWriter, r *http.Request, room *P2PRoom, to string) {
+	name, err := url.PathUnescape(r.Header.Get("X-File-Name"))
+	name = filepath.Base(name)
+	if err != nil || !isValidName(name) {
+		http.Error(w, "invalid file name", 400)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Nothing is stored, but the upload policy still applies: the name
+	// now, and the content once the first chunk is in. Nothing stored
+	// also means nothing to scan, so a scanner turns pipes off unless
+	// the admin allowed them.
+	policy := getFilePolicy()
+	body := &countReader{r: r.Body}
+	chunk, _, err := readChunk(body)
+	if err != nil {
+		http.Error(w, "could not read body", 400)
+		return
+	}
+	code, reason := http.StatusUnsupportedMediaType, policy.checkName(name)
+	if reason == "" {
+		reason = policy.checkContent(bytes.NewReader(chunk))
+	}
+	if reason == "" && getScanner() != nil && !unscannedPipes.Load() {
+		code, reason = http.StatusForbidden, errPipeUnscanned.Error()
+	}
+	e := auditEntry(r, audit.ActionPipe, "")
+	e.File, e.Size, e.Target = name, max(r.ContentLength, 0), room.ID
+	if reason != "" {
+		e.Outcome, e.Detail = audit.OutcomeRejected, reason
+		record(e)
+		http.Error(w, reason, code)
+		return
+	}
+
+	// Pipes go to one person, so they are stripped like private uploads.
+	src := io.MultiReader(bytes.NewReader(chunk), body)
+	size := r.ContentLength
+	if shouldStrip(to, r.Header.Get("X-Strip-Metadata") == "1") {
+		stripped := stripStream(src)
+		defer stripped.Close()
+		src, size = stripped, -1 // the stripped length is not known up front
+	}
+
+	p, err := room.attachPipe(to, &roomPipe{name: name, contentType: contentType, size: size})
+	switch {
+	case errors.Is(err, errPipesFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer room.watch(senderPeer)()
+	log.Printf("P2P room %s: piping %s to %s", room.ID, name, to)
+
+	// A cancelled pipe must not leave this handler blocked reading a
+	// sender that has gone quiet.
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-p.done:
+			http.NewResponseController(w).SetReadDeadline(time.Now())
+		case <-returned:
+		}
+	}()
+
+	if waitPipe(r, room, p, "sender") {
+		streamPipe(r, room, p, src, body)
+	}
+	room.mu.Lock()
+	status := p.status()
+	room.mu.Unlock()
+	if status.State != pipeDone {
+		e.Outcome, e.Detail = audit.OutcomeCancelled, status.Reason
+		record(e)
+		log.Printf("P2P room %s: pipe of %s to %s ended early: %s", room.ID, name, to, status.Reason)
+		http.Error(w, "transfer cancelled: "+status.Reason, http.StatusGone)
+		return
+	}
+	e.Size = status.Bytes
+	record(e)
+	log.Printf("P2P room %s: piped %s to %s (%d bytes)", room.ID, name, to, status.Bytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"bytes": status.Bytes})
+}
+
+// streamPipe feeds the sender's file from src into the buffer, then waits
+// for the receiver to drain it. The buffer is only closed, which tells the
+// receiver the file is complete, once body (the raw request body under
+// src) has ended cleanly with as many bytes as its Content-Length.
+func streamPipe(r *http.Request, room *P2PRoom, p *roomPipe, src io.Reader, body *countReader) {
+	for {
+		chunk, eof, err := readChunk(src)
+		if err != nil {
+			room.finishPipe(p, pipeFailure(err))
+			return
+		}
+		if len(chunk) > 0 {
+			select {
+			case p.chunks <- chunk:
+			case <-p.done:
+				return
+			case <-r.Context().Done():
+				room.finishPipe(p, "sender disconnected")
+				return
+			}
+		}
+		if eof {
+			break
+		}
+	}
+	if r.ContentLength >= 0 && body.n != r.ContentLength {
+		room.finishPipe(p, fmt.Sprintf("sender sent %d of %d bytes", body.n, r.ContentLength))
+		return
+	}
+	close(p.chunks)
+	select {
+	case <-p.done:
+	case <-r.Context().Done():
+		room.finishPipe(p, "sender disconnected")
+	}
+}
+
+func receivePipe(w http.ResponseWriter, r *http.Request, room *P2PRoom, peer string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	p, err := room.attachPipe(peer, nil)
+	switch {
+	case errors.Is(err, errPipesFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer room.watch(peer)()
+	if !waitPipe(r, room, p, "receiver") {
+		room.mu.Lock()
+		reason := p.reason
+		room.mu.Unlock()
+		http.Error(w, "transfer cancelled: "+reason, http.StatusGone)
+		return
+	}
+
+	room.mu.Lock()
+	name, contentType, size := p.name, p.contentType, p.size
+	room.mu.Unlock()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	w.Header().Set("X-File-Name", url.PathEscape(name))
+	w.Header().Set("Cache-Control", "no-store")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case chunk, ok := <-p.chunks:
+			if !ok {
+				room.finishPipe(p, "")
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				room.finishPipe(p, "receiver disconnected")
+				return
+			}
+			flusher.Flush()
+			room.pipeDelivered(p, len(chunk))
+		case <-p.done:
+			// Cancelled mid-stream, or the sender's file ended badly:
+			// abort the response so the receiver cannot mistake a short
+			// body for the whole file.
+			panic(http.ErrAbortHandler)
+		case <-r.Context().Done():
+			room.finishPipe(p, "receiver disconnected")
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Room states, in the only order a room moves through them.
+const (
+	stateWaiting     = "waiting"     // created; the receiver has not joined
+	stateNegotiating = "negotiating" // both peers known; exchanging SDP/ICE
+	stateConnected   = "connected"   // a peer reported the WebRTC connection up
+	stateDone        = "done"        // a peer reported the transfer finished
+)
+
+var stateOrder = map[string]int{
+	stateWaiting:     0,
+	stateNegotiating: 1,
+	stateConnected:   2,
+	stateDone:        3,
+}
+
+// Presence of a role in a room.
+const (
+	presenceAbsent       = "absent"       // has not joined
+	presenceOnline       = "online"       // has a stream open or was seen just now
+	presenceDisconnected = "disconnected" // joined but no longer listening
+)
+
+// presenceRank orders presence values when summarising several receivers.
+var presenceRank = map[string]int{
+	presenceAbsent:       0,
+	presenceDisconnected: 1,
+	presenceOnline:       2,
+}
+
+// p2pPresenceGrace is how long a peer counts as online after its last
+// poll or stream ends, covering the gap between long-polls and quick
+// reconnects.
+const p2pPresenceGrace = 5 * time.Second
+
+var errBadState = errors.New("state can only move forward")
+
+// peerPresence tracks one role's connection to a room.
+type peerPresence struct {
+	joined   bool
+	lastSeen time.Time
+	conns    int             // open event streams, subscriptions and waiting polls
+	addrs    map[string]bool // client IPs that used the peer's token
+}
+
+// PeerStatus is a peer's presence as reported to clients. ID is set in
+// the sender's list of receivers.
+type PeerStatus struct {
+	ID       string    `json:"id,omitempty"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+// RoomStatus is a room's state and the presence of its peers. The sender
+// sees every receiver in Receivers and the most present of them as
+// Receiver; a receiver sees its own presence as Receiver. Relayed is set
+// once the built-in TURN relay has carried the room's data. Pipes lists
+// transfers through the server the peer is part of.
+type RoomStatus struct {
+	State        string       `json:"state"`
+	Sender       PeerStatus   `json:"sender"`
+	Receiver     PeerStatus   `json:"receiver"`
+	Receivers    []PeerStatus `json:"receivers,omitempty"`
+	Relayed      bool         `json:"relayed,omitempty"`
+	RelayedBytes int64        `json:"relayed_bytes,omitempty"`
+	Pipes        []PipeStatus `json:"pipes,omitempty"`
+}
+
+// sameAs reports whether two statuses differ only in timestamps and
+// relayed byte counts, so streams need not push an update.
+func (s RoomStatus) sameAs(o RoomStatus) bool {
+	return s.State == o.State && s.Relayed == o.Relayed && slices.Equal(s.Pipes, o.Pipes) && s.Sender.Status == o.Sender.Status && s.Receiver.Status == o.Receiver.Status &&
+		slices.EqualFunc(s.Receivers, o.Receivers, func(a, b PeerStatus) bool {
+			return a.ID == b.ID && a.Status == b.Status
+		})
+}
+
+// notifyLocked wakes everyone waiting on the room. The caller holds room.mu.
+func (room *P2PRoom) notifyLocked() {
+	if room.changed != nil {
+		close(room.changed)
+		room.changed = nil
+	}
+}
+
+func (room *P2PRoom) notify() {
+	room.mu.Lock()
+	room.notifyLocked()
+	room.mu.Unlock()
+}
+
+// peer returns a peer's presence record, or nil for a receiver that is no
+// longer in the room. The caller holds room.mu.
+func (room *P2PRoom) peer(id string) *peerPresence {
+	if id == senderPeer {
+		return &room.sender
+	}
+	if rc := room.receiverLocked(id); rc != nil {
+		return &rc.peerPresence
+	}
+	return nil
+}
+
+// seen records a request from peer.
+func (room *P2PRoom) seen(peer string) {
+	room.mu.Lock()
+	now := time.Now()
+	room.lastActive = now
+	if p := room.peer(peer); p != nil {
+		p.lastSeen = now
+	}
+	room.mu.Unlock()
+}
+
+// watch registers an open stream or waiting poll for peer. A watched room
+// never expires, so a transfer in progress keeps its room however long it
+// takes. The returned function unregisters it.
+func (room *P2PRoom) watch(peer string) func() {
+	room.mu.Lock()
+	p := room.peer(peer)
+	if p == nil {
+		p = new(peerPresence) // removed meanwhile; count it against nobody
+	}
+	p.conns++
+	p.lastSeen = time.Now()
+	room.watchers++
+	room.lastActive = p.lastSeen
+	room.notifyLocked()
+	room.mu.Unlock()
+	return func() {
+		room.mu.Lock()
+		p.conns--
+		p.lastSeen = time.Now()
+		room.watchers--
+		room.lastActive = p.lastSeen
+		room.notifyLocked()
+		room.mu.Unlock()
+		// Wake the other side again once the grace period has passed, in
+		// case this peer has really gone.
+		time.AfterFunc(p2pPresenceGrace, room.notify)
+	}
+}
+
+// setState moves the room forward to state.
+func (room *P2PRoom) setState(state string) error {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if stateOrder[state] < stateOrder[room.state] {
+		return errBadState
+	}
+	if state != room.state {
+		room.state = state
+		room.lastActive = time.Now()
+		room.notifyLocked()
+	}
+	return nil
+}
+
+func (p *peerPresence) status() PeerStatus {
+	switch {
+	case !p.joined:
+		return PeerStatus{Status: presenceAbsent}
+	case p.conns > 0 || time.Since(p.lastSeen) < p2pPresenceGrace:
+		return PeerStatus{Status: presenceOnline, LastSeen: p.lastSeen}
+	}
+	return PeerStatus{Status: presenceDisconnected, LastSeen: p.lastSeen}
+}
+
+// reportState applies a state reported by peer. In a broadcast room one
+// receiver finishing does not end the room for the others, so only the
+// sender's done counts there.
+func (room *P2PRoom) reportState(peer, state string) error {
+	room.mu.Lock()
+	broadcast := room.maxReceivers > 1
+	room.mu.Unlock()
+	if state == stateDone && broadcast && peer != senderPeer {
+		return nil
+	}
+	return room.setState(state)
+}
+
+// status reports the room's state and presence as peer sees it.
+func (room *P2PRoom) status(peer string) RoomStatus {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	s := RoomStatus{
+		State:    room.state,
+		Sender:   room.sender.status(),
+		Receiver: PeerStatus{Status: presenceAbsent},
+
+		Relayed:      room.relayed,
+		RelayedBytes: room.relayedBytes,
+		Pipes:        room.pipeStatusesLocked(peer),
+	}
+	if peer != senderPeer {
+		if rc := room.receiverLocked(peer); rc != nil {
+			s.Receiver = rc.status()
+		}
+		return s
+	}
+	for _, rc := range room.receivers {
+		ps := rc.status()
+		rank, best := presenceRank[ps.Status], presenceRank[s.Receiver.Status]
+		if rank > best || rank == best && ps.LastSeen.After(s.Receiver.LastSeen) {
+			s.Receiver = ps
+		}
+		ps.ID = rc.id
+		s.Receivers = append(s.Receivers, ps)
+	}
+	return s
+}
+
+// handleRoomState reports the room status (GET) or lets a peer move the
+// room to connected or done (POST {"state": …}), which only the browsers
+// can observe.
+func handleRoomState(w http.ResponseWriter, r *http.Request, room *P2PRoom, peer string) {
+	if r.Method == "POST" {
+		var req struct {
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", 400)
+			return
+		}
+		if req.State != stateConnected && req.State != stateDone {
+			http.Error(w, "state must be connected or done", 400)
+			return
+		}
+		if err := room.reportState(peer, req.State); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		room.seen(peer)
+		log.Printf("P2P room %s: %s reported %s", room.ID, peer, req.State)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(room.status(peer)); err != nil {
+		log.Printf("Error encoding P2P room status: %v", err)
+	}
+}
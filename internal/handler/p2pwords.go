@@ -0,0 +1,40 @@
+package handler
+
+// codeWordList is the vocabulary of word room codes: 256 short, common
+// nouns, so three of them give about 16.7 million codes, more than the
+// million six-digit ones.
+var codeWordList = []string{
+	"acorn", "actor", "agent", "alarm", "album", "alert", "alley", "amber",
+	"angle", "apple", "apron", "arena", "arrow", "atlas", "attic", "award",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil",
+	"basin", "beach", "beacon", "beard", "bench", "berry", "bike", "bird",
+	"blade", "blaze", "bloom", "board", "boat", "bonus", "boot", "bottle",
+	"branch", "bread", "brick", "bridge", "brook", "broom", "brush", "bucket",
+	"bugle", "bunny", "butter", "button", "cabin", "cactus", "cake", "camel",
+	"camera", "candle", "canoe", "canvas", "canyon", "carpet", "carrot",
+	"castle", "cedar", "cello", "chalk", "cherry", "chess", "cider", "cinema",
+	"circle", "cliff", "clock", "cloud", "clover", "coach", "cobra", "cocoa",
+	"comet", "compass", "copper", "coral", "cotton", "cougar", "cowboy",
+	"crane", "crayon", "creek", "crown", "cube", "cycle", "daisy", "dancer",
+	"delta", "desert", "diamond", "dingo", "dolphin", "donkey", "dragon",
+	"drum", "eagle", "easel", "echo", "elbow", "ember", "engine", "falcon",
+	"feather", "fence", "fern", "ferry", "fiddle", "fig", "flag", "flame",
+	"flute", "forest", "fossil", "frog", "galaxy", "garden", "garlic", "gecko",
+	"geyser", "giant", "ginger", "globe", "goose", "grape", "gravel", "guitar",
+	"hammer", "harbor", "harp", "hazel", "helmet", "heron", "hippo", "honey",
+	"hoop", "hornet", "igloo", "island", "ivory", "jacket", "jaguar", "jelly",
+	"jungle", "kayak", "kettle", "kitten", "kiwi", "ladder", "lagoon",
+	"lantern", "lemon", "lilac", "lily", "locket", "lotus", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mirror", "mitten", "moose", "mosaic",
+	"muffin", "nectar", "needle", "nickel", "noodle", "oasis", "ocean", "olive",
+	"onion", "orbit", "orchid", "oyster", "paddle", "palace", "panda", "parrot",
+	"pebble", "pepper", "piano", "pickle", "pillow", "pilot", "planet", "plum",
+	"pony", "poppy", "puffin", "pumpkin", "puzzle", "quartz", "quilt", "rabbit",
+	"radar", "radish", "raft", "rainbow", "raven", "reef", "ribbon", "river",
+	"robin", "rocket", "saddle", "salmon", "sandal", "scarf", "seal", "shovel",
+	"silver", "skate", "sled", "sloth", "spider", "sponge", "spruce", "squid",
+	"statue", "summit", "sunset", "swan", "tablet", "teapot", "temple", "tiger",
+	"tomato", "topaz", "torch", "tractor", "tulip", "tunnel", "turtle",
+	"valley", "velvet", "violin", "volcano", "wafer", "walnut", "walrus",
+	"whale", "willow", "window", "wizard", "yacht", "zebra",
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"fileshare/internal/audit"
+	"fileshare/internal/discovery"
+	"fileshare/internal/scan"
+)
+
+var (
+	scannerLock sync.RWMutex
+	scanner     scan.Scanner
+)
+
+// scanSlots bounds how many files are scanned at once.
+var scanSlots = make(chan struct{}, 4)
+
+// pendingScans holds the quarantine paths still queued for, or being
+// scanned, so the cleanup sweep never removes a file before its verdict.
+var (
+	pendingLock  sync.Mutex
+	pendingScans = map[string]bool{}
+)
+
+func setScanPending(path string, pending bool) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	if pending {
+		pendingScans[path] = true
+	} else {
+		delete(pendingScans, path)
+	}
+}
+
+func scanPending(path string) bool {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return pendingScans[path]
+}
+
+// SetScanner enables upload scanning. Files are held in quarantine until
+// the scanner passes them; nil disables scanning.
+func SetScanner(s scan.Scanner) {
+	scannerLock.Lock()
+	scanner = s
+	scannerLock.Unlock()
+}
+
+func getScanner() scan.Scanner {
+	scannerLock.RLock()
+	defer scannerLock.RUnlock()
+	return scanner
+}
+
+const quarantineDir = "quarantine"
+
+// heldFile is an upload waiting in quarantine for its scan.
+type heldFile struct {
+	Name string
+	Path string
+	Size int64 // as uploaded
+	Meta fileMeta
+}
+
+// quarantineUpload copies an uploaded file into quarantine, where it is
+// invisible to listings and downloads. Images are sanitized on the way in
+// when strip is set, so the scanner sees exactly what will be published.
+func quarantineUpload(name string, src io.Reader, strip bool) (heldFile, error) {
+	if err := share.MkdirAll(quarantineDir, 0700); err != nil {
+		return heldFile{}, err
+	}
+	path := filepath.Join(quarantineDir, randomToken(12))
+	m, err := saveUpload(path, src, false, strip)
+	if err == nil {
+		setScanPending(path, true)
+	}
+	return heldFile{Name: name, Path: path, Meta: m}, err
+}
+
+// releaseAfterScan scans quarantined files and publishes the clean ones
+// to uploadDir. Infected files, and files whose scan failed, are deleted
+// and reported to the uploader with an "upload-rejected" event. Each
+// outcome is audited, starting from base (the upload's entry).
+func releaseAfterScan(s scan.Scanner, held []heldFile, base audit.Entry, uploadDir string) {
+	fromID, toID := base.DeviceID, base.Target
+	var released []string
+	for _, h := range held {
+		defer setScanPending(h.Path, false)
+		scanSlots <- struct{}{}
+		// Scanners need a real path; quarantine names are server-generated.
+		v, err := s.Scan(context.Background(), filepath.Join(share.Dir(), h.Path))
+		<-scanSlots
+
+		entry := base
+		entry.File, entry.Size, entry.SHA256 = h.Name, h.Size, h.Meta.SHA256
+		reason := ""
+		switch {
+		case err != nil:
+			log.Printf("Scan failed for %s: %v", h.Name, err)
+			reason = "scan failed"
+		case !v.Clean:
+			log.Printf("Upload infected: %s (%s)", h.Name, v.Signature)
+			reason = "infected: " + v.Signature
+		}
+		if reason == "" {
+			// Record the verdict first so the file never appears without it.
+			dest := filepath.Join(uploadDir, h.Name)
+			m := h.Meta
+			m.Scan = &v
+			m.Encrypted = encryptsAtRest(toID != "")
+			if err := writeMeta(dest, m); err != nil {
+				log.Printf("Error recording scan verdict for %s: %v", dest, err)
+			}
+			if err := publishQuarantined(h.Path, dest, toID != ""); err != nil {
+				log.Printf("Error releasing %s from quarantine: %v", h.Name, err)
+				share.Remove(metaPathFor(dest))
+				reason = "could not save file"
+			} else {
+				released = append(released, h.Name)
+				entry.Detail = "scanned clean by " + v.Scanner
+				record(entry)
+				continue
+			}
+		}
+		entry.Outcome, entry.Detail = audit.OutcomeRejected, reason
+		record(entry)
+		share.Remove(h.Path)
+		if fromID != "" {
+			discovery.Notify(fromID, "upload-rejected", map[string]interface{}{
+				"name":   h.Name,
+				"reason": reason,
+			})
+		}
+	}
+	if len(released) > 0 {
+		announceUpload(fromID, toID, released, false)
+	}
+}
+
+// publishQuarantined moves a scanned file to its destination, encrypting
+// it on the way when it is bound for a private inbox.
+func publishQuarantined(src, dest string, private bool) error {
+	if !encryptsAtRest(private) {
+		return share.Move(src, dest)
+	}
+	f, err := share.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := saveFile(dest, f, true); err != nil {
+		return err
+	}
+	return share.Remove(src)
+}
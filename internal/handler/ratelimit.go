@@ -1,11 +1,11 @@
 package handler
 
 import (
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
+
+	"fileshare/internal/network"
 )
 
 // rateLimiter tracks request counts per IP using a sliding window.
@@ -23,6 +23,35 @@ type visitor struct {
 
 var defaultLimiter = newRateLimiter(300, time.Minute) // 300 requests/minute per IP
 
+// maxStreamsPerIP bounds the long-lived connections (SSE and WebSocket)
+// one client address may hold open, since they bypass the rate limit.
+const maxStreamsPerIP = 32
+
+var (
+	streamsLock sync.Mutex
+	openStreams = make(map[string]int)
+)
+
+// acquireStream counts a long-lived connection from ip, reporting false
+// if the address already has maxStreamsPerIP open.
+func acquireStream(ip string) bool {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	if openStreams[ip] >= maxStreamsPerIP {
+		return false
+	}
+	openStreams[ip]++
+	return true
+}
+
+func releaseStream(ip string) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	if openStreams[ip]--; openStreams[ip] <= 0 {
+		delete(openStreams, ip)
+	}
+}
+
 func newRateLimiter(rate int, window time.Duration) *rateLimiter {
 	rl := &rateLimiter{rate: rate, window: window}
 	// Background cleanup of stale visitor entries
@@ -58,36 +87,27 @@ func (rl *rateLimiter) allow(ip string) bool {
 	return v.count <= rl.rate
 }
 
-func getIP(r *http.Request) string {
-	// Check X-Forwarded-For for reverse proxy setups (Koyeb, Cloudflare, etc.)
-	// Format: "client, proxy1, proxy2" — take the first (original client) IP.
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if i := strings.IndexByte(xff, ','); i > 0 {
-			return strings.TrimSpace(xff[:i])
-		}
-		return strings.TrimSpace(xff)
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
-}
-
 // RateLimit wraps a handler with per-IP rate limiting.
-// SSE (long-lived connections) and health checks are exempt.
+// SSE and WebSocket (long-lived connections) and health checks are exempt;
+// streams are instead capped per IP.
 func RateLimit(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Exempt SSE and health endpoints — SSE is a single long-lived
-		// connection, not repeated requests.
-		if r.URL.Path == "/api/events" || r.URL.Path == "/health" {
+		ip := network.ClientIP(r)
+		// Exempt SSE, WebSocket and health endpoints — each stream is a
+		// single long-lived connection, not repeated requests.
+		switch r.URL.Path {
+		case "/api/events", "/api/p2p/events", "/api/ws":
+			if !acquireStream(ip) {
+				http.Error(w, "Too many open connections", http.StatusTooManyRequests)
+				return
+			}
+			defer releaseStream(ip)
+			h(w, r)
+			return
+		case "/health":
 			h(w, r)
 			return
 		}
-		ip := getIP(r)
 		if !defaultLimiter.allow(ip) {
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
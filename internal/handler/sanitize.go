@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"fileshare/internal/imagemeta"
+	"fileshare/internal/sandbox"
+)
+
+// Metadata stripping modes for SetMetadataStripping.
+const (
+	StripOff    = "off"
+	StripPublic = "public" // only files put in the public share
+	StripAll    = "all"    // public share and private inboxes
+)
+
+var (
+	stripLock sync.RWMutex
+	stripMode = StripOff
+)
+
+// SetMetadataStripping chooses which uploads have EXIF, GPS and XMP
+// metadata removed from JPEG and PNG images. Uploads can also opt in
+// individually with the strip_metadata=1 form field.
+func SetMetadataStripping(mode string) error {
+	switch mode {
+	case "":
+		mode = StripOff
+	case StripOff, StripPublic, StripAll:
+	default:
+		return fmt.Errorf("unknown metadata stripping mode %q (want off, public or all)", mode)
+	}
+	stripLock.Lock()
+	stripMode = mode
+	stripLock.Unlock()
+	return nil
+}
+
+// shouldStrip reports whether an upload to toID ("" for public) should be
+// sanitized, given the per-upload request.
+func shouldStrip(toID string, requested bool) bool {
+	stripLock.RLock()
+	mode := stripMode
+	stripLock.RUnlock()
+	return requested || mode == StripAll || (mode == StripPublic && toID == "")
+}
+
+// saveUpload stores an uploaded file like saveFile, first passing it
+// through the image metadata stripper when strip is set. The stripper
+// streams, so the file is never held in memory. The returned metadata
+// records the SHA-256 of the stored (pre-encryption) content, whether it
+// was encrypted and, for sanitized images, their format.
+func saveUpload(path string, src io.Reader, encrypt, strip bool) (fileMeta, error) {
+	h := sha256.New()
+	if !strip {
+		if err := saveFile(path, io.TeeReader(src, h), encrypt); err != nil {
+			return fileMeta{}, err
+		}
+		return fileMeta{SHA256: hex.EncodeToString(h.Sum(nil)), Encrypted: encryptsAtRest(encrypt)}, nil
+	}
+	pr, pw := io.Pipe()
+	done := make(chan imagemeta.Format, 1)
+	go func() {
+		format, err := imagemeta.Strip(pw, src)
+		pw.CloseWithError(err)
+		done <- format
+	}()
+	err := saveFile(path, io.TeeReader(pr, h), encrypt)
+	pr.CloseWithError(io.ErrClosedPipe) // unblock the stripper if saving stopped early
+	format := <-done
+	if err != nil {
+		return fileMeta{}, err
+	}
+	return fileMeta{MetadataStripped: string(format), SHA256: hex.EncodeToString(h.Sum(nil)), Encrypted: encryptsAtRest(encrypt)}, nil
+}
+
+// saveFailure turns a storage error into a per-file rejection reason.
+func saveFailure(err error) string {
+	if errors.Is(err, imagemeta.ErrMalformed) {
+		return "could not remove image metadata"
+	}
+	if sandbox.IsViolation(err) {
+		return "path not allowed"
+	}
+	return "could not save file"
+}
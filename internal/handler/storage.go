@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"fileshare/internal/atrest"
+	"fileshare/internal/network"
+	"fileshare/internal/sandbox"
+)
+
+// share confines every access to the shared directory. It is opened once
+// at startup by OpenShare; names passed to it are relative to the share,
+// e.g. "public/report.pdf" or "private/<device>/photo.jpg".
+var share *sandbox.Root
+
+// OpenShare opens dir as the shared directory. Traversal out of it is
+// always refused; symlinks inside it follow the given policy.
+func OpenShare(dir string, symlinks sandbox.SymlinkPolicy) error {
+	root, err := sandbox.Open(dir, symlinks)
+	if err != nil {
+		return err
+	}
+	if share != nil {
+		share.Close()
+	}
+	share = root
+	return nil
+}
+
+// logViolation records a blocked traversal or symlink access.
+func logViolation(r *http.Request, err error) {
+	log.Printf("Sandbox violation from %s: %v", network.ClientIP(r), err)
+}
+
+// rejectViolation answers a request whose path the sandbox refused and
+// reports whether it did so. Every violation gets the same response.
+func rejectViolation(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !sandbox.IsViolation(err) {
+		return false
+	}
+	logViolation(r, err)
+	http.Error(w, "path not allowed", http.StatusForbidden)
+	return true
+}
+
+// atRestKey, when set, encrypts files delivered to private inboxes.
+var atRestKey *atrest.Key
+
+// SetAtRestKey enables at-rest encryption of private inbox files with the
+// given master key. Files already on disk in plaintext are still served.
+func SetAtRestKey(k *atrest.Key) {
+	atRestKey = k
+}
+
+// encryptsAtRest reports whether saveFile encrypts when asked to, i.e.
+// whether a master key is configured. Callers record the answer in the
+// file's metadata, which is what serveFile trusts.
+func encryptsAtRest(encrypt bool) bool {
+	return encrypt && atRestKey != nil
+}
+
+// saveFile streams src to a new file at path, encrypting it when encrypt
+// is set and a master key is configured. A partially written file is
+// removed on error.
+func saveFile(path string, src io.Reader, encrypt bool) (err error) {
+	dst, err := share.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			share.Remove(path)
+		}
+	}()
+
+	if !encryptsAtRest(encrypt) {
+		_, err = io.Copy(dst, src)
+		return err
+	}
+	enc, err := atrest.NewWriter(dst, atRestKey)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(enc, src); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// serveFile serves a stored file, decrypting it on the fly when its
+// metadata says it is encrypted at rest. The content is never sniffed, so a
+// plaintext file that happens to look like ciphertext is served as is.
+// Range and conditional requests work either way. It reports whether the
+// whole file went out in a 200 response; a failed open or decrypt, a
+// partial range, a HEAD or an aborted transfer all report false.
+func serveFile(w http.ResponseWriter, r *http.Request, path, name string) bool {
+	f, err := share.Open(path)
+	if err != nil {
+		if !rejectViolation(w, r, err) {
+			http.NotFound(w, r)
+		}
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "internal error", 500)
+		return false
+	}
+
+	var content io.ReadSeeker = f
+	size := info.Size()
+	if m, _ := readMeta(path); m.Encrypted {
+		if atRestKey == nil {
+			log.Printf("Cannot serve %s: file is encrypted but no master key is configured", path)
+			http.Error(w, "file unavailable", 500)
+			return false
+		}
+		dec, err := atrest.NewReader(f, info.Size(), atRestKey)
+		if err != nil {
+			log.Printf("Cannot decrypt %s: %v", path, err)
+			http.Error(w, "file unavailable", 500)
+			return false
+		}
+		content, size = dec, dec.Size()
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, name, info.ModTime(), content)
+	return r.Method != "HEAD" && cw.status == http.StatusOK && cw.n == size
+}
+
+// countingWriter records the status and body length of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
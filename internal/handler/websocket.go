@@ -0,0 +1,402 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"fileshare/internal/discovery"
+	"fileshare/internal/network"
+	"fileshare/internal/ws"
+)
+
+// WebSocket keepalive and flow-control settings.
+const (
+	wsPingInterval = 25 * time.Second
+	wsReadTimeout  = 60 * time.Second // silence (no message or pong) that closes the socket
+	wsWriteTimeout = 10 * time.Second
+	wsSendQueue    = 64 // outbound messages buffered per connection
+	wsMaxRooms     = 16 // room subscriptions per connection
+)
+
+// wsMessage is the envelope of every WebSocket message. Type selects
+// which other fields are used:
+//
+//	event        server→client  discovery event Event with Data
+//	subscribe    client→server  follow Room with Token from index Since
+//	unsubscribe  client→server  stop following Room
+//	signal       client→server  post Signal to Room with Token; the sender
+//	                            of a broadcast room addresses receiver To
+//	             server→client  Signal from Room; Index is the resume point
+//	state        client→server  report Room's State (connected or done)
+//	status       server→client  Room's state and presence (Data) changed
+//	close        client→server  close Room as its sender, or leave it as a
+//	                            receiver, proving the role with Token
+//	room-closed  server→client  Room was closed or expired, or the client
+//	                            removed from it; Data has the reason
+//	transfer     client→server  relay Data to device To, which receives
+//	                            it as a "transfer" event
+//	error        server→client  Error, with Room if it concerns a room
+type wsMessage struct {
+	Type   string          `json:"type"`
+	Event  string          `json:"event,omitempty"`
+	Room   string          `json:"room,omitempty"`
+	Token  string          `json:"token,omitempty"`
+	State  string          `json:"state,omitempty"`
+	Since  int             `json:"since,omitempty"`
+	Index  int             `json:"index,omitempty"`
+	To     string          `json:"to,omitempty"`
+	Signal *P2PSignal      `json:"signal,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// wsClient is one WebSocket connection.
+type wsClient struct {
+	conn   *ws.Conn
+	req    *http.Request // the handshake, for checks on the caller
+	id     string        // device ID; empty for signaling-only clients
+	out    chan wsMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	rooms map[string]*wsSub // active subscriptions
+
+	overflow sync.Once
+}
+
+// wsSub is one room subscription. Its follow loop removes it from the
+// client's rooms on exit, unless a newer subscription has taken its place.
+type wsSub struct {
+	cancel context.CancelFunc
+}
+
+// HandleWebSocket carries discovery events, P2P signaling and transfer
+// control over one connection. The id query parameter attaches the
+// connection to a device like /api/events; without it the socket is used
+// for signaling only.
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	id, allowed := resolveDeviceID(r, r.URL.Query().Get("id"))
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
+	// Browsers send Origin on every WebSocket handshake; refuse foreign
+	// sites so they cannot drive signaling with the user's cookies.
+	if origin := r.Header.Get("Origin"); origin != "" && !isSameOrigin(r, origin) && !originAllowed(origin) {
+		log.Printf("Cross-origin WebSocket rejected (origin %q)", origin)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := ws.Upgrade(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	context.AfterFunc(ctx, func() { conn.Close() })
+	c := &wsClient{
+		conn:   conn,
+		req:    r,
+		id:     id,
+		out:    make(chan wsMessage, wsSendQueue),
+		ctx:    ctx,
+		cancel: cancel,
+		rooms:  make(map[string]*wsSub),
+	}
+	go c.writeLoop()
+
+	if id != "" {
+		q, peers := attachDevice(r, id, "WebSocket")
+		defer detachDevice(id, q, "WebSocket")
+		c.send(wsMessage{Type: "event", Event: peers.Name, Data: peers.Data})
+		go func() {
+			for {
+				select {
+				case ev := <-q:
+					c.send(wsMessage{Type: "event", Event: ev.Name, Data: ev.Data})
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	c.readLoop()
+}
+
+// send queues a message without blocking. A client that falls a whole
+// queue behind is disconnected with "try again later"; when it reconnects
+// it receives a fresh peer list and resumes its rooms by index, so
+// nothing is lost.
+func (c *wsClient) send(m wsMessage) {
+	select {
+	case c.out <- m:
+	case <-c.ctx.Done():
+	default:
+		c.overflow.Do(func() {
+			log.Printf("WebSocket client %s too slow; disconnecting", c.conn.RemoteAddr())
+			c.conn.CloseWithStatus(ws.CloseTryAgainLater, "client too slow")
+			c.cancel()
+		})
+	}
+}
+
+func (c *wsClient) sendError(room, msg string) {
+	c.send(wsMessage{Type: "error", Room: room, Error: msg})
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case m := <-c.out:
+			data, err := json.Marshal(m)
+			if err != nil {
+				log.Printf("Error encoding WebSocket message: %v", err)
+				continue
+			}
+			if err := c.conn.WriteMessage(ws.OpText, data, time.Now().Add(wsWriteTimeout)); err != nil {
+				c.cancel()
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(ws.OpPing, nil); err != nil {
+				c.cancel()
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsClient) readLoop() {
+	defer c.cancel()
+	c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	c.conn.OnPong = func() { c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout)) }
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var ce *ws.CloseError
+			if !errors.As(err, &ce) && c.ctx.Err() == nil {
+				log.Printf("WebSocket read error from %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.sendError("", "invalid json")
+			continue
+		}
+		c.handle(m)
+	}
+}
+
+func (c *wsClient) handle(m wsMessage) {
+	switch m.Type {
+	case "subscribe":
+		room, peer, err := authorizeRoom(m.Room, m.Token)
+		if err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		room.addAddr(peer, network.ClientIP(c.req))
+		c.mu.Lock()
+		old, ok := c.rooms[m.Room]
+		if !ok && len(c.rooms) >= wsMaxRooms {
+			c.mu.Unlock()
+			c.sendError(m.Room, "too many subscriptions")
+			return
+		}
+		if ok {
+			old.cancel()
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		sub := &wsSub{cancel: cancel}
+		c.rooms[m.Room] = sub
+		c.mu.Unlock()
+		go c.follow(ctx, sub, room, m.Room, peer, m.Since)
+	case "unsubscribe":
+		c.mu.Lock()
+		if sub, ok := c.rooms[m.Room]; ok {
+			sub.cancel()
+			delete(c.rooms, m.Room)
+		}
+		c.mu.Unlock()
+	case "signal":
+		if m.Signal == nil {
+			c.sendError(m.Room, "missing signal")
+			return
+		}
+		room, peer, err := authorizeRoom(m.Room, m.Token)
+		if err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		if err := room.addSignal(peer, m.To, P2PSignal{Type: m.Signal.Type, Data: m.Signal.Data}); err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		log.Printf("P2P signal [%s] %s from %s (WebSocket)", m.Room, m.Signal.Type, peer)
+	case "state":
+		room, peer, err := authorizeRoom(m.Room, m.Token)
+		if err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		if m.State != stateConnected && m.State != stateDone {
+			c.sendError(m.Room, "state must be connected or done")
+			return
+		}
+		if err := room.reportState(peer, m.State); err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		room.seen(peer)
+		log.Printf("P2P room %s: %s reported %s (WebSocket)", m.Room, peer, m.State)
+	case "close":
+		room, peer, err := authorizeRoom(m.Room, m.Token)
+		if err != nil {
+			c.sendError(m.Room, err.Error())
+			return
+		}
+		closeRoomAs(room, peer)
+	case "transfer":
+		if c.id == "" {
+			c.sendError("", "transfer messages need a device id")
+			return
+		}
+		if err := relayTransfer(c.req, c.id, m.To, m.Data); err != nil {
+			c.sendError("", err.Error())
+		}
+	default:
+		c.sendError("", "unknown message type")
+	}
+}
+
+// follow pushes a room's signals meant for peer, from index since, as
+// they arrive, until the subscription ends, the room is removed or the
+// sender removes peer from it. On exit it frees its slot in c.rooms.
+func (c *wsClient) follow(ctx context.Context, sub *wsSub, room *P2PRoom, roomID, peer string, since int) {
+	defer room.watch(peer)()
+	defer func() {
+		sub.cancel()
+		c.mu.Lock()
+		if c.rooms[roomID] == sub {
+			delete(c.rooms, roomID)
+		}
+		c.mu.Unlock()
+	}()
+	var sent RoomStatus
+	for {
+		if !room.hasPeer(peer) {
+			reason, _ := json.Marshal(map[string]string{"reason": roomRemoved})
+			c.send(wsMessage{Type: "room-closed", Room: roomID, Data: reason})
+			return
+		}
+		if status := room.status(peer); !status.sameAs(sent) {
+			sent = status
+			data, _ := json.Marshal(status)
+			c.send(wsMessage{Type: "status", Room: roomID, Data: data})
+		}
+		pending, start, changed := room.pendingSignals(since)
+		for i, sig := range pending {
+			if visibleTo(sig, peer) {
+				c.send(wsMessage{Type: "signal", Room: roomID, Index: start + i + 1, Signal: &sig})
+			}
+		}
+		since = start + len(pending)
+
+		select {
+		case <-changed:
+		case <-room.done:
+			reason, _ := json.Marshal(map[string]string{"reason": room.closedReason()})
+			c.send(wsMessage{Type: "room-closed", Room: roomID, Data: reason})
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Errors returned when a transfer message cannot be delivered.
+var (
+	errNoPeer     = errors.New("recipient is not connected on this network")
+	errNotRelayer = errors.New("not allowed to send as this device")
+)
+
+// relayTransfer passes a transfer-control message (accept, decline,
+// cancel…) from one device to another on the same network, delivered as
+// a "transfer" event over whichever transport the recipient uses. The
+// caller r must own the sending device, or be at the address that first
+// registered it, so a claimed ID cannot be used to speak for another
+// device.
+func relayTransfer(r *http.Request, fromID, toID string, data json.RawMessage) error {
+	ip := network.ClientIP(r)
+	discovery.Lock.RLock()
+	from, okFrom := discovery.Devices[fromID]
+	to, okTo := discovery.Devices[toID]
+	sameNetwork := okFrom && okTo && from.NetworkIP == to.NetworkIP
+	var name string
+	verified := false
+	if okFrom {
+		name = from.Name
+		verified = from.FirstIP == ip || ownsDevice(r, from)
+	}
+	discovery.Lock.RUnlock()
+	if okFrom && !verified {
+		log.Printf("Transfer message as %s refused for %s", fromID, ip)
+		return errNotRelayer
+	}
+	if !sameNetwork || fromID == toID {
+		return errNoPeer
+	}
+	discovery.Notify(toID, "transfer", map[string]interface{}{
+		"from":      fromID,
+		"from_name": name,
+		"data":      data,
+	})
+	return nil
+}
+
+// HandleTransfer relays a transfer-control message for clients on the
+// SSE fallback, which cannot send it over a WebSocket.
+func HandleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		From string          `json:"from"`
+		To   string          `json:"to"`
+		Data json.RawMessage `json:"data"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, ws.DefaultMaxMessage)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	fromID, allowed := resolveDeviceID(r, body.From)
+	if !allowed {
+		http.Error(w, "device identity not allowed", http.StatusForbidden)
+		return
+	}
+	if err := relayTransfer(r, fromID, body.To, body.Data); errors.Is(err, errNotRelayer) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
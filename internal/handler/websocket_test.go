@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fileshare/internal/discovery"
+)
+
+// wsTestClient is a minimal masking WebSocket client speaking wsMessage.
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func wsDial(t *testing.T, srv *httptest.Server, query string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET /api/ws" + query + " HTTP/1.1\r\nHost: " + conn.RemoteAddr().String() +
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v %v", resp, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsTestClient{conn: conn, br: br}
+}
+
+func (c *wsTestClient) send(m wsMessage) {
+	data, _ := json.Marshal(m)
+	frame := []byte{0x81}
+	if len(data) <= 125 {
+		frame = append(frame, 0x80|byte(len(data)))
+	} else {
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(data)))
+	}
+	frame = append(frame, 0, 0, 0, 0) // a zero mask leaves the payload as is
+	c.conn.Write(append(frame, data...))
+}
+
+// next returns the next message of the given type, skipping others.
+func (c *wsTestClient) next(t *testing.T, typ string) wsMessage {
+	t.Helper()
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			t.Fatalf("waiting for %q: %v", typ, err)
+		}
+		n := int(hdr[1] & 0x7F)
+		if n == 126 {
+			var ext [2]byte
+			io.ReadFull(c.br, ext[:])
+			n = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		data := make([]byte, n)
+		io.ReadFull(c.br, data)
+		if hdr[0]&0x0F != 0x1 {
+			continue // ping
+		}
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("bad message %q: %v", data, err)
+		}
+		if m.Type == typ {
+			return m
+		}
+	}
+}
+
+func newWSServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHandleWebSocket_EventsAndTransfer(t *testing.T) {
+	srv := newWSServer(t)
+	t.Cleanup(func() {
+		discovery.Lock.Lock()
+		delete(discovery.Devices, "dev_ws_alice")
+		delete(discovery.Devices, "dev_ws_bob")
+		delete(discovery.Devices, "dev_ws_carol")
+		discovery.Lock.Unlock()
+	})
+
+	alice := wsDial(t, srv, "?id=dev_ws_alice")
+	if m := alice.next(t, "event"); m.Event != "peers" {
+		t.Fatalf("expected initial peers event, got %q", m.Event)
+	}
+	bob := wsDial(t, srv, "?id=dev_ws_bob")
+	bob.next(t, "event")
+	if m := alice.next(t, "event"); m.Event != "device-joined" || !strings.Contains(string(m.Data), "dev_ws_bob") {
+		t.Fatalf("expected device-joined for bob, got %q %s", m.Event, m.Data)
+	}
+
+	bob.send(wsMessage{Type: "transfer", To: "dev_ws_alice", Data: json.RawMessage(`{"action":"accepted"}`)})
+	m := alice.next(t, "event")
+	var payload struct {
+		From string          `json:"from"`
+		Data json.RawMessage `json:"data"`
+	}
+	json.Unmarshal(m.Data, &payload)
+	if m.Event != "transfer" || payload.From != "dev_ws_bob" || string(payload.Data) != `{"action":"accepted"}` {
+		t.Errorf("unexpected transfer event %q %s", m.Event, m.Data)
+	}
+
+	bob.send(wsMessage{Type: "transfer", To: "dev_ws_nobody"})
+	if e := bob.next(t, "error"); e.Error == "" {
+		t.Error("expected an error for an unknown recipient")
+	}
+
+	// A device first registered elsewhere cannot be spoken for by
+	// claiming its ID.
+	discovery.Lock.Lock()
+	discovery.Devices["dev_ws_carol"] = &discovery.Device{
+		ID: "dev_ws_carol", FirstIP: "192.0.2.7",
+		NetworkIP: discovery.Devices["dev_ws_alice"].NetworkIP,
+	}
+	discovery.Lock.Unlock()
+	mallory := wsDial(t, srv, "?id=dev_ws_carol")
+	mallory.send(wsMessage{Type: "transfer", To: "dev_ws_alice", Data: json.RawMessage(`{"action":"cancel"}`)})
+	if e := mallory.next(t, "error"); e.Error != errNotRelayer.Error() {
+		t.Errorf("expected relay to be refused, got %+v", e)
+	}
+}
+
+func TestHandleWebSocket_SubscriptionLimit(t *testing.T) {
+	srv := newWSServer(t)
+	c := wsDial(t, srv, "")
+	for i := 0; i <= wsMaxRooms; i++ {
+		room := createRoom(t)
+		c.send(wsMessage{Type: "subscribe", Room: room.ID, Token: room.Receiver})
+	}
+	if e := c.next(t, "error"); e.Error != "too many subscriptions" {
+		t.Errorf("expected subscription limit error, got %+v", e)
+	}
+}
+
+func TestHandleWebSocket_EndedSubscriptionsFreeSlots(t *testing.T) {
+	srv := newWSServer(t)
+	c := wsDial(t, srv, "")
+	// Rooms closed one after another never pile up against the limit: a
+	// refused subscription would never report its room closed.
+	for i := 0; i < 2*wsMaxRooms; i++ {
+		room := createRoom(t)
+		c.send(wsMessage{Type: "subscribe", Room: room.ID, Token: room.Receiver})
+		c.next(t, "status")
+		c.send(wsMessage{Type: "close", Room: room.ID, Token: room.Sender})
+		if m := c.next(t, "room-closed"); m.Room != room.ID {
+			t.Fatalf("room %d: expected room-closed for %s, got %+v", i, room.ID, m)
+		}
+	}
+}
+
+func TestHandleWebSocket_Signals(t *testing.T) {
+	srv := newWSServer(t)
+	room := createRoom(t)
+
+	c := wsDial(t, srv, "")
+	c.send(wsMessage{Type: "subscribe", Room: room.ID, Token: room.Receiver})
+	time.Sleep(50 * time.Millisecond) // let the subscription start
+	sendSignal(t, room.ID, room.Sender, "offer")
+
+	m := c.next(t, "signal")
+	if m.Room != room.ID || m.Index != 1 || m.Signal == nil || m.Signal.Type != "offer" || m.Signal.From != "sender" {
+		t.Fatalf("unexpected signal message %+v", m)
+	}
+
+	c.send(wsMessage{Type: "signal", Room: room.ID, Token: room.Receiver, Signal: &P2PSignal{Type: "answer", Data: json.RawMessage(`{}`)}})
+	r, _ := lookupRoom(room.ID)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sigs, _, _ := r.signalsFor("sender", 0)
+		if len(sigs) == 1 && sigs[0].Type == "answer" && sigs[0].From == "receiver" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("answer not stored, got %+v", sigs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.send(wsMessage{Type: "subscribe", Room: "nonexistent", Token: room.Sender})
+	if e := c.next(t, "error"); e.Room != "nonexistent" {
+		t.Errorf("expected room error, got %+v", e)
+	}
+	c.send(wsMessage{Type: "subscribe", Room: room.ID, Token: room.Join})
+	if e := c.next(t, "error"); e.Error != errRoomToken.Error() {
+		t.Errorf("expected token error, got %+v", e)
+	}
+}
+
+func TestHandleWebSocket_CrossOrigin(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/ws", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	w := httptest.NewRecorder()
+	HandleWebSocket(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a foreign origin, got %d", w.Code)
+	}
+}
@@ -0,0 +1,295 @@
+// Package imagemeta removes privacy-sensitive metadata (EXIF, GPS, XMP,
+// IPTC, comments) from images as they stream through, without decoding
+// the pixels or buffering the whole file.
+//
+// JPEG and PNG are supported. JPEG files keep their JFIF, ICC profile and
+// Adobe colour segments, and the EXIF orientation tag is carried over in a
+// minimal EXIF block so photos still display upright. Data hidden after
+// the end-of-image marker is dropped. Other formats are copied unchanged.
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Format identifies the image format Strip recognised.
+type Format string
+
+// Recognised formats. None means the input was copied unchanged.
+const (
+	None Format = ""
+	JPEG Format = "jpeg"
+	PNG  Format = "png"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// ErrMalformed is returned when an image's structure cannot be parsed.
+var ErrMalformed = errors.New("imagemeta: malformed image")
+
+// Strip copies src to dst, removing metadata from JPEG and PNG images.
+// Anything else is copied as-is and reported as None.
+func Strip(dst io.Writer, src io.Reader) (Format, error) {
+	br := bufio.NewReaderSize(src, 64<<10)
+	head, _ := br.Peek(len(pngSignature))
+	switch {
+	case len(head) >= 3 && head[0] == 0xFF && head[1] == 0xD8 && head[2] == 0xFF:
+		return JPEG, stripJPEG(dst, br)
+	case bytes.Equal(head, pngSignature):
+		return PNG, stripPNG(dst, br)
+	}
+	_, err := io.Copy(dst, br)
+	return None, err
+}
+
+const (
+	markerSOS = 0xDA
+	markerEOI = 0xD9
+	markerCOM = 0xFE
+	markerAPP = 0xE0 // APP0..APP15 are 0xE0..0xEF
+)
+
+func stripJPEG(w io.Writer, br *bufio.Reader) error {
+	if _, err := br.Discard(2); err != nil { // SOI, checked by the caller
+		return err
+	}
+	if _, err := w.Write([]byte{0xFF, 0xD8}); err != nil {
+		return err
+	}
+	var pending byte // marker already consumed by copyEntropy
+	for {
+		m := pending
+		pending = 0
+		if m == 0 {
+			var err error
+			if m, err = readMarker(br); err != nil {
+				return err
+			}
+		}
+		switch {
+		case m == markerEOI:
+			// Anything after the end of the image is dropped.
+			_, err := w.Write([]byte{0xFF, markerEOI})
+			return err
+		case m == 0x01 || (m >= 0xD0 && m <= 0xD7):
+			// Standalone markers carry no length.
+			if _, err := w.Write([]byte{0xFF, m}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+			return ErrMalformed
+		}
+		n := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
+		if n < 0 {
+			return ErrMalformed
+		}
+
+		if m == markerCOM || (m >= markerAPP && m <= markerAPP+15) {
+			seg := make([]byte, n)
+			if _, err := io.ReadFull(br, seg); err != nil {
+				return ErrMalformed
+			}
+			if keepAPP(m, seg) {
+				if err := writeSegment(w, m, seg); err != nil {
+					return err
+				}
+			} else if m == markerAPP+1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				if o := exifOrientation(seg[6:]); o > 1 {
+					if err := writeSegment(w, markerAPP+1, orientationEXIF(o)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if _, err := w.Write([]byte{0xFF, m, lenBuf[0], lenBuf[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, br, int64(n)); err != nil {
+			return ErrMalformed
+		}
+		if m == markerSOS {
+			var err error
+			if pending, err = copyEntropy(w, br); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// keepAPP reports whether an APPn or COM segment is needed to render the
+// image correctly.
+func keepAPP(m byte, seg []byte) bool {
+	switch m {
+	case markerAPP: // JFIF / JFXX
+		return true
+	case markerAPP + 2:
+		return bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00"))
+	case markerAPP + 14:
+		return bytes.HasPrefix(seg, []byte("Adobe"))
+	}
+	return false
+}
+
+func writeSegment(w io.Writer, m byte, seg []byte) error {
+	hdr := []byte{0xFF, m, 0, 0}
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(seg)+2))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(seg)
+	return err
+}
+
+// readMarker reads the next 0xFF-prefixed marker, skipping fill bytes.
+func readMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil || b != 0xFF {
+		return 0, ErrMalformed
+	}
+	for {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, ErrMalformed
+		}
+		if b != 0xFF {
+			return b, nil
+		}
+	}
+}
+
+// copyEntropy copies entropy-coded scan data and returns the marker that
+// ends it, already consumed.
+func copyEntropy(w io.Writer, br *bufio.Reader) (byte, error) {
+	for {
+		chunk, err := br.ReadSlice(0xFF)
+		if err == bufio.ErrBufferFull {
+			if _, err := w.Write(chunk); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, ErrMalformed
+		}
+		if _, err := w.Write(chunk[:len(chunk)-1]); err != nil {
+			return 0, err
+		}
+		next, err := br.ReadByte()
+		for err == nil && next == 0xFF {
+			next, err = br.ReadByte()
+		}
+		if err != nil {
+			return 0, ErrMalformed
+		}
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			// Stuffed byte or restart marker: part of the scan.
+			if _, err := w.Write([]byte{0xFF, next}); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return next, nil
+	}
+}
+
+// exifOrientation returns the Orientation tag (0x0112) from IFD0 of a
+// TIFF-structured EXIF block, or 0 if absent.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 && bo.Uint16(tiff[e+2:]) == 3 {
+			if o := int(bo.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 0
+}
+
+// orientationEXIF builds an EXIF APP1 payload holding only the
+// Orientation tag.
+func orientationEXIF(o int) []byte {
+	b := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	b = binary.BigEndian.AppendUint16(b, 1)      // one IFD0 entry
+	b = binary.BigEndian.AppendUint16(b, 0x0112) // Orientation
+	b = binary.BigEndian.AppendUint16(b, 3)      // SHORT
+	b = binary.BigEndian.AppendUint32(b, 1)      // count
+	b = binary.BigEndian.AppendUint16(b, uint16(o))
+	b = append(b, 0, 0)                        // value padding
+	return binary.BigEndian.AppendUint32(b, 0) // no next IFD
+}
+
+// pngDropped lists ancillary chunks that carry metadata rather than
+// rendering information.
+var pngDropped = map[string]bool{
+	"eXIf": true, // EXIF, including GPS
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true, // includes XMP ("XML:com.adobe.xmp")
+	"tIME": true,
+}
+
+func stripPNG(w io.Writer, br *bufio.Reader) error {
+	if _, err := br.Discard(len(pngSignature)); err != nil {
+		return err
+	}
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return ErrMalformed // IEND must come first
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4])) + 4 // data + CRC
+		typ := string(hdr[4:])
+		if n-4 > 1<<31-1 {
+			return fmt.Errorf("%w: chunk %q too large", ErrMalformed, typ)
+		}
+		if pngDropped[typ] {
+			if _, err := br.Discard(int(n)); err != nil {
+				return ErrMalformed
+			}
+			continue
+		}
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, br, n); err != nil {
+			return ErrMalformed
+		}
+		if typ == "IEND" {
+			return nil // trailing data is dropped
+		}
+	}
+}
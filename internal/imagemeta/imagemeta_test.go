@@ -0,0 +1,149 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 24; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 10), 128, 255})
+		}
+	}
+	return img
+}
+
+// exifWithGPS builds an EXIF APP1 payload with an Orientation tag and a
+// recognisable GPS marker string.
+func exifWithGPS(orientation uint16) []byte {
+	b := []byte("Exif\x00\x00II\x2a\x00\x08\x00\x00\x00")
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, orientation)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	return append(b, "GPSLatitude 51.5007N GPSLongitude 0.1246W"...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	var enc bytes.Buffer
+	jpeg.Encode(&enc, testImage(), nil)
+	orig := enc.Bytes()
+
+	// Insert EXIF, XMP and a comment right after SOI, and junk after EOI.
+	var in bytes.Buffer
+	in.Write(orig[:2])
+	writeSegment(&in, markerAPP+1, exifWithGPS(6))
+	writeSegment(&in, markerAPP+1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret</x:xmpmeta>"))
+	writeSegment(&in, markerCOM, []byte("shot at home"))
+	in.Write(orig[2:])
+	in.WriteString("TRAILING-SECRET")
+
+	var out bytes.Buffer
+	format, err := Strip(&out, bytes.NewReader(in.Bytes()))
+	if err != nil || format != JPEG {
+		t.Fatalf("Strip = %q, %v", format, err)
+	}
+	for _, secret := range []string{"GPSLatitude", "xmpmeta", "shot at home", "TRAILING-SECRET"} {
+		if bytes.Contains(out.Bytes(), []byte(secret)) {
+			t.Errorf("output still contains %q", secret)
+		}
+	}
+	if exifOrientation(out.Bytes()[bytes.Index(out.Bytes(), []byte("Exif\x00\x00"))+6:]) != 6 {
+		t.Error("orientation was not preserved")
+	}
+	got, err := jpeg.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("stripped JPEG does not decode: %v", err)
+	}
+	want, _ := jpeg.Decode(bytes.NewReader(orig))
+	if !bytes.Equal(got.(*image.YCbCr).Y, want.(*image.YCbCr).Y) {
+		t.Error("pixel data changed")
+	}
+}
+
+func TestStripJPEG_Progressive(t *testing.T) {
+	// A scan containing stuffed bytes and restart markers must survive.
+	var in bytes.Buffer
+	in.Write([]byte{0xFF, 0xD8})
+	writeSegment(&in, 0xDB, make([]byte, 65))
+	in.Write([]byte{0xFF, markerSOS, 0x00, 0x03, 0x00})
+	scan := []byte{0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD0, 0x56}
+	in.Write(scan)
+	writeSegment(&in, markerAPP+13, []byte("Photoshop 3.0\x00IPTC"))
+	in.Write([]byte{0xFF, markerSOS, 0x00, 0x03, 0x00})
+	in.Write(scan)
+	in.Write([]byte{0xFF, markerEOI})
+
+	var out bytes.Buffer
+	if _, err := Strip(&out, bytes.NewReader(in.Bytes())); err != nil {
+		t.Fatalf("Strip: %v", err)
+	}
+	if bytes.Contains(out.Bytes(), []byte("IPTC")) {
+		t.Error("APP13 between scans was kept")
+	}
+	if bytes.Count(out.Bytes(), scan) != 2 {
+		t.Error("scan data was altered")
+	}
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+}
+
+func TestStripPNG(t *testing.T) {
+	var enc bytes.Buffer
+	png.Encode(&enc, testImage())
+	orig := enc.Bytes()
+	iend := bytes.Index(orig, []byte("IEND")) - 4
+
+	var in bytes.Buffer
+	in.Write(orig[:iend])
+	in.Write(pngChunk("tEXt", []byte("Comment\x00GPS 51.5007N")))
+	in.Write(pngChunk("eXIf", exifWithGPS(1)[6:]))
+	in.Write(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")))
+	in.Write(orig[iend:])
+	in.WriteString("TRAILING-SECRET")
+
+	var out bytes.Buffer
+	format, err := Strip(&out, bytes.NewReader(in.Bytes()))
+	if err != nil || format != PNG {
+		t.Fatalf("Strip = %q, %v", format, err)
+	}
+	if !bytes.Equal(out.Bytes(), orig) {
+		t.Error("expected output to equal the original metadata-free PNG")
+	}
+	if _, err := png.Decode(bytes.NewReader(out.Bytes())); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+}
+
+func TestStrip_Passthrough(t *testing.T) {
+	in := []byte("%PDF-1.7 not an image")
+	var out bytes.Buffer
+	format, err := Strip(&out, bytes.NewReader(in))
+	if err != nil || format != None || !bytes.Equal(out.Bytes(), in) {
+		t.Errorf("Strip = %q, %v, %q", format, err, out.Bytes())
+	}
+}
+
+func TestStrip_Truncated(t *testing.T) {
+	var enc bytes.Buffer
+	jpeg.Encode(&enc, testImage(), nil)
+	var out bytes.Buffer
+	if _, err := Strip(&out, bytes.NewReader(enc.Bytes()[:enc.Len()/2])); err == nil {
+		t.Error("expected error for truncated JPEG")
+	}
+}
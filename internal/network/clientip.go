@@ -0,0 +1,153 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Trusted reverse proxies. Forwarded headers are only honoured when the
+// direct peer (RemoteAddr) falls inside one of these networks.
+var (
+	proxyLock      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// SetTrustedProxies replaces the trusted proxy list. Entries may be CIDRs
+// ("10.0.0.0/8") or bare addresses ("127.0.0.1").
+func SetTrustedProxies(entries []string) error {
+	nets, err := ParseCIDRs(entries)
+	if err != nil {
+		return err
+	}
+	proxyLock.Lock()
+	trustedProxies = nets
+	proxyLock.Unlock()
+	return nil
+}
+
+// ParseCIDRs parses a list of CIDRs or bare IP addresses. Blank entries
+// are ignored so comma-separated config values can be passed straight in.
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", e)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", e, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ContainsIP reports whether ip falls inside any of the given networks.
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+	return ip != nil && ContainsIP(trustedProxies, ip)
+}
+
+// ClientIP resolves the originating client address of a request.
+//
+// Forwarded, X-Forwarded-For and X-Real-IP are only consulted when the
+// direct peer is a trusted proxy. The forwarding chain is then walked from
+// right to left, skipping trusted hops, so a client cannot prepend a
+// forged address to the header and have it picked up.
+func ClientIP(r *http.Request) string {
+	remote := stripPort(r.RemoteAddr)
+	if !isTrustedProxy(net.ParseIP(remote)) {
+		return remote
+	}
+
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(chain) == 0 {
+		if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+			chain = []string{xri}
+		}
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := stripPort(chain[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			// "unknown" or an obfuscated identifier — nothing further
+			// left in the chain can be trusted.
+			break
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded headers,
+// in order from the original client to the nearest proxy.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, elem := range splitList(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(k, "for") {
+				continue
+			}
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// stripPort removes an optional port and IPv6 brackets from an address
+// ("1.2.3.4:80", "[::1]:80", "[::1]" and "::1" are all accepted).
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
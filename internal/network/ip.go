@@ -28,3 +28,16 @@ func GetLocalIP() string {
 	}
 	return "127.0.0.1"
 }
+
+// InterfaceIPs returns every unicast address configured on the machine,
+// including loopback, for use in certificate SANs.
+func InterfaceIPs() []net.IP {
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsMulticast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
@@ -2,6 +2,7 @@ package network
 
 import (
 	"net"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -23,3 +24,48 @@ func TestGetLocalIP(t *testing.T) {
 		t.Errorf("expected IPv4 address, got %q", ip)
 	}
 }
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "::1"}); err != nil {
+		t.Fatalf("SetTrustedProxies: %v", err)
+	}
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		name     string
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{"untrusted peer ignores XFF", "192.168.1.5:54321", map[string]string{"X-Forwarded-For": "203.0.113.50"}, "192.168.1.5"},
+		{"untrusted peer ignores X-Real-IP", "192.168.1.5:54321", map[string]string{"X-Real-IP": "198.51.100.10"}, "192.168.1.5"},
+		{"RemoteAddr no port", "192.168.1.5", nil, "192.168.1.5"},
+		{"trusted peer XFF single", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.50"}, "203.0.113.50"},
+		{"trusted peer XFF chain", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.50, 70.41.3.18, 10.0.0.2"}, "70.41.3.18"},
+		{"forged XFF prefix", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.50"}, "203.0.113.50"},
+		{"trusted peer X-Real-IP", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.10"}, "198.51.100.10"},
+		{"Forwarded header", "10.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.43;proto=https, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"Forwarded preferred over XFF", "10.0.0.1:1234", map[string]string{"Forwarded": "for=192.0.2.43", "X-Forwarded-For": "203.0.113.50"}, "192.0.2.43"},
+		{"Forwarded unknown hop", "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+		{"IPv6 trusted peer", "[::1]:8080", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := ClientIP(req); got != tt.expected {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxies_Invalid(t *testing.T) {
+	if err := SetTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid proxy entry")
+	}
+}
@@ -0,0 +1,331 @@
+// Package sandbox confines file access to one directory tree.
+//
+// A Root wraps os.Root, so no name — whether it contains "..", is absolute
+// or resolves through a symlink — can reach outside the directory it was
+// opened on. On top of that it applies an explicit symlink policy and
+// reports every blocked access as ErrEscape or ErrSymlink.
+//
+// Names are relative to the root and use the OS path separator, as built
+// by filepath.Join.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy says how symbolic links inside the root are treated.
+type SymlinkPolicy string
+
+const (
+	// SymlinksDeny refuses any name that passes through a symbolic link.
+	SymlinksDeny SymlinkPolicy = "deny"
+	// SymlinksWithin follows relative links that stay inside the root.
+	// Links that point outside are always refused.
+	SymlinksWithin SymlinkPolicy = "within"
+)
+
+// ParseSymlinkPolicy validates a policy name.
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(s); p {
+	case SymlinksDeny, SymlinksWithin:
+		return p, nil
+	}
+	return "", fmt.Errorf("sandbox: unknown symlink policy %q (want deny or within)", s)
+}
+
+// Errors reported, wrapped in *fs.PathError, for blocked accesses.
+var (
+	ErrEscape  = errors.New("path escapes the shared directory")
+	ErrSymlink = errors.New("path passes through a symbolic link")
+	errClosed  = errors.New("shared directory is not open")
+)
+
+// IsViolation reports whether err is a blocked traversal or symlink.
+func IsViolation(err error) bool {
+	return errors.Is(err, ErrEscape) || errors.Is(err, ErrSymlink)
+}
+
+// Root is a directory opened for confined access. It is safe for
+// concurrent use.
+type Root struct {
+	root     *os.Root
+	dir      string
+	symlinks SymlinkPolicy
+	escape   error // os.Root's own (unexported) escape error
+}
+
+// Open opens dir as a Root.
+func Open(dir string, symlinks SymlinkPolicy) (*Root, error) {
+	if _, err := ParseSymlinkPolicy(string(symlinks)); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Root{root: root, dir: dir, symlinks: symlinks, escape: escapeError(root)}, nil
+}
+
+// escapeError returns the error os.Root wraps when a name leaves the
+// root. It is not exported, so it is taken from a name that must escape.
+func escapeError(root *os.Root) error {
+	f, err := root.Open("..")
+	if err == nil {
+		f.Close()
+		return nil
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return nil
+}
+
+// Dir returns the directory the root was opened on.
+func (r *Root) Dir() string { return r.dir }
+
+// Close releases the root's directory handle.
+func (r *Root) Close() error { return r.root.Close() }
+
+// check validates name against the root. Names that are absolute or
+// contain ".." are refused outright, before os.Root sees them.
+func (r *Root) check(op, name string) error {
+	if r == nil {
+		return &fs.PathError{Op: op, Path: name, Err: errClosed}
+	}
+	if name != "." && !filepath.IsLocal(name) {
+		return &fs.PathError{Op: op, Path: name, Err: ErrEscape}
+	}
+	return nil
+}
+
+// parent returns the directory holding name, as a root, and name's last
+// element. Under SymlinksWithin that is the root itself and the whole
+// name, leaving link resolution to os.Root. Under SymlinksDeny each
+// directory is opened in turn, refusing links, and pinned by its handle,
+// so swapping a component for a link after it was checked changes
+// nothing. The caller closes dir when it is not r.root.
+func (r *Root) parent(op, name string) (dir *os.Root, base string, err error) {
+	if err := r.check(op, name); err != nil {
+		return nil, "", err
+	}
+	if r.symlinks != SymlinksDeny {
+		return r.root, name, nil
+	}
+	parts := strings.Split(name, string(filepath.Separator))
+	dir = r.root
+	for _, part := range parts[:len(parts)-1] {
+		sub, err := r.descend(op, name, dir, part)
+		if dir != r.root {
+			dir.Close()
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		dir = sub
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+// descend opens the directory part of dir, refusing a symlink. The
+// directory is checked after it is opened too, so it cannot be replaced
+// by a link in between.
+func (r *Root) descend(op, name string, dir *os.Root, part string) (*os.Root, error) {
+	fi, err := dir.Lstat(part)
+	if err != nil {
+		return nil, r.classify(op, name, err)
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: ErrSymlink}
+	}
+	sub, err := dir.OpenRoot(part)
+	if err != nil {
+		return nil, r.classify(op, name, err)
+	}
+	if st, err := sub.Stat("."); err != nil || !os.SameFile(fi, st) {
+		sub.Close()
+		return nil, &fs.PathError{Op: op, Path: name, Err: ErrSymlink}
+	}
+	return sub, nil
+}
+
+// release closes a directory returned by parent.
+func (r *Root) release(dir *os.Root) {
+	if dir != r.root {
+		dir.Close()
+	}
+}
+
+// classify maps os.Root's unexported escape error onto ErrEscape.
+func (r *Root) classify(op, name string, err error) error {
+	if err != nil && r.escape != nil && errors.Is(err, r.escape) {
+		return &fs.PathError{Op: op, Path: name, Err: ErrEscape}
+	}
+	return err
+}
+
+// Open opens a file for reading.
+func (r *Root) Open(name string) (*os.File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file with the given flags and permissions. Under
+// SymlinksDeny a link is refused before it is opened, and the opened file
+// is compared with the name once more afterwards, so a link swapped in
+// meanwhile is caught too.
+func (r *Root) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	dir, base, err := r.parent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(dir)
+	if r.symlinks == SymlinksDeny {
+		if fi, err := dir.Lstat(base); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: ErrSymlink}
+		}
+	}
+	f, err := dir.OpenFile(base, flag, perm)
+	if err != nil {
+		return nil, r.classify("open", name, err)
+	}
+	if r.symlinks == SymlinksDeny {
+		fi, lerr := dir.Lstat(base)
+		st, serr := f.Stat()
+		if lerr != nil || serr != nil || !os.SameFile(fi, st) {
+			f.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: ErrSymlink}
+		}
+	}
+	return f, nil
+}
+
+// Create creates or truncates a file for writing.
+func (r *Root) Create(name string) (*os.File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// Stat describes a file, following in-root symlinks the policy allows.
+func (r *Root) Stat(name string) (fs.FileInfo, error) {
+	dir, base, err := r.parent("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(dir)
+	if r.symlinks != SymlinksDeny {
+		fi, err := dir.Stat(base)
+		return fi, r.classify("stat", name, err)
+	}
+	fi, err := dir.Lstat(base)
+	if err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: ErrSymlink}
+	}
+	return fi, r.classify("stat", name, err)
+}
+
+// Remove deletes a file or empty directory. The name itself may be a
+// symlink (the link is removed, not its target).
+func (r *Root) Remove(name string) error {
+	dir, base, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	defer r.release(dir)
+	return r.classify("remove", name, dir.Remove(base))
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (r *Root) MkdirAll(name string, perm fs.FileMode) error {
+	if err := r.check("mkdir", name); err != nil {
+		return err
+	}
+	dir := r.root
+	defer func() { r.release(dir) }()
+	prefix := ""
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		prefix = filepath.Join(prefix, part)
+		if r.symlinks != SymlinksDeny {
+			if err := r.root.Mkdir(prefix, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+				return r.classify("mkdir", name, err)
+			}
+			continue
+		}
+		if err := dir.Mkdir(part, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return r.classify("mkdir", name, err)
+		}
+		sub, err := r.descend("mkdir", name, dir, part)
+		if err != nil {
+			return err
+		}
+		r.release(dir)
+		dir = sub
+	}
+	return nil
+}
+
+// ReadDir lists a directory.
+func (r *Root) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadDir(-1)
+}
+
+// ReadFile reads a whole file.
+func (r *Root) ReadFile(name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile writes data to a file, creating or truncating it.
+func (r *Root) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := r.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Move moves a file within the root. os.Root has no Rename in Go 1.24,
+// so this copies and then removes the source, keeping both ends confined.
+// Readers may see the destination while it is being written, exactly as
+// with a direct upload.
+func (r *Root) Move(oldname, newname string) error {
+	src, err := r.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := r.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		r.Remove(newname)
+		return err
+	}
+	return r.Remove(oldname)
+}
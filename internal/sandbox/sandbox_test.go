@@ -0,0 +1,108 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setup(t *testing.T, policy SymlinkPolicy) (*Root, string) {
+	t.Helper()
+	base := t.TempDir()
+	dir := filepath.Join(base, "share")
+	os.MkdirAll(filepath.Join(dir, "public"), 0755)
+	os.WriteFile(filepath.Join(dir, "public", "ok.txt"), []byte("ok"), 0644)
+	os.WriteFile(filepath.Join(base, "secret.txt"), []byte("secret"), 0644)
+	r, err := Open(dir, policy)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, dir
+}
+
+func TestTraversal(t *testing.T) {
+	r, _ := setup(t, SymlinksWithin)
+	for _, name := range []string{"../secret.txt", "public/../../secret.txt", "/etc/passwd", ""} {
+		if _, err := r.Open(name); !errors.Is(err, ErrEscape) {
+			t.Errorf("Open(%q): expected ErrEscape, got %v", name, err)
+		}
+	}
+	if data, err := r.ReadFile(filepath.Join("public", "ok.txt")); err != nil || string(data) != "ok" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	if _, err := os.Lstat("/"); err != nil {
+		t.Skip("no filesystem root")
+	}
+	for _, policy := range []SymlinkPolicy{SymlinksDeny, SymlinksWithin} {
+		t.Run(string(policy), func(t *testing.T) {
+			r, dir := setup(t, policy)
+			if err := os.Symlink("../../secret.txt", filepath.Join(dir, "public", "escape.txt")); err != nil {
+				t.Skipf("symlinks unsupported: %v", err)
+			}
+			os.Symlink("ok.txt", filepath.Join(dir, "public", "alias.txt"))
+
+			// Links out of the root are refused under every policy.
+			if _, err := r.Open(filepath.Join("public", "escape.txt")); !IsViolation(err) {
+				t.Errorf("escaping link: expected violation, got %v", err)
+			} else if policy == SymlinksWithin && !errors.Is(err, ErrEscape) {
+				t.Errorf("escaping link with within: expected ErrEscape, got %v", err)
+			}
+			_, err := r.Open(filepath.Join("public", "alias.txt"))
+			if policy == SymlinksDeny && !errors.Is(err, ErrSymlink) {
+				t.Errorf("in-root link with deny: expected ErrSymlink, got %v", err)
+			}
+			if policy == SymlinksWithin && err != nil {
+				t.Errorf("in-root link with within: unexpected error %v", err)
+			}
+
+			// The same holds for a linked directory along the way.
+			os.Symlink("public", filepath.Join(dir, "linked"))
+			for op, call := range map[string]func(string) error{
+				"Open":   func(n string) error { _, err := r.Open(n); return err },
+				"Stat":   func(n string) error { _, err := r.Stat(n); return err },
+				"Create": func(n string) error { f, err := r.Create(n); f.Close(); return err },
+			} {
+				err := call(filepath.Join("linked", "ok.txt"))
+				if policy == SymlinksDeny && !errors.Is(err, ErrSymlink) {
+					t.Errorf("%s through linked dir with deny: expected ErrSymlink, got %v", op, err)
+				}
+				if policy == SymlinksWithin && err != nil {
+					t.Errorf("%s through linked dir with within: unexpected error %v", op, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMkdirAllAndMove(t *testing.T) {
+	r, dir := setup(t, SymlinksDeny)
+	if err := r.MkdirAll(filepath.Join("private", "dev_1"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := r.WriteFile(filepath.Join("private", "dev_1", "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := r.Move(filepath.Join("private", "dev_1", "a.txt"), filepath.Join("public", "a.txt")); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "public", "a.txt")); string(data) != "hello" {
+		t.Errorf("moved content = %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "private", "dev_1", "a.txt")); !os.IsNotExist(err) {
+		t.Error("source still exists after move")
+	}
+	if err := r.MkdirAll(filepath.Join("..", "outside"), 0755); !errors.Is(err, ErrEscape) {
+		t.Errorf("MkdirAll outside: expected ErrEscape, got %v", err)
+	}
+}
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	if _, err := ParseSymlinkPolicy("follow"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
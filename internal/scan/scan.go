@@ -0,0 +1,182 @@
+// Package scan runs uploaded files through an antivirus or DLP scanner
+// before they are published.
+//
+// Two backends are built in: a clamd daemon spoken to over its INSTREAM
+// socket protocol, and an arbitrary local command that follows clamscan's
+// exit-code convention.
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds a single scan when a backend has no timeout set.
+const DefaultTimeout = 2 * time.Minute
+
+// Verdict is the outcome of scanning one file.
+type Verdict struct {
+	Clean     bool      `json:"clean"`
+	Signature string    `json:"signature,omitempty"` // what was found, if not clean
+	Scanner   string    `json:"scanner"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// Scanner inspects a file on disk. An error means the scan itself failed
+// and says nothing about the file; callers should fail closed.
+type Scanner interface {
+	Scan(ctx context.Context, path string) (Verdict, error)
+}
+
+// New builds a scanner from a spec string:
+//
+//	clamd:unix:/var/run/clamav/clamd.ctl
+//	clamd:tcp:127.0.0.1:3310
+//	cmd:/usr/local/bin/dlp-check --strict
+func New(spec string) (Scanner, error) {
+	kind, rest, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "clamd":
+		network, addr, ok := strings.Cut(rest, ":")
+		if !ok || addr == "" || (network != "unix" && network != "tcp") {
+			return nil, fmt.Errorf("scan: clamd spec must be clamd:unix:<path> or clamd:tcp:<host:port>, got %q", spec)
+		}
+		return &Clamd{Network: network, Address: addr}, nil
+	case "cmd":
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("scan: cmd spec needs a command, got %q", spec)
+		}
+		return &Command{Path: fields[0], Args: fields[1:]}, nil
+	}
+	return nil, fmt.Errorf("scan: unknown scanner %q (want clamd:… or cmd:…)", spec)
+}
+
+// Clamd scans files by streaming them to a clamd daemon.
+type Clamd struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration
+}
+
+// clamdChunk is the size of each INSTREAM chunk; clamd's StreamMaxLength
+// still bounds the total.
+const clamdChunk = 64 << 10
+
+// Scan implements Scanner using the INSTREAM command.
+func (c *Clamd) Scan(ctx context.Context, path string) (Verdict, error) {
+	v := Verdict{Scanner: "clamd"}
+	f, err := os.Open(path)
+	if err != nil {
+		return v, err
+	}
+	defer f.Close()
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return v, fmt.Errorf("scan: connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return v, err
+	}
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, rerr := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return v, fmt.Errorf("scan: send to clamd: %w", err)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return v, rerr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return v, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return v, fmt.Errorf("scan: read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	v.ScannedAt = time.Now()
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "... ERROR".
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		v.Clean = true
+		return v, nil
+	case strings.HasSuffix(result, " FOUND"):
+		v.Signature = strings.TrimSuffix(result, " FOUND")
+		return v, nil
+	}
+	return v, fmt.Errorf("scan: clamd: %s", reply)
+}
+
+// Command scans files by running a local program with the file path as
+// its last argument. Exit status 0 means clean, 1 means a finding (the
+// first line of output names it) and anything else is a scan error.
+type Command struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Scan implements Scanner.
+func (c *Command) Scan(ctx context.Context, path string) (Verdict, error) {
+	v := Verdict{Scanner: c.Path}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, append(append([]string{}, c.Args...), path)...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	v.ScannedAt = time.Now()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		v.Clean = true
+		return v, nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		v.Signature, _, _ = strings.Cut(strings.TrimSpace(out.String()), "\n")
+		if v.Signature == "" {
+			v.Signature = "rejected by " + c.Path
+		}
+		return v, nil
+	}
+	return v, fmt.Errorf("scan: %s: %v: %s", c.Path, err, strings.TrimSpace(out.String()))
+}
@@ -0,0 +1,117 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd accepts INSTREAM sessions and flags any stream containing the
+// EICAR test string.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&data, r, int64(size))
+				}
+				if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func writeTemp(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClamd(t *testing.T) {
+	s, err := New("clamd:tcp:" + fakeClamd(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	v, err := s.Scan(context.Background(), writeTemp(t, "holiday photos"))
+	if err != nil || !v.Clean {
+		t.Errorf("clean file: got %+v, %v", v, err)
+	}
+	v, err = s.Scan(context.Background(), writeTemp(t, eicar))
+	if err != nil || v.Clean || v.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected file: got %+v, %v", v, err)
+	}
+}
+
+func TestClamd_Unreachable(t *testing.T) {
+	s := &Clamd{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock")}
+	if _, err := s.Scan(context.Background(), writeTemp(t, "x")); err == nil {
+		t.Error("expected error when clamd is unreachable")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+	script := `grep -q EICAR "$1" && { echo Found-EICAR; exit 1; }; [ -s "$1" ] || exit 2; exit 0`
+	s := &Command{Path: "/bin/sh", Args: []string{"-c", script, "scan"}}
+
+	if v, err := s.Scan(context.Background(), writeTemp(t, "quarterly report")); err != nil || !v.Clean {
+		t.Errorf("clean file: got %+v, %v", v, err)
+	}
+	if v, err := s.Scan(context.Background(), writeTemp(t, eicar)); err != nil || v.Clean || v.Signature != "Found-EICAR" {
+		t.Errorf("infected file: got %+v, %v", v, err)
+	}
+	if _, err := s.Scan(context.Background(), writeTemp(t, "")); err == nil {
+		t.Error("expected error for exit status 2")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "clamd:", "clamd:udp:1.2.3.4:5", "cmd:", "virustotal:key"} {
+		if _, err := New(spec); err == nil {
+			t.Errorf("New(%q): expected error", spec)
+		}
+	}
+}
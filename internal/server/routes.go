@@ -3,12 +3,33 @@ package server
 import (
 	"net/http"
 
+	"fileshare/internal/auth"
 	"fileshare/internal/handler"
 )
 
-// wrap applies recovery + security headers + CORS + rate limit middleware to a handler.
+// wrap applies recovery + security headers + CORS + access control + rate limit + SSO session middleware to a handler.
 func wrap(h http.HandlerFunc) http.HandlerFunc {
-	return handler.Recover(handler.SecureHeaders(handler.Cors(handler.RateLimit(h))))
+	return wrapPublic(auth.Require(h))
+}
+
+// wrapPublic is wrap without the SSO session check, for endpoints that must
+// work before sign-in (the login flow itself, CSP reports).
+func wrapPublic(h http.HandlerFunc) http.HandlerFunc {
+	return handler.Recover(handler.SecureHeaders(handler.Cors(handler.AccessControl(handler.RateLimit(h)))))
+}
+
+// publicReads requires an SSO session only for state-changing requests, so
+// recipients without an account can still fetch public links while
+// creating and revoking them needs a sign-in.
+func publicReads(h http.HandlerFunc) http.HandlerFunc {
+	guarded := auth.Require(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h(w, r)
+			return
+		}
+		guarded(w, r)
+	}
 }
 
 // RegisterRoutes wires all API and static file routes to the default mux.
@@ -16,19 +37,38 @@ func RegisterRoutes(staticFS http.Handler, homeFile, notFoundFile string) {
 	// LAN API
 	http.HandleFunc("/api/register", wrap(handler.HandleRegister))
 	http.HandleFunc("/api/events", wrap(handler.HandleEvents))
+	http.HandleFunc("/api/ws", wrap(handler.HandleWebSocket))
+	http.HandleFunc("/api/transfer", wrap(handler.HandleTransfer))
 	http.HandleFunc("/api/upload", wrap(handler.HandleUpload))
 	http.HandleFunc("/api/files", wrap(handler.HandleListFiles))
 	http.HandleFunc("/api/delete/", wrap(handler.HandleDelete))
 	http.HandleFunc("/api/device/", wrap(handler.HandleGetDevice))
+	http.HandleFunc("/api/keys/", wrap(handler.HandleKey))
+	http.HandleFunc("/api/links", wrap(handler.HandleCreateLink))
+	http.HandleFunc("/api/links/", wrapPublic(publicReads(handler.HandleLink)))
 	http.HandleFunc("/api/info", wrap(handler.HandleInfo))
+	http.HandleFunc("/api/csp-report", wrapPublic(handler.HandleCSPReport))
+	// Admin routes check their own credentials (bearer token or SSO group).
+	http.HandleFunc("/api/admin/audit", wrapPublic(handler.HandleAuditQuery))
 	http.HandleFunc("/health", handler.HandleHealth)
-	http.HandleFunc("/download/", handler.HandleDownload)
+	http.HandleFunc("/download/", handler.Recover(handler.AccessControl(auth.Require(handler.HandleDownload))))
+
+	// Single sign-on (no-ops unless OIDC is configured)
+	http.HandleFunc("/auth/login", wrapPublic(auth.HandleLogin))
+	http.HandleFunc("/auth/callback", wrapPublic(auth.HandleCallback))
+	http.HandleFunc("/auth/logout", wrapPublic(auth.HandleLogout))
+	http.HandleFunc("/api/me", wrap(auth.HandleMe))
 
 	// P2P signaling API
+	http.HandleFunc("/api/p2p/config", wrap(handler.HandleP2PConfig))
 	http.HandleFunc("/api/p2p/create", wrap(handler.HandleP2PCreate))
+	http.HandleFunc("/api/p2p/join", wrap(handler.HandleP2PJoin))
+	http.HandleFunc("/api/p2p/join-code", wrap(handler.HandleP2PJoinCode))
 	http.HandleFunc("/api/p2p/signal", wrap(handler.HandleP2PSignal))
 	http.HandleFunc("/api/p2p/poll", wrap(handler.HandleP2PPoll))
+	http.HandleFunc("/api/p2p/events", wrap(handler.HandleP2PEvents))
+	http.HandleFunc("/api/p2p/rooms/", wrap(handler.HandleP2PRoom))
 
 	// Static files (homepage + assets)
-	http.HandleFunc("/", staticHandler(staticFS, homeFile, notFoundFile))
+	http.HandleFunc("/", handler.Recover(handler.SecureHeaders(auth.RequirePage(staticHandler(staticFS, homeFile, notFoundFile)))))
 }
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"mime"
@@ -13,6 +15,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"fileshare/internal/handler"
 )
 
 // staticHandler serves static files and the homepage for "/".
@@ -28,15 +32,18 @@ func staticHandler(fs http.Handler, homeFile, notFoundFile string) http.HandlerF
 		}
 
 		if r.URL.Path == "/" {
-			http.ServeFile(w, r, homeFile)
+			servePage(w, r, homeFile, http.StatusOK)
 			return
 		}
 
 		// Check if the static file exists before serving
 		filePath := filepath.Join("web", r.URL.Path)
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			w.WriteHeader(http.StatusNotFound)
-			http.ServeFile(w, r, notFoundFile)
+			servePage(w, r, notFoundFile, http.StatusNotFound)
+			return
+		}
+		if strings.HasSuffix(filePath, ".html") {
+			servePage(w, r, filePath, http.StatusOK)
 			return
 		}
 
@@ -44,8 +51,43 @@ func staticHandler(fs http.Handler, homeFile, notFoundFile string) http.HandlerF
 	}
 }
 
+// servePage writes an HTML page with the request's CSP nonce stamped onto
+// every <script> tag. Pages are never cached since the nonce changes on
+// each response.
+func servePage(w http.ResponseWriter, r *http.Request, file string, status int) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Printf("Error reading page %s: %v", file, err)
+		http.NotFound(w, r)
+		return
+	}
+	if nonce := handler.CSPNonce(r); nonce != "" {
+		data = bytes.ReplaceAll(data, []byte("<script"), []byte(`<script nonce="`+nonce+`"`))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
 // Start binds to the given port (or the next available one) and starts serving with graceful shutdown.
-func Start(port int, ip string) {
+// HTTPS is used when tlsOpts is enabled.
+func Start(port int, ip string, tlsOpts TLSOptions) {
+	var (
+		tlsConfig   *tls.Config
+		fingerprint string
+	)
+	if tlsOpts.Enabled() {
+		var err error
+		tlsConfig, fingerprint, err = loadTLS(tlsOpts)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		if tlsOpts.CertFile == "" {
+			http.HandleFunc("/ca.pem", wrapPublic(serveCA(tlsOpts.AutoDir)))
+		}
+	}
+
 	currentPort := port
 	const maxPortRetries = 10
 
@@ -62,10 +104,17 @@ func Start(port int, ip string) {
 			continue
 		}
 
-		printBanner(ip, currentPort)
+		printBanner(ip, currentPort, fingerprint)
 
 		srv := &http.Server{
-			Addr: addr,
+			Addr:      addr,
+			TLSConfig: tlsConfig,
+		}
+
+		var redirect *http.Server
+		if tlsConfig != nil && tlsOpts.RedirectPort != 0 {
+			redirect = redirectServer(tlsOpts.RedirectPort, currentPort)
+			startRedirect(redirect)
 		}
 
 		// Channel to listen for interrupt signals
@@ -74,7 +123,13 @@ func Start(port int, ip string) {
 
 		// Run server in a goroutine
 		go func() {
-			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			var err error
+			if tlsConfig != nil {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("Server error: %v", err)
 			}
 		}()
@@ -85,6 +140,9 @@ func Start(port int, ip string) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if redirect != nil {
+			redirect.Shutdown(ctx)
+		}
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Printf("  [!] Server Shutdown Failed: %+v", err)
 		}
@@ -93,13 +151,20 @@ func Start(port int, ip string) {
 	}
 }
 
-func printBanner(ip string, port int) {
+func printBanner(ip string, port int, fingerprint string) {
+	scheme := "http"
+	if fingerprint != "" {
+		scheme = "https"
+	}
 	fmt.Printf("\n  ╔═══════════════════════════════════════════════╗\n")
 	fmt.Printf("  ║              GoShare                      ║\n")
 	fmt.Printf("  ╠═══════════════════════════════════════════════╣\n")
-	fmt.Printf("  ║  Local:   http://localhost:%-17d ║\n", port)
-	fmt.Printf("  ║  Network: http://%-14s:%-12d  ║\n", ip, port)
+	fmt.Printf("  ║  Local:   %-35s ║\n", fmt.Sprintf("%s://localhost:%d", scheme, port))
+	fmt.Printf("  ║  Network: %-35s ║\n", fmt.Sprintf("%s://%s:%d", scheme, ip, port))
 	fmt.Printf("  ╚═══════════════════════════════════════════════╝\n\n")
+	if fingerprint != "" {
+		fmt.Printf("  TLS certificate SHA-256 fingerprint:\n  %s\n\n", fingerprint)
+	}
 	fmt.Printf("  Open the URL on any device in your LAN to share files.\n")
 	fmt.Printf("  Press Ctrl+C to stop.\n\n")
 }
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+
+	"fileshare/internal/handler"
+	"fileshare/internal/stun"
+	"fileshare/internal/turn"
+)
+
+// turnRoomAllocations bounds the relay allocations one P2P room may hold:
+// enough for a full broadcast room whose browsers each gather a few.
+const turnRoomAllocations = 32
+
+// TURNOptions configures the TURN relay StartSTUN can run on its port.
+type TURNOptions struct {
+	// RelayIP is the IPv4 address relayed transports are opened on;
+	// browsers must be able to reach it.
+	RelayIP net.IP
+	// MaxAllocations bounds open relay allocations (0 uses the default).
+	MaxAllocations int
+	// Bandwidth limits each allocation, in bytes per second (0 is
+	// unlimited).
+	Bandwidth int
+	// RoomBandwidth limits all of a P2P room's allocations together, in
+	// bytes per second (0 is unlimited).
+	RoomBandwidth int
+}
+
+// StartSTUN runs the built-in STUN server on the given UDP port, subject
+// to the same access policy as the HTTP API. With relay set the port is
+// also a TURN relay, and P2P rooms are issued credentials for it.
+func StartSTUN(port int, relay *TURNOptions) error {
+	if relay != nil && relay.RelayIP.To4() == nil {
+		return fmt.Errorf("TURN relay address %v is not IPv4", relay.RelayIP)
+	}
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	if relay == nil {
+		s := &stun.Server{Software: "GoShare", Allow: handler.IPAllowed}
+		go func() {
+			if err := s.Serve(conn); err != nil {
+				log.Printf("STUN server stopped: %v", err)
+			}
+		}()
+		log.Printf("STUN server listening on UDP port %d", port)
+		return nil
+	}
+
+	// The secret lives only in memory: credentials need not survive a
+	// restart, since rooms do not either.
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	s := &turn.Server{
+		Realm:              "goshare",
+		Software:           "GoShare",
+		Secret:             secret,
+		RelayIP:            relay.RelayIP.To4(),
+		MaxAllocations:     relay.MaxAllocations,
+		MaxUserAllocations: turnRoomAllocations,
+		Bandwidth:          relay.Bandwidth,
+		UserBandwidth:      relay.RoomBandwidth,
+		Allow:              handler.IPAllowed,
+		AllowPeer:          handler.TURNPeerAllowed,
+		Authorize:          handler.TURNAuthorize,
+		OnRelay:            handler.TURNRelayed,
+	}
+	go func() {
+		if err := s.Serve(conn); err != nil {
+			log.Printf("STUN/TURN server stopped: %v", err)
+		}
+	}()
+	handler.SetTURN(port, secret)
+	log.Printf("STUN/TURN server listening on UDP port %d, relaying on %s", port, relay.RelayIP)
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fileshare/internal/certs"
+	"fileshare/internal/network"
+)
+
+// TLSOptions configures HTTPS serving. The zero value serves plain HTTP.
+type TLSOptions struct {
+	// CertFile and KeyFile select a user-supplied certificate pair.
+	CertFile string
+	KeyFile  string
+	// AutoDir, when set and no pair is supplied, holds a generated local
+	// CA and a certificate covering every interface address.
+	AutoDir string
+	// ClientCAFile, when set, enables mutual TLS: client certificates
+	// signed by this CA are verified and bound to a trusted device
+	// identity. Clients without a certificate can still connect.
+	ClientCAFile string
+	// RedirectPort, when non-zero, serves plain HTTP on that port and
+	// redirects every request to the HTTPS listener.
+	RedirectPort int
+}
+
+// Enabled reports whether the server should speak HTTPS.
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.AutoDir != ""
+}
+
+// loadTLS builds the server TLS configuration and returns it along with
+// the SHA-256 fingerprint of the served certificate.
+func loadTLS(opts TLSOptions) (*tls.Config, string, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if opts.CertFile != "" {
+		cert, err = certs.Load(opts.CertFile, opts.KeyFile)
+	} else {
+		hosts := []string{"localhost"}
+		if h, herr := os.Hostname(); herr == nil && h != "" {
+			hosts = append(hosts, h)
+		}
+		cert, err = certs.EnsureLocal(opts.AutoDir, network.InterfaceIPs(), hosts)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if opts.ClientCAFile != "" {
+		pool, err := certs.LoadPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, certs.Fingerprint(cert.Leaf), nil
+}
+
+// serveCA lets devices download the local CA certificate so it can be
+// installed as trusted once, after which every re-issued leaf is accepted.
+func serveCA(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="goshare-ca.pem"`)
+		http.ServeFile(w, r, filepath.Join(dir, certs.CAFile))
+	}
+}
+
+// redirectServer returns a plain-HTTP server that sends every request to
+// the HTTPS listener on httpsPort.
+func redirectServer(port, httpsPort int) *http.Server {
+	return &http.Server{
+		Addr: fmt.Sprintf("0.0.0.0:%d", port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			} else {
+				// A bare IPv6 literal keeps its brackets; JoinHostPort adds them.
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+			target := "https://" + net.JoinHostPort(host, fmt.Sprint(httpsPort)) + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		}),
+	}
+}
+
+// startRedirect runs the HTTP→HTTPS redirect listener in the background.
+func startRedirect(srv *http.Server) {
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("  [!] HTTP redirect listener failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// maxPacket bounds a datagram read; STUN messages over UDP should fit an
+// unfragmented packet.
+const maxPacket = 1500
+
+// Server answers STUN Binding requests on a packet socket.
+type Server struct {
+	// Software, if set, is sent in the SOFTWARE attribute of responses.
+	Software string
+	// Allow, if set, is asked about each request's source address;
+	// requests it rejects are dropped without an answer.
+	Allow func(net.IP) bool
+}
+
+// Serve answers requests on conn until it is closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok || s.Allow != nil && !s.Allow(from.IP) {
+			continue
+		}
+		if resp := s.Handle(buf[:n], from); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// Handle returns the response to one datagram from a client, or nil to
+// stay silent. Anything but a well-formed Binding request is ignored, so
+// the server cannot be used to reflect traffic at a third party. The
+// access policy is Serve's to apply.
+func (s *Server) Handle(b []byte, from *net.UDPAddr) []byte {
+	req, err := Parse(b)
+	if err != nil || req.Class != ClassRequest || req.Method != MethodBinding {
+		return nil
+	}
+	// A Binding request has no attributes a server must understand;
+	// comprehension-required ones (below 0x8000) get 420 (RFC 5389 7.3.1).
+	var unknown []byte
+	for _, a := range req.Attrs {
+		if a.Type < 0x8000 {
+			unknown = binary.BigEndian.AppendUint16(unknown, a.Type)
+		}
+	}
+	var resp *Message
+	if unknown != nil {
+		resp = req.Response(ClassError)
+		resp.Add(AttrErrorCode, ErrorCode(420, "Unknown Attribute"))
+		resp.Add(AttrUnknownAttributes, unknown)
+	} else {
+		resp = req.Response(ClassSuccess)
+		resp.Add(AttrXORMappedAddress, XORAddress(from, req.TxID))
+	}
+	if s.Software != "" {
+		resp.Add(AttrSoftware, []byte(s.Software))
+	}
+	return resp.Encode()
+}
@@ -0,0 +1,253 @@
+// Package stun implements the parts of STUN (RFC 5389) that GoShare
+// needs: the message format and a Binding responder that tells browsers
+// their address as the server sees it, so WebRTC can gather
+// server-reflexive candidates without reaching a public STUN server.
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	headerSize     = 20
+	magicCookie    = 0x2112A442
+	fingerprintXOR = 0x5354554E
+)
+
+// Message classes, as they appear in the message type.
+const (
+	ClassRequest    = 0x000
+	ClassIndication = 0x010
+	ClassSuccess    = 0x100
+	ClassError      = 0x110
+)
+
+// MethodBinding is the only method a plain STUN server implements.
+const MethodBinding = 0x001
+
+// Attribute types.
+const (
+	AttrMappedAddress     = 0x0001
+	AttrUsername          = 0x0006
+	AttrMessageIntegrity  = 0x0008
+	AttrErrorCode         = 0x0009
+	AttrUnknownAttributes = 0x000A
+	AttrRealm             = 0x0014
+	AttrNonce             = 0x0015
+	AttrXORMappedAddress  = 0x0020
+	AttrSoftware          = 0x8022
+	AttrFingerprint       = 0x8028
+)
+
+var (
+	errNotSTUN     = errors.New("stun: not a STUN message")
+	errMalformed   = errors.New("stun: malformed message")
+	errFingerprint = errors.New("stun: fingerprint mismatch")
+)
+
+// Attr is a single attribute; Value excludes padding.
+type Attr struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a decoded STUN message.
+type Message struct {
+	Method uint16
+	Class  uint16
+	TxID   [12]byte
+	Attrs  []Attr
+
+	raw         []byte // the parsed bytes, for CheckIntegrity
+	integrityAt int    // offset of MESSAGE-INTEGRITY in raw, or 0
+}
+
+// IsMessage reports whether b looks like a STUN message: the two top
+// bits clear and the magic cookie in place. It lets a socket shared with
+// other protocols tell STUN apart cheaply.
+func IsMessage(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0xC0 == 0 && binary.BigEndian.Uint32(b[4:8]) == magicCookie
+}
+
+// Parse decodes a message. A FINGERPRINT attribute, if present, is
+// verified; attributes after it, and any but FINGERPRINT after
+// MESSAGE-INTEGRITY, are ignored (RFC 5389 15.4).
+func Parse(b []byte) (*Message, error) {
+	if !IsMessage(b) {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length%4 != 0 || headerSize+length != len(b) {
+		return nil, errMalformed
+	}
+	t := binary.BigEndian.Uint16(b[0:2])
+	m := &Message{
+		Method: t&0x000F | (t>>1)&0x0070 | (t>>2)&0x0F80,
+		Class:  t & 0x0110,
+		raw:    b,
+	}
+	copy(m.TxID[:], b[8:20])
+
+	for off := headerSize; off < len(b); {
+		if off+4 > len(b) {
+			return nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(b[off : off+2])
+		n := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		end := off + 4 + n
+		if end > len(b) {
+			return nil, errMalformed
+		}
+		if typ == AttrFingerprint {
+			if n != 4 || crc32.ChecksumIEEE(b[:off])^fingerprintXOR != binary.BigEndian.Uint32(b[off+4:end]) {
+				return nil, errFingerprint
+			}
+			break
+		}
+		if typ == AttrMessageIntegrity && n != 20 {
+			return nil, errMalformed
+		}
+		if m.integrityAt == 0 {
+			m.Attrs = append(m.Attrs, Attr{Type: typ, Value: b[off+4 : end]})
+			if typ == AttrMessageIntegrity {
+				m.integrityAt = off
+			}
+		}
+		off = end + (4-n%4)%4
+	}
+	return m, nil
+}
+
+// Get returns the value of the first attribute of type t.
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attrs {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Add appends an attribute.
+func (m *Message) Add(t uint16, v []byte) {
+	m.Attrs = append(m.Attrs, Attr{Type: t, Value: v})
+}
+
+// Encode serialises the message and appends a FINGERPRINT.
+func (m *Message) Encode() []byte {
+	return m.encode(nil)
+}
+
+// EncodeIntegrity is Encode with a MESSAGE-INTEGRITY keyed with key
+// before the FINGERPRINT.
+func (m *Message) EncodeIntegrity(key []byte) []byte {
+	return m.encode(key)
+}
+
+func (m *Message) encode(key []byte) []byte {
+	b := make([]byte, headerSize, 128)
+	t := m.Method&0x000F | (m.Method&0x0070)<<1 | (m.Method&0x0F80)<<2 | m.Class
+	binary.BigEndian.PutUint16(b[0:2], t)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.TxID[:])
+	for _, a := range m.Attrs {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	if key != nil {
+		// The HMAC covers the header with a length that already counts
+		// the MESSAGE-INTEGRITY attribute, but not the FINGERPRINT.
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		b = appendAttr(b, AttrMessageIntegrity, mac.Sum(nil))
+	}
+	// The length covers the fingerprint, which is computed over
+	// everything before it.
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize+8))
+	fp := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(b)^fingerprintXOR)
+	return appendAttr(b, AttrFingerprint, fp)
+}
+
+func appendAttr(b []byte, t uint16, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, t)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	return append(b, make([]byte, (4-len(v)%4)%4)...)
+}
+
+// CheckIntegrity reports whether the message carries a MESSAGE-INTEGRITY
+// attribute that is valid for key.
+func (m *Message) CheckIntegrity(key []byte) bool {
+	if m.integrityAt == 0 {
+		return false
+	}
+	b := append([]byte(nil), m.raw[:m.integrityAt]...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(m.integrityAt-headerSize+24))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b)
+	got := m.raw[m.integrityAt+4 : m.integrityAt+24]
+	return hmac.Equal(mac.Sum(nil), got)
+}
+
+// LongTermKey is the long-term credential key, MD5(username:realm:password)
+// (RFC 5389 15.4).
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// Response returns an empty response of the given class to m.
+func (m *Message) Response(class uint16) *Message {
+	return &Message{Method: m.Method, Class: class, TxID: m.TxID}
+}
+
+// XORAddress encodes addr as an XOR-MAPPED-ADDRESS value for a message
+// with transaction ID txID.
+func XORAddress(addr *net.UDPAddr, txID [12]byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 0x02
+	}
+	v := []byte{0, family}
+	v = binary.BigEndian.AppendUint16(v, uint16(addr.Port)^magicCookie>>16)
+	key := xorKey(txID)
+	for i, c := range ip {
+		v = append(v, c^key[i])
+	}
+	return v
+}
+
+// ParseXORAddress decodes an XOR-MAPPED-ADDRESS value.
+func ParseXORAddress(v []byte, txID [12]byte) (*net.UDPAddr, error) {
+	if len(v) != 8 && len(v) != 20 {
+		return nil, errMalformed
+	}
+	if (v[1] == 0x01) != (len(v) == 8) || v[1] != 0x01 && v[1] != 0x02 {
+		return nil, errMalformed
+	}
+	key := xorKey(txID)
+	ip := make(net.IP, len(v)-4)
+	for i := range ip {
+		ip[i] = v[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(v[2:4]) ^ magicCookie>>16
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// xorKey is the magic cookie followed by the transaction ID, which
+// XOR-MAPPED-ADDRESS uses to obscure the address.
+func xorKey(txID [12]byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, magicCookie), txID[:]...)
+}
+
+// ErrorCode encodes an ERROR-CODE value.
+func ErrorCode(code int, reason string) []byte {
+	return append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...)
+}
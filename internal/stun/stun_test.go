@@ -0,0 +1,186 @@
+package stun
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The sample IPv4 response from RFC 5769 section 2.2.
+const rfc5769Response = `
+0101003c 2112a442 b7e7a701 bc34d686 fa87dfae
+8022000b 74657374 20766563 746f7220
+00200008 0001a147 e112a643
+00080014 2b91f599 fd9e90c3 8c7489f9 2af9ba53 f06be7d7
+80280004 c07d4c96`
+
+func TestParse_RFC5769(t *testing.T) {
+	m, err := Parse(unhex(t, rfc5769Response))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.Method != MethodBinding || m.Class != ClassSuccess {
+		t.Errorf("got method %#x class %#x", m.Method, m.Class)
+	}
+	if v, _ := m.Get(AttrSoftware); string(v) != "test vector" {
+		t.Errorf("SOFTWARE = %q", v)
+	}
+	v, _ := m.Get(AttrXORMappedAddress)
+	addr, err := ParseXORAddress(v, m.TxID)
+	if err != nil || addr.String() != "192.0.2.1:32853" {
+		t.Errorf("XOR-MAPPED-ADDRESS = %v, %v", addr, err)
+	}
+
+	// The vectors use the short-term password as the key.
+	if !m.CheckIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")) {
+		t.Error("MESSAGE-INTEGRITY did not verify")
+	}
+	if m.CheckIntegrity([]byte("wrong")) {
+		t.Error("MESSAGE-INTEGRITY verified with the wrong key")
+	}
+
+	corrupt := unhex(t, rfc5769Response)
+	corrupt[30] ^= 1 // inside SOFTWARE
+	if _, err := Parse(corrupt); err != errFingerprint {
+		t.Errorf("corrupted message: expected fingerprint error, got %v", err)
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	for _, ip := range []string{"203.0.113.7", "2001:db8::1"} {
+		m := &Message{Method: MethodBinding, Class: ClassSuccess, TxID: [12]byte{1, 2, 3}}
+		from := &net.UDPAddr{IP: net.ParseIP(ip), Port: 54321}
+		m.Add(AttrXORMappedAddress, XORAddress(from, m.TxID))
+		m.Add(AttrSoftware, []byte("odd"))
+		key := LongTermKey("user", "realm", "pass")
+
+		got, err := Parse(m.EncodeIntegrity(key))
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", ip, err)
+		}
+		v, _ := got.Get(AttrXORMappedAddress)
+		if addr, err := ParseXORAddress(v, got.TxID); err != nil || !addr.IP.Equal(from.IP) || addr.Port != from.Port {
+			t.Errorf("%s: round trip gave %v, %v", ip, addr, err)
+		}
+		if v, _ := got.Get(AttrSoftware); string(v) != "odd" {
+			t.Errorf("%s: padded attribute came back as %q", ip, v)
+		}
+		if !got.CheckIntegrity(key) {
+			t.Errorf("%s: MESSAGE-INTEGRITY did not verify", ip)
+		}
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	valid := (&Message{Method: MethodBinding, Class: ClassRequest}).Encode()
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"short", valid[:10]},
+		{"not stun", append([]byte("GET / HTTP/1.1\r\nHost: x\r\n"), valid[:4]...)},
+		{"truncated", valid[:len(valid)-4]},
+		{"bad cookie", append(append(append([]byte{}, valid[:4]...), 0, 0, 0, 0), valid[8:]...)},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.b); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// exchange sends b to a running server and returns its answer, or nil
+// if none arrives.
+func exchange(t *testing.T, s *Server, b []byte) *Message {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(b)
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, maxPacket)
+	n, err := client.Read(buf)
+	if err != nil {
+		return nil
+	}
+	m, err := Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("bad response: %v", err)
+	}
+	if v, ok := m.Get(AttrXORMappedAddress); ok {
+		addr, _ := ParseXORAddress(v, m.TxID)
+		if addr.String() != client.LocalAddr().String() {
+			t.Errorf("mapped address %v, want %v", addr, client.LocalAddr())
+		}
+	}
+	return m
+}
+
+func TestServer_Binding(t *testing.T) {
+	req := &Message{Method: MethodBinding, Class: ClassRequest, TxID: [12]byte{9, 8, 7}}
+	resp := exchange(t, &Server{Software: "GoShare"}, req.Encode())
+	if resp == nil || resp.Class != ClassSuccess || resp.TxID != req.TxID {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if _, ok := resp.Get(AttrXORMappedAddress); !ok {
+		t.Error("response has no XOR-MAPPED-ADDRESS")
+	}
+	if v, _ := resp.Get(AttrSoftware); string(v) != "GoShare" {
+		t.Errorf("SOFTWARE = %q", v)
+	}
+}
+
+func TestServer_UnknownAttribute(t *testing.T) {
+	req := &Message{Method: MethodBinding, Class: ClassRequest}
+	req.Add(0x0042, []byte{1, 2, 3, 4})
+	req.Add(0x8042, []byte{1}) // comprehension-optional: ignored
+	resp := exchange(t, &Server{}, req.Encode())
+	if resp == nil || resp.Class != ClassError {
+		t.Fatalf("expected an error response, got %+v", resp)
+	}
+	if v, _ := resp.Get(AttrErrorCode); len(v) < 4 || int(v[2])*100+int(v[3]) != 420 {
+		t.Errorf("ERROR-CODE = %x", v)
+	}
+	if v, _ := resp.Get(AttrUnknownAttributes); hex.EncodeToString(v) != "0042" {
+		t.Errorf("UNKNOWN-ATTRIBUTES = %x", v)
+	}
+}
+
+func TestServer_Ignores(t *testing.T) {
+	indication := (&Message{Method: MethodBinding, Class: ClassIndication}).Encode()
+	request := (&Message{Method: MethodBinding, Class: ClassRequest}).Encode()
+	tests := []struct {
+		name string
+		s    *Server
+		b    []byte
+	}{
+		{"garbage", &Server{}, []byte("hello")},
+		{"indication", &Server{}, indication},
+		{"denied source", &Server{Allow: func(net.IP) bool { return false }}, request},
+	}
+	for _, tt := range tests {
+		if resp := exchange(t, tt.s, tt.b); resp != nil {
+			t.Errorf("%s: expected no answer, got %+v", tt.name, resp)
+		}
+	}
+}
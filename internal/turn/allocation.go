@@ -0,0 +1,226 @@
+package turn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"fileshare/internal/stun"
+)
+
+// allocation is one client's relayed transport address, with the peers
+// it may exchange data with and the channels bound to them.
+type allocation struct {
+	s      *Server
+	client *net.UDPAddr
+	user   string
+	txID   [12]byte // of the Allocate request, to answer retransmissions
+	relay  net.PacketConn
+	limit  *limiter
+
+	// userLimit is shared by all allocations of the user.
+	userLimit *limiter
+
+	mu       sync.Mutex
+	expires  time.Time
+	perms    map[string]time.Time // peer IP → expiry
+	channels map[uint16]*channel
+	byPeer   map[string]uint16 // peer address → channel number
+}
+
+type channel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+func newAllocation(s *Server, client *net.UDPAddr, user string, txID [12]byte, relay net.PacketConn, lifetime time.Duration) *allocation {
+	return &allocation{
+		s:        s,
+		client:   client,
+		user:     user,
+		txID:     txID,
+		relay:    relay,
+		limit:    newLimiter(s.Bandwidth),
+		expires:  time.Now().Add(lifetime),
+		perms:    make(map[string]time.Time),
+		channels: make(map[uint16]*channel),
+		byPeer:   make(map[string]uint16),
+	}
+}
+
+func (a *allocation) relayAddr() *net.UDPAddr {
+	addr := *a.relay.LocalAddr().(*net.UDPAddr)
+	addr.IP = a.s.RelayIP
+	return &addr
+}
+
+func (a *allocation) allocateResponse(req *stun.Message) *stun.Message {
+	a.mu.Lock()
+	lifetime := time.Until(a.expires).Round(time.Second)
+	a.mu.Unlock()
+	resp := req.Response(stun.ClassSuccess)
+	resp.Add(attrXORRelayedAddress, stun.XORAddress(a.relayAddr(), req.TxID))
+	resp.Add(attrLifetime, lifetimeAttr(lifetime))
+	resp.Add(stun.AttrXORMappedAddress, stun.XORAddress(a.client, req.TxID))
+	return resp
+}
+
+func (a *allocation) refresh(d time.Duration) {
+	a.mu.Lock()
+	a.expires = time.Now().Add(d)
+	a.mu.Unlock()
+}
+
+func (a *allocation) expired() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Now().After(a.expires)
+}
+
+// permit installs or refreshes a permission for peer IP.
+func (a *allocation) permit(ip net.IP) {
+	a.mu.Lock()
+	a.perms[ip.String()] = time.Now().Add(permissionLifetime)
+	a.mu.Unlock()
+}
+
+func (a *allocation) permitted(ip net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	exp, ok := a.perms[ip.String()]
+	return ok && time.Now().Before(exp)
+}
+
+// bind binds channel num to peer, or refreshes the binding. A channel
+// and a peer can each be bound only once (RFC 5766 11.2).
+func (a *allocation) bind(num uint16, peer *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if c, ok := a.channels[num]; ok && c.peer.String() != peer.String() {
+		if now.Before(c.expires) {
+			return false
+		}
+		// The channel expired and goes to a new peer: the old one must
+		// not keep receiving on it.
+		delete(a.byPeer, c.peer.String())
+	}
+	if n, ok := a.byPeer[peer.String()]; ok && n != num {
+		if c := a.channels[n]; c != nil && now.Before(c.expires) {
+			return false
+		}
+		delete(a.channels, n)
+	}
+	a.channels[num] = &channel{peer: peer, expires: now.Add(channelLifetime)}
+	a.byPeer[peer.String()] = num
+	return true
+}
+
+func (a *allocation) channelPeer(num uint16) *net.UDPAddr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.channels[num]; ok && time.Now().Before(c.expires) {
+		return c.peer
+	}
+	return nil
+}
+
+func (a *allocation) channelFor(peer *net.UDPAddr) (uint16, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	num, ok := a.byPeer[peer.String()]
+	c := a.channels[num]
+	if !ok || c == nil || c.peer.String() != peer.String() || !time.Now().Before(c.expires) {
+		return 0, false
+	}
+	return num, true
+}
+
+// sendToPeer relays data from the client to a permitted peer.
+func (a *allocation) sendToPeer(data []byte, peer *net.UDPAddr) {
+	if !a.permitted(peer.IP) || !a.s.peerReachable(a.user, peer) || !a.allow(len(data)) {
+		return
+	}
+	a.relay.WriteTo(data, peer)
+	a.count(data)
+}
+
+// relayLoop relays data from permitted peers to the client until the
+// relayed transport is closed, as ChannelData on a bound channel and as
+// a Data indication otherwise.
+func (a *allocation) relayLoop() {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		peer, ok := addr.(*net.UDPAddr)
+		if !ok || !a.permitted(peer.IP) || !a.allow(n) {
+			continue
+		}
+		data := buf[:n]
+		var out []byte
+		if num, ok := a.channelFor(peer); ok {
+			out = binary.BigEndian.AppendUint16(nil, num)
+			out = binary.BigEndian.AppendUint16(out, uint16(n))
+			out = append(out, data...)
+		} else {
+			ind := &stun.Message{Method: methodData, Class: stun.ClassIndication}
+			rand.Read(ind.TxID[:])
+			ind.Add(attrXORPeerAddress, stun.XORAddress(peer, ind.TxID))
+			ind.Add(attrData, data)
+			out = ind.Encode()
+		}
+		a.s.conn.WriteTo(out, a.client)
+		a.count(data)
+	}
+}
+
+// allow takes n bytes from the allocation's and the user's bandwidth.
+func (a *allocation) allow(n int) bool {
+	return a.userLimit.allow(n) && a.limit.allow(n)
+}
+
+// count reports relayed application data; STUN (ICE checks between the
+// peers) is not counted, so a relay that ICE did not pick stays at zero.
+func (a *allocation) count(data []byte) {
+	if a.s.OnRelay != nil && !stun.IsMessage(data) {
+		a.s.OnRelay(a.user, len(data))
+	}
+}
+
+// limiter is a token bucket holding up to one second of traffic.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter for rate bytes per second, or nil (no
+// limit) if rate is not positive.
+func newLimiter(rate int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *limiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,110 @@
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileshare/internal/stun"
+)
+
+// nonceLifetime is how long a nonce is accepted before the client is
+// told it is stale (438) and must retry with a fresh one.
+const nonceLifetime = 10 * time.Minute
+
+// Credentials returns a TURN REST API username and password for user,
+// valid for ttl: the username is "<expiry unix time>:<user>" and the
+// password is base64(HMAC-SHA1(secret, username)), so the server can
+// check them without storing anything.
+func Credentials(secret []byte, user string, ttl time.Duration) (username, password string) {
+	username = fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), user)
+	return username, restPassword(secret, username)
+}
+
+func restPassword(secret []byte, username string) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseUsername splits a REST API username into its expiry and user.
+func parseUsername(username string) (time.Time, string, bool) {
+	exp, user, ok := strings.Cut(username, ":")
+	secs, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || user == "" {
+		return time.Time{}, "", false
+	}
+	return time.Unix(secs, 0), user, true
+}
+
+// newNonce returns a nonce that embeds its issue time, authenticated with
+// the server's nonce key, so validating it needs no state.
+func (s *Server) newNonce() string {
+	ts := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	mac := hmac.New(sha1.New, s.nonceKey)
+	mac.Write(ts)
+	return hex.EncodeToString(ts) + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (s *Server) nonceValid(nonce string) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	mac := hmac.New(sha1.New, s.nonceKey)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil)[:8], b[8:]) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return time.Since(issued) < nonceLifetime
+}
+
+func randomKey() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// challenge is the error response that makes a client (re)try with
+// credentials: it carries the realm and a fresh nonce.
+func (s *Server) challenge(req *stun.Message, code int, reason string) *stun.Message {
+	resp := errorResponse(req, code, reason)
+	resp.Add(stun.AttrRealm, []byte(s.Realm))
+	resp.Add(stun.AttrNonce, []byte(s.newNonce()))
+	return resp
+}
+
+// authenticate checks a request's long-term credentials (RFC 5389 10.2.2)
+// against the REST API scheme. It returns the user and the key for
+// signing the response, or the error response to send instead.
+func (s *Server) authenticate(req *stun.Message) (user string, key []byte, errResp *stun.Message) {
+	if _, ok := req.Get(stun.AttrMessageIntegrity); !ok {
+		return "", nil, s.challenge(req, 401, "Unauthorized")
+	}
+	username, ok1 := req.Get(stun.AttrUsername)
+	realm, ok2 := req.Get(stun.AttrRealm)
+	nonce, ok3 := req.Get(stun.AttrNonce)
+	if !ok1 || !ok2 || !ok3 {
+		return "", nil, errorResponse(req, 400, "Bad Request")
+	}
+	if !s.nonceValid(string(nonce)) {
+		return "", nil, s.challenge(req, 438, "Stale Nonce")
+	}
+	expires, user, ok := parseUsername(string(username))
+	if !ok || string(realm) != s.Realm || time.Now().After(expires) {
+		return "", nil, s.challenge(req, 401, "Unauthorized")
+	}
+	key = stun.LongTermKey(string(username), s.Realm, restPassword(s.Secret, string(username)))
+	if !req.CheckIntegrity(key) {
+		return "", nil, s.challenge(req, 401, "Unauthorized")
+	}
+	return user, key, nil
+}
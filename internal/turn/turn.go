@@ -0,0 +1,510 @@
+// Package turn implements a TURN relay (RFC 5766) over UDP, for browsers
+// that cannot reach each other directly, such as on guest networks with
+// client isolation. Clients authenticate with short-lived credentials in
+// the TURN REST API scheme (see Credentials). The same socket answers
+// plain STUN Binding requests, so one port serves both.
+package turn
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"fileshare/internal/stun"
+)
+
+// TURN methods.
+const (
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+	methodChannelBind      = 0x009
+)
+
+// TURN attributes.
+const (
+	attrChannelNumber      = 0x000C
+	attrLifetime           = 0x000D
+	attrXORPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrXORRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrDontFragment       = 0x001A
+)
+
+// knownAttrs are the comprehension-required attributes the server
+// understands; requests with any other get 420.
+var knownAttrs = map[uint16]bool{
+	stun.AttrUsername:         true,
+	stun.AttrMessageIntegrity: true,
+	stun.AttrRealm:            true,
+	stun.AttrNonce:            true,
+	attrChannelNumber:         true,
+	attrLifetime:              true,
+	attrXORPeerAddress:        true,
+	attrData:                  true,
+	attrRequestedTransport:    true,
+	attrDontFragment:          true,
+}
+
+// Lifetimes from RFC 5766.
+const (
+	defaultLifetime    = 10 * time.Minute
+	maxLifetime        = time.Hour
+	permissionLifetime = 5 * time.Minute
+	channelLifetime    = 10 * time.Minute
+)
+
+// Defaults for the Server limits.
+const (
+	DefaultMaxAllocations     = 100
+	DefaultMaxUserAllocations = 16
+)
+
+const (
+	protoUDP      = 17
+	minChannel    = 0x4000
+	maxChannel    = 0x7FFF
+	maxPacket     = 1 << 16
+	sweepInterval = 30 * time.Second
+)
+
+// Server is a TURN relay. Set its fields, then call Serve.
+type Server struct {
+	// Realm is sent to clients and mixed into their credentials.
+	Realm string
+	// Software, if set, is sent in the SOFTWARE attribute of responses.
+	Software string
+	// Secret is the TURN REST API shared secret that passwords are
+	// derived from (see Credentials).
+	Secret []byte
+	// RelayIP is the IPv4 address relayed transports are opened on and
+	// advertised with; peers must be able to reach it.
+	RelayIP net.IP
+	// MaxAllocations bounds allocations overall and MaxUserAllocations
+	// per user; zero selects the defaults.
+	MaxAllocations     int
+	MaxUserAllocations int
+	// Bandwidth limits the data each allocation relays, in bytes per
+	// second in both directions combined; excess packets are dropped.
+	// Zero is unlimited.
+	Bandwidth int
+	// UserBandwidth limits the data all of a user's allocations relay
+	// together, in bytes per second; a packet between two of them counts
+	// at both. Zero is unlimited.
+	UserBandwidth int
+	// Allow, if set, is asked about every client and peer address;
+	// rejected clients are ignored and rejected peers refused.
+	Allow func(net.IP) bool
+	// AllowPeer, if set, must approve every peer address a user's
+	// clients ask for a permission or channel to, except the relay's own
+	// address: there only the same user's relayed transports can be
+	// reached anyway.
+	AllowPeer func(user string, peer net.IP) bool
+	// Authorize, if set, must approve a user before it gets an
+	// allocation, and again on every later request for it.
+	Authorize func(user string) bool
+	// OnRelay, if set, is called with the size of every application
+	// data packet relayed for user (STUN traffic such as ICE checks is
+	// not counted). It runs on the data path and must be quick.
+	OnRelay func(user string, n int)
+
+	// allowLocal lets tests relay to peers on loopback and the relay
+	// address.
+	allowLocal bool
+
+	binding  stun.Server
+	conn     net.PacketConn
+	nonceKey []byte
+
+	mu         sync.Mutex
+	allocs     map[string]*allocation // by client address
+	perUser    map[string]int
+	userLimits map[string]*limiter // UserBandwidth, shared by the user's allocations
+	relays     map[int]string      // ports of open relayed transports → user
+}
+
+// Serve relays for clients on conn until it is closed, then releases all
+// allocations.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = conn
+	s.binding = stun.Server{Software: s.Software}
+	s.nonceKey = randomKey()
+	s.allocs = make(map[string]*allocation)
+	s.perUser = make(map[string]int)
+	s.userLimits = make(map[string]*limiter)
+	s.relays = make(map[int]string)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.sweep(done)
+	defer s.closeAll()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok || s.Allow != nil && !s.Allow(from.IP) {
+			continue
+		}
+		s.handle(buf[:n], from)
+	}
+}
+
+// Allocations returns the number of open allocations.
+func (s *Server) Allocations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.allocs)
+}
+
+func (s *Server) handle(b []byte, from *net.UDPAddr) {
+	if len(b) >= 4 && b[0]&0xC0 == 0x40 {
+		s.handleChannelData(b, from)
+		return
+	}
+	req, err := stun.Parse(b)
+	if err != nil {
+		return
+	}
+	var resp []byte
+	switch {
+	case req.Method == stun.MethodBinding:
+		resp = s.binding.Handle(b, from)
+	case req.Class == stun.ClassIndication && req.Method == methodSend:
+		s.handleSend(req, from)
+	case req.Class == stun.ClassRequest:
+		resp = s.handleRequest(req, from)
+	}
+	if resp != nil {
+		s.conn.WriteTo(resp, from)
+	}
+}
+
+func (s *Server) handleRequest(req *stun.Message, from *net.UDPAddr) []byte {
+	var unknown []byte
+	for _, a := range req.Attrs {
+		if a.Type < 0x8000 && !knownAttrs[a.Type] {
+			unknown = binary.BigEndian.AppendUint16(unknown, a.Type)
+		}
+	}
+	if unknown != nil {
+		resp := errorResponse(req, 420, "Unknown Attribute")
+		resp.Add(stun.AttrUnknownAttributes, unknown)
+		return s.encode(resp, nil)
+	}
+	switch req.Method {
+	case methodAllocate, methodRefresh, methodCreatePermission, methodChannelBind:
+	default:
+		return s.encode(errorResponse(req, 400, "Bad Request"), nil)
+	}
+
+	user, key, errResp := s.authenticate(req)
+	if errResp != nil {
+		return s.encode(errResp, nil)
+	}
+	if req.Method == methodAllocate {
+		return s.encode(s.allocate(req, from, user), key)
+	}
+	s.mu.Lock()
+	a := s.allocs[from.String()]
+	s.mu.Unlock()
+	var resp *stun.Message
+	switch {
+	case a == nil:
+		resp = errorResponse(req, 437, "Allocation Mismatch")
+	case a.user != user:
+		resp = errorResponse(req, 441, "Wrong Credentials")
+	case s.Authorize != nil && !s.Authorize(user):
+		s.remove(a) // the user lost access; end the allocation early
+		resp = errorResponse(req, 403, "Forbidden")
+	case req.Method == methodRefresh:
+		resp = s.refresh(req, a)
+	case req.Method == methodCreatePermission:
+		resp = s.createPermission(req, a)
+	default:
+		resp = s.channelBind(req, a)
+	}
+	return s.encode(resp, key)
+}
+
+// encode serialises a response, signed with key when the request was
+// authenticated.
+func (s *Server) encode(m *stun.Message, key []byte) []byte {
+	if s.Software != "" {
+		m.Add(stun.AttrSoftware, []byte(s.Software))
+	}
+	if key != nil {
+		return m.EncodeIntegrity(key)
+	}
+	return m.Encode()
+}
+
+func errorResponse(req *stun.Message, code int, reason string) *stun.Message {
+	resp := req.Response(stun.ClassError)
+	resp.Add(stun.AttrErrorCode, stun.ErrorCode(code, reason))
+	return resp
+}
+
+func lifetimeAttr(d time.Duration) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(d/time.Second))
+}
+
+// requestedLifetime is the lifetime a request asks for, kept between the
+// default and the maximum.
+func requestedLifetime(req *stun.Message) time.Duration {
+	v, ok := req.Get(attrLifetime)
+	if !ok || len(v) != 4 {
+		return defaultLifetime
+	}
+	d := time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	return min(max(d, defaultLifetime), maxLifetime)
+}
+
+func (s *Server) allocate(req *stun.Message, from *net.UDPAddr, user string) *stun.Message {
+	s.mu.Lock()
+	existing := s.allocs[from.String()]
+	s.mu.Unlock()
+	if existing != nil {
+		if existing.txID == req.TxID {
+			return existing.allocateResponse(req) // a retransmission
+		}
+		return errorResponse(req, 437, "Allocation Mismatch")
+	}
+
+	transport, ok := req.Get(attrRequestedTransport)
+	switch {
+	case !ok || len(transport) != 4:
+		return errorResponse(req, 400, "Bad Request")
+	case transport[0] != protoUDP:
+		return errorResponse(req, 442, "Unsupported Transport Protocol")
+	case s.Authorize != nil && !s.Authorize(user):
+		return errorResponse(req, 403, "Forbidden")
+	}
+
+	maxAll, maxUser := s.MaxAllocations, s.MaxUserAllocations
+	if maxAll <= 0 {
+		maxAll = DefaultMaxAllocations
+	}
+	if maxUser <= 0 {
+		maxUser = DefaultMaxUserAllocations
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.allocs) >= maxAll:
+		log.Printf("TURN allocation limit (%d) reached; refusing %s", maxAll, from)
+		return errorResponse(req, 508, "Insufficient Capacity")
+	case s.perUser[user] >= maxUser:
+		log.Printf("TURN allocation quota (%d) reached for %s", maxUser, user)
+		return errorResponse(req, 486, "Allocation Quota Reached")
+	}
+	relay, err := net.ListenPacket("udp4", net.JoinHostPort(s.RelayIP.String(), "0"))
+	if err != nil {
+		log.Printf("TURN relay socket: %v", err)
+		return errorResponse(req, 508, "Insufficient Capacity")
+	}
+	if s.perUser[user] == 0 {
+		s.userLimits[user] = newLimiter(s.UserBandwidth)
+	}
+	a := newAllocation(s, from, user, req.TxID, relay, requestedLifetime(req))
+	a.userLimit = s.userLimits[user]
+	s.allocs[from.String()] = a
+	s.perUser[user]++
+	s.relays[a.relayAddr().Port] = user
+	go a.relayLoop()
+	log.Printf("TURN allocation for %s (%s) relayed on %s", from, user, a.relayAddr())
+	return a.allocateResponse(req)
+}
+
+func (s *Server) refresh(req *stun.Message, a *allocation) *stun.Message {
+	d := requestedLifetime(req)
+	if v, ok := req.Get(attrLifetime); ok && len(v) == 4 && binary.BigEndian.Uint32(v) == 0 {
+		s.remove(a)
+		d = 0
+	} else {
+		a.refresh(d)
+	}
+	resp := req.Response(stun.ClassSuccess)
+	resp.Add(attrLifetime, lifetimeAttr(d))
+	return resp
+}
+
+func (s *Server) createPermission(req *stun.Message, a *allocation) *stun.Message {
+	var peers []net.IP
+	for _, attr := range req.Attrs {
+		if attr.Type != attrXORPeerAddress {
+			continue
+		}
+		peer, err := stun.ParseXORAddress(attr.Value, req.TxID)
+		if err != nil {
+			return errorResponse(req, 400, "Bad Request")
+		}
+		if !s.peerAllowed(a.user, peer.IP) {
+			return errorResponse(req, 403, "Forbidden")
+		}
+		peers = append(peers, peer.IP)
+	}
+	if len(peers) == 0 {
+		return errorResponse(req, 400, "Bad Request")
+	}
+	for _, ip := range peers {
+		a.permit(ip)
+	}
+	return req.Response(stun.ClassSuccess)
+}
+
+func (s *Server) channelBind(req *stun.Message, a *allocation) *stun.Message {
+	cv, ok1 := req.Get(attrChannelNumber)
+	pv, ok2 := req.Get(attrXORPeerAddress)
+	if !ok1 || !ok2 || len(cv) != 4 {
+		return errorResponse(req, 400, "Bad Request")
+	}
+	num := binary.BigEndian.Uint16(cv)
+	peer, err := stun.ParseXORAddress(pv, req.TxID)
+	if err != nil || num < minChannel || num > maxChannel {
+		return errorResponse(req, 400, "Bad Request")
+	}
+	if !s.peerAllowed(a.user, peer.IP) {
+		return errorResponse(req, 403, "Forbidden")
+	}
+	if !a.bind(num, peer) {
+		return errorResponse(req, 400, "Bad Request")
+	}
+	a.permit(peer.IP)
+	return req.Response(stun.ClassSuccess)
+}
+
+// handleSend relays a Send indication's data to its peer. Indications are
+// not authenticated; they must come from the allocation's client.
+func (s *Server) handleSend(req *stun.Message, from *net.UDPAddr) {
+	s.mu.Lock()
+	a := s.allocs[from.String()]
+	s.mu.Unlock()
+	pv, ok1 := req.Get(attrXORPeerAddress)
+	data, ok2 := req.Get(attrData)
+	if a == nil || !ok1 || !ok2 {
+		return
+	}
+	if peer, err := stun.ParseXORAddress(pv, req.TxID); err == nil {
+		a.sendToPeer(data, peer)
+	}
+}
+
+// handleChannelData relays a ChannelData message to the channel's peer.
+func (s *Server) handleChannelData(b []byte, from *net.UDPAddr) {
+	num := binary.BigEndian.Uint16(b[0:2])
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if 4+n > len(b) {
+		return
+	}
+	s.mu.Lock()
+	a := s.allocs[from.String()]
+	s.mu.Unlock()
+	if a == nil {
+		return
+	}
+	if peer := a.channelPeer(num); peer != nil {
+		a.sendToPeer(b[4:4+n], peer)
+	}
+}
+
+// peerAllowed reports whether user's clients may relay to ip: the
+// relay's own address (see peerReachable), or an IPv4 unicast address
+// that is not loopback or unspecified and that both the access policy
+// and AllowPeer admit.
+func (s *Server) peerAllowed(user string, ip net.IP) bool {
+	switch {
+	case ip.To4() == nil:
+		return false
+	case ip.Equal(s.RelayIP):
+		return true
+	case s.allowLocal: // tests relay to peers on loopback
+	case ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast):
+		return false
+	case s.Allow != nil && !s.Allow(ip):
+		return false
+	}
+	return s.AllowPeer == nil || s.AllowPeer(user, ip)
+}
+
+// peerReachable reports whether user's data may go to peer now. On the
+// relay's own address only relayed transports of the same user may be
+// reached, so clients can neither use the relay to talk to other
+// services on this host nor reach another user's relays.
+func (s *Server) peerReachable(user string, peer *net.UDPAddr) bool {
+	if !peer.IP.Equal(s.RelayIP) {
+		return true
+	}
+	s.mu.Lock()
+	owner, ok := s.relays[peer.Port]
+	s.mu.Unlock()
+	if ok {
+		return owner == user
+	}
+	return s.allowLocal
+}
+
+func (s *Server) remove(a *allocation) {
+	s.mu.Lock()
+	if s.allocs[a.client.String()] == a {
+		delete(s.allocs, a.client.String())
+		delete(s.relays, a.relayAddr().Port)
+		if s.perUser[a.user]--; s.perUser[a.user] <= 0 {
+			delete(s.perUser, a.user)
+			delete(s.userLimits, a.user)
+		}
+	}
+	s.mu.Unlock()
+	a.relay.Close()
+}
+
+// sweep removes expired allocations until done is closed.
+func (s *Server) sweep(done <-chan struct{}) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			var expired []*allocation
+			s.mu.Lock()
+			for _, a := range s.allocs {
+				if a.expired() {
+					expired = append(expired, a)
+				}
+			}
+			s.mu.Unlock()
+			for _, a := range expired {
+				log.Printf("TURN allocation for %s expired", a.client)
+				s.remove(a)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	all := make([]*allocation, 0, len(s.allocs))
+	for _, a := range s.allocs {
+		all = append(all, a)
+	}
+	s.mu.Unlock()
+	for _, a := range all {
+		s.remove(a)
+	}
+}
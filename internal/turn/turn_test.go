@@ -0,0 +1,465 @@
+package turn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"fileshare/internal/stun"
+)
+
+var testSecret = []byte("test-secret")
+
+// startServer runs s on a loopback socket and returns its address.
+func startServer(t *testing.T, s *Server) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Realm == "" {
+		s.Realm = "goshare"
+	}
+	s.Secret = testSecret
+	s.RelayIP = net.IPv4(127, 0, 0, 1)
+	s.allowLocal = true
+	done := make(chan struct{})
+	go func() {
+		s.Serve(conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// client is a minimal TURN client holding the long-term credentials from
+// the last challenge.
+type client struct {
+	t        *testing.T
+	conn     *net.UDPConn
+	username string
+	password string
+	realm    string
+	nonce    string
+}
+
+func newClient(t *testing.T, server *net.UDPAddr, user string, ttl time.Duration) *client {
+	t.Helper()
+	conn, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	username, password := Credentials(testSecret, user, ttl)
+	return &client{t: t, conn: conn, username: username, password: password}
+}
+
+func (c *client) read() []byte {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPacket)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// roundTrip sends req and returns the response, retrying once with
+// credentials if challenged.
+func (c *client) roundTrip(req *stun.Message) *stun.Message {
+	c.t.Helper()
+	for range 2 {
+		attrs := req.Attrs
+		if c.nonce != "" {
+			req.Add(stun.AttrUsername, []byte(c.username))
+			req.Add(stun.AttrRealm, []byte(c.realm))
+			req.Add(stun.AttrNonce, []byte(c.nonce))
+			c.conn.Write(req.EncodeIntegrity(stun.LongTermKey(c.username, c.realm, c.password)))
+		} else {
+			c.conn.Write(req.Encode())
+		}
+		req.Attrs = attrs
+		b := c.read()
+		if b == nil {
+			c.t.Fatal("no response")
+		}
+		resp, err := stun.Parse(b)
+		if err != nil {
+			c.t.Fatalf("bad response: %v", err)
+		}
+		if code := errorCode(resp); code == 401 || code == 438 {
+			if c.nonce == "" || code == 438 {
+				realm, _ := resp.Get(stun.AttrRealm)
+				nonce, _ := resp.Get(stun.AttrNonce)
+				c.realm, c.nonce = string(realm), string(nonce)
+				continue
+			}
+		}
+		return resp
+	}
+	c.t.Fatal("still challenged after authenticating")
+	return nil
+}
+
+func errorCode(m *stun.Message) int {
+	v, ok := m.Get(stun.AttrErrorCode)
+	if m.Class != stun.ClassError || !ok || len(v) < 4 {
+		return 0
+	}
+	return int(v[2])*100 + int(v[3])
+}
+
+func newRequest(method uint16) *stun.Message {
+	m := &stun.Message{Method: method, Class: stun.ClassRequest}
+	rand.Read(m.TxID[:])
+	return m
+}
+
+// allocate makes an allocation and returns its relayed address.
+func (c *client) allocate() *net.UDPAddr {
+	c.t.Helper()
+	resp := c.roundTrip(allocateRequest())
+	if resp.Class != stun.ClassSuccess {
+		c.t.Fatalf("Allocate failed with %d", errorCode(resp))
+	}
+	v, _ := resp.Get(attrXORRelayedAddress)
+	relay, err := stun.ParseXORAddress(v, resp.TxID)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if v, _ := resp.Get(attrLifetime); binary.BigEndian.Uint32(v) != uint32(defaultLifetime/time.Second) {
+		c.t.Errorf("LIFETIME = %d", binary.BigEndian.Uint32(v))
+	}
+	return relay
+}
+
+func allocateRequest() *stun.Message {
+	req := newRequest(methodAllocate)
+	req.Add(attrRequestedTransport, []byte{protoUDP, 0, 0, 0})
+	return req
+}
+
+func (c *client) permit(peer *net.UDPAddr) {
+	c.t.Helper()
+	req := newRequest(methodCreatePermission)
+	req.Add(attrXORPeerAddress, stun.XORAddress(peer, req.TxID))
+	if resp := c.roundTrip(req); resp.Class != stun.ClassSuccess {
+		c.t.Fatalf("CreatePermission failed with %d", errorCode(resp))
+	}
+}
+
+func listenPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrom(t *testing.T, conn *net.UDPConn) (string, *net.UDPAddr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPacket)
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return "", nil
+	}
+	return string(buf[:n]), from
+}
+
+func TestAllocate_RequiresCredentials(t *testing.T) {
+	addr := startServer(t, &Server{})
+	c := newClient(t, addr, "room1", time.Hour)
+	c.conn.Write(allocateRequest().Encode())
+	resp, err := stun.Parse(c.read())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errorCode(resp) != 401 {
+		t.Fatalf("unauthenticated Allocate: got %d, want 401", errorCode(resp))
+	}
+	if v, _ := resp.Get(stun.AttrRealm); string(v) != "goshare" {
+		t.Errorf("REALM = %q", v)
+	}
+	if _, ok := resp.Get(stun.AttrNonce); !ok {
+		t.Error("challenge has no NONCE")
+	}
+}
+
+func TestAllocate_BadCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		modify func(c *client)
+		want   int
+	}{
+		{"expired", -time.Minute, nil, 401},
+		{"wrong password", time.Hour, func(c *client) { c.password = "guess" }, 401},
+		{"forged user", time.Hour, func(c *client) { c.username += "x" }, 401},
+		{"stale nonce", time.Hour, func(c *client) { c.nonce = "0000000000000000" + "0000000000000000" }, 438},
+	}
+	for _, tt := range tests {
+		addr := startServer(t, &Server{})
+		c := newClient(t, addr, "room1", tt.ttl)
+		c.conn.Write(allocateRequest().Encode())
+		resp, _ := stun.Parse(c.read())
+		realm, _ := resp.Get(stun.AttrRealm)
+		nonce, _ := resp.Get(stun.AttrNonce)
+		c.realm, c.nonce = string(realm), string(nonce)
+		if tt.modify != nil {
+			tt.modify(c)
+		}
+
+		req := allocateRequest()
+		req.Add(stun.AttrUsername, []byte(c.username))
+		req.Add(stun.AttrRealm, []byte(c.realm))
+		req.Add(stun.AttrNonce, []byte(c.nonce))
+		c.conn.Write(req.EncodeIntegrity(stun.LongTermKey(c.username, c.realm, c.password)))
+		resp, _ = stun.Parse(c.read())
+		if resp == nil || errorCode(resp) != tt.want {
+			t.Errorf("%s: got %+v, want error %d", tt.name, resp, tt.want)
+		}
+	}
+}
+
+func TestRelay_SendAndData(t *testing.T) {
+	var mu sync.Mutex
+	relayed := map[string]int{}
+	s := &Server{OnRelay: func(user string, n int) {
+		mu.Lock()
+		relayed[user] += n
+		mu.Unlock()
+	}}
+	addr := startServer(t, s)
+	c := newClient(t, addr, "room1", time.Hour)
+	relay := c.allocate()
+	resp := c.roundTrip(allocateRequest())
+	if errorCode(resp) != 437 {
+		t.Errorf("second Allocate: got %d, want 437", errorCode(resp))
+	}
+	peer := listenPeer(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	// Without a permission the peer's traffic is dropped.
+	peer.WriteToUDP([]byte("early"), relay)
+	if b := c.read(); b != nil {
+		t.Fatalf("data relayed without a permission: %q", b)
+	}
+
+	c.permit(peerAddr)
+	send := &stun.Message{Method: methodSend, Class: stun.ClassIndication}
+	send.Add(attrXORPeerAddress, stun.XORAddress(peerAddr, send.TxID))
+	send.Add(attrData, []byte("hello peer"))
+	c.conn.Write(send.Encode())
+	got, from := readFrom(t, peer)
+	if got != "hello peer" || from.Port != relay.Port {
+		t.Fatalf("peer got %q from %v, want %q from %v", got, from, "hello peer", relay)
+	}
+
+	peer.WriteToUDP([]byte("hello client"), relay)
+	ind, err := stun.Parse(c.read())
+	if err != nil || ind.Method != methodData || ind.Class != stun.ClassIndication {
+		t.Fatalf("expected a Data indication, got %+v, %v", ind, err)
+	}
+	if v, _ := ind.Get(attrData); string(v) != "hello client" {
+		t.Errorf("DATA = %q", v)
+	}
+	v, _ := ind.Get(attrXORPeerAddress)
+	if p, _ := stun.ParseXORAddress(v, ind.TxID); p.String() != peerAddr.String() {
+		t.Errorf("XOR-PEER-ADDRESS = %v, want %v", p, peerAddr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := len("hello peer") + len("hello client"); relayed["room1"] != want {
+		t.Errorf("OnRelay counted %d bytes, want %d", relayed["room1"], want)
+	}
+}
+
+func TestRelay_ChannelData(t *testing.T) {
+	addr := startServer(t, &Server{})
+	c := newClient(t, addr, "room1", time.Hour)
+	relay := c.allocate()
+	peer := listenPeer(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	bind := func(num uint16, p *net.UDPAddr) int {
+		req := newRequest(methodChannelBind)
+		req.Add(attrChannelNumber, []byte{byte(num >> 8), byte(num), 0, 0})
+		req.Add(attrXORPeerAddress, stun.XORAddress(p, req.TxID))
+		return errorCode(c.roundTrip(req))
+	}
+	if code := bind(0x3FFF, peerAddr); code != 400 {
+		t.Errorf("out-of-range channel: got %d, want 400", code)
+	}
+	if code := bind(0x4000, peerAddr); code != 0 {
+		t.Fatalf("ChannelBind failed with %d", code)
+	}
+	other := &net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port + 1}
+	if code := bind(0x4000, other); code != 400 {
+		t.Errorf("rebinding a channel to another peer: got %d, want 400", code)
+	}
+
+	msg := append([]byte{0x40, 0x00, 0, 5}, "ping!"...)
+	c.conn.Write(msg)
+	if got, _ := readFrom(t, peer); got != "ping!" {
+		t.Fatalf("peer got %q over the channel", got)
+	}
+	peer.WriteToUDP([]byte("pong"), relay)
+	b := c.read()
+	if len(b) < 4 || binary.BigEndian.Uint16(b) != 0x4000 || string(b[4:4+binary.BigEndian.Uint16(b[2:])]) != "pong" {
+		t.Errorf("expected ChannelData on 0x4000, got %x", b)
+	}
+}
+
+func TestAllocate_Limits(t *testing.T) {
+	addr := startServer(t, &Server{MaxAllocations: 3, MaxUserAllocations: 2})
+	for range 2 {
+		newClient(t, addr, "room1", time.Hour).allocate()
+	}
+	if code := errorCode(newClient(t, addr, "room1", time.Hour).roundTrip(allocateRequest())); code != 486 {
+		t.Errorf("over the per-user quota: got %d, want 486", code)
+	}
+	newClient(t, addr, "room2", time.Hour).allocate()
+	if code := errorCode(newClient(t, addr, "room3", time.Hour).roundTrip(allocateRequest())); code != 508 {
+		t.Errorf("over capacity: got %d, want 508", code)
+	}
+}
+
+func TestAllocate_AuthorizeAndRefresh(t *testing.T) {
+	s := &Server{Authorize: func(user string) bool { return user == "room1" }}
+	addr := startServer(t, s)
+	if code := errorCode(newClient(t, addr, "gone", time.Hour).roundTrip(allocateRequest())); code != 403 {
+		t.Errorf("unauthorized user: got %d, want 403", code)
+	}
+
+	c := newClient(t, addr, "room1", time.Hour)
+	c.allocate()
+	req := newRequest(methodRefresh)
+	req.Add(attrLifetime, []byte{0, 0, 0, 0})
+	if resp := c.roundTrip(req); resp.Class != stun.ClassSuccess {
+		t.Fatalf("Refresh failed with %d", errorCode(resp))
+	}
+	if n := s.Allocations(); n != 0 {
+		t.Errorf("%d allocations left after a zero-lifetime Refresh", n)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1000)
+	if !l.allow(600) || l.allow(600) {
+		t.Error("limiter should allow one second of traffic, then drop")
+	}
+	if !(*limiter)(nil).allow(1 << 20) {
+		t.Error("a nil limiter should not limit")
+	}
+}
+
+func TestPeerAllowed(t *testing.T) {
+	s := &Server{
+		RelayIP: net.IPv4(192, 168, 1, 2),
+		AllowPeer: func(user string, ip net.IP) bool {
+			return user == "room1" && ip.Equal(net.IPv4(192, 168, 1, 20))
+		},
+	}
+	tests := []struct {
+		user string
+		ip   net.IP
+		want bool
+	}{
+		{"room1", net.IPv4(192, 168, 1, 20), true},
+		{"room2", net.IPv4(192, 168, 1, 20), false},
+		{"room1", net.IPv4(192, 168, 1, 21), false},
+		{"room1", net.IPv4(8, 8, 8, 8), false},
+		{"room2", net.IPv4(192, 168, 1, 2), true}, // the relay itself
+		{"room1", net.IPv4(127, 0, 0, 1), false},
+		{"room1", net.ParseIP("fe80::1"), false},
+	}
+	for _, tt := range tests {
+		if got := s.peerAllowed(tt.user, tt.ip); got != tt.want {
+			t.Errorf("peerAllowed(%s, %v) = %v, want %v", tt.user, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRelay_OnlyOwnRelays(t *testing.T) {
+	addr := startServer(t, &Server{})
+	c1 := newClient(t, addr, "room1", time.Hour)
+	relay1 := c1.allocate()
+	c1.permit(relay1) // the relay address: every other relay
+	send := func(c *client, to *net.UDPAddr, data string) {
+		m := &stun.Message{Method: methodSend, Class: stun.ClassIndication}
+		rand.Read(m.TxID[:])
+		m.Add(attrXORPeerAddress, stun.XORAddress(to, m.TxID))
+		m.Add(attrData, []byte(data))
+		c.conn.Write(m.Encode())
+	}
+
+	other := newClient(t, addr, "room2", time.Hour)
+	other.allocate()
+	other.permit(relay1)
+	send(other, relay1, "from room2")
+	if b := c1.read(); b != nil {
+		t.Fatalf("another user's relay reached room1: %q", b)
+	}
+
+	same := newClient(t, addr, "room1", time.Hour)
+	same.allocate()
+	same.permit(relay1)
+	send(same, relay1, "from room1")
+	ind, err := stun.Parse(c1.read())
+	if err != nil || ind.Method != methodData {
+		t.Fatalf("expected a Data indication from the same user's relay, got %+v, %v", ind, err)
+	}
+	if v, _ := ind.Get(attrData); string(v) != "from room1" {
+		t.Errorf("DATA = %q", v)
+	}
+}
+
+func TestAllocation_RebindAfterExpiry(t *testing.T) {
+	a := &allocation{channels: make(map[uint16]*channel), byPeer: make(map[string]uint16)}
+	old := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5000}
+	peer := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 21), Port: 5000}
+	if !a.bind(0x4000, old) {
+		t.Fatal("bind failed")
+	}
+	a.channels[0x4000].expires = time.Now().Add(-time.Second)
+	if !a.bind(0x4000, peer) {
+		t.Fatal("rebinding an expired channel failed")
+	}
+	if _, ok := a.channelFor(old); ok {
+		t.Error("the old peer still maps to the rebound channel")
+	}
+	if num, ok := a.channelFor(peer); !ok || num != 0x4000 {
+		t.Errorf("channelFor(new peer) = %#x, %v", num, ok)
+	}
+}
+
+func TestAllocate_UserBandwidth(t *testing.T) {
+	s := &Server{UserBandwidth: 1000}
+	addr := startServer(t, s)
+	newClient(t, addr, "room1", time.Hour).allocate()
+	newClient(t, addr, "room1", time.Hour).allocate()
+	newClient(t, addr, "room2", time.Hour).allocate()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shared := s.userLimits["room1"]
+	for _, a := range s.allocs {
+		if want := s.userLimits[a.user]; a.userLimit != want || want == nil {
+			t.Errorf("allocation of %s does not use its user's limiter", a.user)
+		}
+	}
+	if shared == s.userLimits["room2"] {
+		t.Error("users share a bandwidth limiter")
+	}
+}
@@ -0,0 +1,330 @@
+// Package ws is a small server-side WebSocket implementation (RFC 6455)
+// on top of net/http, covering what GoShare needs: the opening handshake,
+// text and binary messages with fragmentation, ping/pong and the closing
+// handshake. Extensions and subprotocols are not supported.
+package ws
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcode is a frame's type.
+type Opcode byte
+
+// Opcodes defined by RFC 6455.
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// Close status codes.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	ClosePolicy        = 1008
+	CloseTooBig        = 1009
+	CloseTryAgainLater = 1013
+)
+
+// DefaultMaxMessage bounds the size of a reassembled incoming message.
+const DefaultMaxMessage = 64 << 10
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("ws: closed by peer (%d %s)", e.Code, e.Reason)
+}
+
+var (
+	errProtocol = errors.New("ws: protocol error")
+	errTooBig   = errors.New("ws: message too large")
+)
+
+// Conn is a server-side WebSocket connection. One goroutine may read
+// while others write; writes are serialised internally.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// MaxMessage bounds incoming messages; larger ones close the
+	// connection with CloseTooBig. Set it before the first read.
+	MaxMessage int64
+
+	// OnPong, if set, is called from the reading goroutine for each pong.
+	OnPong func()
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// headerHas reports whether a comma-separated header contains token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a client key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrade performs the opening handshake and takes over the connection.
+// On failure it has already written an HTTP error response. Callers are
+// responsible for checking the Origin header.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("ws: method not GET")
+	}
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("ws: not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("ws: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		http.Error(w, "invalid websocket key", http.StatusBadRequest)
+		return nil, errors.New("ws: invalid key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("ws: response does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: brw.Reader, MaxMessage: DefaultMaxMessage}, nil
+}
+
+// SetReadDeadline sets the deadline for the next reads.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// RemoteAddr returns the peer's network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// ReadMessage returns the next text or binary message, answering pings
+// and reassembling fragments on the way. After the peer closes, it
+// replies to the close and returns a *CloseError.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var (
+		op  Opcode
+		msg []byte
+	)
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			code := CloseProtocolError
+			if errors.Is(err, errTooBig) {
+				code = CloseTooBig
+			}
+			if errors.Is(err, errProtocol) || errors.Is(err, errTooBig) {
+				c.CloseWithStatus(code, err.Error())
+			}
+			return 0, nil, err
+		}
+		switch fop {
+		case OpPing:
+			if err := c.WriteControl(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if c.OnPong != nil {
+				c.OnPong()
+			}
+			continue
+		case OpClose:
+			ce := &CloseError{Code: 1005}
+			if len(payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(payload))
+				ce.Reason = string(payload[2:])
+			}
+			c.CloseWithStatus(CloseNormal, "")
+			return 0, nil, ce
+		case OpText, OpBinary:
+			if op != 0 {
+				c.CloseWithStatus(CloseProtocolError, "expected continuation")
+				return 0, nil, errProtocol
+			}
+			op = fop
+		case OpContinuation:
+			if op == 0 {
+				c.CloseWithStatus(CloseProtocolError, "unexpected continuation")
+				return 0, nil, errProtocol
+			}
+		default:
+			c.CloseWithStatus(CloseProtocolError, "unknown opcode")
+			return 0, nil, errProtocol
+		}
+		if int64(len(msg)+len(payload)) > c.MaxMessage {
+			c.CloseWithStatus(CloseTooBig, "")
+			return 0, nil, errTooBig
+		}
+		msg = append(msg, payload...)
+		if fin {
+			if op == OpText && !utf8.Valid(msg) {
+				c.CloseWithStatus(CloseInvalidData, "invalid UTF-8")
+				return 0, nil, errProtocol
+			}
+			return op, msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op Opcode, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = Opcode(hdr[0] & 0x0F)
+	if hdr[0]&0x70 != 0 || hdr[1]&0x80 == 0 {
+		// No extensions are negotiated, and clients must mask.
+		return false, 0, nil, errProtocol
+	}
+	n := int64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		u := binary.BigEndian.Uint64(ext[:])
+		if u > 1<<62 {
+			return false, 0, nil, errProtocol
+		}
+		n = int64(u)
+	}
+	if op >= OpClose && (n > 125 || !fin) {
+		return false, 0, nil, errProtocol
+	}
+	if n > c.MaxMessage {
+		return false, 0, nil, errTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *Conn) writeFrame(op Opcode, data []byte, deadline time.Time) error {
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | byte(op)
+	switch n := len(data); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == OpClose {
+		c.closeSent = true
+	}
+	c.conn.SetWriteDeadline(deadline)
+	if _, err := c.conn.Write(append(hdr, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteMessage sends a text or binary message, failing if it cannot be
+// written before the deadline (zero means none).
+func (c *Conn) WriteMessage(op Opcode, data []byte, deadline time.Time) error {
+	return c.writeFrame(op, data, deadline)
+}
+
+// controlTimeout bounds writes of control frames.
+const controlTimeout = 5 * time.Second
+
+// WriteControl sends a ping, pong or close frame.
+func (c *Conn) WriteControl(op Opcode, data []byte) error {
+	if len(data) > 125 {
+		return errTooBig
+	}
+	return c.writeFrame(op, data, time.Now().Add(controlTimeout))
+}
+
+// CloseWithStatus starts the closing handshake with the given status and
+// closes the underlying connection.
+func (c *Conn) CloseWithStatus(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.WriteControl(OpClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// Close closes the connection with a normal closure status.
+func (c *Conn) Close() error {
+	return c.CloseWithStatus(CloseNormal, "")
+}
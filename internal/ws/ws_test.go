@@ -0,0 +1,188 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient is a minimal masking WebSocket client.
+type testClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dial(t *testing.T, url string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	conn.Write([]byte(req))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: got status %d", resp.StatusCode)
+	}
+	// The example key and accept value from RFC 6455 section 1.3.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %q", got)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{conn: conn, br: br}
+}
+
+func (c *testClient) send(fin bool, op Opcode, data []byte) {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(data); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+func (c *testClient) recv(t *testing.T) (Opcode, []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	n := int(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	data := make([]byte, n)
+	io.ReadFull(c.br, data)
+	return Opcode(hdr[0] & 0x0F), data
+}
+
+// echoServer echoes every message and reports how reading ended.
+func echoServer(t *testing.T, maxMessage int64) (*httptest.Server, chan error) {
+	done := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		if maxMessage > 0 {
+			c.MaxMessage = maxMessage
+		}
+		for {
+			op, msg, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			c.WriteMessage(op, msg, time.Now().Add(time.Second))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, done
+}
+
+func TestEchoAndFragments(t *testing.T) {
+	srv, done := echoServer(t, 0)
+	c := dial(t, srv.URL)
+
+	c.send(true, OpText, []byte("hello"))
+	if op, msg := c.recv(t); op != OpText || string(msg) != "hello" {
+		t.Errorf("echo: got %d %q", op, msg)
+	}
+
+	// A fragmented message with a ping in between.
+	c.send(false, OpText, []byte("frag"))
+	c.send(true, OpPing, []byte("p"))
+	c.send(true, OpContinuation, []byte("mented"))
+	if op, msg := c.recv(t); op != OpPong || string(msg) != "p" {
+		t.Errorf("expected pong, got %d %q", op, msg)
+	}
+	if op, msg := c.recv(t); op != OpText || string(msg) != "fragmented" {
+		t.Errorf("reassembly: got %d %q", op, msg)
+	}
+
+	big := []byte(strings.Repeat("x", 60000))
+	c.send(true, OpBinary, big)
+	if op, msg := c.recv(t); op != OpBinary || len(msg) != len(big) {
+		t.Errorf("large message: got %d, %d bytes", op, len(msg))
+	}
+
+	c.send(true, OpClose, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	if op, _ := c.recv(t); op != OpClose {
+		t.Errorf("expected close reply, got %d", op)
+	}
+	var ce *CloseError
+	if err := <-done; !errors.As(err, &ce) || ce.Code != CloseNormal {
+		t.Errorf("expected CloseError 1000, got %v", err)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *testClient)
+		code int
+	}{
+		{"too big", func(c *testClient) { c.send(true, OpText, make([]byte, 200)) }, CloseTooBig},
+		{"bad utf8", func(c *testClient) { c.send(true, OpText, []byte{0xff, 0xfe}) }, CloseInvalidData},
+		{"stray continuation", func(c *testClient) { c.send(true, OpContinuation, []byte("x")) }, CloseProtocolError},
+		{"unmasked", func(c *testClient) { c.conn.Write([]byte{0x81, 0x01, 'x'}) }, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, done := echoServer(t, 100)
+			c := dial(t, srv.URL)
+			tt.send(c)
+			op, data := c.recv(t)
+			if op != OpClose || len(data) < 2 || int(binary.BigEndian.Uint16(data)) != tt.code {
+				t.Errorf("expected close %d, got op %d %v", tt.code, op, data)
+			}
+			if err := <-done; err == nil {
+				t.Error("expected read error")
+			}
+		})
+	}
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	w := httptest.NewRecorder()
+	if _, err := Upgrade(w, httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Fatal("expected error for a non-websocket request")
+	}
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("expected 426, got %d", w.Code)
+	}
+}
@@ -0,0 +1,246 @@
+// Package e2e is the reference implementation of GoShare's end-to-end
+// encrypted file envelope, for CLI clients and for server-side validation.
+//
+// Each receiving device holds a P-256 key pair and publishes the public key
+// when it registers. A sender generates an ephemeral key pair per file,
+// derives a content key with ECDH and HKDF-SHA256, and encrypts the file as
+// a chunked AES-256-GCM stream (see package stream). The server only ever
+// sees the envelope header and ciphertext.
+//
+// A device proves it holds the private key when it publishes the public
+// one by signing a server nonce with the same P-256 key used as an ECDSA
+// key (see SignKeyProof), so nobody can publish a key for another device.
+//
+// Envelope layout:
+//
+//	magic "GSE2E\x01" | recipient key ID (8) | ephemeral public key (65) | stream...
+//
+// The key ID is the first 8 bytes of SHA-256 over the recipient's
+// uncompressed public key. The content key is
+// HKDF-SHA256(secret = ECDH(ephemeral, recipient),
+// salt = ephemeral public key || recipient public key,
+// info = "goshare e2e v1"). Every primitive is available in WebCrypto so
+// browsers can implement the same format.
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"fileshare/pkg/stream"
+)
+
+const (
+	magic      = "GSE2E\x01"
+	keyIDSize  = 8
+	pubKeySize = 65 // uncompressed P-256 point
+	info       = "goshare e2e v1"
+	proofInfo  = "goshare key binding v1"
+)
+
+// HeaderSize is the number of bytes before the encrypted stream.
+const HeaderSize = len(magic) + keyIDSize + pubKeySize
+
+// Errors returned while parsing envelopes.
+var (
+	ErrNotEnvelope = errors.New("e2e: not an encrypted envelope")
+	ErrWrongKey    = errors.New("e2e: envelope is addressed to a different key")
+	ErrCorrupt     = stream.ErrCorrupt
+)
+
+// KeyID identifies a recipient public key.
+type KeyID [keyIDSize]byte
+
+// String returns the key ID as hex.
+func (id KeyID) String() string { return hex.EncodeToString(id[:]) }
+
+// GenerateKey creates a new device key pair.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+// EncodePublicKey returns the base64url (unpadded) form of a public key's
+// uncompressed point, as published in the key directory.
+func EncodePublicKey(pub *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// ParsePublicKey decodes a published public key, rejecting anything that
+// is not a valid uncompressed P-256 point.
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: public key is not base64url: %w", err)
+	}
+	if len(raw) != pubKeySize {
+		return nil, errors.New("e2e: public key must be an uncompressed P-256 point")
+	}
+	pub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: invalid public key: %w", err)
+	}
+	return pub, nil
+}
+
+// KeyIDOf returns the key ID of a public key.
+func KeyIDOf(pub *ecdh.PublicKey) KeyID {
+	sum := sha256.Sum256(pub.Bytes())
+	var id KeyID
+	copy(id[:], sum[:keyIDSize])
+	return id
+}
+
+// proofDigest is what a key proof signs: the device ID and server nonce,
+// under a context string so the signature means nothing elsewhere.
+func proofDigest(deviceID, nonce string) []byte {
+	sum := sha256.Sum256([]byte(proofInfo + "\n" + deviceID + "\n" + nonce))
+	return sum[:]
+}
+
+// SignKeyProof proves possession of priv when publishing its public key for
+// deviceID: an ECDSA P-256 signature over the server's nonce, returned as
+// base64url of r || s (the format WebCrypto produces).
+func SignKeyProof(priv *ecdh.PrivateKey, deviceID, nonce string) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return "", err
+	}
+	sk, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", errors.New("e2e: key is not a P-256 key")
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, sk, proofDigest(deviceID, nonce))
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyKeyProof reports whether sig is a SignKeyProof signature by pub
+// over deviceID and nonce.
+func VerifyKeyProof(pub *ecdh.PublicKey, deviceID, nonce, sig string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || len(raw) != 64 {
+		return false
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+	pk, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	r := new(big.Int).SetBytes(raw[:32])
+	s := new(big.Int).SetBytes(raw[32:])
+	return ecdsa.Verify(pk, proofDigest(deviceID, nonce), r, s)
+}
+
+// Header is a parsed envelope header.
+type Header struct {
+	KeyID     KeyID
+	Ephemeral *ecdh.PublicKey
+}
+
+// ParseHeader validates the envelope at the start of r, whose total length
+// is size. It checks the magic, the ephemeral key and that the remaining
+// length is a well-formed stream; it cannot check the ciphertext itself.
+func ParseHeader(r io.ReaderAt, size int64) (*Header, error) {
+	buf := make([]byte, HeaderSize)
+	if n, _ := r.ReadAt(buf, 0); n < HeaderSize || !bytes.Equal(buf[:len(magic)], []byte(magic)) {
+		return nil, ErrNotEnvelope
+	}
+	h := &Header{}
+	copy(h.KeyID[:], buf[len(magic):])
+	eph, err := ecdh.P256().NewPublicKey(buf[len(magic)+keyIDSize:])
+	if err != nil {
+		return nil, fmt.Errorf("e2e: invalid ephemeral key: %w", err)
+	}
+	h.Ephemeral = eph
+	if _, err := stream.PlainSize(size - int64(HeaderSize)); err != nil {
+		return nil, ErrCorrupt
+	}
+	return h, nil
+}
+
+func contentKey(secret []byte, eph, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, eph.Bytes()...), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewWriter writes an envelope header for recipient to dst and returns a
+// writer that encrypts the file body. Close must be called to finish.
+func NewWriter(dst io.Writer, recipient *ecdh.PublicKey) (*stream.Writer, error) {
+	eph, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := eph.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := contentKey(secret, eph.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+	id := KeyIDOf(recipient)
+	header := append([]byte(magic), id[:]...)
+	header = append(header, eph.PublicKey().Bytes()...)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	return stream.NewWriter(dst, aead), nil
+}
+
+// NewReader opens an envelope of total length size with the recipient's
+// private key and returns a seekable reader over the plaintext.
+func NewReader(src io.ReaderAt, size int64, priv *ecdh.PrivateKey) (*stream.Reader, error) {
+	h, err := ParseHeader(src, size)
+	if err != nil {
+		return nil, err
+	}
+	if h.KeyID != KeyIDOf(priv.PublicKey()) {
+		return nil, ErrWrongKey
+	}
+	secret, err := priv.ECDH(h.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := contentKey(secret, h.Ephemeral, priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewReader(src, int64(HeaderSize), size-int64(HeaderSize), aead)
+}
@@ -0,0 +1,126 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	priv, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	pub, err := ParsePublicKey(EncodePublicKey(priv.PublicKey()))
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+
+	plain := bytes.Repeat([]byte("end to end "), 20000)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, pub)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.Write(plain)
+	w.Close()
+	sealed := buf.Bytes()
+	if bytes.Contains(sealed, []byte("end to end")) {
+		t.Fatal("ciphertext contains plaintext")
+	}
+
+	h, err := ParseHeader(bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		t.Fatalf("ParseHeader: %v", err)
+	}
+	if h.KeyID != KeyIDOf(pub) {
+		t.Error("header key ID does not match recipient")
+	}
+
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), priv)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decrypted content mismatch")
+	}
+
+	other, _ := GenerateKey()
+	if _, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), other); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("expected ErrWrongKey for another device, got %v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	r, _ = NewReader(bytes.NewReader(sealed), int64(len(sealed)), priv)
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt after tampering, got %v", err)
+	}
+}
+
+func TestParseHeader_Rejects(t *testing.T) {
+	priv, _ := GenerateKey()
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, priv.PublicKey())
+	w.Write([]byte("hello"))
+	w.Close()
+	valid := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plaintext", []byte("just a regular file, not encrypted at all, long enough for a header......................")},
+		{"header only", valid[:HeaderSize]},
+		{"truncated stream", valid[:HeaderSize+8]},
+		{"bad ephemeral key", append(append(append([]byte{}, valid[:HeaderSize-1]...), valid[HeaderSize-1]^0xff), valid[HeaderSize:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseHeader(bytes.NewReader(tt.data), int64(len(tt.data))); err == nil {
+				t.Error("expected header to be rejected")
+			}
+		})
+	}
+}
+
+func TestParsePublicKey_Invalid(t *testing.T) {
+	priv, _ := GenerateKey()
+	for _, s := range []string{"", "not base64!", "AAAA", EncodePublicKey(priv.PublicKey())[:40]} {
+		if _, err := ParsePublicKey(s); err == nil {
+			t.Errorf("ParsePublicKey(%q): expected error", s)
+		}
+	}
+}
+
+func TestKeyProof(t *testing.T) {
+	priv, _ := GenerateKey()
+	other, _ := GenerateKey()
+	sig, err := SignKeyProof(priv, "dev_a", "nonce-1")
+	if err != nil {
+		t.Fatalf("SignKeyProof: %v", err)
+	}
+	if !VerifyKeyProof(priv.PublicKey(), "dev_a", "nonce-1", sig) {
+		t.Fatal("valid proof rejected")
+	}
+	tests := []struct {
+		name                 string
+		key                  *ecdh.PublicKey
+		device, nonce, proof string
+	}{
+		{"other key", other.PublicKey(), "dev_a", "nonce-1", sig},
+		{"other device", priv.PublicKey(), "dev_b", "nonce-1", sig},
+		{"other nonce", priv.PublicKey(), "dev_a", "nonce-2", sig},
+		{"malformed", priv.PublicKey(), "dev_a", "nonce-1", "c2ln"},
+	}
+	for _, tt := range tests {
+		if VerifyKeyProof(tt.key, tt.device, tt.nonce, tt.proof) {
+			t.Errorf("%s: proof accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package link implements GoShare's zero-knowledge public links, for CLI
+// clients that create or fetch them.
+//
+// The sender generates a random 128-bit secret that only ever travels in
+// the URL fragment, which browsers never send to the server. Two keys are
+// derived from it with HKDF-SHA256: one encrypts the file as a chunked
+// AES-256-GCM stream (see package stream), the other seals a small JSON
+// metadata record holding the file name and type. The server stores the
+// opaque blob and sealed metadata and learns neither.
+//
+// Link format:
+//
+//	<base>/api/links/<id>#<base64url secret>
+package link
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"fileshare/pkg/stream"
+)
+
+const (
+	infoContent  = "goshare link content v1"
+	infoMetadata = "goshare link metadata v1"
+)
+
+// MaxMetadataSize bounds the sealed metadata the server will accept.
+const MaxMetadataSize = 4 << 10
+
+// ErrCorrupt is returned when content or metadata fails authentication,
+// which usually means the secret is wrong.
+var ErrCorrupt = stream.ErrCorrupt
+
+// Secret is the per-link key material carried in the URL fragment.
+type Secret [16]byte
+
+// Metadata describes the shared file. It is only ever seen by clients.
+type Metadata struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// NewSecret generates a fresh link secret. Never reuse a secret.
+func NewSecret() (Secret, error) {
+	var s Secret
+	_, err := rand.Read(s[:])
+	return s, err
+}
+
+// ParseSecret decodes a secret from its fragment form.
+func ParseSecret(s string) (Secret, error) {
+	var sec Secret
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) != len(sec) {
+		return sec, errors.New("link: invalid secret")
+	}
+	copy(sec[:], raw)
+	return sec, nil
+}
+
+// String returns the secret's fragment form.
+func (s Secret) String() string {
+	return base64.RawURLEncoding.EncodeToString(s[:])
+}
+
+func (s Secret) aead(info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, s[:], nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewWriter returns a writer that encrypts the file body into dst. Close
+// must be called to finish the stream.
+func (s Secret) NewWriter(dst io.Writer) (*stream.Writer, error) {
+	aead, err := s.aead(infoContent)
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewWriter(dst, aead), nil
+}
+
+// NewReader decrypts a downloaded blob of the given size.
+func (s Secret) NewReader(src io.ReaderAt, size int64) (*stream.Reader, error) {
+	aead, err := s.aead(infoContent)
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewReader(src, 0, size, aead)
+}
+
+// SealMetadata encrypts m for upload alongside the blob. The result is
+// base64url: a random nonce followed by the sealed JSON.
+func (s Secret) SealMetadata(m Metadata) (string, error) {
+	aead, err := s.aead(infoMetadata)
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// OpenMetadata decrypts metadata returned by the server.
+func (s Secret) OpenMetadata(sealed string) (*Metadata, error) {
+	aead, err := s.aead(infoMetadata)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	var m Metadata
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, ErrCorrupt
+	}
+	return &m, nil
+}
+
+// URL builds the shareable link for a stored blob.
+func URL(base, id string, s Secret) string {
+	return strings.TrimRight(base, "/") + "/api/links/" + id + "#" + s.String()
+}
+
+// ParseURL splits a shareable link into the server's metadata URL, the
+// link ID and the secret.
+func ParseURL(raw string) (metaURL, id string, s Secret, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", s, err
+	}
+	if s, err = ParseSecret(u.Fragment); err != nil {
+		return "", "", s, err
+	}
+	id = path.Base(u.Path)
+	if id == "" || id == "/" || id == "." {
+		return "", "", s, errors.New("link: missing link ID")
+	}
+	u.Fragment = ""
+	return u.String(), id, s, nil
+}
@@ -0,0 +1,61 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatalf("NewSecret: %v", err)
+	}
+	plain := bytes.Repeat([]byte("zero knowledge "), 9000)
+
+	var blob bytes.Buffer
+	w, _ := secret.NewWriter(&blob)
+	w.Write(plain)
+	w.Close()
+	sealedMeta, err := secret.SealMetadata(Metadata{Name: "holiday.jpg", Type: "image/jpeg", Size: int64(len(plain))})
+	if err != nil {
+		t.Fatalf("SealMetadata: %v", err)
+	}
+	if bytes.Contains(blob.Bytes(), []byte("zero knowledge")) {
+		t.Fatal("blob contains plaintext")
+	}
+
+	r, err := secret.NewReader(bytes.NewReader(blob.Bytes()), int64(blob.Len()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted content mismatch (err %v)", err)
+	}
+	m, err := secret.OpenMetadata(sealedMeta)
+	if err != nil || m.Name != "holiday.jpg" || m.Size != int64(len(plain)) {
+		t.Fatalf("OpenMetadata = %+v, %v", m, err)
+	}
+
+	wrong, _ := NewSecret()
+	if _, err := wrong.OpenMetadata(sealedMeta); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt with wrong secret, got %v", err)
+	}
+}
+
+func TestURL(t *testing.T) {
+	secret, _ := NewSecret()
+	u := URL("https://192.168.1.5:8443/", "abc123", secret)
+	metaURL, id, got, err := ParseURL(u)
+	if err != nil {
+		t.Fatalf("ParseURL: %v", err)
+	}
+	if metaURL != "https://192.168.1.5:8443/api/links/abc123" || id != "abc123" || got != secret {
+		t.Errorf("ParseURL(%q) = %q, %q, %v", u, metaURL, id, got)
+	}
+	if _, _, _, err := ParseURL("https://host/api/links/abc123"); err == nil {
+		t.Error("expected error for link without secret")
+	}
+}
@@ -0,0 +1,219 @@
+// Package stream implements chunked authenticated encryption of byte
+// streams (the STREAM construction), used by the end-to-end and public
+// link file formats.
+//
+// The plaintext is split into 64 KiB chunks, each sealed independently
+// with an AEAD under nonce = uint64(i) big-endian || 3 zero bytes || final
+// flag (1 on the last chunk, 0 otherwise). Because chunks stand alone a
+// reader can decrypt any range without touching the rest of the stream,
+// and the final flag makes truncation at a chunk boundary detectable.
+//
+// A key must never be used for more than one stream.
+package stream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// ChunkSize is the plaintext size of every chunk except the last.
+	ChunkSize = 64 << 10
+	// Overhead is the number of bytes each chunk adds (the AEAD tag).
+	Overhead = 16
+	// SealedChunkSize is the on-disk size of every chunk except the last.
+	SealedChunkSize = ChunkSize + Overhead
+)
+
+// ErrCorrupt is returned when a chunk fails authentication or the stream
+// has been truncated.
+var ErrCorrupt = errors.New("stream: ciphertext is corrupt or the key is wrong")
+
+func nonce(index uint64, final bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n, index)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+// SealedSize returns the ciphertext length for a plaintext of n bytes.
+func SealedSize(n int64) int64 {
+	chunks := n/ChunkSize + 1
+	if n > 0 && n%ChunkSize == 0 {
+		chunks--
+	}
+	return n + chunks*Overhead
+}
+
+// PlainSize returns the plaintext length for a ciphertext of n bytes, or
+// an error if no valid stream has that length.
+func PlainSize(n int64) (int64, error) {
+	if n < Overhead {
+		return 0, ErrCorrupt
+	}
+	chunks := (n + SealedChunkSize - 1) / SealedChunkSize
+	if n-(chunks-1)*SealedChunkSize < Overhead {
+		return 0, ErrCorrupt
+	}
+	return n - chunks*Overhead, nil
+}
+
+// Writer encrypts a stream. Close must be called to write the final chunk.
+type Writer struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// NewWriter returns a Writer sealing everything written to it into dst.
+// The AEAD must use 12-byte nonces.
+func NewWriter(dst io.Writer, aead cipher.AEAD) *Writer {
+	return &Writer{dst: dst, aead: aead, buf: make([]byte, 0, ChunkSize)}
+}
+
+// Write buffers p, sealing and writing each full chunk. A full chunk is only
+// flushed once more data arrives, since the last chunk must carry the
+// final flag.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("stream: write after close")
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *Writer) flush(final bool) error {
+	out := w.aead.Seal(nil, nonce(w.index, final), w.buf, nil)
+	if _, err := w.dst.Write(out); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// Reader decrypts a stream with random access. It implements io.ReadSeeker
+// over the plaintext, suitable for http.ServeContent.
+type Reader struct {
+	src     io.ReaderAt
+	base    int64 // offset of the first chunk in src
+	aead    cipher.AEAD
+	size    int64 // plaintext size
+	chunks  int64
+	pos     int64
+	cached  int64 // index of the chunk held in plain, -1 if none
+	plain   []byte
+	scratch []byte
+}
+
+// NewReader decrypts the sealedLen bytes of src starting at offset base.
+func NewReader(src io.ReaderAt, base, sealedLen int64, aead cipher.AEAD) (*Reader, error) {
+	size, err := PlainSize(sealedLen)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		src:     src,
+		base:    base,
+		aead:    aead,
+		size:    size,
+		chunks:  (sealedLen + SealedChunkSize - 1) / SealedChunkSize,
+		cached:  -1,
+		scratch: make([]byte, SealedChunkSize),
+	}, nil
+}
+
+// Size returns the plaintext size.
+func (r *Reader) Size() int64 { return r.size }
+
+func (r *Reader) load(index int64) error {
+	if index == r.cached {
+		return nil
+	}
+	final := index == r.chunks-1
+	n := int64(SealedChunkSize)
+	if final {
+		n = r.size - index*ChunkSize + Overhead
+	}
+	buf := r.scratch[:n]
+	if m, _ := r.src.ReadAt(buf, r.base+index*SealedChunkSize); int64(m) < n {
+		return ErrCorrupt
+	}
+	plain, err := r.aead.Open(r.plain[:0], nonce(uint64(index), final), buf, nil)
+	if err != nil {
+		r.cached = -1
+		return ErrCorrupt
+	}
+	r.plain, r.cached = plain, index
+	return nil
+}
+
+// Read decrypts from the current position.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		// Authenticate the final chunk even for empty reads at EOF so a
+		// truncated stream never reads as a clean, shorter one.
+		if err := r.load(r.chunks - 1); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	n := 0
+	for len(p) > 0 && r.pos < r.size {
+		index := r.pos / ChunkSize
+		if err := r.load(index); err != nil {
+			return n, err
+		}
+		c := copy(p, r.plain[r.pos-index*ChunkSize:])
+		p = p[c:]
+		n += c
+		r.pos += int64(c)
+	}
+	return n, nil
+}
+
+// Seek sets the plaintext read position.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("stream: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("stream: negative position")
+	}
+	r.pos = abs
+	return abs, nil
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func testAEAD(t *testing.T) cipher.AEAD {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, _ := aes.NewCipher(key)
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("NewGCM: %v", err)
+	}
+	return aead
+}
+
+func TestSizes(t *testing.T) {
+	aead := testAEAD(t)
+	for _, n := range []int64{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, aead)
+		w.Write(make([]byte, n))
+		w.Close()
+		if got := SealedSize(n); got != int64(buf.Len()) {
+			t.Errorf("SealedSize(%d) = %d, actual %d", n, got, buf.Len())
+		}
+		if got, err := PlainSize(int64(buf.Len())); err != nil || got != n {
+			t.Errorf("PlainSize(%d) = %d, %v; want %d", buf.Len(), got, err, n)
+		}
+	}
+	if _, err := PlainSize(SealedChunkSize + 3); err == nil {
+		t.Error("expected error for impossible ciphertext length")
+	}
+}
+
+func TestReaderAtOffset(t *testing.T) {
+	aead := testAEAD(t)
+	plain := make([]byte, ChunkSize+100)
+	rand.Read(plain)
+
+	// Streams are usually embedded after a format-specific header.
+	buf := bytes.NewBufferString("HEADER")
+	w := NewWriter(buf, aead)
+	w.Write(plain)
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), 6, int64(buf.Len()-6), aead)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("round trip failed: %v", err)
+	}
+}
@@ -2,21 +2,44 @@ let peers = {},
   targetPeer = null,
   uploadQueue = [],
   incomingFiles = [],
+  incomingFrom = null,
   notifFile = null,
   evtSource = null,
+  evtSocket = null,
   serverIp = window.location.hostname,
   currentXhr = null,
   transferStartTime = 0,
   abortCurrentTransfer = false,
   sseRetryCount = 0;
 
+Object.assign(actions, {
+  openSharedUpload,
+  openConnectModal,
+  startLanUpload,
+  closeModal,
+  abortTransfer,
+  closeTransferOverlay,
+  closeSharedOverlay,
+  respondToLan,
+  copyConnectUrl,
+  closeConnectModal,
+  saveNameFromModal,
+  closeNotif,
+  downloadNotifFile,
+  delFile: (_, el) => delFile(el),
+  downloadSharedFile: (_, el) =>
+    (location.href = "/download/" + encodeURIComponent(el.dataset.filename) + "?id=" + myId),
+  removeFromQueue: ([index, prefix]) => removeFromQueue(index, prefix),
+});
+
 register().then(() => {
-  connectSSE();
+  connectEvents();
   loadSharedFiles();
   setupDragDrop();
   setupGlobalDragFeedback();
   window.addEventListener("resize", renderPeers);
   window.addEventListener("beforeunload", () => {
+    if (evtSocket) evtSocket.close();
     if (evtSource) evtSource.close();
   });
   // Remove skeleton loading states
@@ -79,52 +102,38 @@ async function saveNameFromModal() {
   closeNameModal();
 }
 
+// Events arrive over a WebSocket when possible; connectSSE is the fallback
+// for proxies that refuse the upgrade.
+function connectEvents() {
+  if (!("WebSocket" in window)) return connectSSE();
+  const proto = location.protocol === "https:" ? "wss://" : "ws://";
+  const sock = new WebSocket(proto + location.host + "/api/ws?id=" + myId);
+  let opened = false;
+  sock.onopen = () => {
+    opened = true;
+    evtSocket = sock;
+    sseRetryCount = 0;
+  };
+  sock.onmessage = (e) => {
+    const m = JSON.parse(e.data);
+    if (m.type === "event") handleEvent(m.event, m.data);
+    else if (m.type === "error") console.warn("WebSocket error:", m.error);
+  };
+  sock.onclose = () => {
+    evtSocket = null;
+    if (!opened) return connectSSE();
+    sseRetryCount++;
+    const delay = Math.min(3000 * Math.pow(1.5, sseRetryCount - 1), 30000);
+    setTimeout(connectEvents, delay);
+  };
+}
+
 function connectSSE() {
   if (evtSource) evtSource.close();
   evtSource = new EventSource("/api/events?id=" + myId);
-  evtSource.addEventListener("peers", (e) => {
-    peers = {};
-    const data = JSON.parse(e.data);
-    if (data && Array.isArray(data)) data.forEach((p) => (peers[p.id] = p));
-    renderPeers();
-  });
-  evtSource.addEventListener("device-joined", (e) => {
-    const p = JSON.parse(e.data);
-    peers[p.id] = p;
-    renderPeers();
-  });
-  evtSource.addEventListener("device-left", (e) => {
-    const p = JSON.parse(e.data);
-    delete peers[p.id];
-    renderPeers();
-  });
-  evtSource.addEventListener("files-sent", (e) => {
-    const d = JSON.parse(e.data);
-    incomingFiles = d.filenames;
-
-    // Show Accept/Decline modal for private transfers
-    const modal = document.getElementById("lanRequestModal");
-    const info = document.getElementById("lanRequestInfo");
-    info.textContent = `${d.from_name} wants to send you ${incomingFiles.length} file(s).`;
-    modal.classList.add("open");
-
-    // Backup: standard notification too
-    notifFile = incomingFiles[0];
-    document.getElementById("notifTitle").textContent =
-      d.from_name + " sent " + incomingFiles.length + " file(s)";
-    document.getElementById("notifSub").textContent =
-      incomingFiles[0] + (incomingFiles.length > 1 ? " and more..." : "");
-    document.getElementById("notif").classList.add("notif-show");
-    setTimeout(() => closeNotif(), 10000);
-    // Browser notification
-    if ("Notification" in window && Notification.permission === "granted") {
-      new Notification("GoShare — File Received", {
-        body: incomingFiles[0] + (incomingFiles.length > 1 ? " and " + (incomingFiles.length - 1) + " more" : ""),
-        icon: "data:image/svg+xml,<svg xmlns='http://www.w3.org/2000/svg' viewBox='0 0 100 100'><text y='.9em' font-size='90'>🚀</text></svg>",
-      });
-    }
-  });
-  evtSource.addEventListener("shared-update", () => loadSharedFiles());
+  ["peers", "device-joined", "device-left", "files-sent", "shared-update", "upload-rejected", "transfer"].forEach((name) =>
+    evtSource.addEventListener(name, (e) => handleEvent(name, e.data ? JSON.parse(e.data) : null))
+  );
   evtSource.onopen = () => { sseRetryCount = 0; };
   evtSource.onerror = () => {
     sseRetryCount++;
@@ -133,6 +142,84 @@ function connectSSE() {
   };
 }
 
+function handleEvent(name, d) {
+  switch (name) {
+    case "peers":
+      peers = {};
+      if (d && Array.isArray(d)) d.forEach((p) => (peers[p.id] = p));
+      renderPeers();
+      break;
+    case "device-joined":
+      peers[d.id] = d;
+      renderPeers();
+      break;
+    case "device-left":
+      delete peers[d.id];
+      renderPeers();
+      break;
+    case "files-sent":
+      onFilesSent(d);
+      break;
+    case "shared-update":
+      loadSharedFiles();
+      break;
+    case "upload-rejected":
+      showToast(`${d.name} was not delivered: ${d.reason}`);
+      break;
+    case "transfer":
+      if (d.data && d.data.action === "accepted") showToast(`${d.from_name} accepted your files`);
+      else if (d.data && d.data.action === "declined") showToast(`${d.from_name} declined your files`);
+      break;
+  }
+}
+
+function onFilesSent(d) {
+  incomingFiles = d.filenames;
+  incomingFrom = d.from;
+
+  // Certificate-authenticated senders are trusted — accept without asking
+  if (d.trusted) {
+    showToast(`Receiving ${incomingFiles.length} file(s) from ${d.from_name}`);
+    respondToLan(true);
+    return;
+  }
+
+  // Show Accept/Decline modal for private transfers
+  const modal = document.getElementById("lanRequestModal");
+  const info = document.getElementById("lanRequestInfo");
+  info.textContent = `${d.from_name} wants to send you ${incomingFiles.length} file(s).`;
+  modal.classList.add("open");
+
+  // Backup: standard notification too
+  notifFile = incomingFiles[0];
+  document.getElementById("notifTitle").textContent =
+    d.from_name + " sent " + incomingFiles.length + " file(s)";
+  document.getElementById("notifSub").textContent =
+    incomingFiles[0] + (incomingFiles.length > 1 ? " and more..." : "");
+  document.getElementById("notif").classList.add("notif-show");
+  setTimeout(() => closeNotif(), 10000);
+  // Browser notification
+  if ("Notification" in window && Notification.permission === "granted") {
+    new Notification("GoShare — File Received", {
+      body: incomingFiles[0] + (incomingFiles.length > 1 ? " and " + (incomingFiles.length - 1) + " more" : ""),
+      icon: "data:image/svg+xml,<svg xmlns='http://www.w3.org/2000/svg' viewBox='0 0 100 100'><text y='.9em' font-size='90'>🚀</text></svg>",
+    });
+  }
+}
+
+// sendTransfer tells another device how we answered its transfer.
+function sendTransfer(to, data) {
+  if (!to) return;
+  if (evtSocket && evtSocket.readyState === WebSocket.OPEN) {
+    evtSocket.send(JSON.stringify({ type: "transfer", to, data }));
+    return;
+  }
+  fetch("/api/transfer", {
+    method: "POST",
+    body: JSON.stringify({ from: myId, to, data }),
+  }).catch((e) => console.error("Transfer message failed:", e));
+}
+
 function renderPeers() {
   const area = document.getElementById("deviceArea");
   area.querySelectorAll(".peer-node").forEach((el) => el.remove());
@@ -319,12 +406,31 @@ function upload(files, to, prefix) {
       abortBtn.classList.add("hidden");
       successBtn.classList.remove("hidden");
 
-      showToast("Files sent! ✓");
+      let rejected = [], quarantined = [];
+      try {
+        const resp = JSON.parse(currentXhr.responseText);
+        rejected = resp.rejected || [];
+        quarantined = resp.quarantined || [];
+      } catch (e) {}
+      if (rejected.length > 0) {
+        showToast(`Sent, but ${rejected.length} file(s) refused: ${rejected.map(r => `${r.name} (${r.reason})`).join(", ")}`);
+      } else if (quarantined.length > 0) {
+        showToast("Files sent — scanning before delivery");
+      } else {
+        showToast("Files sent! ✓");
+      }
       loadSharedFiles();
       // Auto-close overlay after success
       setTimeout(() => {
         closeTransferOverlay();
       }, 2000);
+    } else if (currentXhr.status === 422) {
+      let rejected = [];
+      try {
+        rejected = JSON.parse(currentXhr.responseText).rejected || [];
+      } catch (e) {}
+      showToast("Upload refused: " + rejected.map(r => `${r.name} (${r.reason})`).join(", "));
+      closeTransferOverlay();
     } else {
       showToast("Upload failed: " + currentXhr.statusText);
       closeTransferOverlay();
@@ -393,11 +499,10 @@ async function loadSharedFiles() {
         <div style="flex: 1; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; font-size: 0.75rem; font-weight: 500;">
           ${safeName}
         </div>
-        <span style="color: var(--text-dim); font-size: 1.25rem; font-weight: 300; line-height: 1;" onclick="event.stopPropagation();delFile(this)">×</span>
+        <span style="color: var(--text-dim); font-size: 1.25rem; font-weight: 300; line-height: 1;" data-action="delFile">×</span>
       `;
       chip.dataset.filename = f.name;
-      chip.onclick = () =>
-        (location.href = "/download/" + encodeURIComponent(f.name) + "?id=" + myId);
+      chip.dataset.action = "downloadSharedFile";
       bar.appendChild(chip);
     });
   } catch (e) {
@@ -409,7 +514,7 @@ async function delFile(el) {
   const chip = el.closest('.file-chip');
   const name = chip ? chip.dataset.filename : '';
   if (!name || !confirm('Delete "' + name + '"?')) return;
-  await fetch("/api/delete/" + encodeURIComponent(name), { method: "DELETE" });
+  await fetch("/api/delete/" + encodeURIComponent(name) + "?id=" + myId, { method: "DELETE" });
   loadSharedFiles();
 }
 function downloadNotifFile() {
@@ -516,7 +621,7 @@ function renderQueue(prefix) {
         </div>
         <div style="display: flex; align-items: center; gap: 0.75rem;">
           <span style="color: var(--text-dim); font-size: 0.7rem;">${formatBytes(f.size)}</span>
-          <i class="fa-solid fa-xmark" style="cursor: pointer; padding: 4px; color: var(--text-dim);" onclick="removeFromQueue(${i}, '${prefix}')"></i>
+          <i class="fa-solid fa-xmark" style="cursor: pointer; padding: 4px; color: var(--text-dim);" data-action="removeFromQueue" data-arg='[${i}, "${prefix}"]'></i>
         </div>
       `;
       list.appendChild(item);
@@ -560,6 +665,7 @@ function startLanUpload(isShared) {
 
 function respondToLan(accepted) {
   document.getElementById("lanRequestModal").classList.remove("open");
+  sendTransfer(incomingFrom, { action: accepted ? "accepted" : "declined", files: incomingFiles });
   if (accepted && incomingFiles.length > 0) {
     // Start downloading each file
     incomingFiles.forEach((name, i) => {
@@ -574,6 +680,7 @@ function respondToLan(accepted) {
     loadSharedFiles();
   }
   incomingFiles = [];
+  incomingFrom = null;
 }
 
 function preventDefaults(e) {
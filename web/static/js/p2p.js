@@ -1,30 +1,53 @@
 // ─── P2P WebRTC File Sharing ───
 const CHUNK_SIZE = 64 * 1024; // 64 KB chunks
-const ICE_SERVERS = [
-  { urls: "stun:stun.l.google.com:19302" },
-  { urls: "stun:stun1.l.google.com:19302" },
-  { urls: "stun:stun2.l.google.com:19302" },
-  { urls: "stun:stun3.l.google.com:19302" },
-  { urls: "stun:stun4.l.google.com:19302" },
-  { urls: "stun:global.stun.twilio.com:3478" },
-];
-const POLL_INTERVAL = 800; // ms
+const POLL_WAIT = 25; // seconds the server may hold a long-poll open
+const POLL_RETRY = 1000; // ms before retrying a failed poll
 
 let pc = null;
 let dataChannel = null;
 let roomId = null;
 let role = null; // "sender" or "receiver"
+let roomToken = null; // secret proving our role in the room
 let selectedFiles = [];
 let pollTimer = null;
 let pollIndex = 0;
+let signalSocket = null; // WebSocket carrying signals both ways
+let signalSource = null; // EventSource pushing signals for this room
+let signalQueue = Promise.resolve();
 let pendingCandidates = [];
 let transferAccepted = false;
 let transferStartTime = 0;
 let abortCurrentTransfer = false;
 let isTransferring = false;
 let serverIp = window.location.hostname;
-let isPollingActive = false;
+let isSignalingActive = false;
 let hasReceivedAnswer = false;
+let iceServers = []; // from /api/p2p/config; empty still connects on a LAN
+let relayNoticeShown = false;
+let pipeMode = false; // files go through the server instead of WebRTC
+let pipeFiles = []; // the manifest of a piped transfer, for the receiver
+let pipeAbort = null; // cancels the piped request in progress
+let broadcast = false; // the room admits several receivers
+const links = new Map(); // broadcast sender: receiver peer ID → its connection
+
+Object.assign(actions, {
+  pickFiles: () => document.getElementById("fileInput").click(),
+  createRoom,
+  joinByCode,
+  removeFile,
+  restartConnection,
+  offerPipe,
+  respondToTransfer,
+  abortTransfer,
+  closeTransferOverlay,
+  saveNameFromModal,
+  resetSender,
+  removeReceiver,
+});
+
+document.getElementById("joinCodeInput").addEventListener("keydown", (e) => {
+  if (e.key === "Enter") joinByCode();
+});
 
 // ─── Init ───
 (async function init() {
@@ -46,13 +69,20 @@ let hasReceivedAnswer = false;
     document.getElementById("senderView").classList.add("hidden");
     document.getElementById("receiverView").classList.remove("hidden");
     updateIdentity(); // Allow receiver to have a name too
-    startReceiver();
+    if (await joinRoom()) {
+      await loadICEConfig();
+      startReceiver();
+    }
   } else {
     // Sender mode
     role = "sender";
     setupFileInput();
     updateIdentity();
   }
+  // The sender's room dies with its page.
+  window.addEventListener("beforeunload", () => {
+    if (role === "sender") closeRoom();
+  });
   // Request notification permission
   if ("Notification" in window && Notification.permission === "default") {
     Notification.requestPermission();
@@ -139,7 +169,7 @@ function showSelectedFile() {
         <div style="font-weight: 600; font-size: 0.9rem; overflow: hidden; text-overflow: ellipsis; white-space: nowrap;">${escapeHtml(file.name)}</div>
         <div style="color: var(--text-dim); font-size: 0.75rem;">${formatBytes(file.size)}</div>
       </div>
-      <button onclick="removeFile(${index})" style="background: transparent; color: var(--text-dim); font-size: 1.5rem; line-height: 1; padding: 0 0.5rem;">&times;</button>
+      <button data-action="removeFile" data-arg="${index}" style="background: transparent; color: var(--text-dim); font-size: 1.5rem; line-height: 1; padding: 0 0.5rem;">&times;</button>
     `;
     fileList.appendChild(item);
   });
@@ -169,6 +199,8 @@ function clearFile() {
   document.getElementById("fileInput").value = "";
   document.getElementById("selectedFile").classList.add("hidden");
   document.getElementById("fileSelectArea").classList.remove("hidden");
+  document.getElementById("shareCode").classList.add("hidden");
+  document.getElementById("joinCodeForm").classList.remove("hidden");
   document.getElementById("shareInfo").classList.add("hidden");
 }
 
@@ -178,54 +210,107 @@ async function createRoom() {
   btn.disabled = true;
   btn.textContent = "Creating link…";
 
+  const count = Number(document.getElementById("receiverCount").value) || 1;
+  broadcast = count > 1;
+
   try {
-    const res = await fetch("/api/p2p/create", { method: "POST" });
+    let url = "/api/p2p/create?code=digits";
+    if (broadcast) url += "&receivers=" + count;
+    const res = await fetch(url, { method: "POST" });
     if (!res.ok) throw new Error("Server error: " + res.status);
     const data = await res.json();
     roomId = data.room;
+    roomToken = data.token;
+    showShareLink(data.join);
 
-    // Show share link + QR
-    const port = window.location.port ? `:${window.location.port}` : "";
-    let base = window.location.origin;
-
-    // Replace localhost with the real IP if needed
-    if (
-      window.location.hostname === "localhost" ||
-      window.location.hostname === "127.0.0.1"
-    ) {
-      base = `${window.location.protocol}//${serverIp}${port}`;
-    }
-
-    const shareLink = base + "/pages/p2p.html?room=" + roomId;
-    document.getElementById("shareUrl").textContent = shareLink;
-
-    const qrEl = document.getElementById("qrcode");
-    qrEl.innerHTML = "";
-    try {
-      new QRCode(qrEl, {
-        text: shareLink,
-        width: 160,
-        height: 160,
-        colorDark: "#000000",
-        colorLight: "#ffffff",
-        correctLevel: QRCode.CorrectLevel.M,
-      });
-    } catch (e) {
-      qrEl.innerHTML = '<div style="padding: 1rem; color: var(--text-dim); font-size: 0.85rem;">QR code unavailable</div>';
+    if (data.code) {
+      document.getElementById("shareCodeValue").textContent =
+        data.code.slice(0, 3) + " " + data.code.slice(3);
+      document.getElementById("shareCode").classList.remove("hidden");
     }
 
+    document.getElementById("joinCodeForm").classList.add("hidden");
     document.getElementById("shareInfo").classList.remove("hidden");
     btn.textContent = "Link created!";
 
-    // Setup WebRTC as sender
-    setupSenderConnection();
+    await loadICEConfig();
+    if (broadcast) {
+      // One connection per receiver, opened as each of them joins.
+      document.getElementById("waitingStatus").classList.add("hidden");
+      document.getElementById("receiverPanel").classList.remove("hidden");
+      renderReceivers();
+      startSignaling();
+    } else {
+      setupSenderConnection();
+    }
   } catch (err) {
     btn.disabled = false;
     btn.textContent = "Create share link";
+    broadcast = false;
     console.error("Failed to create room:", err);
   }
 }
 
+// showShareLink shows the link and QR code that admit receivers with the
+// join token. Removing a receiver changes the token, so this runs again.
+function showShareLink(join) {
+  const port = window.location.port ? `:${window.location.port}` : "";
+  let base = window.location.origin;
+
+  // Replace localhost with the real IP if needed
+  if (
+    window.location.hostname === "localhost" ||
+    window.location.hostname === "127.0.0.1"
+  ) {
+    base = `${window.location.protocol}//${serverIp}${port}`;
+  }
+
+  // The join token rides in the fragment, so it never reaches server logs.
+  const shareLink = base + "/pages/p2p.html?room=" + roomId + "#join=" + join;
+  document.getElementById("shareUrl").textContent = shareLink;
+
+  const qrEl = document.getElementById("qrcode");
+  qrEl.innerHTML = "";
+  try {
+    new QRCode(qrEl, {
+      text: shareLink,
+      width: 160,
+      height: 160,
+      colorDark: "#000000",
+      colorLight: "#ffffff",
+      correctLevel: QRCode.CorrectLevel.M,
+    });
+  } catch (e) {
+    qrEl.innerHTML = '<div style="padding: 1rem; color: var(--text-dim); font-size: 0.85rem;">QR code unavailable</div>';
+  }
+}
+
+// loadICEConfig asks the server which ICE servers to use: its own STUN
+// server, public ones only if the admin enabled them, and its TURN relay
+// (with credentials for this room) if it runs one.
+async function loadICEConfig() {
+  try {
+    const res = await fetch("/api/p2p/config?room=" + encodeURIComponent(roomId), {
+      headers: { "X-Room-Token": roomToken },
+    });
+    if (!res.ok) throw new Error("Server error: " + res.status);
+    iceServers = (await res.json()).ice_servers || [];
+  } catch (e) {
+    console.warn("Failed to fetch ICE config, using host candidates only:", e);
+  }
+}
+
+function transferManifest() {
+  return {
+    sender: localStorage.getItem("user_name") || "Anonymous",
+    files: selectedFiles.map((f) => ({
+      name: f.name,
+      size: f.size,
+      type: f.type,
+    })),
+  };
+}
+
 function checkAndSendRequest() {
   if (
     pc &&
@@ -233,21 +318,13 @@ function checkAndSendRequest() {
       pc.iceConnectionState === "completed") &&
     selectedFiles.length > 0
   ) {
-    const manifest = {
-      sender: localStorage.getItem("user_name") || "Anonymous",
-      files: selectedFiles.map((f) => ({
-        name: f.name,
-        size: f.size,
-        type: f.type,
-      })),
-    };
-    sendSignal("transfer-request", manifest);
+    sendSignal("transfer-request", transferManifest());
     showToast("Sent transfer request to receiver");
   }
 }
 
 function setupSenderConnection() {
-  pc = new RTCPeerConnection({ iceServers: ICE_SERVERS });
+  pc = new RTCPeerConnection({ iceServers });
 
   // Create data channel
   dataChannel = pc.createDataChannel("fileTransfer", {
@@ -282,12 +359,13 @@ function setupSenderConnection() {
     ) {
       document.getElementById("waitingStatus").innerHTML =
         '<div style="width: 8px; height: 8px; border-radius: 50%; background: var(--success);"></div> <span class="text-success">Device connected!</span>';
+      reportState("connected");
 
       // Send transfer request after connection if files are selected
       checkAndSendRequest();
     } else if (pc.iceConnectionState === "failed") {
       document.getElementById("waitingStatus").innerHTML =
-        '<div style="width: 8px; height: 8px; border-radius: 50%; background: var(--danger);"></div> <span class="text-danger">Connection failed</span> <button onclick="restartConnection()" style="margin-left: 10px; padding: 2px 8px; font-size: 0.75rem; background: var(--surface-light); border: 1px solid var(--border); border-radius: 4px; cursor: pointer;">Retry</button>';
+        '<div style="width: 8px; height: 8px; border-radius: 50%; background: var(--danger);"></div> <span class="text-danger">Connection failed</span> <button data-action="restartConnection" style="margin-left: 10px; padding: 2px 8px; font-size: 0.75rem; background: var(--surface-light); border: 1px solid var(--border); border-radius: 4px; cursor: pointer;">Retry</button> <button data-action="offerPipe" style="margin-left: 6px; padding: 2px 8px; font-size: 0.75rem; background: var(--surface-light); border: 1px solid var(--border); border-radius: 4px; cursor: pointer;">Send via server</button>';
     }
   };
 
@@ -296,8 +374,8 @@ function setupSenderConnection() {
     .then((offer) => pc.setLocalDescription(offer))
     .then(() => {
       sendSignal("offer", pc.localDescription);
-      // Start polling for answer/candidates
-      startPolling();
+      // Listen for the answer and candidates
+      startSignaling();
     })
     .catch((err) => console.error("Offer error:", err));
 }
@@ -322,8 +400,7 @@ async function sendFile() {
   if (isTransferring) return;
   if (
     selectedFiles.length === 0 ||
-    !dataChannel ||
-    dataChannel.readyState !== "open"
+    (!pipeMode && (!dataChannel || dataChannel.readyState !== "open"))
   ) {
     if (selectedFiles.length > 0) transferAccepted = true; // Wait for channel to open
     return;
@@ -349,9 +426,6 @@ async function sendFile() {
   overlay.classList.add("open");
   setTimeout(() => card.classList.remove("scale-95", "opacity-0"), 10);
 
-  const BUFFER_HIGH = 2 * 1024 * 1024; // 2MB
-  dataChannel.bufferedAmountLowThreshold = 512 * 1024; // 512KB
-
   transferStartTime = Date.now();
 
   try {
@@ -361,82 +435,32 @@ async function sendFile() {
       nameEl.textContent = file.name;
       stageEl.textContent = `Preparing file ${i + 1} of ${selectedFiles.length}...`;
 
-      // Send metadata for this file
-      dataChannel.send(
-        JSON.stringify({
-          name: file.name,
-          size: file.size,
-          type: file.type,
-          index: i,
-          total: selectedFiles.length,
-        }),
-      );
-
-      await new Promise((resolve, reject) => {
-        const fileReader = new FileReader();
-        let offset = 0;
-
-        function updateProgress() {
-          const now = Date.now();
-          const duration = Math.max(0.1, (now - transferStartTime) / 1000); // Guard against div-by-zero
-          const speed = offset / duration;
-          const remainingBytes = file.size - offset;
-          const eta = remainingBytes / speed;
-
-          const percent = Math.min(100, Math.round((offset / file.size) * 100));
-          bar.style.width = percent + "%";
-          percentEl.textContent = percent + "%";
-          speedEl.textContent = formatBytes(speed) + "/s";
-          stageEl.textContent = "Sending your files...";
-
-          if (eta > 0 && eta < 3600) {
-            const mins = Math.floor(eta / 60);
-            const secs = Math.floor(eta % 60);
-            etaEl.textContent = `${mins}:${secs.toString().padStart(2, "0")}`;
-          } else {
-            etaEl.textContent = "--:--";
-          }
-        }
-
-        function sendNextChunk() {
-          if (abortCurrentTransfer) return reject("Aborted");
-          if (!dataChannel || dataChannel.readyState !== "open") return reject("Channel closed");
-
-          if (offset >= file.size) {
-            dataChannel.send("__EOF__");
-            resolve();
-            return;
-          }
-
-          if (dataChannel.bufferedAmount > BUFFER_HIGH) {
-            dataChannel.onbufferedamountlow = () => {
-              dataChannel.onbufferedamountlow = null;
-              readAndSend();
-            };
-            return;
-          }
-          readAndSend();
-        }
+      if (pipeMode) {
+        await pipeUpload(file);
+        continue;
+      }
 
-        function readAndSend() {
-          const slice = file.slice(offset, offset + CHUNK_SIZE);
-          fileReader.readAsArrayBuffer(slice);
+      await streamFile(dataChannel, file, i, selectedFiles.length, (offset) => {
+        const now = Date.now();
+        const duration = Math.max(0.1, (now - transferStartTime) / 1000); // Guard against div-by-zero
+        const speed = offset / duration;
+        const remainingBytes = file.size - offset;
+        const eta = remainingBytes / speed;
+
+        const percent = Math.min(100, Math.round((offset / file.size) * 100));
+        bar.style.width = percent + "%";
+        percentEl.textContent = percent + "%";
+        speedEl.textContent = formatBytes(speed) + "/s";
+        stageEl.textContent = "Sending your files...";
+
+        if (eta > 0 && eta < 3600) {
+          const mins = Math.floor(eta / 60);
+          const secs = Math.floor(eta % 60);
+          etaEl.textContent = `${mins}:${secs.toString().padStart(2, "0")}`;
+        } else {
+          etaEl.textContent = "--:--";
         }
-
-        fileReader.onload = (e) => {
-          if (!dataChannel || dataChannel.readyState !== "open") {
-            reject("Channel closed");
-            return;
-          }
-          dataChannel.send(e.target.result);
-          offset += e.target.result.byteLength;
-          updateProgress();
-          sendNextChunk();
-        };
-
-        fileReader.onerror = () => reject("File read error");
-        sendNextChunk();
-      });
+      }, () => abortCurrentTransfer);
     }
   } catch (err) {
     console.error("Transfer error:", err);
@@ -479,7 +503,9 @@ async function sendFile() {
   }
 
   isTransferring = false;
-  stopPolling();
+  reportState("done");
+  stopSignaling();
+  closeRoom();
 
   // Auto-close overlay after success
   setTimeout(() => {
@@ -487,9 +513,136 @@ async function sendFile() {
   }, 2500);
 }
 
+// streamFile sends one file over an open data channel: its metadata, the
+// chunks (pausing while the channel's buffer is full) and an EOF marker.
+// onProgress gets the bytes sent so far; aborted is checked between chunks.
+function streamFile(channel, file, index, total, onProgress, aborted) {
+  const BUFFER_HIGH = 2 * 1024 * 1024; // 2MB
+  channel.bufferedAmountLowThreshold = 512 * 1024; // 512KB
+
+  channel.send(
+    JSON.stringify({
+      name: file.name,
+      size: file.size,
+      type: file.type,
+      index,
+      total,
+    }),
+  );
+
+  return new Promise((resolve, reject) => {
+    const fileReader = new FileReader();
+    let offset = 0;
+
+    function sendNextChunk() {
+      if (aborted()) return reject("Aborted");
+      if (channel.readyState !== "open") return reject("Channel closed");
+
+      if (offset >= file.size) {
+        channel.send("__EOF__");
+        resolve();
+        return;
+      }
+
+      if (channel.bufferedAmount > BUFFER_HIGH) {
+        channel.onbufferedamountlow = () => {
+          channel.onbufferedamountlow = null;
+          readAndSend();
+        };
+        return;
+      }
+      readAndSend();
+    }
+
+    function readAndSend() {
+      const slice = file.slice(offset, offset + CHUNK_SIZE);
+      fileReader.readAsArrayBuffer(slice);
+    }
+
+    fileReader.onload = (e) => {
+      if (channel.readyState !== "open") {
+        reject("Channel closed");
+        return;
+      }
+      channel.send(e.target.result);
+      offset += e.target.result.byteLength;
+      onProgress(offset);
+      sendNextChunk();
+    };
+
+    fileReader.onerror = () => reject("File read error");
+    sendNextChunk();
+  });
+}
+
 // ─── Receiver: Connect & Receive ───
+// Exchange the link's join token for our receiver token. Only the first
+// device to open the link gets in; the token is kept for this tab so a
+// reload can rejoin.
+async function joinRoom() {
+  const saved = sessionStorage.getItem("p2p_token_" + roomId);
+  if (saved) {
+    roomToken = saved;
+    return true;
+  }
+  const join = new URLSearchParams(window.location.hash.slice(1)).get("join");
+  history.replaceState(null, "", window.location.pathname + window.location.search);
+  if (!join) {
+    showRecvError("This link is incomplete. Ask the sender for a new one.");
+    return false;
+  }
+  try {
+    const res = await fetch("/api/p2p/join", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ room: roomId, token: join }),
+    });
+    if (!res.ok) {
+      if (res.status === 409) showRecvError("This link has already been opened on another device.");
+      else if (res.status === 404) showRecvError("Room not found or expired.");
+      else showRecvError("This link is not valid.");
+      return false;
+    }
+    roomToken = (await res.json()).token;
+    sessionStorage.setItem("p2p_token_" + roomId, roomToken);
+    return true;
+  } catch (err) {
+    console.error("Join error:", err);
+    showRecvError("Could not reach the server.");
+    return false;
+  }
+}
+
+// Join with a short code read off the sender's screen. The server hands
+// back the room and our receiver token, which joinRoom picks up after the
+// page reloads into the room.
+async function joinByCode() {
+  const input = document.getElementById("joinCodeInput");
+  const code = input.value.trim();
+  if (!code) return;
+  try {
+    const res = await fetch("/api/p2p/join-code", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ code }),
+    });
+    if (!res.ok) {
+      if (res.status === 429) showToast("Too many wrong codes. Try again later.");
+      else if (res.status === 409) showToast("Someone already joined with this code.");
+      else showToast("Unknown or expired code.");
+      return;
+    }
+    const data = await res.json();
+    sessionStorage.setItem("p2p_token_" + data.room, data.token);
+    window.location.href = "/pages/p2p.html?room=" + encodeURIComponent(data.room);
+  } catch (err) {
+    console.error("Join by code error:", err);
+    showToast("Could not reach the server.");
+  }
+}
+
 async function startReceiver() {
-  pc = new RTCPeerConnection({ iceServers: ICE_SERVERS });
+  pc = new RTCPeerConnection({ iceServers });
 
   let currentFileChunks = [];
   let currentFileMeta = null;
@@ -498,10 +651,11 @@ async function startReceiver() {
   // Connection timeout — 30 seconds
   const connectTimeout = setTimeout(() => {
     if (!dataChannel || dataChannel.readyState !== "open") {
+      // Signaling stays up: the sender can still offer to send the
+      // files through the server.
       showRecvError(
-        "Connection timed out. The sender may have closed the page.",
+        "Could not connect directly. Waiting for the sender to send through the server...",
       );
-      stopPolling();
       if (pc) pc.close();
     }
   }, 30000);
@@ -530,6 +684,7 @@ async function startReceiver() {
     console.log("Received data channel");
     dataChannel = e.channel;
     dataChannel.binaryType = "arraybuffer";
+    reportState("connected");
 
     // Update receiver status to show connection is established
     const statusEl = document.getElementById("receiverStatus");
@@ -596,7 +751,7 @@ async function startReceiver() {
           if (iconBox) iconBox.innerHTML = `<svg style="width: 40px; height: 40px; color: #fff;" class="check-animate" fill="none" viewBox="0 0 24 24" stroke="currentColor"><path stroke-linecap="round" stroke-linejoin="round" stroke-width="3" d="M5 13l4 4L19 7" /></svg>`;
           abortBtn.classList.add("hidden");
           successBtn.classList.remove("hidden");
-          stopPolling();
+          stopSignaling();
           // Browser notification for receiver
           if ("Notification" in window && Notification.permission === "granted") {
             new Notification("GoShare — Files Received", {
@@ -659,8 +814,8 @@ async function startReceiver() {
     };
   };
 
-  // Start polling for the sender's offer
-  startPolling();
+  // Listen for the sender's offer
+  startSignaling();
 }
 
 function showRecvError(msg) {
@@ -672,61 +827,228 @@ function showRecvError(msg) {
 }
 
 // ─── Signaling: Send & Poll ───
-function sendSignal(type, data) {
+// sendSignal sends a signal to the other peer; in a broadcast room the
+// sender names the receiver it is for with to.
+function sendSignal(type, data, to) {
+  if (signalSocket && signalSocket.readyState === WebSocket.OPEN) {
+    signalSocket.send(JSON.stringify({ type: "signal", room: roomId, token: roomToken, to, signal: { type, data } }));
+    return;
+  }
   fetch("/api/p2p/signal", {
     method: "POST",
     headers: { "Content-Type": "application/json" },
     body: JSON.stringify({
       room: roomId,
-      from: role,
+      token: roomToken,
+      to: to,
       type: type,
       data: data,
     }),
   }).catch((err) => console.error("Signal send error:", err));
 }
 
-function startPolling() {
-  stopPolling(); // Clear any existing
-  isPollingActive = true;
+function startSignaling() {
+  stopSignaling(); // Clear any existing
+  isSignalingActive = true;
   pollIndex = 0;
-  pollSignals();
+  if (window.WebSocket) socketSignals();
+  else if (window.EventSource) streamSignals();
+  else pollSignals();
 }
 
-function stopPolling() {
-  isPollingActive = false;
+function stopSignaling() {
+  isSignalingActive = false;
+  if (signalSocket) {
+    const sock = signalSocket;
+    signalSocket = null;
+    sock.close();
+  }
+  if (signalSource) {
+    signalSource.close();
+    signalSource = null;
+  }
   if (pollTimer) {
     clearTimeout(pollTimer);
     pollTimer = null;
   }
 }
 
+// closeRoom tells the server we are done with the room; the peer gets a
+// room-closed event. keepalive lets it run while the page unloads.
+function closeRoom() {
+  if (!roomId || !roomToken) return;
+  fetch("/api/p2p/rooms/" + roomId, {
+    method: "DELETE",
+    headers: { "X-Room-Token": roomToken },
+    keepalive: true,
+  }).catch(() => {});
+}
+
+// reportState tells the server how far the WebRTC session has got
+// ("connected" or "done"), which only the browsers can see.
+function reportState(state) {
+  if (!roomId || !roomToken) return;
+  if (signalSocket && signalSocket.readyState === WebSocket.OPEN) {
+    signalSocket.send(JSON.stringify({ type: "state", room: roomId, token: roomToken, state }));
+    return;
+  }
+  fetch("/api/p2p/rooms/" + roomId, {
+    method: "POST",
+    headers: { "Content-Type": "application/json", "X-Room-Token": roomToken },
+    body: JSON.stringify({ state }),
+  }).catch(() => {});
+}
+
+// onRoomStatus shows what the other peer is doing until the WebRTC
+// connection takes over the status display, and warns once if the data
+// goes through the server's TURN relay.
+function onRoomStatus(s) {
+  if (s && s.relayed && !relayNoticeShown) {
+    relayNoticeShown = true;
+    showToast("Direct connection blocked by the network — relaying through the server, so this transfer is slower.");
+  }
+  if (role === "sender" && broadcast) {
+    if (s) syncReceivers(s.receivers || []);
+    return;
+  }
+  if (!s || (s.state !== "waiting" && s.state !== "negotiating")) return;
+  if (role === "sender") {
+    if (pc && (pc.iceConnectionState === "connected" || pc.iceConnectionState === "completed")) return;
+    const peer = s.receiver.status;
+    const text =
+      peer === "online" ? "Recipient opened the link — connecting..." :
+      peer === "disconnected" ? "Recipient went offline — waiting for them to return..." :
+      "Waiting for recipient...";
+    const color = peer === "disconnected" ? "var(--danger)" : "var(--accent)";
+    document.getElementById("waitingStatus").innerHTML =
+      `<div style="width: 6px; height: 6px; border-radius: 50%; background: ${color}; animation: pulse 2s infinite;"></div> ${text}`;
+  } else if (!dataChannel) {
+    document.getElementById("recvSubtext").textContent =
+      s.sender.status === "online" ? "Establishing encrypted connection..." : "The sender seems to be offline. Waiting...";
+  }
+}
+
+// onRoomClosed handles the room going away. An open data channel does not
+// depend on the room, so a transfer in progress carries on.
+function onRoomClosed(reason) {
+  stopSignaling();
+  if (dataChannel && dataChannel.readyState === "open") return;
+  if ([...links.values()].some((l) => l.sending)) return;
+  const msg =
+    reason === "expired" ? "The share link expired." :
+    reason === "removed" ? "The sender removed you from the share link." :
+    "The other device closed the share link.";
+  if (role === "receiver") {
+    showRecvError(msg);
+  } else if (roomId) {
+    showToast(msg);
+    resetSender();
+  }
+}
+
+// Signals are handled one at a time, in the order they were sent.
+function queueSignal(signal) {
+  signalQueue = signalQueue.then(() => handleSignal(signal));
+}
+
+// Signals travel over a WebSocket in both directions. If the socket cannot
+// be opened (e.g. a proxy refuses the upgrade) SSE takes over; if it drops
+// later it reconnects and resubscribes from pollIndex.
+function socketSignals() {
+  const proto = location.protocol === "https:" ? "wss://" : "ws://";
+  const sock = new WebSocket(proto + location.host + "/api/ws");
+  let opened = false;
+  signalSocket = sock;
+  sock.onopen = () => {
+    opened = true;
+    sock.send(JSON.stringify({ type: "subscribe", room: roomId, token: roomToken, since: pollIndex }));
+  };
+  sock.onmessage = (e) => {
+    const m = JSON.parse(e.data);
+    if (m.type === "signal") {
+      pollIndex = m.index;
+      queueSignal(m.signal);
+    } else if (m.type === "status" && m.room === roomId) {
+      onRoomStatus(m.data);
+    } else if (m.type === "room-closed" && m.room === roomId) {
+      onRoomClosed(m.data && m.data.reason);
+    } else if (m.type === "error" && m.room === roomId) {
+      console.warn("Signaling error:", m.error);
+      if (m.error === "room not found" || m.error === "invalid room token") {
+        showRecvError("Room not found or expired.");
+        stopSignaling();
+      }
+    }
+  };
+  sock.onclose = () => {
+    if (signalSocket !== sock) return;
+    signalSocket = null;
+    if (!isSignalingActive) return;
+    if (!opened) streamSignals();
+    else pollTimer = setTimeout(socketSignals, POLL_RETRY);
+  };
+}
+
+// Signals are pushed over SSE as soon as the peer sends them. Each event id
+// is the index to resume from, so reconnects pick up where they left off.
+function streamSignals() {
+  const es = new EventSource(
+    "/api/p2p/events?room=" + roomId + "&token=" + encodeURIComponent(roomToken) + "&since=" + pollIndex,
+  );
+  signalSource = es;
+  es.addEventListener("signal", (e) => {
+    pollIndex = parseInt(e.lastEventId, 10) || pollIndex;
+    queueSignal(JSON.parse(e.data));
+  });
+  es.addEventListener("status", (e) => onRoomStatus(JSON.parse(e.data)));
+  es.addEventListener("room-closed", (e) => onRoomClosed(JSON.parse(e.data).reason));
+  es.onerror = () => {
+    // EventSource reconnects by itself unless the server refused the
+    // stream (e.g. an unknown room); long-polling then takes over and
+    // reports the error.
+    if (es.readyState === EventSource.CLOSED && signalSource === es) {
+      signalSource = null;
+      pollSignals();
+    }
+  };
+}
+
+// Long-poll fallback: the server holds each request until a signal
+// arrives or POLL_WAIT passes.
 async function pollSignals() {
-  if (!isPollingActive) return;
+  if (!isSignalingActive) return;
   if (pollTimer) clearTimeout(pollTimer);
+  let delay = 0;
   try {
     const res = await fetch(
-      "/api/p2p/poll?room=" + roomId + "&role=" + role + "&since=" + pollIndex,
+      "/api/p2p/poll?room=" + roomId + "&token=" + encodeURIComponent(roomToken) + "&since=" + pollIndex + "&wait=" + POLL_WAIT,
     );
     if (!res.ok) {
-      if (res.status === 404) {
+      if (res.status === 410) {
+        onRoomClosed((await res.text()).trim().replace(/^room /, ""));
+      } else if (res.status === 404 || res.status === 403) {
         showRecvError("Room not found or expired.");
-        stopPolling();
+        stopSignaling();
       }
+      delay = POLL_RETRY;
       return;
     }
 
     const data = await res.json();
     pollIndex = data.index;
+    onRoomStatus(data.status);
 
     for (const signal of data.signals || []) {
-      await handleSignal(signal);
+      queueSignal(signal);
     }
+    await signalQueue;
   } catch (err) {
     console.error("Poll error:", err);
+    delay = POLL_RETRY;
   } finally {
     // Schedule next poll only if still active
-    if (isPollingActive && pc) {
-      pollTimer = setTimeout(pollSignals, POLL_INTERVAL);
+    if (isSignalingActive && (pc || broadcast)) {
+      pollTimer = setTimeout(pollSignals, delay);
     }
   }
 }
@@ -736,11 +1058,14 @@ function respondToTransfer(accepted) {
   sendSignal("transfer-response", { accepted: accepted });
   if (!accepted) {
     showRecvError("You declined the transfer.");
+  } else if (pipeMode) {
+    receiveViaPipe();
   }
 }
 
 async function handleSignal(signal) {
   console.log("Handling signal:", signal.type, "from:", signal.from);
+  if (role === "sender" && broadcast) return handleLinkSignal(signal);
 
   try {
     if (signal.type === "offer" && role === "receiver") {
@@ -774,8 +1099,10 @@ async function handleSignal(signal) {
           pendingCandidates.push(signal.data);
         }
       }
-    } else if (signal.type === "transfer-request") {
+    } else if (signal.type === "transfer-request" || signal.type === "pipe-offer") {
       const { sender, files } = signal.data;
+      pipeMode = signal.type === "pipe-offer";
+      pipeFiles = files;
       const count = files.length;
       const totalSize = files.reduce((sum, f) => sum + f.size, 0);
       document.getElementById("requestInfo").textContent =
@@ -785,7 +1112,7 @@ async function handleSignal(signal) {
       if (signal.data.accepted) {
         showToast("Transfer accepted! Starting...");
         transferAccepted = true;
-        sendFile();
+        sendFile(); // over WebRTC, or through the server in pipeMode
       } else {
         showToast("Transfer declined by receiver.");
         transferAccepted = false;
@@ -797,16 +1124,334 @@ async function handleSignal(signal) {
   }
 }
 
+// ─── Sender: Several Recipients ───
+// In a broadcast room the sender keeps one WebRTC connection per receiver.
+// The room status lists the receivers; each new one gets its own offer,
+// transfer request and copy of the files, and the sender can remove any
+// of them, which changes the share link.
+
+// syncReceivers opens a connection to each receiver that joined and drops
+// those that left or were removed.
+function syncReceivers(list) {
+  const present = new Set();
+  for (const r of list) {
+    present.add(r.id);
+    if (!links.has(r.id)) openLink(r.id);
+    links.get(r.id).status = r.status;
+  }
+  for (const peer of [...links.keys()]) {
+    if (!present.has(peer)) closeLink(peer);
+  }
+  renderReceivers();
+}
+
+function openLink(peer) {
+  const link = {
+    pc: new RTCPeerConnection({ iceServers }),
+    channel: null,
+    status: "online",
+    stage: "Connecting...",
+    pendingCandidates: [],
+    answered: false,
+    requested: false,
+    accepted: false,
+    sending: false,
+  };
+  links.set(peer, link);
+
+  link.channel = link.pc.createDataChannel("fileTransfer", { ordered: true });
+  link.channel.binaryType = "arraybuffer";
+  link.channel.onopen = () => {
+    if (link.accepted) sendToLink(peer);
+  };
+
+  link.pc.onicecandidate = (e) => {
+    if (e.candidate) sendSignal("ice-candidate", e.candidate, peer);
+  };
+  link.pc.oniceconnectionstatechange = () => {
+    const state = link.pc.iceConnectionState;
+    if ((state === "connected" || state === "completed") && !link.requested) {
+      link.requested = true;
+      link.stage = "Waiting for them to accept...";
+      sendSignal("transfer-request", transferManifest(), peer);
+      reportState("connected");
+    } else if (state === "failed") {
+      link.stage = "Connection failed";
+    }
+    renderReceivers();
+  };
+
+  link.pc.createOffer()
+    .then((offer) => link.pc.setLocalDescription(offer))
+    .then(() => sendSignal("offer", link.pc.localDescription, peer))
+    .catch((err) => console.error("Offer error:", err));
+}
+
+function closeLink(peer) {
+  const link = links.get(peer);
+  if (!link) return;
+  links.delete(peer);
+  link.pc.close();
+}
+
+// handleLinkSignal handles a receiver's signal in a broadcast room; the
+// server tags each one with the receiver's peer ID.
+async function handleLinkSignal(signal) {
+  const link = links.get(signal.peer);
+  if (!link) return;
+  try {
+    if (signal.type === "answer") {
+      if (link.answered) return;
+      link.answered = true;
+      await link.pc.setRemoteDescription(new RTCSessionDescription(signal.data));
+      for (const c of link.pendingCandidates) {
+        await link.pc.addIceCandidate(new RTCIceCandidate(c));
+      }
+      link.pendingCandidates = [];
+    } else if (signal.type === "ice-candidate" && signal.data) {
+      if (link.pc.remoteDescription) {
+        await link.pc.addIceCandidate(new RTCIceCandidate(signal.data));
+      } else {
+        link.pendingCandidates.push(signal.data);
+      }
+    } else if (signal.type === "transfer-response") {
+      if (signal.data.accepted) {
+        link.accepted = true;
+        sendToLink(signal.peer);
+      } else {
+        link.stage = "Declined";
+        renderReceivers();
+      }
+    }
+  } catch (err) {
+    console.error("Signal handling error:", err);
+  }
+}
+
+// sendToLink sends every selected file to one receiver once it accepted
+// and its data channel is open.
+async function sendToLink(peer) {
+  const link = links.get(peer);
+  if (!link || link.sending || link.channel.readyState !== "open") return;
+  link.sending = true;
+  const total = selectedFiles.length;
+  try {
+    for (let i = 0; i < total; i++) {
+      const file = selectedFiles[i];
+      let shown = -1;
+      await streamFile(link.channel, file, i, total, (offset) => {
+        const percent = Math.min(100, Math.round((offset / file.size) * 100));
+        if (percent === shown) return;
+        shown = percent;
+        link.stage = `Sending file ${i + 1} of ${total}: ${percent}%`;
+        renderReceivers();
+      }, () => !links.has(peer));
+    }
+    link.stage = "Sent";
+  } catch (err) {
+    console.error("Transfer error:", err);
+    link.stage = "Transfer failed";
+  }
+  link.sending = false;
+  renderReceivers();
+}
+
+function renderReceivers() {
+  const list = document.getElementById("receiverList");
+  list.innerHTML = "";
+  if (links.size === 0) {
+    list.innerHTML = '<div class="text-dim" style="font-size: 0.85rem;">Nobody has opened the link yet.</div>';
+    return;
+  }
+  let n = 0;
+  for (const [peer, link] of links) {
+    n++;
+    const color =
+      link.status === "online" ? "var(--success)" :
+      link.status === "disconnected" ? "var(--danger)" :
+      "var(--text-dim)";
+    const item = document.createElement("div");
+    item.style.cssText =
+      "display: flex; align-items: center; gap: 0.75rem; padding: 0.5rem 0; border-bottom: 1px solid var(--border);";
+    item.innerHTML = `
+      <div style="width: 8px; height: 8px; border-radius: 50%; background: ${color}; flex-shrink: 0;"></div>
+      <div style="flex: 1; min-width: 0;">
+        <div style="font-size: 0.9rem; font-weight: 600;">Recipient ${n}</div>
+        <div class="text-dim" style="font-size: 0.75rem;">${escapeHtml(link.stage)}</div>
+      </div>
+      <button data-action="removeReceiver" title="Remove"
+        style="padding: 2px 8px; font-size: 0.75rem; background: var(--surface-light); border: 1px solid var(--border); border-radius: 4px; cursor: pointer;">Remove</button>`;
+    item.querySelector("button").dataset.arg = JSON.stringify(peer);
+    list.appendChild(item);
+  }
+}
+
+// removeReceiver takes a receiver out of the room. The server changes the
+// join token so the link it holds stops working, and the new link replaces
+// the old one on screen.
+async function removeReceiver(peer) {
+  try {
+    const res = await fetch("/api/p2p/rooms/" + roomId + "/peers/" + encodeURIComponent(peer), {
+      method: "DELETE",
+      headers: { "X-Room-Token": roomToken },
+    });
+    if (!res.ok) throw new Error("Server error: " + res.status);
+    showShareLink((await res.json()).join);
+    closeLink(peer);
+    renderReceivers();
+    showToast("Recipient removed. The share link changed — share the new one.");
+  } catch (err) {
+    console.error("Failed to remove receiver:", err);
+    showToast("Could not remove the recipient.");
+  }
+}
+
+// ─── Fallback: Pipe Through the Server ───
+// When WebRTC cannot connect, files stream through the server instead: the
+// sender POSTs each file while the receiver GETs it. Nothing is stored on
+// the way, and the server holds the upload back to the receiver's pace.
+function offerPipe() {
+  if (selectedFiles.length === 0) {
+    showToast("Choose the files to send first.");
+    return;
+  }
+  pipeMode = true;
+  sendSignal("pipe-offer", transferManifest());
+  showToast("Asked the recipient to receive through the server");
+}
+
+// pipeUpload sends one file; the browser reads it from disk as it goes.
+function pipeUpload(file) {
+  return new Promise((resolve, reject) => {
+    const xhr = new XMLHttpRequest();
+    const started = Date.now();
+    xhr.open("POST", "/api/p2p/rooms/" + roomId + "/pipe");
+    xhr.setRequestHeader("X-Room-Token", roomToken);
+    xhr.setRequestHeader("X-File-Name", encodeURIComponent(file.name));
+    xhr.setRequestHeader("Content-Type", file.type || "application/octet-stream");
+    xhr.upload.onprogress = (e) =>
+      showPipeProgress(e.loaded, file.size, started, "Sending through the server...");
+    xhr.onload = () => {
+      pipeAbort = null;
+      if (xhr.status === 200) resolve();
+      else reject(xhr.responseText.trim() || "Server error " + xhr.status);
+    };
+    xhr.onerror = () => reject("Lost the connection to the server");
+    xhr.onabort = () => reject("Aborted");
+    pipeAbort = () => xhr.abort();
+    xhr.send(file);
+  });
+}
+
+// receiveViaPipe downloads the offered files one after another.
+async function receiveViaPipe() {
+  const overlay = document.getElementById("transferOverlay");
+  const card = document.getElementById("transferCard");
+  const nameEl = document.getElementById("transferName");
+  const stageEl = document.getElementById("transferStage");
+  const abortBtn = document.getElementById("abortBtn");
+  const successBtn = document.getElementById("successCloseBtn");
+  const iconBox = document.getElementById("transferIcon");
+
+  document.getElementById("recvError").classList.add("hidden");
+  abortBtn.classList.remove("hidden");
+  successBtn.classList.add("hidden");
+  if (iconBox) iconBox.classList.remove("success", "error");
+  overlay.classList.add("open");
+  setTimeout(() => card.classList.remove("scale-95", "opacity-0"), 10);
+  abortCurrentTransfer = false;
+
+  try {
+    for (let i = 0; i < pipeFiles.length; i++) {
+      if (abortCurrentTransfer) break;
+      nameEl.textContent = pipeFiles[i].name;
+      stageEl.textContent = `Waiting for file ${i + 1} of ${pipeFiles.length}...`;
+      const ctrl = new AbortController();
+      pipeAbort = () => ctrl.abort();
+      const res = await fetch("/api/p2p/rooms/" + roomId + "/pipe", {
+        headers: { "X-Room-Token": roomToken },
+        signal: ctrl.signal,
+      });
+      if (!res.ok) throw new Error((await res.text()).trim() || "Server error " + res.status);
+      const name = decodeURIComponent(res.headers.get("X-File-Name") || "") || pipeFiles[i].name;
+      const size = Number(res.headers.get("Content-Length")) || pipeFiles[i].size;
+
+      const reader = res.body.getReader();
+      const chunks = [];
+      const started = Date.now();
+      let received = 0;
+      for (;;) {
+        const { done, value } = await reader.read();
+        if (done) break;
+        chunks.push(value);
+        received += value.byteLength;
+        showPipeProgress(received, size, started, `Receiving file ${i + 1} of ${pipeFiles.length} through the server...`);
+      }
+      pipeAbort = null;
+
+      const url = URL.createObjectURL(new Blob(chunks, { type: res.headers.get("Content-Type") || "application/octet-stream" }));
+      const a = document.createElement("a");
+      a.href = url;
+      a.download = name;
+      a.click();
+      setTimeout(() => URL.revokeObjectURL(url), 5 * 60 * 1000);
+    }
+  } catch (err) {
+    pipeAbort = null;
+    if (abortCurrentTransfer) {
+      closeTransferOverlay();
+      return;
+    }
+    console.error("Pipe transfer error:", err);
+    stageEl.textContent = "Transfer failed: " + err.message;
+    if (iconBox) iconBox.classList.add("error");
+    abortBtn.classList.add("hidden");
+    successBtn.classList.remove("hidden");
+    successBtn.textContent = "Close";
+    return;
+  }
+  if (abortCurrentTransfer) return;
+
+  stageEl.textContent = "All files received!";
+  document.getElementById("transferBar").style.width = "100%";
+  if (iconBox) iconBox.classList.add("success");
+  if (iconBox) iconBox.innerHTML = `<svg style="width: 40px; height: 40px; color: #fff;" class="check-animate" fill="none" viewBox="0 0 24 24" stroke="currentColor"><path stroke-linecap="round" stroke-linejoin="round" stroke-width="3" d="M5 13l4 4L19 7" /></svg>`;
+  abortBtn.classList.add("hidden");
+  successBtn.classList.remove("hidden");
+  reportState("done");
+  stopSignaling();
+}
+
+// showPipeProgress updates the transfer overlay during a piped transfer.
+function showPipeProgress(done, total, started, stage) {
+  const speed = done / Math.max(0.1, (Date.now() - started) / 1000);
+  const eta = (total - done) / speed;
+  const percent = total > 0 ? Math.min(100, Math.round((done / total) * 100)) : 0;
+  document.getElementById("transferBar").style.width = percent + "%";
+  document.getElementById("uiPercent").textContent = percent + "%";
+  document.getElementById("uiSpeed").textContent = formatBytes(speed) + "/s";
+  document.getElementById("uiEta").textContent =
+    eta > 0 && eta < 3600 ? `${Math.floor(eta / 60)}:${Math.floor(eta % 60).toString().padStart(2, "0")}` : "--:--";
+  document.getElementById("transferStage").textContent = stage;
+}
+
 // ─── Utilities ───
 // formatBytes and toast removed (now in shared.js)
 
 function resetSender() {
+  closeRoom();
   if (pc) {
     pc.close();
     pc = null;
   }
   dataChannel = null;
   roomId = null;
+  roomToken = null;
+  relayNoticeShown = false;
+  pipeMode = false;
+  pipeAbort = null;
+  for (const peer of [...links.keys()]) closeLink(peer);
+  broadcast = false;
   selectedFiles = [];
   isTransferring = false;
   transferAccepted = false;
@@ -814,11 +1459,15 @@ function resetSender() {
   pollIndex = 0;
   pendingCandidates = [];
   abortCurrentTransfer = false;
-  stopPolling();
+  stopSignaling();
 
   document.getElementById("shareInfo").classList.add("hidden");
+  document.getElementById("receiverPanel").classList.add("hidden");
+  document.getElementById("waitingStatus").classList.remove("hidden");
   document.getElementById("selectedFile").classList.add("hidden");
   document.getElementById("fileSelectArea").classList.remove("hidden");
+  document.getElementById("shareCode").classList.add("hidden");
+  document.getElementById("joinCodeForm").classList.remove("hidden");
   document.getElementById("fileInput").value = "";
 
   const btn = document.getElementById("shareBtn");
@@ -843,6 +1492,7 @@ function closeTransferOverlay() {
 
 function abortTransfer() {
   abortCurrentTransfer = true;
+  if (pipeAbort) pipeAbort();
   if (dataChannel) dataChannel.close();
   showToast("Transfer cancelled");
   closeTransferOverlay();
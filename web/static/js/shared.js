@@ -105,6 +105,28 @@ function showToast(msg) {
     }, 2000);
 }
 
+// ── Click actions ──
+// The CSP blocks inline on* attributes, so clickable elements name their
+// handler with data-action (and an optional data-arg, parsed as JSON when
+// it can be) and pages register the handlers in `actions`. A handler gets
+// the argument, the element and the event.
+const actions = { changeName, closeNameModal, copyUrl };
+
+document.addEventListener("click", (e) => {
+    const el = e.target.closest("[data-action]");
+    if (!el || !Object.hasOwn(actions, el.dataset.action)) return;
+    let arg = el.dataset.arg;
+    try {
+        arg = JSON.parse(arg);
+    } catch { }
+    actions[el.dataset.action](arg, el, e);
+});
+
+document.addEventListener("DOMContentLoaded", () => {
+    const input = document.getElementById("newNameInput");
+    if (input) input.addEventListener("input", updateModalPreview);
+});
+
 // XSS prevention helper
 function escapeHtml(str) {
     const div = document.createElement("div");